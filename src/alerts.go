@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	AlertSentKeyPrefix        = "ingestion-alert-sent"
+	AlertRuleFrontPage        = "front-page"
+	AlertRuleVelocityPrefix   = "velocity"
+	AlertSignatureHeader      = "X-Signature-256"
+	AlertTimestampHeader      = "X-Signature-Timestamp"
+	DefaultAlertsFrontPageMax = 30
+	DefaultAlertsFrontPageTTL = time.Minute
+	DefaultAlertsDedupTTL     = 7 * 24 * time.Hour
+	DefaultAlertsMaxAttempts  = 3
+	DefaultAlertsBackoff      = time.Second
+	DefaultAlertsHTTPTimeout  = 5 * time.Second
+	DefaultAlertsMaxPending   = 100
+	// DefaultAlertsMaxRetryAfter is the longest that a webhook may ask for
+	// deliveries to be retried after, before they are given up on instead.
+	DefaultAlertsMaxRetryAfter = time.Minute
+)
+
+var ErrWebhookFailed = errors.New("Webhook failed")
+
+// VelocityRule alerts when the score of a story grows at least as quickly as
+// the threshold, in points per hour, between the snapshot with the given
+// label and the one before it.
+type VelocityRule struct {
+	Label     string
+	Threshold float64
+}
+
+func (r VelocityRule) Name() string {
+	return fmt.Sprintf("%s-%s", AlertRuleVelocityPrefix, r.Label)
+}
+
+// ParseVelocityRules parses rules from a comma separated list of
+// `label:threshold` pairs, e.g. `15m:30,30m:20`.
+func ParseVelocityRules(s string) ([]VelocityRule, error) {
+	var rules []VelocityRule
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		label, value, ok := strings.Cut(pair, ":")
+		if !ok || label == "" {
+			return nil, fmt.Errorf("Invalid velocity rule: %s", pair)
+		}
+		threshold, err := strconv.ParseFloat(value, 64)
+		if err != nil || threshold <= 0 {
+			return nil, fmt.Errorf("Invalid velocity rule threshold: %s", pair)
+		}
+		rules = append(rules, VelocityRule{Label: label, Threshold: threshold})
+	}
+	return rules, nil
+}
+
+// Alert is the payload POSTed to webhooks. The id is the same for every
+// delivery of an alert, so that receivers can discard duplicates.
+type Alert struct {
+	ID          string    `json:"id"`
+	Rule        string    `json:"rule"`
+	StoryID     int64     `json:"story_id"`
+	Title       string    `json:"title"`
+	URL         string    `json:"url,omitempty"`
+	By          string    `json:"by"`
+	Score       int32     `json:"score"`
+	Descendants int32     `json:"descendants"`
+	Label       string    `json:"label"`
+	Velocity    *float64  `json:"velocity,omitempty"`
+	Threshold   *float64  `json:"threshold,omitempty"`
+	Rank        *int      `json:"rank,omitempty"`
+	FiredAt     time.Time `json:"fired_at"`
+}
+
+func MakeAlert(rule string, story HNStory, label string, firedAt time.Time) Alert {
+	return Alert{
+		ID:          fmt.Sprintf("%s:%d", rule, story.ID),
+		Rule:        rule,
+		StoryID:     story.ID,
+		Title:       story.Title,
+		URL:         story.URL,
+		By:          story.By,
+		Score:       story.Score,
+		Descendants: story.Descendants,
+		Label:       label,
+		FiredAt:     firedAt,
+	}
+}
+
+// SignPayload signs a payload with HMAC-SHA256, over the timestamp and the
+// payload joined by a period, so that receivers can reject replayed payloads.
+func SignPayload(secret []byte, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhook delivers alerts to an endpoint, as signed JSON. Deliveries are
+// retried after network errors, server errors and rate limiting. When rate
+// limited, the Retry-After header is honoured, up to MaxRetryAfter.
+type Webhook struct {
+	client        HTTPDoer
+	URL           string
+	secret        []byte
+	MaxAttempts   int
+	Backoff       time.Duration
+	MaxRetryAfter time.Duration
+}
+
+func NewWebhook(client HTTPDoer, url string, secret []byte, maxAttempts int, backoff time.Duration) *Webhook {
+	if maxAttempts <= 0 {
+		panic("Max attempts must be positive")
+	}
+
+	return &Webhook{
+		client:        client,
+		URL:           url,
+		secret:        secret,
+		MaxAttempts:   maxAttempts,
+		Backoff:       backoff,
+		MaxRetryAfter: DefaultAlertsMaxRetryAfter,
+	}
+}
+
+// key identifies the webhook in keys, without revealing its URL.
+func (w *Webhook) key() string {
+	sum := sha256.Sum256([]byte(w.URL))
+	return hex.EncodeToString(sum[:8])
+}
+
+// parseRetryAfter parses a Retry-After header, which is either a number of
+// seconds or an HTTP date, returning false if it is missing or invalid.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return max(time.Duration(seconds)*time.Second, 0), true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(date.Sub(now), 0), true
+	}
+	return 0, false
+}
+
+// post POSTs a payload, returning whether it should be retried if it fails,
+// and how long to wait first if the endpoint asked for that.
+func (w *Webhook) post(ctx context.Context, payload []byte) (retryAfter time.Duration, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, false, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(AlertTimestampHeader, timestamp)
+	req.Header.Set(AlertSignatureHeader, SignPayload(w.secret, timestamp, payload))
+
+	rsp, err := w.client.Do(req)
+	if err != nil {
+		return 0, true, err
+	}
+	defer rsp.Body.Close()
+	io.Copy(io.Discard, rsp.Body)
+
+	switch {
+	case rsp.StatusCode >= 200 && rsp.StatusCode < 300:
+		return 0, false, nil
+	case rsp.StatusCode == http.StatusTooManyRequests || rsp.StatusCode == http.StatusServiceUnavailable:
+		retryAfter, _ = parseRetryAfter(rsp.Header.Get("Retry-After"), time.Now())
+		return retryAfter, true, fmt.Errorf("HTTP Error: %d", rsp.StatusCode)
+	case rsp.StatusCode >= http.StatusInternalServerError:
+		return 0, true, fmt.Errorf("HTTP Error: %d", rsp.StatusCode)
+	default:
+		return 0, false, fmt.Errorf("HTTP Error: %d", rsp.StatusCode)
+	}
+}
+
+// Send delivers an alert, retrying with a linear backoff, or after as long as
+// the endpoint asks for if that is longer. If the endpoint asks for longer
+// than MaxRetryAfter, the alert isn't retried.
+func (w *Webhook) Send(ctx context.Context, alert Alert) error {
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	var retryAfter time.Duration
+	for attempt := 0; attempt < w.MaxAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(max(time.Duration(attempt)*w.Backoff, retryAfter)):
+			}
+		}
+
+		var retry bool
+		retryAfter, retry, err = w.post(ctx, payload)
+		if err == nil || !retry {
+			break
+		}
+		if retryAfter > w.MaxRetryAfter {
+			err = fmt.Errorf("%w, retry after %s", err, retryAfter)
+			break
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrWebhookFailed, alert.ID, err)
+	}
+	return nil
+}
+
+// TopStoriesFetcher provides a method to fetch the ranked top stories.
+type TopStoriesFetcher interface {
+	FetchTopStories() ([]int64, error)
+}
+
+// FrontPage ranks stories on the front page, which is the top MaxRank
+// stories. The ranking is cached for TTL, as it is looked up for every
+// snapshot. It is safe for concurrent use.
+type FrontPage struct {
+	client    TopStoriesFetcher
+	MaxRank   int
+	TTL       time.Duration
+	mu        sync.Mutex
+	ranks     map[int64]int
+	fetchedAt time.Time
+}
+
+func NewFrontPage(client TopStoriesFetcher, maxRank int, ttl time.Duration) *FrontPage {
+	return &FrontPage{client: client, MaxRank: maxRank, TTL: ttl}
+}
+
+// Rank returns the story's rank on the front page, from 1, or false if it
+// isn't on it.
+func (f *FrontPage) Rank(storyID int64) (int, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.ranks == nil || time.Since(f.fetchedAt) >= f.TTL {
+		ids, err := f.client.FetchTopStories()
+		if err != nil {
+			return 0, false, fmt.Errorf("%w top stories: %w", ErrFetching, err)
+		}
+
+		f.ranks = make(map[int64]int, f.MaxRank)
+		for idx, id := range ids[:min(len(ids), f.MaxRank)] {
+			f.ranks[id] = idx + 1
+		}
+		f.fetchedAt = time.Now()
+	}
+
+	rank, ok := f.ranks[storyID]
+	return rank, ok, nil
+}
+
+// SeenCache records which keys have been seen recently.
+type SeenCache interface {
+	SetNX(context.Context, string, interface{}, time.Duration) *redis.BoolCmd
+	Del(context.Context, ...string) *redis.IntCmd
+}
+
+// Alerter alerts webhooks when a snapshot of a story meets any of the rules.
+// Each alert is delivered to each webhook at most once within DedupTTL,
+// unless delivery fails, in which case it is retried when the story is next
+// snapshotted and still meets the rule.
+//
+// Alerts are delivered in the background, so that slow webhooks don't hold
+// up snapshots. At most DefaultAlertsMaxPending deliveries are in flight;
+// alerts beyond that are dropped, and sent when the story is next
+// snapshotted instead.
+type Alerter struct {
+	repo          SnapshotReader
+	seen          SeenCache
+	webhooks      []*Webhook
+	VelocityRules []VelocityRule
+	// FrontPage enables alerts for stories on the front page, if set.
+	FrontPage  *FrontPage
+	DedupTTL   time.Duration
+	slots      chan struct{}
+	deliveries sync.WaitGroup
+}
+
+func NewAlerter(repo SnapshotReader, seen SeenCache, webhooks []*Webhook, dedupTTL time.Duration) *Alerter {
+	return &Alerter{
+		repo:     repo,
+		seen:     seen,
+		webhooks: webhooks,
+		DedupTTL: dedupTTL,
+		slots:    make(chan struct{}, DefaultAlertsMaxPending),
+	}
+}
+
+// velocity returns the velocity of a story's score between its latest
+// snapshot and the one before it, or false if it has only one.
+func (a *Alerter) velocity(ctx context.Context, storyID int64) (float64, bool, error) {
+	snapshots, err := a.repo.LatestSnapshots(ctx, storyID, 2)
+	if err != nil {
+		return 0, false, err
+	}
+	if len(snapshots) < 2 {
+		return 0, false, nil
+	}
+
+	current, err := MakeStoryPoint(snapshots[0])
+	if err != nil {
+		return 0, false, err
+	}
+	previous, err := MakeStoryPoint(snapshots[1])
+	if err != nil {
+		return 0, false, err
+	}
+
+	velocity := perHour(current.Score-previous.Score, current.FetchedAt.Sub(previous.FetchedAt))
+	if velocity == nil {
+		return 0, false, nil
+	}
+	return *velocity, true, nil
+}
+
+// Evaluate returns the alerts for rules that a snapshot of a story meets.
+func (a *Alerter) Evaluate(ctx context.Context, items StoryItems, model StoryModel) ([]Alert, error) {
+	var alerts []Alert
+	if model.Status != StoryStatusOK {
+		return alerts, nil
+	}
+
+	now := time.Now().UTC()
+
+	for _, rule := range a.VelocityRules {
+		if rule.Label != model.QueueName {
+			continue
+		}
+
+		velocity, ok, err := a.velocity(ctx, model.StoryID)
+		if err != nil {
+			return alerts, err
+		}
+		if !ok || velocity < rule.Threshold {
+			continue
+		}
+
+		alert := MakeAlert(rule.Name(), items.Story, model.QueueName, now)
+		alert.Velocity = &velocity
+		alert.Threshold = &rule.Threshold
+		alerts = append(alerts, alert)
+	}
+
+	if a.FrontPage != nil {
+		rank, ok, err := a.FrontPage.Rank(model.StoryID)
+		if err != nil {
+			return alerts, err
+		}
+		if ok {
+			alert := MakeAlert(AlertRuleFrontPage, items.Story, model.QueueName, now)
+			alert.Rank = &rank
+			alerts = append(alerts, alert)
+		}
+	}
+
+	return alerts, nil
+}
+
+// deliver sends an alert to a webhook, unless it has already been sent.
+func (a *Alerter) deliver(ctx context.Context, webhook *Webhook, alert Alert) error {
+	key := fmt.Sprintf("%s:%s:%s", AlertSentKeyPrefix, webhook.key(), alert.ID)
+	due, err := a.seen.SetNX(ctx, key, 1, a.DedupTTL).Result()
+	if err != nil {
+		return err
+	}
+	if !due {
+		return nil
+	}
+
+	err = webhook.Send(ctx, alert)
+	if err != nil {
+		// Forget the alert, so that it is sent if the rule is met again.
+		if delErr := a.seen.Del(ctx, key).Err(); delErr != nil {
+			slog.Error("Unable to forget alert", "alert_id", alert.ID, "error", delErr)
+		}
+		return err
+	}
+
+	slog.Info("Sent alert", "alert_id", alert.ID, "webhook", webhook.key())
+	return nil
+}
+
+// ObserveStory alerts webhooks of the rules that the snapshot meets. It
+// returns once the alerts are pending, rather than delivered.
+func (a *Alerter) ObserveStory(ctx context.Context, items StoryItems, model StoryModel) error {
+	alerts, err := a.Evaluate(ctx, items, model)
+	if err != nil {
+		return err
+	}
+
+	// Deliveries outlive the snapshot, including when shutting down.
+	ctx = context.WithoutCancel(ctx)
+	for _, alert := range alerts {
+		for _, webhook := range a.webhooks {
+			select {
+			case a.slots <- struct{}{}:
+			default:
+				slog.Warn("Dropped alert, too many pending", "alert_id", alert.ID, "webhook", webhook.key())
+				continue
+			}
+
+			a.deliveries.Add(1)
+			go func() {
+				defer a.deliveries.Done()
+				defer func() { <-a.slots }()
+
+				if err := a.deliver(ctx, webhook, alert); err != nil {
+					slog.Error("Unable to send alert", "alert_id", alert.ID, "webhook", webhook.key(), "error", err)
+				}
+			}()
+		}
+	}
+	return nil
+}
+
+// Flush waits until the pending alerts have been delivered, or have failed.
+func (a *Alerter) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		a.deliveries.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockTopStoriesFetcher struct {
+	mock.Mock
+}
+
+type mockSeenCache struct {
+	mock.Mock
+}
+
+func (m *mockSeenCache) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	args := m.Called(ctx, key, value, expiration)
+	return args.Get(0).(*redis.BoolCmd)
+}
+
+func (m *mockSeenCache) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	args := m.Called(ctx, keys)
+	return args.Get(0).(*redis.IntCmd)
+}
+
+func (m *mockTopStoriesFetcher) FetchTopStories() ([]int64, error) {
+	args := m.Called()
+	return args.Get(0).([]int64), args.Error(1)
+}
+
+// webhookStandIn is a local webhook endpoint, which responds with the given
+// status codes in turn, and records the alerts it receives. Rate limited
+// responses carry retryAfter as their Retry-After header, if set.
+type webhookStandIn struct {
+	server     *httptest.Server
+	statuses   []int
+	retryAfter string
+	requests   atomic.Int32
+	alerts     []Alert
+}
+
+func newWebhookStandIn(t *testing.T, secret []byte, statuses ...int) *webhookStandIn {
+	s := &webhookStandIn{statuses: statuses}
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(s.requests.Add(1))
+
+		body, _ := io.ReadAll(r.Body)
+		timestamp := r.Header.Get(AlertTimestampHeader)
+		assert.Equal(t, SignPayload(secret, timestamp, body), r.Header.Get(AlertSignatureHeader))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		status := http.StatusOK
+		if n <= len(s.statuses) {
+			status = s.statuses[n-1]
+		}
+		if status == http.StatusOK {
+			alert := Alert{}
+			assert.Nil(t, json.Unmarshal(body, &alert))
+			s.alerts = append(s.alerts, alert)
+		}
+		if status == http.StatusTooManyRequests && s.retryAfter != "" {
+			w.Header().Set("Retry-After", s.retryAfter)
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(s.server.Close)
+	return s
+}
+
+func (s *webhookStandIn) webhook(secret []byte, maxAttempts int) *Webhook {
+	return NewWebhook(s.server.Client(), s.server.URL, secret, maxAttempts, 0*time.Second)
+}
+
+func TestParseVelocityRules(t *testing.T) {
+	expected := []VelocityRule{{Label: "15m", Threshold: 30}, {Label: "30m", Threshold: 12.5}}
+
+	actual, err := ParseVelocityRules("15m:30, 30m:12.5,")
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+	assert.Equal(t, "velocity-15m", actual[0].Name())
+}
+
+func TestParseVelocityRulesWhenInvalidReturnsError(t *testing.T) {
+	for _, s := range []string{"15m", ":30", "15m:fast", "15m:-1"} {
+		_, err := ParseVelocityRules(s)
+
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestWebhookSend(t *testing.T) {
+	secret := []byte("secret")
+	standIn := newWebhookStandIn(t, secret)
+	alert := MakeAlert(AlertRuleFrontPage, HNStory{ID: 1, Title: "Title", Score: 50}, "30m", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	err := standIn.webhook(secret, 1).Send(context.Background(), alert)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Alert{alert}, standIn.alerts)
+	assert.Equal(t, "front-page:1", standIn.alerts[0].ID)
+}
+
+func TestWebhookSendRetries(t *testing.T) {
+	secret := []byte("secret")
+	standIn := newWebhookStandIn(t, secret, http.StatusServiceUnavailable, http.StatusTooManyRequests)
+
+	err := standIn.webhook(secret, 3).Send(context.Background(), Alert{ID: "front-page:1"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int32(3), standIn.requests.Load())
+	assert.Len(t, standIn.alerts, 1)
+}
+
+func TestWebhookSendHonoursRetryAfter(t *testing.T) {
+	secret := []byte("secret")
+	standIn := newWebhookStandIn(t, secret, http.StatusTooManyRequests)
+	standIn.retryAfter = "1"
+
+	start := time.Now()
+	err := standIn.webhook(secret, 2).Send(context.Background(), Alert{ID: "front-page:1"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), standIn.requests.Load())
+	assert.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestWebhookSendWhenRetryAfterTooLongReturnsError(t *testing.T) {
+	secret := []byte("secret")
+	standIn := newWebhookStandIn(t, secret, http.StatusTooManyRequests)
+	standIn.retryAfter = "3600"
+
+	err := standIn.webhook(secret, 3).Send(context.Background(), Alert{ID: "front-page:1"})
+
+	assert.ErrorIs(t, err, ErrWebhookFailed)
+	assert.Equal(t, int32(1), standIn.requests.Load())
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	type testCase struct {
+		Name     string
+		Value    string
+		Expected time.Duration
+		OK       bool
+	}
+
+	testCases := []testCase{
+		{Name: "Seconds", Value: "30", Expected: 30 * time.Second, OK: true},
+		{Name: "Date", Value: "Mon, 01 Jan 2024 00:01:00 GMT", Expected: time.Minute, OK: true},
+		{Name: "Past date", Value: "Sun, 31 Dec 2023 23:59:00 GMT", Expected: 0, OK: true},
+		{Name: "Missing", Value: "", Expected: 0, OK: false},
+		{Name: "Invalid", Value: "soon", Expected: 0, OK: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			actual, ok := parseRetryAfter(tc.Value, now)
+			assert.Equal(t, tc.Expected, actual)
+			assert.Equal(t, tc.OK, ok)
+		})
+	}
+}
+
+func TestWebhookSendWhenMaxAttemptsReachedReturnsError(t *testing.T) {
+	secret := []byte("secret")
+	standIn := newWebhookStandIn(t, secret, http.StatusInternalServerError, http.StatusInternalServerError)
+
+	err := standIn.webhook(secret, 2).Send(context.Background(), Alert{ID: "front-page:1"})
+
+	assert.ErrorIs(t, err, ErrWebhookFailed)
+	assert.Equal(t, int32(2), standIn.requests.Load())
+}
+
+func TestWebhookSendWhenRejectedDoesNotRetry(t *testing.T) {
+	secret := []byte("secret")
+	standIn := newWebhookStandIn(t, secret, http.StatusBadRequest)
+
+	err := standIn.webhook(secret, 3).Send(context.Background(), Alert{ID: "front-page:1"})
+
+	assert.ErrorIs(t, err, ErrWebhookFailed)
+	assert.Equal(t, int32(1), standIn.requests.Load())
+}
+
+func TestFrontPageRank(t *testing.T) {
+	client := new(mockTopStoriesFetcher)
+	client.On("FetchTopStories").Return([]int64{5, 3, 1}, nil).Once()
+
+	frontPage := NewFrontPage(client, 2, time.Hour)
+
+	rank, ok, err := frontPage.Rank(3)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, 2, rank)
+
+	// Ranked below the front page.
+	_, ok, err = frontPage.Rank(1)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	client.AssertNumberOfCalls(t, "FetchTopStories", 1)
+}
+
+func TestFrontPageRankRefetchesOnceStale(t *testing.T) {
+	client := new(mockTopStoriesFetcher)
+	client.On("FetchTopStories").Return([]int64{5}, nil)
+
+	frontPage := NewFrontPage(client, 30, 0*time.Second)
+	frontPage.Rank(5)
+	frontPage.Rank(5)
+
+	client.AssertNumberOfCalls(t, "FetchTopStories", 2)
+}
+
+func makeLabelledSnapshot(storyID int64, label string, fetchedAt time.Time, score int) StoryModel {
+	snapshot := makeSnapshot(storyID, fetchedAt.Add(-time.Hour), score, 0)
+	snapshot.QueueName = label
+	snapshot.FetchedAt = fetchedAt
+	return snapshot
+}
+
+func TestAlerterEvaluate(t *testing.T) {
+	now := time.Now().UTC()
+	items := StoryItems{Story: HNStory{ID: 1, Title: "Title", Score: 40}}
+	model := makeLabelledSnapshot(1, "15m", now, 40)
+
+	type testCase struct {
+		Name     string
+		Previous int
+		Rules    []VelocityRule
+		Expected []string
+	}
+
+	testCases := []testCase{
+		{Name: "above threshold", Previous: 10, Rules: []VelocityRule{{Label: "15m", Threshold: 100}}, Expected: []string{"velocity-15m"}},
+		{Name: "below threshold", Previous: 30, Rules: []VelocityRule{{Label: "15m", Threshold: 100}}, Expected: nil},
+		{Name: "other label", Previous: 10, Rules: []VelocityRule{{Label: "30m", Threshold: 100}}, Expected: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			repo := new(mockSnapshotReader)
+			repo.On("LatestSnapshots", mock.Anything, int64(1), 2).Return([]StoryModel{
+				model,
+				makeLabelledSnapshot(1, "0m", now.Add(-15*time.Minute), tc.Previous),
+			}, nil)
+
+			alerter := NewAlerter(repo, new(mockSeenCache), nil, time.Hour)
+			alerter.VelocityRules = tc.Rules
+			alerts, err := alerter.Evaluate(context.Background(), items, model)
+
+			var rules []string
+			for _, alert := range alerts {
+				rules = append(rules, alert.Rule)
+			}
+
+			assert.Nil(t, err)
+			assert.Equal(t, tc.Expected, rules)
+		})
+	}
+}
+
+func TestAlerterEvaluateVelocity(t *testing.T) {
+	now := time.Now().UTC()
+	model := makeLabelledSnapshot(1, "15m", now, 40)
+
+	repo := new(mockSnapshotReader)
+	repo.On("LatestSnapshots", mock.Anything, int64(1), 2).Return([]StoryModel{
+		model,
+		makeLabelledSnapshot(1, "0m", now.Add(-15*time.Minute), 10),
+	}, nil)
+
+	alerter := NewAlerter(repo, new(mockSeenCache), nil, time.Hour)
+	alerter.VelocityRules = []VelocityRule{{Label: "15m", Threshold: 100}}
+	alerts, err := alerter.Evaluate(context.Background(), StoryItems{Story: HNStory{ID: 1}}, model)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 120.0, *alerts[0].Velocity)
+	assert.Equal(t, 100.0, *alerts[0].Threshold)
+}
+
+func TestAlerterEvaluateFrontPage(t *testing.T) {
+	client := new(mockTopStoriesFetcher)
+	client.On("FetchTopStories").Return([]int64{2, 1}, nil)
+
+	alerter := NewAlerter(new(mockSnapshotReader), new(mockSeenCache), nil, time.Hour)
+	alerter.FrontPage = NewFrontPage(client, 30, time.Minute)
+	alerts, err := alerter.Evaluate(context.Background(), StoryItems{Story: HNStory{ID: 1}}, StoryModel{StoryID: 1, Status: StoryStatusOK})
+
+	assert.Nil(t, err)
+	assert.Len(t, alerts, 1)
+	assert.Equal(t, AlertRuleFrontPage, alerts[0].Rule)
+	assert.Equal(t, 2, *alerts[0].Rank)
+}
+
+func TestAlerterEvaluateSkipsRemovedStories(t *testing.T) {
+	client := new(mockTopStoriesFetcher)
+
+	alerter := NewAlerter(new(mockSnapshotReader), new(mockSeenCache), nil, time.Hour)
+	alerter.FrontPage = NewFrontPage(client, 30, time.Minute)
+	alerts, err := alerter.Evaluate(context.Background(), StoryItems{}, StoryModel{StoryID: 1, Status: StoryStatusDead})
+
+	assert.Nil(t, err)
+	assert.Empty(t, alerts)
+	client.AssertNotCalled(t, "FetchTopStories")
+}
+
+func TestAlerterObserveStory(t *testing.T) {
+	secret := []byte("secret")
+	standIn := newWebhookStandIn(t, secret)
+	webhook := standIn.webhook(secret, 1)
+
+	client := new(mockTopStoriesFetcher)
+	client.On("FetchTopStories").Return([]int64{1}, nil)
+
+	key := fmt.Sprintf("ingestion-alert-sent:%s:front-page:1", webhook.key())
+	seen := new(mockSeenCache)
+	seen.On("SetNX", mock.Anything, key, 1, time.Hour).Return(redis.NewBoolResult(true, nil)).Once()
+	// Already sent.
+	seen.On("SetNX", mock.Anything, key, 1, time.Hour).Return(redis.NewBoolResult(false, nil))
+
+	alerter := NewAlerter(new(mockSnapshotReader), seen, []*Webhook{webhook}, time.Hour)
+	alerter.FrontPage = NewFrontPage(client, 30, time.Minute)
+
+	model := StoryModel{StoryID: 1, Status: StoryStatusOK}
+	for range 2 {
+		err := alerter.ObserveStory(context.Background(), StoryItems{Story: HNStory{ID: 1}}, model)
+		assert.Nil(t, err)
+		assert.Nil(t, alerter.Flush(context.Background()))
+	}
+
+	assert.Equal(t, int32(1), standIn.requests.Load())
+}
+
+func TestAlerterObserveStoryWhenDeliveryFailsForgetsAlert(t *testing.T) {
+	secret := []byte("secret")
+	standIn := newWebhookStandIn(t, secret, http.StatusInternalServerError)
+	webhook := standIn.webhook(secret, 1)
+
+	client := new(mockTopStoriesFetcher)
+	client.On("FetchTopStories").Return([]int64{1}, nil)
+
+	key := fmt.Sprintf("ingestion-alert-sent:%s:front-page:1", webhook.key())
+	seen := new(mockSeenCache)
+	seen.On("SetNX", mock.Anything, key, 1, time.Hour).Return(redis.NewBoolResult(true, nil))
+	seen.On("Del", mock.Anything, []string{key}).Return(redis.NewIntResult(1, nil))
+
+	alerter := NewAlerter(new(mockSnapshotReader), seen, []*Webhook{webhook}, time.Hour)
+	alerter.FrontPage = NewFrontPage(client, 30, time.Minute)
+	err := alerter.ObserveStory(context.Background(), StoryItems{Story: HNStory{ID: 1}}, StoryModel{StoryID: 1, Status: StoryStatusOK})
+	assert.Nil(t, err)
+
+	err = alerter.Flush(context.Background())
+	assert.Nil(t, err)
+	seen.AssertCalled(t, "Del", mock.Anything, []string{key})
+}
+
+func TestAlerterObserveStoryDoesNotWaitForDelivery(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(server.Close)
+	webhook := NewWebhook(server.Client(), server.URL, []byte("secret"), 1, 0*time.Second)
+
+	client := new(mockTopStoriesFetcher)
+	client.On("FetchTopStories").Return([]int64{1}, nil)
+
+	seen := new(mockSeenCache)
+	seen.On("SetNX", mock.Anything, mock.Anything, 1, time.Hour).Return(redis.NewBoolResult(true, nil))
+
+	alerter := NewAlerter(new(mockSnapshotReader), seen, []*Webhook{webhook}, time.Hour)
+	alerter.FrontPage = NewFrontPage(client, 30, time.Minute)
+	err := alerter.ObserveStory(context.Background(), StoryItems{Story: HNStory{ID: 1}}, StoryModel{StoryID: 1, Status: StoryStatusOK})
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, alerter.Flush(ctx), context.DeadlineExceeded)
+
+	close(release)
+	assert.Nil(t, alerter.Flush(context.Background()))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	DefaultAlgoliaBaseURL         = "https://hn.algolia.com/api"
+	AlgoliaAPIVersion             = "v1"
+	ResourceNameAlgoliaItems      = "items"
+	ResourceNameAlgoliaSearchDate = "search_by_date"
+	// AlgoliaNewStoriesPageSize is the number of new stories fetched at once,
+	// matching the number returned by the Firebase API's `newstories`.
+	AlgoliaNewStoriesPageSize = 500
+)
+
+// AlgoliaItem represents a marshalled item, along with its descendants, from
+// the Algolia Hacker News Search API.
+type AlgoliaItem struct {
+	ID         int64         `json:"id"`
+	CreatedAtI int64         `json:"created_at_i"`
+	Type       string        `json:"type"`
+	Author     string        `json:"author"`
+	Title      string        `json:"title"`
+	URL        string        `json:"url"`
+	Text       string        `json:"text"`
+	Points     int32         `json:"points"`
+	ParentID   int64         `json:"parent_id"`
+	Children   []AlgoliaItem `json:"children"`
+	// Options are a poll's options.
+	Options []AlgoliaItem `json:"options"`
+}
+
+// CountDescendants counts the item's descendants.
+func (item AlgoliaItem) CountDescendants() int32 {
+	n := int32(len(item.Children))
+	for _, child := range item.Children {
+		n += child.CountDescendants()
+	}
+	return n
+}
+
+func itemIDs(items []AlgoliaItem) []int64 {
+	if len(items) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, len(items))
+	for idx, item := range items {
+		ids[idx] = item.ID
+	}
+	return ids
+}
+
+// ToHNStory converts the item to a story, as returned by the Firebase API.
+func (item AlgoliaItem) ToHNStory() HNStory {
+	return HNStory{
+		By:          item.Author,
+		Descendants: item.CountDescendants(),
+		ID:          item.ID,
+		Kids:        itemIDs(item.Children),
+		Parts:       itemIDs(item.Options),
+		Score:       item.Points,
+		Time:        item.CreatedAtI,
+		Title:       item.Title,
+		Type:        item.Type,
+		URL:         item.URL,
+	}
+}
+
+// ToHNComment converts the item to a comment, as returned by the Firebase API.
+func (item AlgoliaItem) ToHNComment() HNComment {
+	return HNComment{
+		By:     item.Author,
+		ID:     item.ID,
+		Kids:   itemIDs(item.Children),
+		Parent: item.ParentID,
+		Text:   item.Text,
+		Time:   item.CreatedAtI,
+		Type:   item.Type,
+	}
+}
+
+// ToHNPollOpt converts the item to a poll option, as returned by the Firebase
+// API.
+func (item AlgoliaItem) ToHNPollOpt(pollID int64) HNPollOpt {
+	return HNPollOpt{
+		By:    item.Author,
+		ID:    item.ID,
+		Poll:  pollID,
+		Score: item.Points,
+		Text:  item.Text,
+		Time:  item.CreatedAtI,
+		Type:  item.Type,
+	}
+}
+
+type algoliaSearchResult struct {
+	Hits []struct {
+		ObjectID string `json:"objectID"`
+	} `json:"hits"`
+}
+
+// AlgoliaClient is a client for the Algolia Hacker News Search API, which
+// returns a story along with all of its comments in a single request.
+//
+// Requests are made with an HNClient configured with the Algolia API's base
+// URL, so that they are retried, rate limited and circuit broken in the same
+// way as requests to the Firebase API.
+type AlgoliaClient struct {
+	client *HNClient
+}
+
+func NewAlgoliaClient(client *HNClient) *AlgoliaClient {
+	return &AlgoliaClient{client: client}
+}
+
+func (c *AlgoliaClient) makeURL(parts ...string) string {
+	return strings.Join(append([]string{c.client.BaseURL, c.client.APIVersion}, parts...), "/")
+}
+
+func (c *AlgoliaClient) FetchNewStories() ([]int64, error) {
+	var newStoryIDs []int64
+
+	url := fmt.Sprintf(
+		"%s?tags=story&hitsPerPage=%d",
+		c.makeURL(ResourceNameAlgoliaSearchDate),
+		AlgoliaNewStoriesPageSize,
+	)
+
+	payload, err := c.client.get(url)
+	if err != nil {
+		return newStoryIDs, err
+	}
+
+	result := algoliaSearchResult{}
+	err = json.Unmarshal(payload, &result)
+	if err != nil {
+		return newStoryIDs, err
+	}
+
+	for _, hit := range result.Hits {
+		id, err := strconv.ParseInt(hit.ObjectID, 10, 64)
+		if err != nil {
+			return newStoryIDs, err
+		}
+		newStoryIDs = append(newStoryIDs, id)
+	}
+
+	// Consumers expect the newest story first, as with the Firebase API.
+	slices.SortFunc(newStoryIDs, func(a, b int64) int { return cmp.Compare(b, a) })
+	return newStoryIDs, nil
+}
+
+func (c *AlgoliaClient) FetchStory(id int64) (StoryItems, error) {
+	items := StoryItems{}
+
+	url := c.makeURL(ResourceNameAlgoliaItems, strconv.FormatInt(id, 10))
+	payload, err := c.client.get(url)
+	if err != nil {
+		return items, fmt.Errorf("%w story: %w", ErrFetching, err)
+	}
+
+	item := AlgoliaItem{}
+	err = json.Unmarshal(payload, &item)
+	if err != nil {
+		return items, err
+	}
+
+	items.Story = item.ToHNStory()
+	if !IsStoryType(item.Type) {
+		return items, nil
+	}
+
+	items.Comments = make([]HNComment, 0, len(item.Children))
+	for _, child := range item.Children {
+		items.Comments = append(items.Comments, child.ToHNComment())
+	}
+
+	if item.Type == ItemTypePoll {
+		items.PollOptions = make([]HNPollOpt, 0, len(item.Options))
+		for _, option := range item.Options {
+			items.PollOptions = append(items.PollOptions, option.ToHNPollOpt(item.ID))
+		}
+	}
+
+	return items, nil
+}
+
+func (c *AlgoliaClient) WaitAvailable(ctx context.Context) error {
+	return c.client.WaitAvailable(ctx)
+}
+
+func (c *AlgoliaClient) Version() string {
+	return c.client.APIVersion
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const algoliaItemPayload = `{
+    "id": 1,
+    "created_at": "2007-04-04T19:16:40.000Z",
+    "created_at_i": 1175714200,
+    "type": "story",
+    "author": "author1",
+    "title": "My YC app: Dropbox",
+    "url": "http://www.getdropbox.com/u/2/screencast.html",
+    "text": null,
+    "points": 111,
+    "parent_id": null,
+    "story_id": 1,
+    "children": [
+        {
+            "id": 2,
+            "created_at_i": 1175714300,
+            "type": "comment",
+            "author": "author2",
+            "text": "Aw shucks, guys",
+            "points": null,
+            "parent_id": 1,
+            "story_id": 1,
+            "children": [
+                {
+                    "id": 4,
+                    "created_at_i": 1175714400,
+                    "type": "comment",
+                    "author": "author1",
+                    "text": "Reply",
+                    "parent_id": 2,
+                    "story_id": 1,
+                    "children": []
+                }
+            ]
+        },
+        {
+            "id": 3,
+            "created_at_i": 1175714500,
+            "type": "comment",
+            "author": "author3",
+            "text": "Another",
+            "parent_id": 1,
+            "story_id": 1,
+            "children": []
+        }
+    ]
+}`
+
+const algoliaPollPayload = `{
+    "id": 5,
+    "created_at_i": 1175714200,
+    "type": "poll",
+    "author": "author1",
+    "title": "Poll: Tabs or spaces?",
+    "points": 20,
+    "children": [],
+    "options": [
+        {"id": 6, "created_at_i": 1175714200, "type": "pollopt", "author": "author1", "text": "Tabs", "points": 12, "parent_id": 5, "children": []},
+        {"id": 7, "created_at_i": 1175714200, "type": "pollopt", "author": "author1", "text": "Spaces", "points": 8, "parent_id": 5, "children": []}
+    ]
+}`
+
+// newFakeAlgoliaServer serves the Algolia API's endpoints from fixed payloads.
+func newFakeAlgoliaServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/items/1", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, algoliaItemPayload)
+	})
+	mux.HandleFunc("GET /v1/items/5", func(w http.ResponseWriter, _ *http.Request) {
+		fmt.Fprint(w, algoliaPollPayload)
+	})
+	mux.HandleFunc("GET /v1/items/404", func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, `{"error":"Not found"}`, http.StatusNotFound)
+	})
+	mux.HandleFunc("GET /v1/search_by_date", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "story", r.URL.Query().Get("tags"))
+		fmt.Fprint(w, `{"hits":[{"objectID":"9"},{"objectID":"10"},{"objectID":"8"}]}`)
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestAlgoliaClient(server *httptest.Server) *AlgoliaClient {
+	client := NewHNClient(server.Client(), server.URL, AlgoliaAPIVersion, 0*time.Second, 1)
+	return NewAlgoliaClient(client)
+}
+
+func TestAlgoliaClientFetchNewStories(t *testing.T) {
+	server := newFakeAlgoliaServer(t)
+	client := newTestAlgoliaClient(server)
+
+	actual, err := client.FetchNewStories()
+
+	assert.Nil(t, err)
+	// Newest stories first.
+	assert.Equal(t, []int64{10, 9, 8}, actual)
+}
+
+func TestAlgoliaClientFetchStory(t *testing.T) {
+	server := newFakeAlgoliaServer(t)
+	client := newTestAlgoliaClient(server)
+
+	expected := StoryItems{
+		Story: HNStory{
+			By:          "author1",
+			Descendants: 3,
+			ID:          1,
+			Kids:        []int64{2, 3},
+			Score:       111,
+			Time:        1175714200,
+			Title:       "My YC app: Dropbox",
+			Type:        "story",
+			URL:         "http://www.getdropbox.com/u/2/screencast.html",
+		},
+		Comments: []HNComment{
+			{By: "author2", ID: 2, Kids: []int64{4}, Parent: 1, Text: "Aw shucks, guys", Time: 1175714300, Type: "comment"},
+			{By: "author3", ID: 3, Parent: 1, Text: "Another", Time: 1175714500, Type: "comment"},
+		},
+	}
+
+	actual, err := client.FetchStory(1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestAlgoliaClientFetchStoryWhenPollIncludesOptions(t *testing.T) {
+	server := newFakeAlgoliaServer(t)
+	client := newTestAlgoliaClient(server)
+
+	expected := StoryItems{
+		Story: HNStory{
+			By:    "author1",
+			ID:    5,
+			Parts: []int64{6, 7},
+			Score: 20,
+			Time:  1175714200,
+			Title: "Poll: Tabs or spaces?",
+			Type:  "poll",
+		},
+		Comments: []HNComment{},
+		PollOptions: []HNPollOpt{
+			{By: "author1", ID: 6, Poll: 5, Score: 12, Text: "Tabs", Time: 1175714200, Type: "pollopt"},
+			{By: "author1", ID: 7, Poll: 5, Score: 8, Text: "Spaces", Time: 1175714200, Type: "pollopt"},
+		},
+	}
+
+	actual, err := client.FetchStory(5)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestAlgoliaClientFetchStoryWhenErrorReturnsError(t *testing.T) {
+	server := newFakeAlgoliaServer(t)
+	client := newTestAlgoliaClient(server)
+
+	_, err := client.FetchStory(404)
+
+	assert.ErrorIs(t, err, ErrFetching)
+	assert.ErrorIs(t, err, ErrItemMissing)
+}
+
+func TestAlgoliaClientVersion(t *testing.T) {
+	server := newFakeAlgoliaServer(t)
+	client := newTestAlgoliaClient(server)
+
+	assert.Equal(t, "v1", client.Version())
+}
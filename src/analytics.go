@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	BreakoutNone = "none"
+	// BreakoutEarly is a story that stood out amongst stories of the same age
+	// soon after it was submitted.
+	BreakoutEarly = "breakout"
+	// BreakoutLate is a story that only stood out later on.
+	BreakoutLate = "late_breakout"
+
+	DefaultAnalyticsAgeBucket     = 15 * time.Minute
+	DefaultAnalyticsMinPopulation = 10
+	DefaultBreakoutPercentile     = 95
+	DefaultBreakoutWindow         = time.Hour
+)
+
+// StoryPoint is a snapshot of a story's score and number of comments.
+type StoryPoint struct {
+	StoryID     int64
+	Label       string
+	CreatedAt   time.Time
+	FetchedAt   time.Time
+	Score       int32
+	Descendants int32
+}
+
+// Age returns the age of the story when the snapshot was taken.
+func (p StoryPoint) Age() time.Duration {
+	return p.FetchedAt.Sub(p.CreatedAt)
+}
+
+// SnapshotMetrics are the growth of a story up to a snapshot, per hour since
+// the previous snapshot, and its percentile rank amongst snapshots of stories
+// of the same age. Metrics that can't be computed are nil.
+type SnapshotMetrics struct {
+	StoryPoint
+	ScoreVelocity         *float64
+	CommentVelocity       *float64
+	ScorePercentile       *float64
+	DescendantsPercentile *float64
+}
+
+// StoryAnalytics summarises a story's metrics.
+type StoryAnalytics struct {
+	StoryID             int64
+	Classification      string
+	PeakScorePercentile *float64
+	PeakAge             *time.Duration
+	MaxScoreVelocity    *float64
+}
+
+// AnalyticsConfig configures how stories are compared with each other.
+type AnalyticsConfig struct {
+	// AgeBucket is the width of the age buckets that snapshots are compared
+	// within.
+	AgeBucket time.Duration
+	// MinPopulation is the fewest snapshots an age bucket needs for
+	// percentiles to be computed.
+	MinPopulation int
+	// BreakoutPercentile is the score percentile that a story must reach to
+	// break out.
+	BreakoutPercentile float64
+	// BreakoutWindow is the age up to which breakouts are early.
+	BreakoutWindow time.Duration
+}
+
+func MakeDefaultAnalyticsConfig() AnalyticsConfig {
+	return AnalyticsConfig{
+		AgeBucket:          DefaultAnalyticsAgeBucket,
+		MinPopulation:      DefaultAnalyticsMinPopulation,
+		BreakoutPercentile: DefaultBreakoutPercentile,
+		BreakoutWindow:     DefaultBreakoutWindow,
+	}
+}
+
+func (c AnalyticsConfig) Validate() error {
+	if c.AgeBucket <= 0 {
+		return fmt.Errorf("Age bucket must be positive: %s", c.AgeBucket)
+	}
+	if c.BreakoutPercentile < 0 || c.BreakoutPercentile > 100 {
+		return fmt.Errorf("Breakout percentile must be between 0 and 100: %f", c.BreakoutPercentile)
+	}
+	return nil
+}
+
+func perHour(delta int32, elapsed time.Duration) *float64 {
+	if elapsed <= 0 {
+		return nil
+	}
+	velocity := float64(delta) / elapsed.Hours()
+	return &velocity
+}
+
+// StoryVelocities computes the velocities of a story between each of its
+// snapshots, which are in the order they were taken. The first snapshot has
+// no velocity.
+func StoryVelocities(points []StoryPoint) []SnapshotMetrics {
+	metrics := make([]SnapshotMetrics, 0, len(points))
+	for idx, point := range points {
+		m := SnapshotMetrics{StoryPoint: point}
+		if idx > 0 {
+			previous := points[idx-1]
+			elapsed := point.FetchedAt.Sub(previous.FetchedAt)
+			m.ScoreVelocity = perHour(point.Score-previous.Score, elapsed)
+			m.CommentVelocity = perHour(point.Descendants-previous.Descendants, elapsed)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// ageDistribution is the distribution of scores and comments amongst the
+// snapshots in an age bucket.
+type ageDistribution struct {
+	scores      []float64
+	descendants []float64
+}
+
+// percentileRank returns the percentage of values below the given value,
+// counting equal values as half below. The values must be sorted.
+func percentileRank(values []float64, value float64) float64 {
+	below := sort.SearchFloat64s(values, value)
+	notAbove := sort.Search(len(values), func(idx int) bool { return values[idx] > value })
+	return 100 * (float64(below) + 0.5*float64(notAbove-below)) / float64(len(values))
+}
+
+// AgeDistributions holds the distributions of snapshots of stories, bucketed
+// by the age of the story when they were taken.
+type AgeDistributions struct {
+	buckets       map[int64]*ageDistribution
+	bucket        time.Duration
+	minPopulation int
+}
+
+func NewAgeDistributions(points []StoryPoint, bucket time.Duration, minPopulation int) *AgeDistributions {
+	d := &AgeDistributions{
+		buckets:       make(map[int64]*ageDistribution),
+		bucket:        bucket,
+		minPopulation: minPopulation,
+	}
+
+	for _, point := range points {
+		key, ok := d.key(point)
+		if !ok {
+			continue
+		}
+		dist, ok := d.buckets[key]
+		if !ok {
+			dist = &ageDistribution{}
+			d.buckets[key] = dist
+		}
+		dist.scores = append(dist.scores, float64(point.Score))
+		dist.descendants = append(dist.descendants, float64(point.Descendants))
+	}
+
+	for _, dist := range d.buckets {
+		slices.Sort(dist.scores)
+		slices.Sort(dist.descendants)
+	}
+	return d
+}
+
+func (d *AgeDistributions) key(point StoryPoint) (int64, bool) {
+	age := point.Age()
+	if age < 0 {
+		return 0, false
+	}
+	return int64(age / d.bucket), true
+}
+
+// Percentiles returns the percentile ranks of a snapshot's score and number
+// of comments amongst snapshots of the same age, or false if there are too few
+// snapshots of that age to compare with.
+func (d *AgeDistributions) Percentiles(point StoryPoint) (float64, float64, bool) {
+	key, ok := d.key(point)
+	if !ok {
+		return 0, 0, false
+	}
+	dist, ok := d.buckets[key]
+	if !ok || len(dist.scores) < d.minPopulation {
+		return 0, 0, false
+	}
+	return percentileRank(dist.scores, float64(point.Score)), percentileRank(dist.descendants, float64(point.Descendants)), true
+}
+
+// ClassifyStory summarises a story's metrics, classifying it as a breakout if
+// its score reached the breakout percentile. Metrics must be of a single
+// story, in the order the snapshots were taken.
+func ClassifyStory(metrics []SnapshotMetrics, config AnalyticsConfig) StoryAnalytics {
+	analytics := StoryAnalytics{Classification: BreakoutNone}
+
+	for _, m := range metrics {
+		analytics.StoryID = m.StoryID
+
+		if m.ScoreVelocity != nil && (analytics.MaxScoreVelocity == nil || *m.ScoreVelocity > *analytics.MaxScoreVelocity) {
+			analytics.MaxScoreVelocity = m.ScoreVelocity
+		}
+
+		if m.ScorePercentile == nil {
+			continue
+		}
+		if analytics.PeakScorePercentile == nil || *m.ScorePercentile > *analytics.PeakScorePercentile {
+			age := m.Age()
+			analytics.PeakScorePercentile = m.ScorePercentile
+			analytics.PeakAge = &age
+		}
+		if *m.ScorePercentile >= config.BreakoutPercentile {
+			if m.Age() <= config.BreakoutWindow {
+				analytics.Classification = BreakoutEarly
+			} else if analytics.Classification == BreakoutNone {
+				analytics.Classification = BreakoutLate
+			}
+		}
+	}
+
+	return analytics
+}
+
+// AnalyseStories computes the metrics of the snapshots of stories, comparing
+// each with the others, and summarises each story. Points must be grouped by
+// story, in the order the snapshots were taken.
+func AnalyseStories(points []StoryPoint, config AnalyticsConfig) ([]SnapshotMetrics, []StoryAnalytics) {
+	distributions := NewAgeDistributions(points, config.AgeBucket, config.MinPopulation)
+
+	var (
+		metrics []SnapshotMetrics
+		stories []StoryAnalytics
+	)
+
+	for start := 0; start < len(points); {
+		end := start + 1
+		for end < len(points) && points[end].StoryID == points[start].StoryID {
+			end++
+		}
+
+		storyMetrics := StoryVelocities(points[start:end])
+		for idx := range storyMetrics {
+			score, descendants, ok := distributions.Percentiles(storyMetrics[idx].StoryPoint)
+			if ok {
+				storyMetrics[idx].ScorePercentile = &score
+				storyMetrics[idx].DescendantsPercentile = &descendants
+			}
+		}
+
+		metrics = append(metrics, storyMetrics...)
+		stories = append(stories, ClassifyStory(storyMetrics, config))
+		start = end
+	}
+
+	return metrics, stories
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeStoryPoint(storyID int64, age time.Duration, score, descendants int32) StoryPoint {
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	return StoryPoint{
+		StoryID:     storyID,
+		Label:       age.String(),
+		CreatedAt:   createdAt,
+		FetchedAt:   createdAt.Add(age),
+		Score:       score,
+		Descendants: descendants,
+	}
+}
+
+func TestStoryVelocities(t *testing.T) {
+	points := []StoryPoint{
+		makeStoryPoint(1, 0, 1, 0),
+		makeStoryPoint(1, 30*time.Minute, 11, 4),
+		makeStoryPoint(1, 90*time.Minute, 8, 4),
+	}
+
+	actual := StoryVelocities(points)
+
+	assert.Len(t, actual, 3)
+	assert.Nil(t, actual[0].ScoreVelocity)
+	assert.Nil(t, actual[0].CommentVelocity)
+	assert.Equal(t, 20.0, *actual[1].ScoreVelocity)
+	assert.Equal(t, 8.0, *actual[1].CommentVelocity)
+	assert.Equal(t, -3.0, *actual[2].ScoreVelocity)
+	assert.Equal(t, 0.0, *actual[2].CommentVelocity)
+}
+
+func TestPercentileRank(t *testing.T) {
+	values := []float64{1, 2, 2, 3}
+
+	assert.Equal(t, 0.0, percentileRank(values, 0))
+	assert.Equal(t, 12.5, percentileRank(values, 1))
+	assert.Equal(t, 50.0, percentileRank(values, 2))
+	assert.Equal(t, 100.0, percentileRank(values, 4))
+}
+
+func TestAgeDistributionsPercentiles(t *testing.T) {
+	points := []StoryPoint{
+		makeStoryPoint(1, 5*time.Minute, 1, 0),
+		makeStoryPoint(2, 10*time.Minute, 2, 1),
+		makeStoryPoint(3, 14*time.Minute, 3, 2),
+		makeStoryPoint(4, 20*time.Minute, 100, 50),
+	}
+
+	distributions := NewAgeDistributions(points, 15*time.Minute, 2)
+
+	score, descendants, ok := distributions.Percentiles(points[2])
+	assert.True(t, ok)
+	assert.InDelta(t, 83.33, score, 0.01)
+	assert.InDelta(t, 83.33, descendants, 0.01)
+
+	// Too few snapshots of that age to compare with.
+	_, _, ok = distributions.Percentiles(points[3])
+	assert.False(t, ok)
+}
+
+func TestClassifyStory(t *testing.T) {
+	config := MakeDefaultAnalyticsConfig()
+	low, high := 50.0, 99.0
+	slow, fast := 2.0, 30.0
+
+	type testCase struct {
+		Name           string
+		Percentiles    []*float64
+		Classification string
+	}
+
+	testCases := []testCase{
+		{Name: "breakout", Percentiles: []*float64{&low, &high, &low}, Classification: BreakoutEarly},
+		{Name: "late breakout", Percentiles: []*float64{&low, &low, &high}, Classification: BreakoutLate},
+		{Name: "none", Percentiles: []*float64{&low, nil, &low}, Classification: BreakoutNone},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			metrics := []SnapshotMetrics{
+				{StoryPoint: makeStoryPoint(1, 15*time.Minute, 0, 0), ScorePercentile: tc.Percentiles[0]},
+				{StoryPoint: makeStoryPoint(1, time.Hour, 0, 0), ScorePercentile: tc.Percentiles[1], ScoreVelocity: &fast},
+				{StoryPoint: makeStoryPoint(1, 2*time.Hour, 0, 0), ScorePercentile: tc.Percentiles[2], ScoreVelocity: &slow},
+			}
+
+			actual := ClassifyStory(metrics, config)
+
+			assert.Equal(t, int64(1), actual.StoryID)
+			assert.Equal(t, tc.Classification, actual.Classification)
+			assert.Equal(t, fast, *actual.MaxScoreVelocity)
+		})
+	}
+}
+
+func TestClassifyStoryPeak(t *testing.T) {
+	low, high := 50.0, 80.0
+	metrics := []SnapshotMetrics{
+		{StoryPoint: makeStoryPoint(1, 15*time.Minute, 0, 0), ScorePercentile: &low},
+		{StoryPoint: makeStoryPoint(1, time.Hour, 0, 0), ScorePercentile: &high},
+	}
+
+	actual := ClassifyStory(metrics, MakeDefaultAnalyticsConfig())
+
+	assert.Equal(t, high, *actual.PeakScorePercentile)
+	assert.Equal(t, time.Hour, *actual.PeakAge)
+	assert.Nil(t, actual.MaxScoreVelocity)
+}
+
+func TestAnalyseStories(t *testing.T) {
+	config := MakeDefaultAnalyticsConfig()
+	config.MinPopulation = 3
+
+	points := []StoryPoint{
+		makeStoryPoint(1, 5*time.Minute, 20, 5),
+		makeStoryPoint(1, 35*time.Minute, 50, 10),
+		makeStoryPoint(2, 5*time.Minute, 2, 0),
+		makeStoryPoint(3, 5*time.Minute, 1, 0),
+		makeStoryPoint(3, 35*time.Minute, 1, 0),
+	}
+
+	metrics, stories := AnalyseStories(points, config)
+
+	assert.Len(t, metrics, 5)
+	assert.InDelta(t, 83.33, *metrics[0].ScorePercentile, 0.01)
+	// Too few snapshots of that age to compare with.
+	assert.Nil(t, metrics[1].ScorePercentile)
+	assert.Equal(t, 60.0, *metrics[1].ScoreVelocity)
+
+	assert.Len(t, stories, 3)
+	assert.Equal(t, []int64{1, 2, 3}, []int64{stories[0].StoryID, stories[1].StoryID, stories[2].StoryID})
+	assert.Equal(t, BreakoutNone, stories[0].Classification)
+}
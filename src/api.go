@@ -0,0 +1,611 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultAPIPageSize    = 50
+	MaxAPIPageSize        = 500
+	DefaultGrowthBucket   = 15 * time.Minute
+	DefaultGrowthMaxAge   = 24 * time.Hour
+	maxGrowthBucketsCount = 1000
+)
+
+// StoryReader provides methods to read stories for the API.
+type StoryReader interface {
+	ListStories(context.Context, StoryFilter) ([]StoryModel, error)
+	StorySnapshots(context.Context, int64) ([]StoryModel, error)
+	ReadSnapshot(context.Context, int64, string) (StoryModel, error)
+	GrowthCurves(context.Context, StoryFilter, time.Duration, time.Duration) ([]GrowthPoint, error)
+	ReadAnalytics(context.Context, int64) (StoryAnalytics, []SnapshotMetrics, error)
+	StoryDuplicates(context.Context, int64) ([]StoryModel, error)
+	DomainStats(context.Context, StoryFilter, int) ([]DomainStats, error)
+}
+
+// StorySummary is the latest snapshot of a story.
+type StorySummary struct {
+	StoryID      int64     `json:"story_id"`
+	Type         string    `json:"type"`
+	By           string    `json:"by"`
+	Title        string    `json:"title"`
+	URL          string    `json:"url,omitempty"`
+	CanonicalURL string    `json:"canonical_url,omitempty"`
+	Domain       string    `json:"domain,omitempty"`
+	Score        int32     `json:"score"`
+	Descendants  int32     `json:"descendants"`
+	CreatedAt    time.Time `json:"created_at"`
+	Status       string    `json:"status"`
+	Label        string    `json:"label"`
+	FetchedAt    time.Time `json:"fetched_at"`
+	Tags         []string  `json:"tags,omitempty"`
+}
+
+// StoryPage is a page of stories. The next page is requested with the cursor,
+// which is empty on the last page.
+type StoryPage struct {
+	Stories    []StorySummary `json:"stories"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+// SnapshotPoint is a point of a story's time series.
+type SnapshotPoint struct {
+	Label       string    `json:"label"`
+	FetchedAt   time.Time `json:"fetched_at"`
+	Status      string    `json:"status"`
+	Score       int32     `json:"score"`
+	Descendants int32     `json:"descendants"`
+}
+
+// SnapshotDocument is a snapshot of a story, with the raw documents of the
+// story, its comments and its poll options.
+type SnapshotDocument struct {
+	StoryID     int64             `json:"story_id"`
+	Label       string            `json:"label"`
+	APIVersion  string            `json:"api_version"`
+	FetchedAt   time.Time         `json:"fetched_at"`
+	Status      string            `json:"status"`
+	Tags        []string          `json:"tags,omitempty"`
+	Story       json.RawMessage   `json:"story"`
+	Comments    []json.RawMessage `json:"comments"`
+	PollOptions []json.RawMessage `json:"poll_options,omitempty"`
+}
+
+// GrowthCurvePoint aggregates snapshots of stories taken at a given age.
+type GrowthCurvePoint struct {
+	AgeSeconds        int64   `json:"age_seconds"`
+	Snapshots         int64   `json:"snapshots"`
+	MeanScore         float64 `json:"mean_score"`
+	MedianScore       float64 `json:"median_score"`
+	MeanDescendants   float64 `json:"mean_descendants"`
+	MedianDescendants float64 `json:"median_descendants"`
+}
+
+// SnapshotAnalytics are the metrics of a snapshot of a story.
+type SnapshotAnalytics struct {
+	Label                 string    `json:"label"`
+	FetchedAt             time.Time `json:"fetched_at"`
+	AgeSeconds            int64     `json:"age_seconds"`
+	Score                 int32     `json:"score"`
+	Descendants           int32     `json:"descendants"`
+	ScoreVelocity         *float64  `json:"score_velocity"`
+	CommentVelocity       *float64  `json:"comment_velocity"`
+	ScorePercentile       *float64  `json:"score_percentile"`
+	DescendantsPercentile *float64  `json:"descendants_percentile"`
+}
+
+// StoryAnalyticsDocument is the metrics of a story. Velocities are always
+// current, whereas percentiles and the classification are as of the last
+// analytics batch, and are absent if the story hasn't been analysed.
+type StoryAnalyticsDocument struct {
+	StoryID             int64               `json:"story_id"`
+	Classification      string              `json:"classification,omitempty"`
+	PeakScorePercentile *float64            `json:"peak_score_percentile,omitempty"`
+	PeakAgeSeconds      *int64              `json:"peak_age_seconds,omitempty"`
+	MaxScoreVelocity    *float64            `json:"max_score_velocity,omitempty"`
+	Snapshots           []SnapshotAnalytics `json:"snapshots"`
+}
+
+// DuplicateGroup is the submissions of an article, in the order they were
+// submitted.
+type DuplicateGroup struct {
+	CanonicalURL string         `json:"canonical_url"`
+	Stories      []StorySummary `json:"stories"`
+}
+
+// DomainSummary aggregates the stories submitted from a domain.
+type DomainSummary struct {
+	Domain          string  `json:"domain"`
+	Stories         int64   `json:"stories"`
+	Articles        int64   `json:"articles"`
+	MeanScore       float64 `json:"mean_score"`
+	MedianScore     float64 `json:"median_score"`
+	MaxScore        int32   `json:"max_score"`
+	MeanDescendants float64 `json:"mean_descendants"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func MakeStorySummary(model StoryModel) (StorySummary, error) {
+	story, err := ParseStory(model)
+	if err != nil {
+		return StorySummary{}, err
+	}
+
+	return StorySummary{
+		StoryID:      model.StoryID,
+		Type:         story.Type,
+		By:           story.By,
+		Title:        story.Title,
+		URL:          story.URL,
+		CanonicalURL: model.CanonicalURL,
+		Domain:       model.Domain,
+		Score:        story.Score,
+		Descendants:  story.Descendants,
+		CreatedAt:    time.Unix(story.Time, 0).UTC(),
+		Status:       model.Status,
+		Label:        model.QueueName,
+		FetchedAt:    model.FetchedAt,
+		Tags:         model.Tags,
+	}, nil
+}
+
+func MakeSnapshotPoint(model StoryModel) (SnapshotPoint, error) {
+	story, err := ParseStory(model)
+	if err != nil {
+		return SnapshotPoint{}, err
+	}
+
+	return SnapshotPoint{
+		Label:       model.QueueName,
+		FetchedAt:   model.FetchedAt,
+		Status:      model.Status,
+		Score:       story.Score,
+		Descendants: story.Descendants,
+	}, nil
+}
+
+func MakeSnapshotDocument(model StoryModel) SnapshotDocument {
+	doc := SnapshotDocument{
+		StoryID:    model.StoryID,
+		Label:      model.QueueName,
+		APIVersion: model.APIVersion,
+		FetchedAt:  model.FetchedAt,
+		Status:     model.Status,
+		Tags:       model.Tags,
+		Story:      json.RawMessage(model.RawDocument),
+		Comments:   make([]json.RawMessage, 0, len(model.Comments)),
+	}
+	for _, comment := range model.Comments {
+		doc.Comments = append(doc.Comments, json.RawMessage(comment.RawDocument))
+	}
+	for _, option := range model.PollOptions {
+		doc.PollOptions = append(doc.PollOptions, json.RawMessage(option.RawDocument))
+	}
+	return doc
+}
+
+// ETag computes the entity tag of a response body.
+func ETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// MatchesETag returns whether the value of an `If-None-Match` header matches
+// the entity tag. Weak tags match their strong counterparts.
+func MatchesETag(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// StoriesAPI serves stories over HTTP, as JSON.
+type StoriesAPI struct {
+	repo StoryReader
+}
+
+func NewStoriesAPI(repo StoryReader) *StoriesAPI {
+	return &StoriesAPI{repo: repo}
+}
+
+// Handler returns the API's routes.
+func (a *StoriesAPI) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /stories", a.listStories)
+	mux.HandleFunc("GET /stories/{id}/snapshots", a.storySnapshots)
+	mux.HandleFunc("GET /stories/{id}/snapshots/{label}", a.readSnapshot)
+	mux.HandleFunc("GET /stories/{id}/analytics", a.storyAnalytics)
+	mux.HandleFunc("GET /stories/{id}/duplicates", a.storyDuplicates)
+	mux.HandleFunc("GET /growth", a.growthCurves)
+	mux.HandleFunc("GET /domains", a.domainStats)
+	return mux
+}
+
+// writeJSON writes the value as JSON with its entity tag, or responds that it
+// is not modified if the request already has it.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	etag := ETag(body)
+	w.Header().Set("ETag", etag)
+	if status == http.StatusOK && MatchesETag(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	body, _ := json.Marshal(apiError{Error: msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func writeInternalError(w http.ResponseWriter, err error) {
+	slog.Error("Error serving request", "error", err)
+	writeError(w, http.StatusInternalServerError, "Internal error")
+}
+
+func parseTimeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("Invalid %s: %s", name, value)
+	}
+	return t, nil
+}
+
+func parseIntParam(r *http.Request, name string, fallback int64) (int64, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("Invalid %s: %s", name, value)
+	}
+	return n, nil
+}
+
+func parseDurationParam(r *http.Request, name string, fallback time.Duration) (time.Duration, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return fallback, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("Invalid %s: %s", name, value)
+	}
+	return d, nil
+}
+
+// ParseStoryFilter parses the filters of a request for stories, from the
+// `from`, `to`, `min_score`, `domain`, `cursor` and `limit` parameters.
+func ParseStoryFilter(r *http.Request) (StoryFilter, error) {
+	var (
+		filter StoryFilter
+		err    error
+	)
+
+	filter.CreatedAfter, err = parseTimeParam(r, "from")
+	if err != nil {
+		return filter, err
+	}
+	filter.CreatedBefore, err = parseTimeParam(r, "to")
+	if err != nil {
+		return filter, err
+	}
+
+	minScore, err := parseIntParam(r, "min_score", 0)
+	if err != nil {
+		return filter, err
+	}
+	filter.MinScore = int(minScore)
+
+	if domain := r.URL.Query().Get("domain"); domain != "" {
+		filter.Domain = RegistrableDomain(domain)
+	}
+
+	filter.BeforeID, err = parseIntParam(r, "cursor", 0)
+	if err != nil {
+		return filter, err
+	}
+
+	limit, err := parseIntParam(r, "limit", DefaultAPIPageSize)
+	if err != nil {
+		return filter, err
+	}
+	if limit == 0 || limit > MaxAPIPageSize {
+		return filter, fmt.Errorf("Invalid limit: must be between 1 and %d", MaxAPIPageSize)
+	}
+	filter.Limit = int(limit)
+
+	return filter, nil
+}
+
+func parseStoryID(r *http.Request) (int64, error) {
+	storyID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid story id: %s", r.PathValue("id"))
+	}
+	return storyID, nil
+}
+
+func (a *StoriesAPI) listStories(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseStoryFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Read an extra story to find out whether there is another page.
+	limit := filter.Limit
+	filter.Limit++
+	models, err := a.repo.ListStories(r.Context(), filter)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	page := StoryPage{Stories: make([]StorySummary, 0, len(models))}
+	if len(models) > limit {
+		models = models[:limit]
+		page.NextCursor = strconv.FormatInt(models[limit-1].StoryID, 10)
+	}
+	for _, model := range models {
+		summary, err := MakeStorySummary(model)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		page.Stories = append(page.Stories, summary)
+	}
+
+	writeJSON(w, r, http.StatusOK, page)
+}
+
+func (a *StoriesAPI) storySnapshots(w http.ResponseWriter, r *http.Request) {
+	storyID, err := parseStoryID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	models, err := a.repo.StorySnapshots(r.Context(), storyID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if len(models) == 0 {
+		writeError(w, http.StatusNotFound, "Story not found")
+		return
+	}
+
+	points := make([]SnapshotPoint, 0, len(models))
+	for _, model := range models {
+		point, err := MakeSnapshotPoint(model)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		points = append(points, point)
+	}
+
+	writeJSON(w, r, http.StatusOK, points)
+}
+
+func (a *StoriesAPI) readSnapshot(w http.ResponseWriter, r *http.Request) {
+	storyID, err := parseStoryID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	model, err := a.repo.ReadSnapshot(r.Context(), storyID, r.PathValue("label"))
+	if errors.Is(err, ErrSnapshotNotFound) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	writeJSON(w, r, http.StatusOK, MakeSnapshotDocument(model))
+}
+
+func (a *StoriesAPI) growthCurves(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseStoryFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	bucket, err := parseDurationParam(r, "bucket", DefaultGrowthBucket)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	maxAge, err := parseDurationParam(r, "max_age", DefaultGrowthMaxAge)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if maxAge/bucket > maxGrowthBucketsCount {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Too many buckets: at most %d are allowed", maxGrowthBucketsCount))
+		return
+	}
+
+	points, err := a.repo.GrowthCurves(r.Context(), filter, bucket, maxAge)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	curve := make([]GrowthCurvePoint, 0, len(points))
+	for _, point := range points {
+		curve = append(curve, GrowthCurvePoint{
+			AgeSeconds:        int64(point.Age.Seconds()),
+			Snapshots:         point.Snapshots,
+			MeanScore:         point.MeanScore,
+			MedianScore:       point.MedianScore,
+			MeanDescendants:   point.MeanDescendants,
+			MedianDescendants: point.MedianDescendants,
+		})
+	}
+
+	writeJSON(w, r, http.StatusOK, curve)
+}
+
+func (a *StoriesAPI) storyAnalytics(w http.ResponseWriter, r *http.Request) {
+	storyID, err := parseStoryID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	models, err := a.repo.StorySnapshots(r.Context(), storyID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if len(models) == 0 {
+		writeError(w, http.StatusNotFound, "Story not found")
+		return
+	}
+
+	// Removed stories have no score, so are left out as they are from the
+	// analytics batch.
+	var points []StoryPoint
+	for _, model := range models {
+		if model.Status != StoryStatusOK {
+			continue
+		}
+		point, err := MakeStoryPoint(model)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		points = append(points, point)
+	}
+
+	stored, storedMetrics, err := a.repo.ReadAnalytics(r.Context(), storyID)
+	if err != nil && !errors.Is(err, ErrAnalyticsNotFound) {
+		writeInternalError(w, err)
+		return
+	}
+
+	doc := StoryAnalyticsDocument{StoryID: storyID, Snapshots: make([]SnapshotAnalytics, 0, len(points))}
+	if err == nil {
+		doc.Classification = stored.Classification
+		doc.PeakScorePercentile = stored.PeakScorePercentile
+		doc.MaxScoreVelocity = stored.MaxScoreVelocity
+		if stored.PeakAge != nil {
+			seconds := int64(stored.PeakAge.Seconds())
+			doc.PeakAgeSeconds = &seconds
+		}
+	}
+
+	percentiles := make(map[string]SnapshotMetrics, len(storedMetrics))
+	for _, m := range storedMetrics {
+		percentiles[m.Label] = m
+	}
+
+	for _, m := range StoryVelocities(points) {
+		stored := percentiles[m.Label]
+		doc.Snapshots = append(doc.Snapshots, SnapshotAnalytics{
+			Label:                 m.Label,
+			FetchedAt:             m.FetchedAt,
+			AgeSeconds:            int64(m.Age().Seconds()),
+			Score:                 m.Score,
+			Descendants:           m.Descendants,
+			ScoreVelocity:         m.ScoreVelocity,
+			CommentVelocity:       m.CommentVelocity,
+			ScorePercentile:       stored.ScorePercentile,
+			DescendantsPercentile: stored.DescendantsPercentile,
+		})
+	}
+
+	writeJSON(w, r, http.StatusOK, doc)
+}
+
+func (a *StoriesAPI) storyDuplicates(w http.ResponseWriter, r *http.Request) {
+	storyID, err := parseStoryID(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	models, err := a.repo.StoryDuplicates(r.Context(), storyID)
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+	if len(models) == 0 {
+		writeError(w, http.StatusNotFound, "Story not found, or has no URL")
+		return
+	}
+
+	group := DuplicateGroup{CanonicalURL: models[0].CanonicalURL, Stories: make([]StorySummary, 0, len(models))}
+	for _, model := range models {
+		summary, err := MakeStorySummary(model)
+		if err != nil {
+			writeInternalError(w, err)
+			return
+		}
+		group.Stories = append(group.Stories, summary)
+	}
+
+	writeJSON(w, r, http.StatusOK, group)
+}
+
+func (a *StoriesAPI) domainStats(w http.ResponseWriter, r *http.Request) {
+	filter, err := ParseStoryFilter(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	minStories, err := parseIntParam(r, "min_stories", 1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	stats, err := a.repo.DomainStats(r.Context(), filter, int(minStories))
+	if err != nil {
+		writeInternalError(w, err)
+		return
+	}
+
+	domains := make([]DomainSummary, 0, len(stats))
+	for _, s := range stats {
+		domains = append(domains, DomainSummary(s))
+	}
+
+	writeJSON(w, r, http.StatusOK, domains)
+}
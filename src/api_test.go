@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockStoryReader struct {
+	mock.Mock
+}
+
+func (m *mockStoryReader) ListStories(ctx context.Context, filter StoryFilter) ([]StoryModel, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).([]StoryModel), args.Error(1)
+}
+
+func (m *mockStoryReader) StorySnapshots(ctx context.Context, storyID int64) ([]StoryModel, error) {
+	args := m.Called(ctx, storyID)
+	return args.Get(0).([]StoryModel), args.Error(1)
+}
+
+func (m *mockStoryReader) ReadSnapshot(ctx context.Context, storyID int64, label string) (StoryModel, error) {
+	args := m.Called(ctx, storyID, label)
+	return args.Get(0).(StoryModel), args.Error(1)
+}
+
+func (m *mockStoryReader) GrowthCurves(ctx context.Context, filter StoryFilter, bucket, maxAge time.Duration) ([]GrowthPoint, error) {
+	args := m.Called(ctx, filter, bucket, maxAge)
+	return args.Get(0).([]GrowthPoint), args.Error(1)
+}
+
+func (m *mockStoryReader) ReadAnalytics(ctx context.Context, storyID int64) (StoryAnalytics, []SnapshotMetrics, error) {
+	args := m.Called(ctx, storyID)
+	return args.Get(0).(StoryAnalytics), args.Get(1).([]SnapshotMetrics), args.Error(2)
+}
+
+func (m *mockStoryReader) StoryDuplicates(ctx context.Context, storyID int64) ([]StoryModel, error) {
+	args := m.Called(ctx, storyID)
+	return args.Get(0).([]StoryModel), args.Error(1)
+}
+
+func (m *mockStoryReader) DomainStats(ctx context.Context, filter StoryFilter, minStories int) ([]DomainStats, error) {
+	args := m.Called(ctx, filter, minStories)
+	return args.Get(0).([]DomainStats), args.Error(1)
+}
+
+func serveAPI(repo StoryReader, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	NewStoriesAPI(repo).Handler().ServeHTTP(rec, req)
+	return rec
+}
+
+func TestParseStoryFilter(t *testing.T) {
+	req := httptest.NewRequest(
+		http.MethodGet,
+		"/stories?from=2024-01-01T00:00:00Z&min_score=10&domain=WWW.Example.com&cursor=100&limit=5",
+		nil,
+	)
+
+	expected := StoryFilter{
+		CreatedAfter: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		MinScore:     10,
+		Domain:       "example.com",
+		BeforeID:     100,
+		Limit:        5,
+	}
+
+	actual, err := ParseStoryFilter(req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestParseStoryFilterUsesRegistrableDomain(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/stories?domain=Blog.Example.co.uk", nil)
+
+	actual, err := ParseStoryFilter(req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "example.co.uk", actual.Domain)
+}
+
+func TestParseStoryFilterWhenInvalidReturnsError(t *testing.T) {
+	for _, query := range []string{"from=yesterday", "min_score=-1", "cursor=abc", "limit=0", "limit=501"} {
+		req := httptest.NewRequest(http.MethodGet, "/stories?"+query, nil)
+
+		_, err := ParseStoryFilter(req)
+
+		assert.NotNil(t, err, query)
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	assert.True(t, MatchesETag(`"a"`, `"a"`))
+	assert.True(t, MatchesETag(`"b", W/"a"`, `"a"`))
+	assert.True(t, MatchesETag(`*`, `"a"`))
+	assert.False(t, MatchesETag(`"b"`, `"a"`))
+	assert.False(t, MatchesETag(``, `"a"`))
+}
+
+func TestStoriesAPIListStories(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("ListStories", mock.Anything, StoryFilter{MinScore: 5, Limit: 3}).Return([]StoryModel{
+		{StoryID: 3, QueueName: "30m", Status: StoryStatusOK, RawDocument: `{"id":3,"score":20,"title":"Third"}`},
+		{StoryID: 2, QueueName: "0m", Status: StoryStatusOK, RawDocument: `{"id":2,"score":10,"title":"Second"}`},
+		{StoryID: 1, QueueName: "new", Status: StoryStatusOK, RawDocument: `{"id":1,"score":5,"title":"First"}`},
+	}, nil)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories?min_score=5&limit=2", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("ETag"))
+
+	page := StoryPage{}
+	err := json.Unmarshal(rec.Body.Bytes(), &page)
+	assert.Nil(t, err)
+	assert.Len(t, page.Stories, 2)
+	assert.Equal(t, "Third", page.Stories[0].Title)
+	assert.Equal(t, "30m", page.Stories[0].Label)
+	assert.Equal(t, "2", page.NextCursor)
+}
+
+func TestStoriesAPIListStoriesOnLastPage(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("ListStories", mock.Anything, mock.Anything).Return([]StoryModel{
+		{StoryID: 1, QueueName: "new", Status: StoryStatusOK, RawDocument: `{"id":1}`},
+	}, nil)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories", nil))
+
+	page := StoryPage{}
+	err := json.Unmarshal(rec.Body.Bytes(), &page)
+	assert.Nil(t, err)
+	assert.Len(t, page.Stories, 1)
+	assert.Empty(t, page.NextCursor)
+}
+
+func TestStoriesAPIListStoriesWhenInvalidFilter(t *testing.T) {
+	repo := new(mockStoryReader)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories?limit=abc", nil))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	repo.AssertNotCalled(t, "ListStories", mock.Anything, mock.Anything)
+}
+
+func TestStoriesAPIListStoriesWhenErrorReading(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("ListStories", mock.Anything, mock.Anything).Return([]StoryModel{}, fmt.Errorf("Error"))
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+}
+
+func TestStoriesAPIWhenNotModified(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("ListStories", mock.Anything, mock.Anything).Return([]StoryModel{
+		{StoryID: 1, QueueName: "new", Status: StoryStatusOK, RawDocument: `{"id":1}`},
+	}, nil)
+
+	first := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories", nil))
+
+	req := httptest.NewRequest(http.MethodGet, "/stories", nil)
+	req.Header.Set("If-None-Match", first.Header().Get("ETag"))
+	second := serveAPI(repo, req)
+
+	assert.Equal(t, http.StatusNotModified, second.Code)
+	assert.Empty(t, second.Body.Bytes())
+	assert.Equal(t, first.Header().Get("ETag"), second.Header().Get("ETag"))
+}
+
+func TestStoriesAPIStorySnapshots(t *testing.T) {
+	fetchedAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	repo := new(mockStoryReader)
+	repo.On("StorySnapshots", mock.Anything, int64(1)).Return([]StoryModel{
+		{StoryID: 1, QueueName: "new", FetchedAt: fetchedAt, Status: StoryStatusOK, RawDocument: `{"id":1,"score":1,"descendants":0}`},
+		{StoryID: 1, QueueName: "0m", FetchedAt: fetchedAt.Add(time.Hour), Status: StoryStatusOK, RawDocument: `{"id":1,"score":7,"descendants":2}`},
+	}, nil)
+
+	expected := []SnapshotPoint{
+		{Label: "new", FetchedAt: fetchedAt, Status: StoryStatusOK, Score: 1, Descendants: 0},
+		{Label: "0m", FetchedAt: fetchedAt.Add(time.Hour), Status: StoryStatusOK, Score: 7, Descendants: 2},
+	}
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories/1/snapshots", nil))
+
+	var actual []SnapshotPoint
+	err := json.Unmarshal(rec.Body.Bytes(), &actual)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, expected, actual)
+}
+
+func TestStoriesAPIStorySnapshotsWhenStoryNotFound(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("StorySnapshots", mock.Anything, int64(1)).Return([]StoryModel{}, nil)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories/1/snapshots", nil))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestStoriesAPIStorySnapshotsWhenInvalidID(t *testing.T) {
+	repo := new(mockStoryReader)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories/abc/snapshots", nil))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestStoriesAPIReadSnapshot(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("ReadSnapshot", mock.Anything, int64(1), "30m").Return(StoryModel{
+		StoryID:     1,
+		APIVersion:  "v0",
+		QueueName:   "30m",
+		Status:      StoryStatusOK,
+		RawDocument: `{"id":1}`,
+		Comments:    []CommentModel{{CommentID: 2, RawDocument: `{"id":2}`}},
+	}, nil)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories/1/snapshots/30m", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(
+		t,
+		`{"story_id":1,"label":"30m","api_version":"v0","fetched_at":"0001-01-01T00:00:00Z","status":"ok","story":{"id":1},"comments":[{"id":2}]}`,
+		rec.Body.String(),
+	)
+}
+
+func TestStoriesAPIReadSnapshotWhenNotFound(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("ReadSnapshot", mock.Anything, int64(1), "1h").Return(StoryModel{}, ErrSnapshotNotFound)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories/1/snapshots/1h", nil))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestStoriesAPIGrowthCurves(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("GrowthCurves", mock.Anything, StoryFilter{Domain: "example.com", Limit: DefaultAPIPageSize}, 30*time.Minute, 2*time.Hour).Return([]GrowthPoint{
+		{Age: 0, Snapshots: 4, MeanScore: 1.5, MedianScore: 1, MeanDescendants: 0.5, MedianDescendants: 0},
+		{Age: 30 * time.Minute, Snapshots: 2, MeanScore: 10, MedianScore: 10, MeanDescendants: 3, MedianDescendants: 3},
+	}, nil)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/growth?domain=example.com&bucket=30m&max_age=2h", nil))
+
+	var actual []GrowthCurvePoint
+	err := json.Unmarshal(rec.Body.Bytes(), &actual)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Len(t, actual, 2)
+	assert.Equal(t, int64(1800), actual[1].AgeSeconds)
+	assert.Equal(t, 10.0, actual[1].MedianScore)
+}
+
+func TestStoriesAPIGrowthCurvesWhenTooManyBuckets(t *testing.T) {
+	repo := new(mockStoryReader)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/growth?bucket=1s&max_age=24h", nil))
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	repo.AssertNotCalled(t, "GrowthCurves", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestStoriesAPIStoryAnalytics(t *testing.T) {
+	fetchedAt := time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC)
+	peakAge := time.Hour
+	percentile := 97.5
+	velocity := 12.0
+
+	repo := new(mockStoryReader)
+	repo.On("StorySnapshots", mock.Anything, int64(1)).Return([]StoryModel{
+		{StoryID: 1, QueueName: "0m", FetchedAt: fetchedAt, Status: StoryStatusOK, RawDocument: `{"id":1,"time":1704067200,"score":4,"descendants":2}`},
+		{StoryID: 1, QueueName: "30m", FetchedAt: fetchedAt.Add(30 * time.Minute), Status: StoryStatusOK, RawDocument: `{"id":1,"time":1704067200,"score":10,"descendants":3}`},
+		{StoryID: 1, QueueName: "1h", FetchedAt: fetchedAt.Add(time.Hour), Status: StoryStatusDeleted, RawDocument: `{"id":1,"deleted":true}`},
+	}, nil)
+	repo.On("ReadAnalytics", mock.Anything, int64(1)).Return(
+		StoryAnalytics{StoryID: 1, Classification: BreakoutEarly, PeakScorePercentile: &percentile, PeakAge: &peakAge, MaxScoreVelocity: &velocity},
+		[]SnapshotMetrics{{StoryPoint: StoryPoint{StoryID: 1, Label: "0m"}, ScorePercentile: &percentile}},
+		nil,
+	)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories/1/analytics", nil))
+
+	doc := StoryAnalyticsDocument{}
+	err := json.Unmarshal(rec.Body.Bytes(), &doc)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, BreakoutEarly, doc.Classification)
+	assert.Equal(t, int64(3600), *doc.PeakAgeSeconds)
+	assert.Len(t, doc.Snapshots, 2)
+	assert.Equal(t, int64(3600), doc.Snapshots[0].AgeSeconds)
+	assert.Equal(t, percentile, *doc.Snapshots[0].ScorePercentile)
+	assert.Nil(t, doc.Snapshots[0].ScoreVelocity)
+	assert.Equal(t, 12.0, *doc.Snapshots[1].ScoreVelocity)
+	assert.Equal(t, 2.0, *doc.Snapshots[1].CommentVelocity)
+	assert.Nil(t, doc.Snapshots[1].ScorePercentile)
+}
+
+func TestStoriesAPIStoryAnalyticsWhenNotAnalysed(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("StorySnapshots", mock.Anything, int64(1)).Return([]StoryModel{
+		{StoryID: 1, QueueName: "0m", Status: StoryStatusOK, RawDocument: `{"id":1}`},
+	}, nil)
+	repo.On("ReadAnalytics", mock.Anything, int64(1)).Return(StoryAnalytics{}, []SnapshotMetrics(nil), ErrAnalyticsNotFound)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories/1/analytics", nil))
+
+	doc := StoryAnalyticsDocument{}
+	err := json.Unmarshal(rec.Body.Bytes(), &doc)
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, doc.Classification)
+	assert.Len(t, doc.Snapshots, 1)
+}
+
+func TestStoriesAPIStoryDuplicates(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("StoryDuplicates", mock.Anything, int64(2)).Return([]StoryModel{
+		{StoryID: 1, Status: StoryStatusOK, CanonicalURL: "https://example.com/a", Domain: "example.com", RawDocument: `{"id":1,"url":"http://www.example.com/a/"}`},
+		{StoryID: 2, Status: StoryStatusOK, CanonicalURL: "https://example.com/a", Domain: "example.com", RawDocument: `{"id":2,"url":"https://example.com/a?utm_source=hn"}`},
+	}, nil)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories/2/duplicates", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	group := DuplicateGroup{}
+	err := json.Unmarshal(rec.Body.Bytes(), &group)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.com/a", group.CanonicalURL)
+	assert.Len(t, group.Stories, 2)
+	assert.Equal(t, "example.com", group.Stories[0].Domain)
+}
+
+func TestStoriesAPIStoryDuplicatesWhenNoURL(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("StoryDuplicates", mock.Anything, int64(1)).Return([]StoryModel{}, nil)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/stories/1/duplicates", nil))
+
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestStoriesAPIDomainStats(t *testing.T) {
+	repo := new(mockStoryReader)
+	repo.On("DomainStats", mock.Anything, StoryFilter{Limit: DefaultAPIPageSize}, 3).Return([]DomainStats{
+		{Domain: "example.com", Stories: 4, Articles: 3, MeanScore: 12.5, MedianScore: 10, MaxScore: 30},
+	}, nil)
+
+	rec := serveAPI(repo, httptest.NewRequest(http.MethodGet, "/domains?min_stories=3", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var domains []DomainSummary
+	err := json.Unmarshal(rec.Body.Bytes(), &domains)
+	assert.Nil(t, err)
+	assert.Equal(t, []DomainSummary{{Domain: "example.com", Stories: 4, Articles: 3, MeanScore: 12.5, MedianScore: 10, MaxScore: 30}}, domains)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBreakerMaxConsecutiveFailures = 5
+	DefaultBreakerMaxErrorRate           = 0.5
+	DefaultBreakerMinRequests            = 20
+	DefaultBreakerWindow                 = 1 * time.Minute
+	DefaultBreakerOpenDuration           = 30 * time.Second
+	// breakerProbeInterval is how often waiters check whether a half-open
+	// breaker's trial request has completed.
+	breakerProbeInterval = 100 * time.Millisecond
+)
+
+var ErrCircuitOpen = errors.New("Circuit open")
+
+type BreakerState int
+
+const (
+	// BreakerClosed allows requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects requests until its open duration has elapsed.
+	BreakerOpen
+	// BreakerHalfOpen allows a single trial request through, which decides
+	// whether the breaker closes or reopens.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// CircuitBreaker stops requests from being made to a failing service. The
+// breaker opens after MaxConsecutiveFailures consecutive failures, or once
+// the rate of failures within the current window reaches MaxErrorRate, given
+// that at least MinRequests requests were made in it. After OpenDuration, a
+// trial request is allowed through to check whether the service has
+// recovered.
+type CircuitBreaker struct {
+	MaxConsecutiveFailures int
+	MaxErrorRate           float64
+	MinRequests            int
+	Window                 time.Duration
+	OpenDuration           time.Duration
+
+	mu                  sync.Mutex
+	now                 func() time.Time
+	state               BreakerState
+	consecutiveFailures int
+	windowStart         time.Time
+	windowRequests      int
+	windowFailures      int
+	openedAt            time.Time
+	trialInFlight       bool
+}
+
+func NewCircuitBreaker(maxConsecutiveFailures int, maxErrorRate float64, minRequests int, window, openDuration time.Duration) *CircuitBreaker {
+	if maxConsecutiveFailures <= 0 {
+		panic("Max consecutive failures must be positive")
+	}
+	if maxErrorRate <= 0 || maxErrorRate > 1 {
+		panic("Max error rate must be in (0, 1]")
+	}
+
+	breaker := &CircuitBreaker{
+		MaxConsecutiveFailures: maxConsecutiveFailures,
+		MaxErrorRate:           maxErrorRate,
+		MinRequests:            minRequests,
+		Window:                 window,
+		OpenDuration:           openDuration,
+		now:                    time.Now,
+	}
+	circuitBreakerState.Set(BreakerClosed.String())
+	return breaker
+}
+
+// State returns the breaker's current state.
+func (b *CircuitBreaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+func (b *CircuitBreaker) transition(state BreakerState) {
+	slog.Info("Circuit breaker state changed", "from", b.state, "to", state)
+	b.state = state
+	circuitBreakerState.Set(state.String())
+
+	switch state {
+	case BreakerOpen:
+		b.openedAt = b.now()
+		circuitBreakerTrips.Add(1)
+	case BreakerClosed:
+		b.resetWindow()
+	}
+	b.consecutiveFailures = 0
+	b.trialInFlight = false
+}
+
+func (b *CircuitBreaker) resetWindow() {
+	b.windowStart = b.now()
+	b.windowRequests = 0
+	b.windowFailures = 0
+}
+
+// Allow returns ErrCircuitOpen if a request may not be made. Otherwise, the
+// outcome of the request must be recorded.
+func (b *CircuitBreaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == BreakerOpen && !b.now().Before(b.openedAt.Add(b.OpenDuration)) {
+		b.transition(BreakerHalfOpen)
+	}
+
+	switch b.state {
+	case BreakerOpen:
+		return ErrCircuitOpen
+	case BreakerHalfOpen:
+		if b.trialInFlight {
+			return ErrCircuitOpen
+		}
+		b.trialInFlight = true
+	}
+	return nil
+}
+
+// Record records the outcome of an allowed request.
+func (b *CircuitBreaker) Record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerHalfOpen:
+		if failed {
+			b.transition(BreakerOpen)
+		} else {
+			b.transition(BreakerClosed)
+		}
+		return
+	case BreakerOpen:
+		// Outcome of a request that was allowed before the breaker opened.
+		return
+	}
+
+	if b.now().Sub(b.windowStart) >= b.Window {
+		b.resetWindow()
+	}
+
+	b.windowRequests++
+	if !failed {
+		b.consecutiveFailures = 0
+		return
+	}
+
+	b.windowFailures++
+	b.consecutiveFailures++
+
+	errorRate := float64(b.windowFailures) / float64(b.windowRequests)
+	if b.consecutiveFailures >= b.MaxConsecutiveFailures ||
+		(b.windowRequests >= b.MinRequests && errorRate >= b.MaxErrorRate) {
+		b.transition(BreakerOpen)
+	}
+}
+
+// WaitAvailable blocks until requests may be made, or the context is done. An
+// open breaker is considered available once its open duration has elapsed,
+// as a trial request may then be made.
+func (b *CircuitBreaker) WaitAvailable(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		var wait time.Duration
+		switch {
+		case b.state == BreakerOpen:
+			wait = b.openedAt.Add(b.OpenDuration).Sub(b.now())
+		case b.state == BreakerHalfOpen && b.trialInFlight:
+			wait = breakerProbeInterval
+		}
+		b.mu.Unlock()
+
+		if wait <= 0 {
+			return nil
+		}
+
+		err := sleepCtx(ctx, wait)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeClock is a manually advanced clock.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func newTestCircuitBreaker(clock *fakeClock) *CircuitBreaker {
+	breaker := NewCircuitBreaker(3, 0.5, 4, time.Minute, 30*time.Second)
+	breaker.now = clock.Now
+	return breaker
+}
+
+func TestCircuitBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	breaker := newTestCircuitBreaker(clock)
+
+	for range 2 {
+		assert.Nil(t, breaker.Allow())
+		breaker.Record(true)
+	}
+	assert.Equal(t, BreakerClosed, breaker.State())
+
+	assert.Nil(t, breaker.Allow())
+	breaker.Record(true)
+	assert.Equal(t, BreakerOpen, breaker.State())
+	assert.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+}
+
+func TestCircuitBreakerSuccessResetsConsecutiveFailures(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	breaker := NewCircuitBreaker(3, 1, 100, time.Minute, 30*time.Second)
+	breaker.now = clock.Now
+
+	for _, failed := range []bool{true, true, false, true, true} {
+		assert.Nil(t, breaker.Allow())
+		breaker.Record(failed)
+	}
+
+	assert.Equal(t, BreakerClosed, breaker.State())
+}
+
+func TestCircuitBreakerOpensOnErrorRate(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	breaker := newTestCircuitBreaker(clock)
+
+	// Failures are never consecutive, but make up half of the requests once
+	// enough requests have been made.
+	for _, failed := range []bool{true, false, true} {
+		assert.Nil(t, breaker.Allow())
+		breaker.Record(failed)
+	}
+	assert.Equal(t, BreakerClosed, breaker.State())
+
+	assert.Nil(t, breaker.Allow())
+	breaker.Record(false)
+	assert.Nil(t, breaker.Allow())
+	breaker.Record(true)
+	assert.Equal(t, BreakerOpen, breaker.State())
+}
+
+func TestCircuitBreakerErrorRateResetsEachWindow(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	breaker := newTestCircuitBreaker(clock)
+
+	for _, failed := range []bool{true, false, true} {
+		breaker.Record(failed)
+	}
+
+	clock.now = clock.now.Add(time.Minute)
+	for _, failed := range []bool{false, true} {
+		breaker.Record(failed)
+	}
+
+	assert.Equal(t, BreakerClosed, breaker.State())
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	for _, testCase := range []struct {
+		trialFailed bool
+		expected    BreakerState
+	}{
+		{trialFailed: false, expected: BreakerClosed},
+		{trialFailed: true, expected: BreakerOpen},
+	} {
+		clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+		breaker := newTestCircuitBreaker(clock)
+		for range 3 {
+			breaker.Record(true)
+		}
+
+		clock.now = clock.now.Add(30 * time.Second)
+
+		// A single trial request is allowed.
+		assert.Nil(t, breaker.Allow())
+		assert.Equal(t, BreakerHalfOpen, breaker.State())
+		assert.ErrorIs(t, breaker.Allow(), ErrCircuitOpen)
+
+		breaker.Record(testCase.trialFailed)
+		assert.Equal(t, testCase.expected, breaker.State())
+	}
+}
+
+func TestCircuitBreakerWaitAvailable(t *testing.T) {
+	breaker := NewCircuitBreaker(1, 1, 1, time.Minute, 10*time.Millisecond)
+	breaker.Record(true)
+	assert.Equal(t, BreakerOpen, breaker.State())
+
+	start := time.Now()
+	err := breaker.WaitAvailable(context.Background())
+
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+	assert.Nil(t, breaker.Allow())
+}
+
+func TestCircuitBreakerWaitAvailableWhenContextDoneReturnsError(t *testing.T) {
+	breaker := NewCircuitBreaker(1, 1, 1, time.Minute, time.Hour)
+	breaker.Record(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := breaker.WaitAvailable(ctx)
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBulkWriteBatchSize     = 100
+	DefaultBulkWriteFlushInterval = time.Second
+	DefaultBulkWriteMaxPending    = 1000
+)
+
+// BulkRepoer provides methods to write snapshots of stories in bulk, and one
+// at a time.
+type BulkRepoer interface {
+	Repoer
+	StoryCopier
+}
+
+// CapacityWaiter provides a method to wait until a writer has capacity for
+// another write.
+type CapacityWaiter interface {
+	WaitCapacity(context.Context) error
+}
+
+// Flusher provides a method to wait until pending writes have been written.
+type Flusher interface {
+	Flush(context.Context) error
+}
+
+// BulkWriter gathers snapshots of stories and writes them in bulk, once
+// BatchSize are pending, or FlushInterval after the first of them. Writes
+// return once their snapshot has been written, with its error, so that what
+// follows a write, such as observers and producers that read the story's
+// snapshots back, sees it. Batches therefore fill up with the writes of
+// concurrent consumers, and consumers should run at least BatchSize at a
+// time.
+//
+// If a batch fails, its snapshots are written one at a time, so that each
+// write gets its own snapshot's error.
+//
+// At most maxPending writes are pending at a time, including those being
+// written, after which writes block. Consumers should WaitCapacity before
+// taking on more work, so that it isn't left waiting on the writer, and
+// Flush once they've stopped writing. It is safe for concurrent use.
+type BulkWriter struct {
+	repo          BulkRepoer
+	mu            sync.Mutex
+	batch         []pendingWrite
+	timer         *time.Timer
+	slots         chan struct{}
+	flushes       sync.WaitGroup
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+// pendingWrite is a snapshot waiting to be written, and the write waiting on
+// it.
+type pendingWrite struct {
+	story StoryModel
+	done  chan error
+}
+
+func NewBulkWriter(repo BulkRepoer, batchSize int, flushInterval time.Duration, maxPending int) *BulkWriter {
+	if batchSize <= 0 || flushInterval <= 0 || maxPending < batchSize {
+		panic("Bulk writes require a positive batch size and flush interval, and at least a batch's worth of pending writes")
+	}
+	return &BulkWriter{
+		repo:          repo,
+		slots:         make(chan struct{}, maxPending),
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+	}
+}
+
+// WaitCapacity waits until fewer than the maximum number of writes are
+// pending, or the context is done.
+func (w *BulkWriter) WaitCapacity(ctx context.Context) error {
+	select {
+	case w.slots <- struct{}{}:
+		<-w.slots
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// WriteStory adds a snapshot to the pending batch, waiting until there is
+// capacity for it, and then until the batch has been written. The batch is
+// written in the background once it's full. If the context is done first,
+// the snapshot is still written.
+func (w *BulkWriter) WriteStory(ctx context.Context, story StoryModel) error {
+	select {
+	case w.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	bulkWritePending.Add(1)
+
+	done := make(chan error, 1)
+	w.mu.Lock()
+	w.batch = append(w.batch, pendingWrite{story: story, done: done})
+	if len(w.batch) >= w.BatchSize {
+		w.flushInBackground(w.takeBatch())
+	} else if len(w.batch) == 1 {
+		w.timer = time.AfterFunc(w.FlushInterval, w.flushPending)
+	}
+	w.mu.Unlock()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush writes the pending batch, and waits until every batch has been
+// written, or the context is done. Writes should have stopped.
+func (w *BulkWriter) Flush(ctx context.Context) error {
+	w.mu.Lock()
+	w.flushInBackground(w.takeBatch())
+	w.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.flushes.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// takeBatch takes the pending batch, stopping its timer. The lock must be
+// held.
+func (w *BulkWriter) takeBatch() []pendingWrite {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	batch := w.batch
+	w.batch = nil
+	return batch
+}
+
+// flushInBackground writes a batch in the background. The lock must be held,
+// so that Flush waits for it.
+func (w *BulkWriter) flushInBackground(batch []pendingWrite) {
+	if len(batch) == 0 {
+		return
+	}
+	w.flushes.Add(1)
+	go func() {
+		defer w.flushes.Done()
+		w.flush(context.Background(), batch)
+	}()
+}
+
+// flushPending writes the pending batch, if its timer fired before it filled.
+func (w *BulkWriter) flushPending() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushInBackground(w.takeBatch())
+}
+
+// flush writes a batch, returning the error of each snapshot to its write,
+// and freeing capacity for as many writes once done.
+func (w *BulkWriter) flush(ctx context.Context, batch []pendingWrite) {
+	defer func() {
+		for range batch {
+			<-w.slots
+		}
+		bulkWritePending.Add(-int64(len(batch)))
+	}()
+
+	stories := make([]StoryModel, 0, len(batch))
+	for _, pending := range batch {
+		stories = append(stories, pending.story)
+	}
+
+	start := time.Now()
+	conflicts, err := w.repo.CopyStories(ctx, stories)
+	ObserveBulkWriteFlush(len(batch), time.Since(start), err != nil)
+
+	if err != nil && len(batch) > 1 {
+		slog.Warn("Error writing batch, writing snapshots one at a time", "snapshots", len(batch), "error", err)
+		for _, pending := range batch {
+			err := w.repo.WriteStory(ctx, pending.story)
+			if err != nil {
+				ObserveBulkWriteError()
+			}
+			pending.done <- err
+		}
+		return
+	}
+	if err != nil {
+		ObserveBulkWriteError()
+	}
+
+	// Conflicts are skipped, as with `Repo.WriteStory`.
+	for _, idx := range conflicts {
+		slog.Error("Skipping insert of duplicate story", "story_id", stories[idx].StoryID, "label", stories[idx].QueueName)
+	}
+	for _, pending := range batch {
+		pending.done <- err
+	}
+}
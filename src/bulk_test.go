@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockBulkRepo struct {
+	mockRepo
+}
+
+func (m *mockBulkRepo) CopyStories(ctx context.Context, stories []StoryModel) ([]int, error) {
+	args := m.Called(ctx, stories)
+	return args.Get(0).([]int), args.Error(1)
+}
+
+// writeConcurrently writes each of the stories from its own goroutine, and
+// returns their errors.
+func writeConcurrently(writer *BulkWriter, stories []StoryModel) []error {
+	errs := make([]error, len(stories))
+	var wg sync.WaitGroup
+	for idx, story := range stories {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[idx] = writer.WriteStory(context.Background(), story)
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestBulkWriterFlushesFullBatch(t *testing.T) {
+	repo := new(mockBulkRepo)
+	repo.On("CopyStories", mock.Anything, mock.Anything).Return([]int{}, nil)
+
+	writer := NewBulkWriter(repo, 2, time.Hour, 2)
+	errs := writeConcurrently(writer, []StoryModel{{StoryID: 1}, {StoryID: 2}})
+	assert.Nil(t, writer.Flush(context.Background()))
+
+	assert.Equal(t, []error{nil, nil}, errs)
+	repo.AssertNumberOfCalls(t, "CopyStories", 1)
+	repo.AssertCalled(t, "CopyStories", mock.Anything, mock.MatchedBy(func(stories []StoryModel) bool {
+		return len(stories) == 2
+	}))
+}
+
+func TestBulkWriterFlushesAfterInterval(t *testing.T) {
+	flushed := make(chan struct{})
+	repo := new(mockBulkRepo)
+	repo.On("CopyStories", mock.Anything, []StoryModel{{StoryID: 1}}).Run(func(mock.Arguments) {
+		close(flushed)
+	}).Return([]int{0}, nil)
+
+	writer := NewBulkWriter(repo, 10, time.Millisecond, 10)
+	err := writer.WriteStory(context.Background(), StoryModel{StoryID: 1})
+
+	// Conflicts are skipped, as with `Repo.WriteStory`.
+	assert.Nil(t, err)
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Fatal("Batch wasn't flushed")
+	}
+	assert.Nil(t, writer.Flush(context.Background()))
+}
+
+func TestBulkWriterBatchesConcurrentWriters(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		sizes []int
+	)
+	repo := new(mockBulkRepo)
+	repo.On("CopyStories", mock.Anything, mock.Anything).Run(func(args mock.Arguments) {
+		mu.Lock()
+		defer mu.Unlock()
+		sizes = append(sizes, len(args.Get(1).([]StoryModel)))
+	}).Return([]int{}, nil)
+
+	// As many writers as the batch size, as with a worker's concurrency.
+	writer := NewBulkWriter(repo, 10, time.Hour, 20)
+	var wg sync.WaitGroup
+	for worker := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range 5 {
+				start := time.Now()
+				err := writer.WriteStory(context.Background(), StoryModel{StoryID: int64(worker*100 + idx)})
+				assert.Nil(t, err)
+				// Full batches don't wait for the flush interval.
+				assert.Less(t, time.Since(start), time.Second)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Nil(t, writer.Flush(context.Background()))
+
+	assert.Equal(t, []int{10, 10, 10, 10, 10}, sizes)
+}
+
+func TestBulkWriterWaitsUntilWritten(t *testing.T) {
+	release := make(chan time.Time)
+	repo := new(mockBulkRepo)
+	repo.On("CopyStories", mock.Anything, mock.Anything).WaitUntil(release).Return([]int{}, fmt.Errorf("Error"))
+
+	writer := NewBulkWriter(repo, 1, time.Hour, 1)
+	written := make(chan error)
+	go func() {
+		written <- writer.WriteStory(context.Background(), StoryModel{StoryID: 1})
+	}()
+
+	select {
+	case <-written:
+		t.Fatal("Write returned before its snapshot was written")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	close(release)
+	assert.NotNil(t, <-written)
+}
+
+func TestBulkWriterWhenBatchFailsWritesOneAtATime(t *testing.T) {
+	repo := new(mockBulkRepo)
+	repo.On("CopyStories", mock.Anything, mock.Anything).Return([]int{}, fmt.Errorf("Error"))
+	repo.On("WriteStory", mock.Anything, StoryModel{StoryID: 1}).Return(nil)
+	repo.On("WriteStory", mock.Anything, StoryModel{StoryID: 2}).Return(fmt.Errorf("Invalid document"))
+
+	writer := NewBulkWriter(repo, 2, time.Hour, 2)
+	errs := writeConcurrently(writer, []StoryModel{{StoryID: 1}, {StoryID: 2}})
+	assert.Nil(t, writer.Flush(context.Background()))
+
+	// Each write gets its own snapshot's error.
+	assert.Nil(t, errs[0])
+	assert.EqualError(t, errs[1], "Invalid document")
+	repo.AssertNumberOfCalls(t, "WriteStory", 2)
+}
+
+func TestBulkWriterWaitCapacity(t *testing.T) {
+	release := make(chan time.Time)
+	repo := new(mockBulkRepo)
+	repo.On("CopyStories", mock.Anything, mock.Anything).WaitUntil(release).Return([]int{}, nil)
+
+	writer := NewBulkWriter(repo, 1, time.Hour, 1)
+	assert.Nil(t, writer.WaitCapacity(context.Background()))
+	written := make(chan error)
+	go func() {
+		written <- writer.WriteStory(context.Background(), StoryModel{StoryID: 1})
+	}()
+
+	// The writer is saturated until the pending write is flushed.
+	assert.Eventually(t, func() bool {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+		return writer.WaitCapacity(ctx) != nil
+	}, time.Second, time.Millisecond)
+
+	close(release)
+	assert.Nil(t, <-written)
+	assert.Nil(t, writer.Flush(context.Background()))
+	assert.Nil(t, writer.WaitCapacity(context.Background()))
+}
+
+// memorySnapshotRepo stores snapshots in memory, to read them back.
+type memorySnapshotRepo struct {
+	mu        sync.Mutex
+	snapshots []StoryModel
+}
+
+func (r *memorySnapshotRepo) WriteStory(ctx context.Context, story StoryModel) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.snapshots = append(r.snapshots, story)
+	return nil
+}
+
+func (r *memorySnapshotRepo) CopyStories(ctx context.Context, stories []StoryModel) ([]int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.snapshots = append(r.snapshots, stories...)
+	return nil, nil
+}
+
+func (r *memorySnapshotRepo) LatestSnapshots(ctx context.Context, storyID int64, n int) ([]StoryModel, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var latest []StoryModel
+	for idx := len(r.snapshots) - 1; idx >= 0 && len(latest) < n; idx-- {
+		if r.snapshots[idx].StoryID == storyID {
+			latest = append(latest, r.snapshots[idx])
+		}
+	}
+	return latest, nil
+}
+
+func TestBulkWriterWithAdaptiveProducerPlansFromWrittenSnapshot(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-time.Hour)
+	fetchedAt := time.Now().UTC()
+
+	repo := &memorySnapshotRepo{}
+	repo.WriteStory(context.Background(), makeFetchedSnapshot(1, createdAt, fetchedAt.Add(-time.Hour), 20, 10))
+
+	dst := new(mockEnqueuer)
+	dst.On("Enqueue", mock.Anything, mock.Anything).Return(nil)
+	dst.On("ProcessAfter").Return(time.Duration(0))
+
+	writer := NewBulkWriter(repo, 10, 10*time.Millisecond, 10)
+	producer := NewAdaptiveProducer(dst, repo, MakeDefaultScheduleConfig())
+
+	// As a consumer with bulk writes does, before the story is produced.
+	err := writer.WriteStory(context.Background(), makeFetchedSnapshot(1, createdAt, fetchedAt, 30, 10))
+	assert.Nil(t, err)
+	err = producer.SendMessage(context.Background(), 1, &createdAt)
+	assert.Nil(t, err)
+
+	// Planned from the growth between the snapshots, rather than the fixed
+	// schedule for stories with a single snapshot.
+	dst.AssertCalled(t, "Enqueue", mock.Anything, mock.MatchedBy(func(msg Message) bool {
+		return msg.StoryID == 1 && msg.ProcessAt.Sub(fetchedAt).Round(time.Minute) == 30*time.Minute
+	}))
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"strconv"
@@ -13,30 +15,48 @@ import (
 )
 
 const (
+	ItemSourceFirebase           = "firebase"
+	ItemSourceAlgolia            = "algolia"
 	ResourceNameNewStories       = "newstories"
+	ResourceNameTopStories       = "topstories"
 	ResourceNameItem             = "item"
+	ResourceNameUser             = "user"
 	MaxBackoffJitterMilliseconds = 250
+	ItemTypeStory                = "story"
+	ItemTypePoll                 = "poll"
+	ItemTypePollOpt              = "pollopt"
 )
 
-var ErrMaxRetriesReached = errors.New("Maximum retries reached")
+var (
+	ErrMaxRetriesReached = errors.New("Maximum retries reached")
+	// ErrItemMissing indicates that an item was found not to exist, as
+	// opposed to the API being unavailable. The API also transiently reports
+	// items that exist as missing, so an item may yet turn up later.
+	ErrItemMissing = errors.New("Item missing")
+)
 
 // HNComment represents a marshalled story from the Hacker News API.
 type HNComment struct {
-	By     string  `json:"by"`
-	ID     int64   `json:"id"`
-	Kids   []int64 `json:"kids"`
-	Parent int64   `json:"parent"`
-	Text   string  `json:"text"`
-	Time   int64   `json:"time"`
-	Type   string  `json:"type"`
+	By      string  `json:"by"`
+	Dead    bool    `json:"dead,omitempty"`
+	Deleted bool    `json:"deleted,omitempty"`
+	ID      int64   `json:"id"`
+	Kids    []int64 `json:"kids"`
+	Parent  int64   `json:"parent"`
+	Text    string  `json:"text"`
+	Time    int64   `json:"time"`
+	Type    string  `json:"type"`
 }
 
 // HNStory represents a marshalled story from the Hacker News API.
 type HNStory struct {
 	By          string  `json:"by"`
+	Dead        bool    `json:"dead,omitempty"`
+	Deleted     bool    `json:"deleted,omitempty"`
 	Descendants int32   `json:"descendants"`
 	ID          int64   `json:"id"`
 	Kids        []int64 `json:"kids"`
+	Parts       []int64 `json:"parts,omitempty"`
 	Score       int32   `json:"score"`
 	Time        int64   `json:"time"`
 	Title       string  `json:"title"`
@@ -44,17 +64,118 @@ type HNStory struct {
 	URL         string  `json:"url"`
 }
 
+// HNPollOpt represents a marshalled poll option from the Hacker News API.
+type HNPollOpt struct {
+	By      string `json:"by"`
+	Dead    bool   `json:"dead,omitempty"`
+	Deleted bool   `json:"deleted,omitempty"`
+	ID      int64  `json:"id"`
+	Poll    int64  `json:"poll"`
+	Score   int32  `json:"score"`
+	Text    string `json:"text"`
+	Time    int64  `json:"time"`
+	Type    string `json:"type"`
+}
+
+// Statuses of stories, as recorded with each snapshot.
+const (
+	StoryStatusOK       = "ok"
+	StoryStatusDeleted  = "deleted"
+	StoryStatusDead     = "dead"
+	StoryStatusMissing  = "missing"
+	StoryStatusNotStory = "not_story"
+)
+
+// StoryStatus returns the status of a story. Stories with any status other
+// than "ok" have been removed, and aren't snapshotted again.
+func StoryStatus(story HNStory) string {
+	switch {
+	case story.Deleted:
+		return StoryStatusDeleted
+	case story.Dead:
+		return StoryStatusDead
+	case !IsStoryType(story.Type):
+		return StoryStatusNotStory
+	default:
+		return StoryStatusOK
+	}
+}
+
+// IsStoryType returns whether items of the given type are snapshotted as
+// stories. Polls are stories with options.
+func IsStoryType(itemType string) bool {
+	return itemType == ItemTypeStory || itemType == ItemTypePoll
+}
+
+// HNUser represents a marshalled user profile from the Hacker News API.
+type HNUser struct {
+	About     string  `json:"about,omitempty"`
+	Created   int64   `json:"created"`
+	ID        string  `json:"id"`
+	Karma     int32   `json:"karma"`
+	Submitted []int64 `json:"submitted,omitempty"`
+}
+
+// StoryItems is a story along with its top-level comments, and its options
+// if it is a poll.
+type StoryItems struct {
+	Story       HNStory
+	Comments    []HNComment
+	PollOptions []HNPollOpt
+}
+
+// ItemSource provides Hacker News items from an API.
+type ItemSource interface {
+	// FetchNewStories fetches the ids of new stories, newest first.
+	FetchNewStories() ([]int64, error)
+	// FetchStory fetches a story and its top-level comments, along with its
+	// options if it is a poll.
+	FetchStory(int64) (StoryItems, error)
+	// WaitAvailable blocks until requests may be made to the API.
+	WaitAvailable(context.Context) error
+	// Version gives the version of the API that items are fetched from.
+	Version() string
+}
+
+// CommentlessFetcher provides a method to fetch a story without its
+// comments, for item sources where fetching them costs extra requests.
+type CommentlessFetcher interface {
+	FetchStoryWithoutComments(int64) (StoryItems, error)
+}
+
+// FetchStoryItems fetches a story, skipping its comments if they aren't
+// wanted and the item source is able to.
+func FetchStoryItems(client ItemSource, id int64, withComments bool) (StoryItems, error) {
+	if fetcher, ok := client.(CommentlessFetcher); ok && !withComments {
+		return fetcher.FetchStoryWithoutComments(id)
+	}
+	return client.FetchStory(id)
+}
+
+// HNUpdates represents the items and profiles that have recently changed, as
+// marshalled from the Hacker News API.
+type HNUpdates struct {
+	Items    []int64  `json:"items"`
+	Profiles []string `json:"profiles"`
+}
+
 type HTTPGetter interface {
 	Get(string) (*http.Response, error)
 }
 
 // HNClient is an HTTP client for the Hacker News API.
+//
+// If a Limiter is set, every request, including retries, waits on it first.
+// If a Breaker is set, requests are not made while it is open, and
+// ErrCircuitOpen is returned instead.
 type HNClient struct {
 	client      HTTPGetter
 	BaseURL     string
 	APIVersion  string
 	Backoff     time.Duration
 	MaxAttempts int
+	Limiter     RateLimiter
+	Breaker     *CircuitBreaker
 }
 
 func NewHNClient(client HTTPGetter, baseURL, apiVersion string, backoff time.Duration, maxAttempts int) *HNClient {
@@ -71,11 +192,15 @@ func NewHNClient(client HTTPGetter, baseURL, apiVersion string, backoff time.Dur
 	}
 }
 
+// get makes a GET request, retrying after transient errors. If every attempt
+// returns `null`, ErrItemMissing is returned, though the resource may only be
+// missing for longer than the retries took.
 func (c *HNClient) get(url string) ([]byte, error) {
 	var (
 		rsp     *http.Response
 		err     error
 		payload []byte
+		nulls   int
 	)
 
 	for attempt := 0; attempt < c.MaxAttempts; attempt++ {
@@ -85,17 +210,35 @@ func (c *HNClient) get(url string) ([]byte, error) {
 			time.Sleep(backoff)
 		}
 
+		if c.Breaker != nil {
+			if breakerErr := c.Breaker.Allow(); breakerErr != nil {
+				return payload, breakerErr
+			}
+		}
+
+		if c.Limiter != nil {
+			// Prefer to keep making requests over halting if the limiter is
+			// unavailable.
+			if limiterErr := c.Limiter.Wait(context.Background()); limiterErr != nil {
+				slog.Error("Error waiting on rate limiter", "error", limiterErr)
+			}
+		}
+
 		rsp, err = c.client.Get(url)
 		if err != nil {
+			c.recordOutcome(true)
 			continue
 		}
 		defer rsp.Body.Close()
 
 		payload, err = io.ReadAll(rsp.Body)
 		if err != nil {
+			c.recordOutcome(true)
 			continue
 		}
 
+		c.recordOutcome(IsServiceFailure(rsp.StatusCode))
+
 		switch {
 		case rsp.StatusCode == http.StatusOK && string(payload) == "null":
 			// XXX: The HN API will return 200 with a body of `null` for
@@ -103,6 +246,7 @@ func (c *HNClient) get(url string) ([]byte, error) {
 			//      exists, but wasn't able to be retrieved for whatever reason.
 			//      The latter case should be ephemeral, and can be resolved by
 			//      retrying.
+			nulls++
 			continue
 		case rsp.StatusCode == http.StatusOK:
 			return payload, nil
@@ -110,12 +254,18 @@ func (c *HNClient) get(url string) ([]byte, error) {
 			continue
 		case rsp.StatusCode >= http.StatusInternalServerError:
 			continue
+		case rsp.StatusCode == http.StatusNotFound:
+			return payload, fmt.Errorf("%w: HTTP Error: %d", ErrItemMissing, rsp.StatusCode)
 		default:
 			return payload, fmt.Errorf("HTTP Error: %d", rsp.StatusCode)
 		}
 
 	}
 
+	if nulls == c.MaxAttempts {
+		return payload, ErrItemMissing
+	}
+
 	if err != nil {
 		err = fmt.Errorf("%w: %s", ErrMaxRetriesReached, err.Error())
 	} else {
@@ -125,6 +275,27 @@ func (c *HNClient) get(url string) ([]byte, error) {
 	return payload, err
 }
 
+// IsServiceFailure returns whether the status code indicates that the service
+// is failing, as opposed to the request being invalid.
+func IsServiceFailure(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= http.StatusInternalServerError
+}
+
+func (c *HNClient) recordOutcome(failed bool) {
+	if c.Breaker != nil {
+		c.Breaker.Record(failed)
+	}
+}
+
+// WaitAvailable blocks until requests may be made to the API, as determined
+// by the client's circuit breaker, if any.
+func (c *HNClient) WaitAvailable(ctx context.Context) error {
+	if c.Breaker == nil {
+		return nil
+	}
+	return c.Breaker.WaitAvailable(ctx)
+}
+
 func (c *HNClient) FetchNewStories() ([]int64, error) {
 	var newStoryIDs []int64
 
@@ -139,6 +310,36 @@ func (c *HNClient) FetchNewStories() ([]int64, error) {
 	return newStoryIDs, err
 }
 
+// FetchTopStories fetches the ids of the top stories, in the order they are
+// ranked on the front page and beyond.
+func (c *HNClient) FetchTopStories() ([]int64, error) {
+	var topStoryIDs []int64
+
+	url := strings.Join([]string{c.BaseURL, c.APIVersion, ResourceNameTopStories}, "/") + ".json"
+
+	payload, err := c.get(url)
+	if err != nil {
+		return topStoryIDs, err
+	}
+
+	err = json.Unmarshal(payload, &topStoryIDs)
+	return topStoryIDs, err
+}
+
+func (c *HNClient) FetchUpdates() (HNUpdates, error) {
+	updates := HNUpdates{}
+
+	url := strings.Join([]string{c.BaseURL, c.APIVersion, ResourceNameUpdates}, "/") + ".json"
+
+	payload, err := c.get(url)
+	if err != nil {
+		return updates, err
+	}
+
+	err = json.Unmarshal(payload, &updates)
+	return updates, err
+}
+
 func (c *HNClient) FetchItem(id int64, o interface{}) error {
 	idString := strconv.Itoa(int(id))
 	url := strings.Join([]string{c.BaseURL, c.APIVersion, ResourceNameItem, idString}, "/") + ".json"
@@ -150,3 +351,90 @@ func (c *HNClient) FetchItem(id int64, o interface{}) error {
 
 	return json.Unmarshal(payload, &o)
 }
+
+// FetchUser fetches a user's profile. If the user doesn't exist, such as when
+// their account has been deleted, ErrItemMissing is returned.
+func (c *HNClient) FetchUser(id string) (HNUser, error) {
+	user := HNUser{}
+
+	url := strings.Join([]string{c.BaseURL, c.APIVersion, ResourceNameUser, id}, "/") + ".json"
+
+	payload, err := c.get(url)
+	if err != nil {
+		return user, err
+	}
+
+	err = json.Unmarshal(payload, &user)
+	return user, err
+}
+
+// FetchStory fetches a story and then each of its top-level comments, and
+// each of its options if it is a poll.
+func (c *HNClient) FetchStory(id int64) (StoryItems, error) {
+	return c.fetchStory(id, true)
+}
+
+// FetchStoryWithoutComments fetches a story, and each of its options if it is
+// a poll, but not its comments, each of which costs a request.
+func (c *HNClient) FetchStoryWithoutComments(id int64) (StoryItems, error) {
+	return c.fetchStory(id, false)
+}
+
+func (c *HNClient) fetchStory(id int64, withComments bool) (StoryItems, error) {
+	items := StoryItems{}
+
+	err := c.FetchItem(id, &items.Story)
+	if err != nil {
+		return items, fmt.Errorf("%w story: %w", ErrFetching, err)
+	}
+
+	// Other items' kids aren't comments on a story.
+	if !IsStoryType(items.Story.Type) {
+		return items, nil
+	}
+
+	commentIDs := items.Story.Kids
+	if !withComments {
+		commentIDs = nil
+	}
+
+	items.Comments = make([]HNComment, 0, len(commentIDs))
+	for _, commentID := range commentIDs {
+		comment := HNComment{}
+		err = c.FetchItem(commentID, &comment)
+		if errors.Is(err, ErrItemMissing) {
+			slog.Info("Skipping missing comment", "story_id", id, "comment_id", commentID)
+			continue
+		}
+		if err != nil {
+			return items, fmt.Errorf("%w comment: %w", ErrFetching, err)
+		}
+
+		items.Comments = append(items.Comments, comment)
+	}
+
+	if items.Story.Type != ItemTypePoll {
+		return items, nil
+	}
+
+	items.PollOptions = make([]HNPollOpt, 0, len(items.Story.Parts))
+	for _, optionID := range items.Story.Parts {
+		option := HNPollOpt{}
+		err = c.FetchItem(optionID, &option)
+		if errors.Is(err, ErrItemMissing) {
+			slog.Info("Skipping missing poll option", "story_id", id, "poll_option_id", optionID)
+			continue
+		}
+		if err != nil {
+			return items, fmt.Errorf("%w poll option: %w", ErrFetching, err)
+		}
+
+		items.PollOptions = append(items.PollOptions, option)
+	}
+
+	return items, nil
+}
+
+func (c *HNClient) Version() string {
+	return c.APIVersion
+}
@@ -89,6 +89,71 @@ func TestHNClientGetWhenUnretryableErrorReturnsError(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestHNClientGetWhenAlwaysNullReturnsErrItemMissing(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	for range 2 {
+		httpClient.On("Get", mock.Anything).Return(
+			makeMockResponse(http.StatusOK, "null"),
+			nil,
+		).Once()
+	}
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 2)
+
+	_, err := client.get("http://localhost/v0")
+	assert.ErrorIs(t, err, ErrItemMissing)
+	assert.NotErrorIs(t, err, ErrMaxRetriesReached)
+}
+
+func TestHNClientGetWhenNullThenErrorReturnsErrMaxRetriesReached(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	mock.InOrder(
+		httpClient.On("Get", mock.Anything).Return(
+			makeMockResponse(http.StatusOK, "null"),
+			nil,
+		).Once(),
+		httpClient.On("Get", mock.Anything).Return(
+			makeMockResponse(http.StatusInternalServerError, ""),
+			nil,
+		).Once(),
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 2)
+
+	_, err := client.get("http://localhost/v0")
+	assert.ErrorIs(t, err, ErrMaxRetriesReached)
+}
+
+func TestHNClientGetWhenNotFoundReturnsErrItemMissing(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusNotFound, ""),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 2)
+
+	_, err := client.get("http://localhost/v0")
+	assert.ErrorIs(t, err, ErrItemMissing)
+	httpClient.AssertNumberOfCalls(t, "Get", 1)
+}
+
+func TestStoryStatus(t *testing.T) {
+	for _, testCase := range []struct {
+		story    HNStory
+		expected string
+	}{
+		{story: HNStory{Type: "story"}, expected: StoryStatusOK},
+		{story: HNStory{Type: "poll"}, expected: StoryStatusOK},
+		{story: HNStory{Type: "story", Deleted: true}, expected: StoryStatusDeleted},
+		{story: HNStory{Type: "story", Dead: true}, expected: StoryStatusDead},
+		{story: HNStory{Type: "comment"}, expected: StoryStatusNotStory},
+		{story: HNStory{Type: "job"}, expected: StoryStatusNotStory},
+	} {
+		assert.Equal(t, testCase.expected, StoryStatus(testCase.story))
+	}
+}
+
 func TestHNClientFetchNewStories(t *testing.T) {
 	httpClient := new(mockHTTPClient)
 	httpClient.On("Get", mock.Anything).Return(
@@ -104,6 +169,21 @@ func TestHNClientFetchNewStories(t *testing.T) {
 	httpClient.AssertCalled(t, "Get", "http://localhost/v0/newstories.json")
 }
 
+func TestHNClientFetchTopStories(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, "[3, 10, 1]"),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+	actual, err := client.FetchTopStories()
+
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{3, 10, 1}, actual)
+	httpClient.AssertCalled(t, "Get", "http://localhost/v0/topstories.json")
+}
+
 func TestHNClientFetchItem(t *testing.T) {
 	type obj struct {
 		ID   int64   `json:"id"`
@@ -126,3 +206,259 @@ func TestHNClientFetchItem(t *testing.T) {
 	assert.Equal(t, []int64{2, 3}, o.Kids)
 	httpClient.AssertCalled(t, "Get", "http://localhost/v0/item/1.json")
 }
+
+func TestHNClientGetWaitsOnLimiterForEachAttempt(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	mock.InOrder(
+		httpClient.On("Get", mock.Anything).Return(
+			makeMockResponse(http.StatusTooManyRequests, ""),
+			nil,
+		).Once(),
+		httpClient.On("Get", mock.Anything).Return(
+			makeMockResponse(http.StatusOK, "[10, 9, 8]"),
+			nil,
+		).Once(),
+	)
+
+	limiter := new(mockRateLimiter)
+	limiter.On("Wait", mock.Anything).Return(nil)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 2)
+	client.Limiter = limiter
+
+	_, err := client.get("http://localhost/v0")
+
+	assert.Nil(t, err)
+	limiter.AssertNumberOfCalls(t, "Wait", 2)
+}
+
+func TestHNClientGetWhenLimiterErrorStillRequests(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, "[10, 9, 8]"),
+		nil,
+	)
+
+	limiter := new(mockRateLimiter)
+	limiter.On("Wait", mock.Anything).Return(fmt.Errorf("Error"))
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+	client.Limiter = limiter
+
+	actual, err := client.get("http://localhost/v0")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("[10, 9, 8]"), actual)
+}
+
+func TestHNClientGetWhenCircuitOpenReturnsError(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusInternalServerError, ""),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 5)
+	client.Breaker = NewCircuitBreaker(2, 1, 100, time.Minute, time.Hour)
+
+	_, err := client.get("http://localhost/v0")
+
+	// Retries stop once the breaker opens.
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	httpClient.AssertNumberOfCalls(t, "Get", 2)
+
+	_, err = client.get("http://localhost/v0")
+
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	httpClient.AssertNumberOfCalls(t, "Get", 2)
+}
+
+func TestIsServiceFailure(t *testing.T) {
+	for _, testCase := range []struct {
+		statusCode int
+		expected   bool
+	}{
+		{statusCode: http.StatusOK, expected: false},
+		{statusCode: http.StatusNotFound, expected: false},
+		{statusCode: http.StatusTooManyRequests, expected: true},
+		{statusCode: http.StatusInternalServerError, expected: true},
+		{statusCode: http.StatusServiceUnavailable, expected: true},
+	} {
+		actual := IsServiceFailure(testCase.statusCode)
+		assert.Equal(t, testCase.expected, actual)
+	}
+}
+
+func TestHNClientFetchStory(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"kids":[2,3],"type":"story"}`),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/2.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":2,"parent":1,"type":"comment"}`),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/3.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":3,"parent":1,"type":"comment"}`),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	expected := StoryItems{
+		Story: HNStory{ID: 1, Kids: []int64{2, 3}, Type: "story"},
+		Comments: []HNComment{
+			{ID: 2, Parent: 1, Type: "comment"},
+			{ID: 3, Parent: 1, Type: "comment"},
+		},
+	}
+
+	actual, err := client.FetchStory(1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestHNClientFetchStoryWhenPollFetchesOptions(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"kids":[2],"parts":[3,4],"type":"poll"}`),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/2.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":2,"parent":1,"type":"comment"}`),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/3.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":3,"poll":1,"score":10,"text":"Yes","type":"pollopt"}`),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/4.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":4,"poll":1,"score":5,"text":"No","type":"pollopt"}`),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	expected := StoryItems{
+		Story: HNStory{ID: 1, Kids: []int64{2}, Parts: []int64{3, 4}, Type: "poll"},
+		Comments: []HNComment{
+			{ID: 2, Parent: 1, Type: "comment"},
+		},
+		PollOptions: []HNPollOpt{
+			{ID: 3, Poll: 1, Score: 10, Text: "Yes", Type: "pollopt"},
+			{ID: 4, Poll: 1, Score: 5, Text: "No", Type: "pollopt"},
+		},
+	}
+
+	actual, err := client.FetchStory(1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestHNClientFetchStoryWhenErrorFetchingCommentReturnsError(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"kids":[2],"type":"story"}`),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/2.json").Return(
+		makeMockResponse(http.StatusBadRequest, ""),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	_, err := client.FetchStory(1)
+
+	assert.ErrorIs(t, err, ErrFetching)
+}
+
+func TestHNClientFetchStorySkipsMissingComments(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"kids":[2,3],"type":"story"}`),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/2.json").Return(
+		makeMockResponse(http.StatusOK, "null"),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/3.json").Return(
+		makeMockResponse(http.StatusOK, `{"deleted":true,"id":3,"parent":1,"type":"comment"}`),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	actual, err := client.FetchStory(1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []HNComment{{Deleted: true, ID: 3, Parent: 1, Type: "comment"}}, actual.Comments)
+}
+
+func TestHNClientFetchStoryWhenNotStoryDoesNotFetchKids(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"kids":[2],"parent":9,"type":"comment"}`),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	actual, err := client.FetchStory(1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "comment", actual.Story.Type)
+	assert.Empty(t, actual.Comments)
+	httpClient.AssertNumberOfCalls(t, "Get", 1)
+}
+
+func TestHNClientFetchUpdates(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, `{"items":[8863,8952],"profiles":["pg"]}`),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	actual, err := client.FetchUpdates()
+
+	assert.Nil(t, err)
+	assert.Equal(t, HNUpdates{Items: []int64{8863, 8952}, Profiles: []string{"pg"}}, actual)
+	httpClient.AssertCalled(t, "Get", "http://localhost/v0/updates.json")
+}
+
+func TestHNClientFetchUser(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, `{"about":"Bug fixer.","created":1160418092,"id":"pg","karma":155111,"submitted":[8863]}`),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	expected := HNUser{
+		About:     "Bug fixer.",
+		Created:   1160418092,
+		ID:        "pg",
+		Karma:     155111,
+		Submitted: []int64{8863},
+	}
+
+	actual, err := client.FetchUser("pg")
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+	httpClient.AssertCalled(t, "Get", "http://localhost/v0/user/pg.json")
+}
+
+func TestIsStoryType(t *testing.T) {
+	assert.True(t, IsStoryType("story"))
+	assert.True(t, IsStoryType("poll"))
+	assert.False(t, IsStoryType("pollopt"))
+	assert.False(t, IsStoryType("comment"))
+}
@@ -0,0 +1,1422 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	OutputFormatText = "text"
+	OutputFormatJSON = "json"
+	// BackfillLabelPrefix prefixes the labels of the snapshots of stories that
+	// were backfilled onto a queue after they'd passed its stage.
+	BackfillLabelPrefix    = "backfill"
+	DefaultHNClientBaseURL = "https://hacker-news.firebaseio.com"
+	// The HTTP client settings of refresh-users, which makes its own client.
+	refreshUsersHTTPTimeout = 30 * time.Second
+	refreshUsersBackoff     = time.Second
+	refreshUsersMaxAttempts = 3
+)
+
+// Command is a subcommand of the binary, which is run with its arguments.
+type Command func(ctx context.Context, args []string, stdout io.Writer) error
+
+// Commands are the binary's subcommands. Without a subcommand, the binary runs
+// an ingestion worker, as configured by environment variables.
+var Commands = map[string]Command{
+	"analytics":     RunAnalyticsCommand,
+	"backfill":      RunBackfillCommand,
+	"canonicalise":  RunCanonicaliseCommand,
+	"config":        RunConfigCommand,
+	"diff":          RunDiffCommand,
+	"export":        RunExportCommand,
+	"import":        RunImportCommand,
+	"migrate":       RunMigrateCommand,
+	"poll-new":      RunPollNewCommand,
+	"poll-updates":  RunPollUpdatesCommand,
+	"queue":         RunQueueCommand,
+	"refresh-users": RunRefreshUsersCommand,
+	"retention":     RunRetentionCommand,
+	"serve":         RunServeCommand,
+	"snapshot":      RunSnapshotCommand,
+}
+
+// SnapshotStore provides methods to read stored snapshots.
+type SnapshotStore interface {
+	ReadSnapshot(context.Context, int64, string) (StoryModel, error)
+	SnapshotLabels(context.Context, int64) ([]string, error)
+}
+
+// AnalyticsStore provides methods to read snapshots of stories and write
+// their metrics.
+type AnalyticsStore interface {
+	ReadStoryPoints(context.Context, StoryFilter) ([]StoryPoint, error)
+	WriteAnalytics(context.Context, []SnapshotMetrics, []StoryAnalytics, time.Time) error
+}
+
+// URLStore provides methods to backfill the canonical URLs of snapshots.
+type URLStore interface {
+	ReadUncanonicalised(context.Context, int64, int) ([]SnapshotURL, error)
+	WriteCanonicalURLs(context.Context, []SnapshotURL) error
+}
+
+// connectDatabase connects to the database at the given URL, or at the URL
+// given by the `DATABASE_URL` environment variable if it is empty.
+func connectDatabase(ctx context.Context, databaseURL string) (*pgxpool.Pool, error) {
+	if databaseURL == "" {
+		databaseURL = LoadEnvDefault("DATABASE_URL", "")
+	}
+	if databaseURL == "" {
+		return nil, errors.New("A database URL is required")
+	}
+	return pgxpool.New(ctx, databaseURL)
+}
+
+// parseTimeFlag parses the value of a flag as an RFC 3339 time, if it is set.
+func parseTimeFlag(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("Invalid -%s: %s", name, value)
+	}
+	return t, nil
+}
+
+// openOutput opens the file at the given path for writing, or returns stdout
+// if the path is empty.
+func openOutput(path string, stdout io.Writer) (io.Writer, func() error, error) {
+	if path == "" {
+		return stdout, func() error { return nil }, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+// DiffSnapshots diffs the snapshots of a story with the given labels. If no
+// labels are given, each of the story's snapshots is diffed against the one
+// before it.
+func DiffSnapshots(ctx context.Context, store SnapshotStore, storyID int64, from, to string) ([]StoryDiff, error) {
+	labels := []string{from, to}
+	if from == "" && to == "" {
+		var err error
+		labels, err = store.SnapshotLabels(ctx, storyID)
+		if err != nil {
+			return nil, err
+		}
+	} else if from == "" || to == "" {
+		return nil, errors.New("Both or neither of the snapshots to diff must be given")
+	}
+
+	snapshots := make([]StoryModel, 0, len(labels))
+	for _, label := range labels {
+		snapshot, err := store.ReadSnapshot(ctx, storyID, label)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, label)
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+
+	var diffs []StoryDiff
+	for idx := 1; idx < len(snapshots); idx++ {
+		diff, err := DiffStories(snapshots[idx-1], snapshots[idx])
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+// WriteDiffs writes diffs in the given format. JSON is written as one diff per
+// line.
+func WriteDiffs(w io.Writer, diffs []StoryDiff, format string) error {
+	encoder := json.NewEncoder(w)
+	for _, diff := range diffs {
+		var err error
+		switch format {
+		case OutputFormatText:
+			err = diff.WriteText(w)
+		case OutputFormatJSON:
+			err = encoder.Encode(diff)
+		default:
+			err = fmt.Errorf("Unsupported format: %s", format)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunDiffCommand prints what changed between snapshots of a story.
+func RunDiffCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: diff -story ID [-from LABEL -to LABEL] [flags]")
+		fmt.Fprintln(flags.Output(), "\nDiffs two snapshots of a story, or each consecutive pair if none are given.")
+		flags.PrintDefaults()
+	}
+
+	storyID := flags.Int64("story", 0, "id of the story")
+	from := flags.String("from", "", "label of the earlier snapshot, e.g. 0m")
+	to := flags.String("to", "", "label of the later snapshot, e.g. 30m")
+	format := flags.String("format", OutputFormatText, "output format: text or json")
+	output := flags.String("output", "", "file to write to, instead of stdout")
+	databaseURL := flags.String("database-url", "", "database URL (default $DATABASE_URL)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *storyID == 0 {
+		flags.Usage()
+		return errors.New("A story id is required")
+	}
+
+	pool, err := connectDatabase(ctx, *databaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	diffs, err := DiffSnapshots(ctx, NewRepo(pool), *storyID, *from, *to)
+	if err != nil {
+		return err
+	}
+
+	w, closeOutput, err := openOutput(*output, stdout)
+	if err != nil {
+		return err
+	}
+
+	err = WriteDiffs(w, diffs, *format)
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// RunServeCommand serves the stories API over HTTP, until interrupted.
+func RunServeCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: serve [flags]")
+		fmt.Fprintln(flags.Output(), "\nServes stories and their snapshots over HTTP, as JSON.")
+		flags.PrintDefaults()
+	}
+
+	addr := flags.String("addr", LoadEnvDefault("API_ADDR", ":8080"), "address to listen on (default $API_ADDR)")
+	shutdownTimeout := flags.Duration("shutdown-timeout", 10*time.Second, "time to wait for requests to finish when stopping")
+	databaseURL := flags.String("database-url", "", "database URL (default $DATABASE_URL)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	pool, err := connectDatabase(ctx, *databaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	server := &http.Server{
+		Addr:              *addr,
+		Handler:           NewStoriesAPI(NewRepo(pool)).Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		slog.Info("Serving API", "addr", *addr)
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(shutdownCtx)
+}
+
+// RunAnalytics computes the metrics of the stories that match the filter, and
+// writes them to the store.
+func RunAnalytics(ctx context.Context, store AnalyticsStore, filter StoryFilter, config AnalyticsConfig, now time.Time) ([]StoryAnalytics, error) {
+	points, err := store.ReadStoryPoints(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics, stories := AnalyseStories(points, config)
+	err = store.WriteAnalytics(ctx, metrics, stories, now)
+	if err != nil {
+		return nil, err
+	}
+	return stories, nil
+}
+
+// RunAnalyticsCommand computes the metrics of stories, as a batch.
+func RunAnalyticsCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("analytics", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: analytics [flags]")
+		fmt.Fprintln(flags.Output(), "\nComputes the velocities, age-normalised percentiles and breakouts of stories.")
+		flags.PrintDefaults()
+	}
+
+	defaults := MakeDefaultAnalyticsConfig()
+	from := flags.String("from", "", "only stories created at or after this time, in RFC 3339")
+	to := flags.String("to", "", "only stories created before this time, in RFC 3339")
+	ageBucket := flags.Duration("age-bucket", defaults.AgeBucket, "width of the age buckets that snapshots are compared within")
+	minPopulation := flags.Int("min-population", defaults.MinPopulation, "fewest snapshots an age bucket needs for percentiles")
+	breakoutPercentile := flags.Float64("breakout-percentile", defaults.BreakoutPercentile, "score percentile at which a story breaks out")
+	breakoutWindow := flags.Duration("breakout-window", defaults.BreakoutWindow, "age up to which breakouts are early")
+	databaseURL := flags.String("database-url", "", "database URL (default $DATABASE_URL)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	filter := StoryFilter{}
+	filter.CreatedAfter, err = parseTimeFlag("from", *from)
+	if err != nil {
+		return err
+	}
+	filter.CreatedBefore, err = parseTimeFlag("to", *to)
+	if err != nil {
+		return err
+	}
+
+	config := AnalyticsConfig{
+		AgeBucket:          *ageBucket,
+		MinPopulation:      *minPopulation,
+		BreakoutPercentile: *breakoutPercentile,
+		BreakoutWindow:     *breakoutWindow,
+	}
+	err = config.Validate()
+	if err != nil {
+		return err
+	}
+
+	pool, err := connectDatabase(ctx, *databaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	stories, err := RunAnalytics(ctx, NewRepo(pool), filter, config, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[string]int)
+	for _, story := range stories {
+		counts[story.Classification]++
+	}
+	fmt.Fprintf(
+		stdout,
+		"Analysed %d stories: %d breakouts, %d late breakouts\n",
+		len(stories),
+		counts[BreakoutEarly],
+		counts[BreakoutLate],
+	)
+	return nil
+}
+
+// RunCanonicalise backfills the canonical URLs and domains of snapshots
+// without them, in batches, returning the number of snapshots backfilled.
+// Snapshots with invalid URLs are left without.
+func RunCanonicalise(ctx context.Context, store URLStore, batchSize int) (int, error) {
+	var (
+		afterID int64
+		count   int
+	)
+	for {
+		snapshots, err := store.ReadUncanonicalised(ctx, afterID, batchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(snapshots) == 0 {
+			return count, nil
+		}
+		afterID = snapshots[len(snapshots)-1].ID
+
+		var canonicalised []SnapshotURL
+		for _, snapshot := range snapshots {
+			snapshot.CanonicalURL, snapshot.Domain = CanonicaliseStoryURL(snapshot.URL)
+			if snapshot.CanonicalURL == "" {
+				slog.Info("Skipping invalid URL", "id", snapshot.ID, "url", snapshot.URL)
+				continue
+			}
+			canonicalised = append(canonicalised, snapshot)
+		}
+
+		if len(canonicalised) == 0 {
+			continue
+		}
+		err = store.WriteCanonicalURLs(ctx, canonicalised)
+		if err != nil {
+			return count, err
+		}
+		count += len(canonicalised)
+	}
+}
+
+func RunCanonicaliseCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("canonicalise", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: canonicalise [flags]")
+		fmt.Fprintln(flags.Output(), "\nBackfills the canonical URLs and domains of snapshots written without them.")
+		flags.PrintDefaults()
+	}
+
+	batchSize := flags.Int("batch-size", 1000, "number of snapshots to backfill at a time")
+	databaseURL := flags.String("database-url", "", "database URL (default $DATABASE_URL)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("Invalid -batch-size: %d", *batchSize)
+	}
+
+	pool, err := connectDatabase(ctx, *databaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	count, err := RunCanonicalise(ctx, NewRepo(pool), *batchSize)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Canonicalised %d snapshots\n", count)
+	return nil
+}
+
+// RunExportCommand exports the snapshots of stories to a flat file.
+func RunExportCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: export [flags]")
+		fmt.Fprintln(flags.Output(), "\nExports stories, with a row per snapshot or a row per story, as CSV or Parquet.")
+		flags.PrintDefaults()
+	}
+
+	from := flags.String("from", "", "only stories created at or after this time, in RFC 3339")
+	to := flags.String("to", "", "only stories created before this time, in RFC 3339")
+	domain := flags.String("domain", "", "only stories on this registrable domain, which covers its subdomains")
+	format := flags.String("format", ExportFormatCSV, "output format: csv or parquet")
+	layout := flags.String("layout", ExportLayoutLong, "layout: long, with a row per snapshot, or wide, with a row per story")
+	labels := flags.String("labels", "", "comma separated labels of the snapshots to give columns in the wide layout (default all)")
+	output := flags.String("output", "", "file to write to, instead of stdout")
+	databaseURL := flags.String("database-url", "", "database URL (default $DATABASE_URL)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	filter := StoryFilter{}
+	if *domain != "" {
+		filter.Domain = RegistrableDomain(*domain)
+	}
+	filter.CreatedAfter, err = parseTimeFlag("from", *from)
+	if err != nil {
+		return err
+	}
+	filter.CreatedBefore, err = parseTimeFlag("to", *to)
+	if err != nil {
+		return err
+	}
+	if *format != ExportFormatCSV && *format != ExportFormatParquet {
+		return fmt.Errorf("Unsupported format: %s", *format)
+	}
+
+	pool, err := connectDatabase(ctx, *databaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	w, closeOutput, err := openOutput(*output, stdout)
+	if err != nil {
+		return err
+	}
+
+	count, err := Export(ctx, NewRepo(pool), filter, *layout, parseList(*labels), func(columns []ExportColumn) (RowWriter, error) {
+		return NewRowWriter(w, *format, columns)
+	})
+	if closeErr := closeOutput(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	// Only report the count when it isn't mixed in with the export.
+	if *output != "" {
+		fmt.Fprintf(stdout, "Exported %d rows\n", count)
+	}
+	return nil
+}
+
+// readArchive returns a function that reads the archived snapshots in the
+// file at the given path, or on stdin if the path is `-`, in the given format,
+// or in the format given by the file's extension if it is empty. JSONL may be
+// gzipped, with a `.gz` extension.
+func readArchive(path, format string, stdin io.Reader) (func(func(StoryModel) error) error, func() error, error) {
+	name := strings.TrimSuffix(path, ".gz")
+	if format == "" {
+		format = ImportFormatJSONL
+		if strings.HasSuffix(name, ".parquet") {
+			format = ImportFormatParquet
+		}
+	}
+	if format != ImportFormatJSONL && format != ImportFormatParquet {
+		return nil, nil, fmt.Errorf("Unsupported format: %s", format)
+	}
+
+	if path == "-" {
+		if format != ImportFormatJSONL {
+			return nil, nil, errors.New("Only JSONL can be read from stdin")
+		}
+		read := func(fn func(StoryModel) error) error { return ReadJSONL(stdin, fn) }
+		return read, func() error { return nil }, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if format == ImportFormatParquet {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		reader, err := NewParquetReader(f, info.Size())
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		read := func(fn func(StoryModel) error) error { return ReadParquet(reader, fn) }
+		return read, f.Close, nil
+	}
+
+	var r io.Reader = f
+	if name != path {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		r = gz
+	}
+	read := func(fn func(StoryModel) error) error { return ReadJSONL(r, fn) }
+	return read, f.Close, nil
+}
+
+// RunImportCommand imports archived snapshots of stories.
+func RunImportCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: import -input FILE [flags]")
+		fmt.Fprintln(flags.Output(), "\nImports archived snapshots of stories, skipping those that conflict with stored snapshots.")
+		flags.PrintDefaults()
+	}
+
+	input := flags.String("input", "", "JSONL or Parquet file to import, or - for JSONL on stdin")
+	format := flags.String("format", "", "input format: jsonl or parquet (default by the file's extension)")
+	batchSize := flags.Int("batch-size", DefaultImportBatchSize, "number of snapshots to write in each transaction")
+	databaseURL := flags.String("database-url", "", "database URL (default $DATABASE_URL)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *input == "" {
+		flags.Usage()
+		return errors.New("An input file is required")
+	}
+	if *batchSize <= 0 {
+		return fmt.Errorf("Invalid -batch-size: %d", *batchSize)
+	}
+
+	read, closeInput, err := readArchive(*input, *format, os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer closeInput()
+
+	pool, err := connectDatabase(ctx, *databaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	result, err := Import(ctx, NewRepo(pool), read, *batchSize)
+	for _, conflict := range result.Conflicts {
+		fmt.Fprintf(stdout, "Skipped conflicting snapshot of story %d: %s\n", conflict.StoryID, conflict.Label)
+	}
+	fmt.Fprintf(stdout, "Imported %d snapshots, skipped %d conflicts\n", result.Imported, len(result.Conflicts))
+	return err
+}
+
+func RunRetentionCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("retention", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: retention [flags]")
+		fmt.Fprintln(flags.Output(), "\nCreates monthly partitions of snapshots ahead of time, and drops those older than the horizon, archiving them first if an archive directory is given.")
+		flags.PrintDefaults()
+	}
+
+	ahead := flags.Int("ahead", DefaultRetentionAhead, "number of months after the current one to create partitions for")
+	horizon := flags.Duration("horizon", 0, "age after which partitions are dropped, once every snapshot in them is older (default 0, which keeps every partition)")
+	archiveDir := flags.String("archive-dir", "", "directory to archive partitions to, as gzipped JSONL, before they're dropped")
+	dryRun := flags.Bool("dry-run", false, "print the partitions that would be created and dropped, without changing them")
+	databaseURL := flags.String("database-url", "", "database URL (default $DATABASE_URL)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *ahead < 0 {
+		return fmt.Errorf("Invalid -ahead: %d", *ahead)
+	}
+	if *horizon < 0 {
+		return fmt.Errorf("Invalid -horizon: %s", *horizon)
+	}
+
+	var sink ArchiveSink
+	directory := DirectorySink{Dir: *archiveDir}
+	if *archiveDir != "" {
+		info, err := os.Stat(*archiveDir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("Not a directory: %s", *archiveDir)
+		}
+		sink = directory
+	}
+
+	pool, err := connectDatabase(ctx, *databaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	repo := NewRepo(pool)
+	existing, err := repo.Partitions(ctx)
+	if err != nil {
+		return err
+	}
+	plan := PlanRetention(existing, time.Now(), *ahead, *horizon)
+
+	if *dryRun {
+		for _, month := range plan.Create {
+			fmt.Fprintf(stdout, "Would create partition %s\n", PartitionName("stories", month))
+		}
+		for _, month := range plan.Drop {
+			fmt.Fprintf(stdout, "Would drop partition %s\n", PartitionName("stories", month))
+		}
+		return nil
+	}
+
+	result, err := ApplyRetention(ctx, repo, sink, plan)
+	for _, month := range result.Created {
+		fmt.Fprintf(stdout, "Created partition %s\n", PartitionName("stories", month))
+	}
+	for _, month := range result.Dropped {
+		if sink != nil {
+			fmt.Fprintf(stdout, "Archived partition %s to %s\n", PartitionName("stories", month), directory.Path(PartitionName("stories", month)))
+		}
+		fmt.Fprintf(stdout, "Dropped partition %s\n", PartitionName("stories", month))
+	}
+	if len(result.Dropped) > 0 {
+		fmt.Fprintf(stdout, "Deleted %d orphaned poll options and comment versions\n", result.Orphans)
+	}
+	return err
+}
+
+// RunConfigCommand runs the config subcommand's action. Only `print` is
+// supported, which prints the worker's effective config, as resolved from
+// the given flags, and reports any problems with it.
+func RunConfigCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(stdout, "Usage: config print [flags]")
+		fmt.Fprintln(stdout, "\nPrints the effective config of the worker, with secrets redacted. Flags are those of the worker; run `config print -help` to list them.")
+		return errors.New("Unknown or missing config action")
+	}
+
+	values, err := ResolveConfig(args[1:], os.LookupEnv, stdout)
+	if values == nil {
+		return err
+	}
+	PrintConfig(stdout, values)
+
+	_, configErr := values.Config()
+	return errors.Join(err, configErr)
+}
+
+// runWorkerCommand runs the ingestion worker with the given source and
+// destination queues. Its flags are the worker's settings, as well as those
+// defined by the subcommand, which queues reads once they're parsed.
+func runWorkerCommand(ctx context.Context, flags *flag.FlagSet, args []string, queues func() (string, string, error)) error {
+	loader := NewConfigLoader(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("Unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	source, dst, err := queues()
+	if err != nil {
+		flags.Usage()
+		return err
+	}
+	loader.Override("source_queue_name", source)
+	loader.Override("dst_queue_name", dst)
+
+	values, err := loader.Resolve(os.LookupEnv)
+	config, configErr := values.Config()
+	if err = errors.Join(err, configErr); err != nil {
+		return err
+	}
+
+	return RunWorker(ctx, config)
+}
+
+// workerFlagSet makes the FlagSet of a subcommand that runs the ingestion
+// worker.
+func workerFlagSet(name, usage, description string, stdout io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: "+usage)
+		fmt.Fprintln(flags.Output(), "\n"+description+" Settings are read from the config file, then environment variables, then flags; run `config print` to show them.")
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+func RunPollNewCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := workerFlagSet("poll-new", "poll-new [flags]", "Polls or streams new stories, and puts them on the \"new\" queue. Only the replica holding the leadership lease does so.", stdout)
+	return runWorkerCommand(ctx, flags, args, func() (string, string, error) {
+		return "", NewQueueName, nil
+	})
+}
+
+func RunPollUpdatesCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := workerFlagSet("poll-updates", "poll-updates [flags]", "Polls or streams the updates feed, and puts updated stories on the \"updates\" queue for an extra snapshot. Only the replica holding the leadership lease does so.", stdout)
+	return runWorkerCommand(ctx, flags, args, func() (string, string, error) {
+		return "", UpdatesQueueName, nil
+	})
+}
+
+func RunSnapshotCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := workerFlagSet("snapshot", "snapshot -from QUEUE [-to QUEUE] [flags]", "Snapshots the stories on a queue, and puts them on the next queue, if there is one.", stdout)
+	from := flags.String("from", "", "queue to snapshot stories from, such as new, 15m or watch")
+	to := flags.String("to", "", "queue to put snapshotted stories on, if any")
+	return runWorkerCommand(ctx, flags, args, func() (string, string, error) {
+		if *from == "" {
+			return "", "", errors.New("A queue to snapshot stories from is required")
+		}
+		return *from, *to, nil
+	})
+}
+
+func RunMigrateCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: migrate [flags]")
+		fmt.Fprintln(flags.Output(), "\nApplies pending database migrations. Workers only apply them when they start if DATABASE_MIGRATE is set.")
+		flags.PrintDefaults()
+	}
+
+	databaseURL := flags.String("database-url", "", "database URL (default $DATABASE_URL)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	pool, err := connectDatabase(ctx, *databaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	err = Migrate(ctx, pool)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Database is up to date")
+	return nil
+}
+
+// connectBroker connects to the broker at the given URL, or at the URL given
+// by the `BROKER_URL` environment variable if it is empty.
+func connectBroker(brokerURL string) (*redis.Client, error) {
+	if brokerURL == "" {
+		brokerURL = LoadEnvDefault("BROKER_URL", "")
+	}
+	if brokerURL == "" {
+		return nil, errors.New("A broker URL is required")
+	}
+	opts, err := redis.ParseURL(brokerURL)
+	if err != nil {
+		return nil, err
+	}
+	return redis.NewClient(opts), nil
+}
+
+// RunRefreshUsersCommand snapshots the profiles of users that are due to be
+// refreshed.
+func RunRefreshUsersCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("refresh-users", flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: refresh-users [flags]")
+		fmt.Fprintln(flags.Output(), "\nSnapshots the profiles of users that are due to be refreshed. Workers capturing users schedule each user's profile to be refreshed every interval once they've first snapshotted it, until the user hasn't been seen for -max-idle.")
+		flags.PrintDefaults()
+	}
+
+	// Workers schedule refreshes with the same interval.
+	defaultInterval := DefaultUsersRefreshInterval
+	if value := LoadEnvDefault("USERS_REFRESH_INTERVAL", ""); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("Invalid USERS_REFRESH_INTERVAL: %s", value)
+		}
+		defaultInterval = parsed
+	}
+
+	limit := flags.Int("limit", DefaultUsersRefreshBatchSize, "most profiles to refresh")
+	interval := flags.Duration("interval", defaultInterval, "interval between snapshots of a user's profile (default $USERS_REFRESH_INTERVAL)")
+	maxIdle := flags.Duration("max-idle", DefaultUsersMaxIdle, "time since a user was last seen after which their profile is no longer refreshed")
+	rateLimit := flags.Float64("rate-limit", DefaultUsersRefreshRateLimit, "requests per second to the API")
+	databaseURL := flags.String("database-url", "", "database URL (default $DATABASE_URL)")
+	brokerURL := flags.String("broker-url", "", "broker URL (default $BROKER_URL)")
+	baseURL := flags.String("hn-client-base-url", LoadEnvDefault("HN_CLIENT_BASE_URL", DefaultHNClientBaseURL), "base URL of the Firebase API (default $HN_CLIENT_BASE_URL)")
+	apiVersion := flags.String("hn-client-api-version", LoadEnvDefault("HN_CLIENT_API_VERSION", "v0"), "version of the Firebase API (default $HN_CLIENT_API_VERSION)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *limit <= 0 {
+		return fmt.Errorf("Invalid -limit: %d", *limit)
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("Invalid -interval: %s", *interval)
+	}
+	if *maxIdle <= 0 {
+		return fmt.Errorf("Invalid -max-idle: %s", *maxIdle)
+	}
+	if *rateLimit <= 0 {
+		return fmt.Errorf("Invalid -rate-limit: %v", *rateLimit)
+	}
+
+	pool, err := connectDatabase(ctx, *databaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	client, err := connectBroker(*brokerURL)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	hnClient := NewHNClient(&http.Client{Timeout: refreshUsersHTTPTimeout}, *baseURL, *apiVersion, refreshUsersBackoff, refreshUsersMaxAttempts)
+	hnClient.Limiter = NewTokenBucket(*rateLimit, 1)
+
+	capturer := NewUserCapturer(hnClient, NewRepo(pool), client, *interval)
+	capturer.MaxIdle = *maxIdle
+	refreshed, err := capturer.Refresh(ctx, time.Now().UTC(), *limit)
+	fmt.Fprintf(stdout, "Refreshed %d user profiles\n", refreshed)
+	return err
+}
+
+// ReadStoryIDs reads story ids, one per line, skipping blank lines.
+func ReadStoryIDs(r io.Reader) ([]int64, error) {
+	var ids []int64
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(text, 10, 64)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("Invalid story id on line %d: %s", line, text)
+		}
+		ids = append(ids, id)
+	}
+	return ids, scanner.Err()
+}
+
+// MakeBackfillLabel labels the snapshot of a story that was backfilled onto a
+// queue after it had passed the queue's stage, so that it's kept apart from
+// the snapshots taken at the stage.
+func MakeBackfillLabel(queueName string) string {
+	return fmt.Sprintf("%s-%s", BackfillLabelPrefix, queueName)
+}
+
+// BackfillResult counts the stories that were backfilled.
+type BackfillResult struct {
+	// Scheduled stories were put on the queue for when they reach its stage.
+	Scheduled int
+	// Late stories had already passed the queue's stage, so were put on it
+	// due now, under the backfill label.
+	Late int
+	// Missing stories couldn't be found, so weren't put on the queue.
+	Missing int
+}
+
+// Backfill looks up when each of the stories was created, and puts it on dst
+// for when it reaches dst's stage, as it would have been had it not been
+// missed. Stories that have already passed the stage, by more than the grace
+// period, are put on dst due now, and labelled with label instead, so that
+// they don't pass for snapshots taken at the stage.
+func Backfill(ctx context.Context, client ItemSource, dst Enqueuer, label string, ids []int64, now time.Time) (BackfillResult, error) {
+	result := BackfillResult{}
+	producer := NewMessageProducer(dst)
+
+	for _, id := range ids {
+		if err := client.WaitAvailable(ctx); err != nil {
+			return result, err
+		}
+		items, err := FetchStoryItems(client, id, false)
+		if errors.Is(err, ErrItemMissing) {
+			result.Missing++
+			continue
+		}
+		if err != nil {
+			return result, fmt.Errorf("Error fetching story %d: %w", id, err)
+		}
+
+		createdAt := time.Unix(items.Story.Time, 0).UTC()
+		msg := producer.MakeMessage(id, &createdAt)
+		late := msg.ProcessAt.Add(DefaultGracePeriod).Before(now)
+		if late {
+			msg.ProcessAt = now
+			msg.Label = label
+		}
+
+		if err := dst.Enqueue(ctx, msg); err != nil {
+			return result, err
+		}
+		if late {
+			result.Late++
+		} else {
+			result.Scheduled++
+		}
+	}
+	return result, nil
+}
+
+func RunBackfillCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	flags := workerFlagSet("backfill", "backfill [flags] [ID...]", "Puts stories on a queue, such as to snapshot stories that were missed while ingestion was down. Each story is looked up, and put on the queue for when it reaches the queue's stage. Stories that have already passed the stage are snapshotted now, under a backfill-QUEUE label rather than the stage's. Stories are looked up with the worker's item source, rate limit and circuit breaker.", stdout)
+	queueName := flags.String("queue", NewQueueName, "queue to put the stories on")
+	input := flags.String("input", "", "file of story ids to backfill, one per line, or - for stdin")
+
+	loader := NewConfigLoader(flags)
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	var ids []int64
+	for _, arg := range flags.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || id <= 0 {
+			return fmt.Errorf("Invalid story id: %s", arg)
+		}
+		ids = append(ids, id)
+	}
+	if *input != "" {
+		var r io.Reader = os.Stdin
+		if *input != "-" {
+			f, err := os.Open(*input)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		read, err := ReadStoryIDs(r)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, read...)
+	}
+	if len(ids) == 0 {
+		flags.Usage()
+		return errors.New("Story ids to backfill are required")
+	}
+
+	queueConfig, err := MakeQueueConfig(*queueName)
+	if err != nil {
+		return fmt.Errorf("Invalid -queue: %s", *queueName)
+	}
+
+	// The stories are put on the queue that workers snapshot them from.
+	loader.Override("source_queue_name", *queueName)
+	loader.Override("dst_queue_name", "")
+	values, err := loader.Resolve(os.LookupEnv)
+	config, configErr := values.Config()
+	if err = errors.Join(err, configErr); err != nil {
+		return err
+	}
+
+	client, err := connectBroker(config.BrokerURL)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	queue := NewPriorityQueue(client, queueConfig, 0)
+	result, err := Backfill(ctx, MakeItemSource(config, client), queue, MakeBackfillLabel(*queueName), ids, time.Now().UTC())
+	fmt.Fprintf(
+		stdout,
+		"Backfilled %d stories onto the %s queue: %d scheduled for the stage, %d labelled %s as they'd passed it, %d missing\n",
+		result.Scheduled+result.Late,
+		*queueName,
+		result.Scheduled,
+		result.Late,
+		MakeBackfillLabel(*queueName),
+		result.Missing,
+	)
+	return err
+}
+
+// queueActions are the actions of the queue subcommand.
+var queueActions = map[string]Command{
+	"delete":     runQueueDeleteAction,
+	"lag":        runQueueLagAction,
+	"list":       runQueueListAction,
+	"move":       runQueueMoveAction,
+	"pause":      runQueuePauseAction,
+	"peek":       runQueuePeekAction,
+	"reschedule": runQueueRescheduleAction,
+	"resume":     runQueueResumeAction,
+}
+
+// RunQueueCommand runs an action of the queue subcommand, which administers
+// the queues that stories pass through.
+func RunQueueCommand(ctx context.Context, args []string, stdout io.Writer) error {
+	var action Command
+	if len(args) > 0 {
+		action = queueActions[args[0]]
+	}
+	if action == nil {
+		names := make([]string, 0, len(queueActions))
+		for name := range queueActions {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		fmt.Fprintln(stdout, "Usage: queue ACTION [flags]")
+		fmt.Fprintf(stdout, "\nAdministers the queues that stories pass through. Actions: %s. Run `queue ACTION -help` for an action's flags.\n", strings.Join(names, ", "))
+		return errors.New("Unknown or missing queue action")
+	}
+	return action(ctx, args[1:], stdout)
+}
+
+// queueActionFlagSet makes the flags of a queue action, with a flag for the
+// broker's URL.
+func queueActionFlagSet(name, usage, description string, stdout io.Writer) (*flag.FlagSet, *string) {
+	flags := flag.NewFlagSet("queue "+name, flag.ContinueOnError)
+	flags.SetOutput(stdout)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: queue %s %s\n", name, usage)
+		fmt.Fprintf(flags.Output(), "\n%s\n", description)
+		flags.PrintDefaults()
+	}
+
+	brokerURL := flags.String("broker-url", "", "broker URL (default $BROKER_URL)")
+	return flags, brokerURL
+}
+
+// openQueue connects to the broker and opens the named queue on it. The
+// client is to be closed by the caller.
+func openQueue(brokerURL, flagName, name string) (*redis.Client, *PriorityQueue, error) {
+	if name == "" {
+		return nil, nil, fmt.Errorf("-%s is required", flagName)
+	}
+	config, err := MakeQueueConfig(name)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid -%s: %s", flagName, name)
+	}
+
+	client, err := connectBroker(brokerURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, NewPriorityQueue(client, config, 0), nil
+}
+
+// parseProcessAtFlags parses the time that messages are to be processed at,
+// from either the time given by the -at flag, or the duration from now given
+// by the -in flag. Nil is returned if neither is given.
+func parseProcessAtFlags(at, in string, now time.Time) (*time.Time, error) {
+	if at != "" && in != "" {
+		return nil, errors.New("Only one of -at and -in may be given")
+	}
+	if at != "" {
+		processAt, err := parseTimeFlag("at", at)
+		return &processAt, err
+	}
+	if in != "" {
+		after, err := time.ParseDuration(in)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid -in: %s", in)
+		}
+		processAt := now.Add(after)
+		return &processAt, nil
+	}
+	return nil, nil
+}
+
+// formatQueueTime formats the time a message is to be processed at, for
+// display.
+func formatQueueTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+func runQueueListAction(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, brokerURL := queueActionFlagSet(
+		"list",
+		"[flags]",
+		"Lists the queues with messages on them, or that are paused, with the number of messages on each and the times the oldest and newest are to be processed at.",
+		stdout,
+	)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	client, err := connectBroker(*brokerURL)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	stats, err := ListQueues(ctx, client)
+	if err != nil {
+		return err
+	}
+	for _, queue := range stats {
+		state := "running"
+		if queue.Paused {
+			state = "paused"
+		}
+		fmt.Fprintf(stdout, "%s\t%d\t%s\t%s\t%s\n", queue.Name, queue.Depth, formatQueueTime(queue.Oldest), formatQueueTime(queue.Newest), state)
+	}
+	return nil
+}
+
+func runQueuePeekAction(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, brokerURL := queueActionFlagSet(
+		"peek",
+		"-queue NAME [flags]",
+		"Prints the messages at the front of a queue, in the order they're due to be processed, without removing them.",
+		stdout,
+	)
+	queueName := flags.String("queue", "", "queue to peek at")
+	count := flags.Int64("n", 10, "number of messages to print")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	client, queue, err := openQueue(*brokerURL, "queue", *queueName)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	messages, err := queue.Peek(ctx, *count)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, msg := range messages {
+		createdAt := time.Time{}
+		if msg.CreatedAt != nil {
+			createdAt = *msg.CreatedAt
+		}
+		label := msg.Label
+		if label == "" {
+			label = "-"
+		}
+		fmt.Fprintf(
+			stdout,
+			"%d\t%s\t%s\t%s\t%s\n",
+			msg.StoryID,
+			formatQueueTime(msg.ProcessAt),
+			now.Sub(msg.ProcessAt).Truncate(time.Second),
+			formatQueueTime(createdAt),
+			label,
+		)
+	}
+	return nil
+}
+
+func runQueueLagAction(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, brokerURL := queueActionFlagSet(
+		"lag",
+		"-queue NAME [flags]",
+		"Prints a histogram of how long the messages on a queue are overdue.",
+		stdout,
+	)
+	queueName := flags.String("queue", "", "queue to inspect")
+	buckets := flags.String("buckets", "", "comma-separated upper bounds of the histogram's buckets (default 1m,5m,15m,1h,6h,24h)")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	bounds := DefaultLagBuckets
+	if *buckets != "" {
+		bounds = nil
+		for _, bucket := range parseList(*buckets) {
+			bound, err := time.ParseDuration(bucket)
+			if err != nil || bound <= 0 {
+				return fmt.Errorf("Invalid -buckets: %s", *buckets)
+			}
+			bounds = append(bounds, bound)
+		}
+	}
+
+	client, queue, err := openQueue(*brokerURL, "queue", *queueName)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	histogram, err := queue.Lag(ctx, time.Now().UTC(), bounds)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "not due\t%d\n", histogram.NotDue)
+	for idx, label := range histogram.Labels() {
+		fmt.Fprintf(stdout, "%s\t%d\n", label, histogram.Counts[idx])
+	}
+	return nil
+}
+
+func runQueueMoveAction(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, brokerURL := queueActionFlagSet(
+		"move",
+		"-from NAME -to NAME -story ID [flags]",
+		"Moves the messages about a story from one queue onto another. Messages keep the time they're to be processed at, unless -at or -in is given.",
+		stdout,
+	)
+	from := flags.String("from", "", "queue to move messages from")
+	to := flags.String("to", "", "queue to move messages onto")
+	storyID := flags.Int64("story", 0, "id of the story whose messages are moved")
+	at := flags.String("at", "", "time to process the messages at, in RFC 3339 format")
+	in := flags.String("in", "", "duration from now to process the messages in")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *storyID == 0 {
+		return errors.New("-story is required")
+	}
+	processAt, err := parseProcessAtFlags(*at, *in, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	if *to == "" {
+		return errors.New("-to is required")
+	}
+	dstConfig, err := MakeQueueConfig(*to)
+	if err != nil {
+		return fmt.Errorf("Invalid -to: %s", *to)
+	}
+
+	client, src, err := openQueue(*brokerURL, "from", *from)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	dst := NewPriorityQueue(client, dstConfig, 0)
+
+	moved, err := src.Move(ctx, *storyID, dst, processAt)
+	fmt.Fprintf(stdout, "Moved %d messages from the %s queue onto the %s queue\n", moved, src.QueueName(), dst.QueueName())
+	return err
+}
+
+func runQueueRescheduleAction(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, brokerURL := queueActionFlagSet(
+		"reschedule",
+		"-queue NAME -story ID (-at TIME | -in DURATION) [flags]",
+		"Changes the time that the messages about a story are to be processed at.",
+		stdout,
+	)
+	queueName := flags.String("queue", "", "queue of the messages")
+	storyID := flags.Int64("story", 0, "id of the story whose messages are rescheduled")
+	at := flags.String("at", "", "time to process the messages at, in RFC 3339 format")
+	in := flags.String("in", "", "duration from now to process the messages in")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *storyID == 0 {
+		return errors.New("-story is required")
+	}
+	processAt, err := parseProcessAtFlags(*at, *in, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if processAt == nil {
+		return errors.New("One of -at and -in is required")
+	}
+
+	client, queue, err := openQueue(*brokerURL, "queue", *queueName)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	moved, err := queue.Move(ctx, *storyID, queue, processAt)
+	fmt.Fprintf(stdout, "Rescheduled %d messages for %s\n", moved, processAt.Format(time.RFC3339))
+	return err
+}
+
+func runQueueDeleteAction(ctx context.Context, args []string, stdout io.Writer) error {
+	flags, brokerURL := queueActionFlagSet(
+		"delete",
+		"-queue NAME -story ID [flags]",
+		"Deletes the messages about a story from a queue.",
+		stdout,
+	)
+	queueName := flags.String("queue", "", "queue to delete messages from")
+	storyID := flags.Int64("story", 0, "id of the story whose messages are deleted")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *storyID == 0 {
+		return errors.New("-story is required")
+	}
+
+	client, queue, err := openQueue(*brokerURL, "queue", *queueName)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	removed, err := queue.Remove(ctx, *storyID)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Deleted %d messages from the %s queue\n", removed, queue.QueueName())
+	return nil
+}
+
+func runQueuePauseAction(ctx context.Context, args []string, stdout io.Writer) error {
+	return runQueueStateAction(ctx, args, stdout, "pause")
+}
+
+func runQueueResumeAction(ctx context.Context, args []string, stdout io.Writer) error {
+	return runQueueStateAction(ctx, args, stdout, "resume")
+}
+
+// runQueueStateAction pauses or resumes a queue.
+func runQueueStateAction(ctx context.Context, args []string, stdout io.Writer, action string) error {
+	description := "Pauses a queue, so that consumers take no messages off of it until it's resumed. Messages are still put onto it."
+	if action == "resume" {
+		description = "Resumes a paused queue. Messages that fell due while it was paused are rescheduled for as long as it was paused, so that they don't expire."
+	}
+	flags, brokerURL := queueActionFlagSet(action, "-queue NAME [flags]", description, stdout)
+	queueName := flags.String("queue", "", "queue to "+action)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	client, queue, err := openQueue(*brokerURL, "queue", *queueName)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if action == "resume" {
+		var rescheduled int64
+		rescheduled, err = queue.Resume(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "The %s queue is resumed, with %d overdue messages rescheduled\n", queue.QueueName(), rescheduled)
+		return nil
+	}
+
+	err = queue.Pause(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "The %s queue is paused\n", queue.QueueName())
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockSnapshotStore struct {
+	mock.Mock
+}
+
+func (m *mockSnapshotStore) ReadSnapshot(ctx context.Context, storyID int64, label string) (StoryModel, error) {
+	args := m.Called(ctx, storyID, label)
+	return args.Get(0).(StoryModel), args.Error(1)
+}
+
+func (m *mockSnapshotStore) SnapshotLabels(ctx context.Context, storyID int64) ([]string, error) {
+	args := m.Called(ctx, storyID)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func newMockSnapshotStore() *mockSnapshotStore {
+	store := new(mockSnapshotStore)
+	store.On("SnapshotLabels", mock.Anything, int64(1)).Return([]string{"new", "0m", "15m"}, nil)
+	store.On("ReadSnapshot", mock.Anything, int64(1), "new").Return(StoryModel{StoryID: 1, QueueName: "new", RawDocument: `{"score":1}`}, nil)
+	store.On("ReadSnapshot", mock.Anything, int64(1), "0m").Return(StoryModel{StoryID: 1, QueueName: "0m", RawDocument: `{"score":3}`}, nil)
+	store.On("ReadSnapshot", mock.Anything, int64(1), "15m").Return(StoryModel{StoryID: 1, QueueName: "15m", RawDocument: `{"score":8}`}, nil)
+	store.On("ReadSnapshot", mock.Anything, int64(1), "1h").Return(StoryModel{}, ErrSnapshotNotFound)
+	return store
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	store := newMockSnapshotStore()
+
+	actual, err := DiffSnapshots(context.Background(), store, 1, "new", "15m")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []StoryDiff{{StoryID: 1, From: "new", To: "15m", ScoreDelta: 7}}, actual)
+	store.AssertNotCalled(t, "SnapshotLabels", mock.Anything, mock.Anything)
+}
+
+func TestDiffSnapshotsWhenNoLabelsDiffsConsecutiveSnapshots(t *testing.T) {
+	store := newMockSnapshotStore()
+
+	expected := []StoryDiff{
+		{StoryID: 1, From: "new", To: "0m", ScoreDelta: 2},
+		{StoryID: 1, From: "0m", To: "15m", ScoreDelta: 5},
+	}
+
+	actual, err := DiffSnapshots(context.Background(), store, 1, "", "")
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestDiffSnapshotsWhenSnapshotNotFoundReturnsError(t *testing.T) {
+	store := newMockSnapshotStore()
+
+	_, err := DiffSnapshots(context.Background(), store, 1, "new", "1h")
+
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
+
+func TestDiffSnapshotsWhenOneLabelReturnsError(t *testing.T) {
+	store := newMockSnapshotStore()
+
+	_, err := DiffSnapshots(context.Background(), store, 1, "new", "")
+
+	assert.NotNil(t, err)
+}
+
+func TestWriteDiffsJSON(t *testing.T) {
+	diffs := []StoryDiff{
+		{StoryID: 1, From: "new", To: "0m", ScoreDelta: 2},
+		{StoryID: 1, From: "0m", To: "15m", ScoreDelta: 5, AddedKids: []int64{3}},
+	}
+
+	expected := `{"story_id":1,"from":"new","to":"0m","score_delta":2,"descendants_delta":0}
+{"story_id":1,"from":"0m","to":"15m","score_delta":5,"descendants_delta":0,"added_kids":[3]}
+`
+
+	var b strings.Builder
+	err := WriteDiffs(&b, diffs, OutputFormatJSON)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, b.String())
+}
+
+func TestWriteDiffsWhenUnsupportedFormatReturnsError(t *testing.T) {
+	var b strings.Builder
+	err := WriteDiffs(&b, []StoryDiff{{}}, "xml")
+
+	assert.NotNil(t, err)
+}
+
+func TestRunDiffCommandWhenNoStoryReturnsError(t *testing.T) {
+	var b strings.Builder
+	err := RunDiffCommand(context.Background(), []string{"-from", "0m"}, &b)
+
+	assert.NotNil(t, err)
+	assert.Contains(t, b.String(), "Usage: diff")
+}
+
+type mockAnalyticsStore struct {
+	mock.Mock
+}
+
+func (m *mockAnalyticsStore) ReadStoryPoints(ctx context.Context, filter StoryFilter) ([]StoryPoint, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).([]StoryPoint), args.Error(1)
+}
+
+func (m *mockAnalyticsStore) WriteAnalytics(ctx context.Context, metrics []SnapshotMetrics, stories []StoryAnalytics, computedAt time.Time) error {
+	args := m.Called(ctx, metrics, stories, computedAt)
+	return args.Error(0)
+}
+
+func TestRunAnalytics(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	filter := StoryFilter{CreatedAfter: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+
+	store := new(mockAnalyticsStore)
+	store.On("ReadStoryPoints", mock.Anything, filter).Return([]StoryPoint{
+		makeStoryPoint(1, 5*time.Minute, 20, 5),
+		makeStoryPoint(2, 5*time.Minute, 2, 0),
+	}, nil)
+	store.On("WriteAnalytics", mock.Anything, mock.Anything, mock.Anything, now).Return(nil)
+
+	stories, err := RunAnalytics(context.Background(), store, filter, MakeDefaultAnalyticsConfig(), now)
+
+	assert.Nil(t, err)
+	assert.Len(t, stories, 2)
+	store.AssertCalled(t, "WriteAnalytics", mock.Anything, mock.MatchedBy(func(metrics []SnapshotMetrics) bool {
+		return len(metrics) == 2
+	}), stories, now)
+}
+
+func TestRunAnalyticsWhenErrorReadingReturnsError(t *testing.T) {
+	store := new(mockAnalyticsStore)
+	store.On("ReadStoryPoints", mock.Anything, mock.Anything).Return([]StoryPoint{}, fmt.Errorf("Error"))
+
+	_, err := RunAnalytics(context.Background(), store, StoryFilter{}, MakeDefaultAnalyticsConfig(), time.Now())
+
+	assert.NotNil(t, err)
+	store.AssertNotCalled(t, "WriteAnalytics", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+type mockURLStore struct {
+	mock.Mock
+}
+
+func (m *mockURLStore) ReadUncanonicalised(ctx context.Context, afterID int64, limit int) ([]SnapshotURL, error) {
+	args := m.Called(ctx, afterID, limit)
+	return args.Get(0).([]SnapshotURL), args.Error(1)
+}
+
+func (m *mockURLStore) WriteCanonicalURLs(ctx context.Context, snapshots []SnapshotURL) error {
+	args := m.Called(ctx, snapshots)
+	return args.Error(0)
+}
+
+func TestRunCanonicalise(t *testing.T) {
+	store := new(mockURLStore)
+	store.On("ReadUncanonicalised", mock.Anything, int64(0), 2).Return([]SnapshotURL{
+		{ID: 1, URL: "http://www.example.com/a/"},
+		{ID: 3, URL: "not a url"},
+	}, nil)
+	store.On("ReadUncanonicalised", mock.Anything, int64(3), 2).Return([]SnapshotURL{
+		{ID: 4, URL: "https://blog.example.co.uk/?utm_source=hn"},
+	}, nil)
+	store.On("ReadUncanonicalised", mock.Anything, int64(4), 2).Return([]SnapshotURL{}, nil)
+	store.On("WriteCanonicalURLs", mock.Anything, mock.Anything).Return(nil)
+
+	count, err := RunCanonicalise(context.Background(), store, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	store.AssertCalled(t, "WriteCanonicalURLs", mock.Anything, []SnapshotURL{
+		{ID: 1, URL: "http://www.example.com/a/", CanonicalURL: "https://example.com/a", Domain: "example.com"},
+	})
+	store.AssertCalled(t, "WriteCanonicalURLs", mock.Anything, []SnapshotURL{
+		{ID: 4, URL: "https://blog.example.co.uk/?utm_source=hn", CanonicalURL: "https://blog.example.co.uk/", Domain: "example.co.uk"},
+	})
+}
+
+func TestReadStoryIDs(t *testing.T) {
+	ids, err := ReadStoryIDs(strings.NewReader("1\n\n 2 \n3\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 2, 3}, ids)
+
+	_, err = ReadStoryIDs(strings.NewReader("1\nitem?id=2\n"))
+	assert.ErrorContains(t, err, "Invalid story id on line 2")
+}
+
+func TestBackfill(t *testing.T) {
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := createdAt.Add(5 * time.Minute)
+
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, fmt.Sprintf(`{"id": 1, "type": "story", "time": %d}`, createdAt.Unix())),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/2.json").Return(
+		makeMockResponse(http.StatusOK, fmt.Sprintf(`{"id": 2, "type": "story", "time": %d}`, createdAt.Add(-24*time.Hour).Unix())),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/3.json").Return(
+		makeMockResponse(http.StatusOK, "null"),
+		nil,
+	)
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	dst := new(mockEnqueuer)
+	dst.On("ProcessAfter").Return(15 * time.Minute)
+	dst.On("Enqueue", mock.Anything, mock.Anything).Return(nil)
+
+	result, err := Backfill(context.Background(), client, dst, MakeBackfillLabel("15m"), []int64{1, 2, 3}, now)
+
+	assert.Nil(t, err)
+	assert.Equal(t, BackfillResult{Scheduled: 1, Late: 1, Missing: 1}, result)
+	// Stories are scheduled for when they reach the stage.
+	dst.AssertCalled(t, "Enqueue", mock.Anything, Message{StoryID: 1, CreatedAt: &createdAt, ProcessAt: createdAt.Add(15 * time.Minute)})
+	// Stories that have passed it are labelled apart.
+	dst.AssertCalled(t, "Enqueue", mock.Anything, mock.MatchedBy(func(msg Message) bool {
+		return msg.StoryID == 2 && msg.Label == "backfill-15m" && msg.ProcessAt.Equal(now)
+	}))
+	dst.AssertNumberOfCalls(t, "Enqueue", 2)
+}
+
+func TestBackfillWhenEnqueueFailsReturnsError(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, `{"id": 1, "type": "story", "time": 1175714200}`),
+		nil,
+	)
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	dst := new(mockEnqueuer)
+	dst.On("ProcessAfter").Return(time.Duration(0))
+	dst.On("Enqueue", mock.Anything, mock.Anything).Return(fmt.Errorf("Error"))
+
+	result, err := Backfill(context.Background(), client, dst, MakeBackfillLabel("new"), []int64{1, 2}, time.Now().UTC())
+
+	assert.NotNil(t, err)
+	assert.Equal(t, BackfillResult{}, result)
+	dst.AssertNumberOfCalls(t, "Enqueue", 1)
+}
+
+func TestRunSnapshotCommandRequiresSourceQueue(t *testing.T) {
+	err := RunSnapshotCommand(context.Background(), []string{"-to", "30m"}, io.Discard)
+	assert.ErrorContains(t, err, "A queue to snapshot stories from is required")
+}
+
+func TestRunQueueCommandWhenUnknownActionReturnsError(t *testing.T) {
+	buf := &strings.Builder{}
+	err := RunQueueCommand(context.Background(), []string{"drain"}, buf)
+	assert.NotNil(t, err)
+	assert.Contains(t, buf.String(), "Actions: delete, lag, list, move, pause, peek, reschedule, resume")
+}
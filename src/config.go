@@ -1,67 +1,617 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of the values of settings, each of which overrides those before it.
+const (
+	ConfigSourceDefault = "default"
+	ConfigSourceFile    = "file"
+	ConfigSourceEnv     = "env"
+	ConfigSourceFlag    = "flag"
 )
 
-func LoadEnv(key string) string {
+// ConfigFileEnv names the environment variable that gives the config file,
+// if the -config flag doesn't.
+const ConfigFileEnv = "CONFIG_FILE"
+
+const redactedValue = "REDACTED"
+
+// LoadEnvDefault reads an optional environment variable, returning the
+// fallback value if it is unset.
+func LoadEnvDefault(key string, fallback string) string {
 	value, ok := os.LookupEnv(key)
 	if !ok {
-		errorMsg := fmt.Sprintf("Unable to read environment variable `%s`", key)
-		panic(errorMsg)
+		return fallback
 	}
 	return value
 }
 
-func LoadDurationEnv(key string) time.Duration {
-	s := LoadEnv(key)
-	value, err := time.ParseDuration(s)
+// parseList parses a comma separated list, skipping empty elements.
+func parseList(s string) []string {
+	var values []string
+	for _, value := range strings.Split(s, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+type Config struct {
+	DatabaseURL                  string
+	BrokerURL                    string
+	SourceQueueName              string
+	DstQueueName                 string
+	ItemSource                   string
+	AlgoliaBaseURL               string
+	HNClientBaseURL              string
+	HNClientAPIVersion           string
+	HNClientBackoff              time.Duration
+	HNClientMaxAttempts          int
+	HNClientHTTPTimeout          time.Duration
+	HNClientRateLimit            float64
+	HNClientRateLimitBurst       int
+	HNClientRateLimitDistributed bool
+	HNClientBreakerMaxFailures   int
+	HNClientBreakerMaxErrorRate  float64
+	HNClientBreakerMinRequests   int
+	HNClientBreakerWindow        time.Duration
+	HNClientBreakerOpenDuration  time.Duration
+	ConsumerPollInterval         time.Duration
+	ConsumerTimeout              time.Duration
+	ConsumerConcurrency          int
+	ConsumerStreaming            bool
+	StreamResource               string
+	StreamMaxReconnectAttempts   int
+	StreamFallbackDuration       time.Duration
+	UpdatesMaxSnapshots          int
+	UpdatesMaxStoryAge           time.Duration
+	SchedulerEnabled             bool
+	SchedulerBaseInterval        time.Duration
+	SchedulerMinInterval         time.Duration
+	SchedulerMaxInterval         time.Duration
+	SchedulerReferenceVelocity   float64
+	SchedulerMaxStoryAge         time.Duration
+	UsersCaptureEnabled          bool
+	UsersRefreshInterval         time.Duration
+	UsersMaxPerStory             int
+	AlertsEnabled                bool
+	AlertsWebhookURLs            []string
+	AlertsWebhookSecret          string
+	AlertsVelocityRules          []VelocityRule
+	AlertsFrontPage              bool
+	AlertsFrontPageMaxRank       int
+	AlertsDedupTTL               time.Duration
+	AlertsMaxAttempts            int
+	AlertsBackoff                time.Duration
+	AlertsHTTPTimeout            time.Duration
+	Watchlists                   Watchlists
+	WatchlistStages              []time.Duration
+	WatchlistTagsTTL             time.Duration
+	WatchlistSkipUnwatched       bool
+	DatabaseMigrate              bool
+	BulkWriteEnabled             bool
+	BulkWriteBatchSize           int
+	BulkWriteFlushInterval       time.Duration
+	BulkWriteMaxPending          int
+	LeaderLeaseTTL               time.Duration
+	MetricsAddr                  string
+}
+
+// ConfigSetting is a setting of the Config. It is read from the key in config
+// files, from the environment variable named as the key in upper case, and
+// from the flag named as the key with dashes, as in `consumer_timeout`,
+// `CONSUMER_TIMEOUT` and `-consumer-timeout`.
+type ConfigSetting struct {
+	Key     string
+	Default string
+	Usage   string
+	// Required settings have no default, and must be set.
+	Required bool
+	isBool   bool
+	set      func(*Config, string) error
+	// redact hides the secrets in the setting's value, if it has any.
+	redact func(string) string
+}
+
+// Env is the environment variable that the setting is read from.
+func (s ConfigSetting) Env() string {
+	return strings.ToUpper(s.Key)
+}
+
+// Flag is the flag that the setting is read from.
+func (s ConfigSetting) Flag() string {
+	return strings.ReplaceAll(s.Key, "_", "-")
+}
+
+// Redact returns the value with its secrets hidden.
+func (s ConfigSetting) Redact(value string) string {
+	if s.redact == nil || value == "" {
+		return value
+	}
+	return s.redact(value)
+}
+
+func (s ConfigSetting) required() ConfigSetting {
+	s.Required = true
+	return s
+}
+
+// secret redacts the whole of the setting's value.
+func (s ConfigSetting) secret() ConfigSetting {
+	s.redact = func(string) string { return redactedValue }
+	return s
+}
+
+// secretURL redacts the passwords in the setting's connection string.
+func (s ConfigSetting) secretURL() ConfigSetting {
+	s.redact = redactURL
+	return s
+}
+
+// dsnPasswordPattern matches the passwords of keyword/value connection
+// strings, which may be quoted.
+var dsnPasswordPattern = regexp.MustCompile(`(?i)(\b\w*password\s*=\s*)('(?:[^'\\]|\\.)*'|\S*)`)
+
+// redactURL redacts the passwords in a connection string, given as a URL or as
+// keyword/value pairs, whether in the URL's user info or its query. Anything
+// else is redacted in full, as it can't be told what's secret.
+func redactURL(value string) string {
+	if !strings.Contains(value, "://") {
+		if !strings.Contains(value, "=") {
+			return redactedValue
+		}
+		return dsnPasswordPattern.ReplaceAllString(value, "${1}xxxxx")
+	}
+
+	u, err := url.Parse(value)
 	if err != nil {
-		errorMsg := fmt.Sprintf("Unable to parse duration environment variable `%s`: `%s`", key, s)
-		panic(errorMsg)
+		return redactedValue
 	}
-	return value
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return redactedValue
+	}
+	for key := range query {
+		if strings.Contains(strings.ToLower(key), "password") {
+			query.Set(key, "xxxxx")
+		}
+	}
+	u.RawQuery = query.Encode()
+	return u.Redacted()
+}
+
+// newSetting makes a setting that is parsed by parse into the field of the
+// Config, with the given default.
+func newSetting[T any](key, fallback, usage string, parse func(string) (T, error), field func(*Config) *T) ConfigSetting {
+	_, isBool := any(*new(T)).(bool)
+	return ConfigSetting{
+		Key:     key,
+		Default: fallback,
+		Usage:   usage,
+		isBool:  isBool,
+		set: func(config *Config, s string) error {
+			value, err := parse(s)
+			if err != nil {
+				return err
+			}
+			*field(config) = value
+			return nil
+		},
+	}
+}
+
+func parseString(s string) (string, error) {
+	return s, nil
+}
+
+func parseFloat(s string) (float64, error) {
+	return strconv.ParseFloat(s, 64)
+}
+
+func parseListSetting(s string) ([]string, error) {
+	return parseList(s), nil
+}
+
+func formatDurations(durations []time.Duration) string {
+	values := make([]string, 0, len(durations))
+	for _, d := range durations {
+		values = append(values, d.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func itoa(i int) string {
+	return strconv.Itoa(i)
+}
+
+func ftoa(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// ConfigSettings are the settings of the Config, in the order they're
+// printed.
+var ConfigSettings = []ConfigSetting{
+	newSetting("database_url", "", "URL of the Postgres database", parseString, func(c *Config) *string { return &c.DatabaseURL }).required().secretURL(),
+	newSetting("database_migrate", "false", "apply pending migrations on start", strconv.ParseBool, func(c *Config) *bool { return &c.DatabaseMigrate }),
+	newSetting("broker_url", "", "URL of the Redis broker", parseString, func(c *Config) *string { return &c.BrokerURL }).required().secretURL(),
+	newSetting("source_queue_name", "", "queue to consume stories from, if any", parseString, func(c *Config) *string { return &c.SourceQueueName }),
+	newSetting("dst_queue_name", "", "queue to produce stories to, if any", parseString, func(c *Config) *string { return &c.DstQueueName }),
+	newSetting("item_source", ItemSourceFirebase, "API to fetch items from: firebase or algolia", parseString, func(c *Config) *string { return &c.ItemSource }),
+	newSetting("algolia_base_url", DefaultAlgoliaBaseURL, "base URL of the Algolia API", parseString, func(c *Config) *string { return &c.AlgoliaBaseURL }),
+	newSetting("hn_client_base_url", "", "base URL of the Firebase API", parseString, func(c *Config) *string { return &c.HNClientBaseURL }).required(),
+	newSetting("hn_client_api_version", "", "version of the Firebase API", parseString, func(c *Config) *string { return &c.HNClientAPIVersion }).required(),
+	newSetting("hn_client_backoff", "", "backoff between attempts of requests", time.ParseDuration, func(c *Config) *time.Duration { return &c.HNClientBackoff }).required(),
+	newSetting("hn_client_max_attempts", "", "number of attempts of each request", strconv.Atoi, func(c *Config) *int { return &c.HNClientMaxAttempts }).required(),
+	newSetting("hn_client_http_timeout", "", "timeout of each request", time.ParseDuration, func(c *Config) *time.Duration { return &c.HNClientHTTPTimeout }).required(),
+	newSetting("hn_client_rate_limit", "0", "requests per second, or 0 for no limit", parseFloat, func(c *Config) *float64 { return &c.HNClientRateLimit }),
+	newSetting("hn_client_rate_limit_burst", "1", "requests allowed in a burst", strconv.Atoi, func(c *Config) *int { return &c.HNClientRateLimitBurst }),
+	newSetting("hn_client_rate_limit_distributed", "false", "share the rate limit across workers", strconv.ParseBool, func(c *Config) *bool { return &c.HNClientRateLimitDistributed }),
+	newSetting("hn_client_breaker_max_failures", itoa(DefaultBreakerMaxConsecutiveFailures), "consecutive failures that open the circuit breaker", strconv.Atoi, func(c *Config) *int { return &c.HNClientBreakerMaxFailures }),
+	newSetting("hn_client_breaker_max_error_rate", ftoa(DefaultBreakerMaxErrorRate), "error rate that opens the circuit breaker", parseFloat, func(c *Config) *float64 { return &c.HNClientBreakerMaxErrorRate }),
+	newSetting("hn_client_breaker_min_requests", itoa(DefaultBreakerMinRequests), "requests in the window before the error rate is checked", strconv.Atoi, func(c *Config) *int { return &c.HNClientBreakerMinRequests }),
+	newSetting("hn_client_breaker_window", DefaultBreakerWindow.String(), "window of the circuit breaker's error rate", time.ParseDuration, func(c *Config) *time.Duration { return &c.HNClientBreakerWindow }),
+	newSetting("hn_client_breaker_open_duration", DefaultBreakerOpenDuration.String(), "time the circuit breaker stays open", time.ParseDuration, func(c *Config) *time.Duration { return &c.HNClientBreakerOpenDuration }),
+	newSetting("consumer_poll_interval", "", "interval between polls for new stories and updates", time.ParseDuration, func(c *Config) *time.Duration { return &c.ConsumerPollInterval }).required(),
+	newSetting("consumer_timeout", "", "timeout of waits on queues, or 0s to wait indefinitely", time.ParseDuration, func(c *Config) *time.Duration { return &c.ConsumerTimeout }).required(),
+	newSetting("consumer_concurrency", "1", "number of stories processed concurrently", strconv.Atoi, func(c *Config) *int { return &c.ConsumerConcurrency }),
+	newSetting("consumer_streaming", "false", "stream new stories and updates, rather than polling", strconv.ParseBool, func(c *Config) *bool { return &c.ConsumerStreaming }),
+	newSetting("stream_resource", ResourceNameNewStories, "resource to stream new stories from", parseString, func(c *Config) *string { return &c.StreamResource }),
+	newSetting("stream_max_reconnect_attempts", itoa(DefaultStreamMaxReconnectAttempts), "reconnects before falling back to polling", strconv.Atoi, func(c *Config) *int { return &c.StreamMaxReconnectAttempts }),
+	newSetting("stream_fallback_duration", DefaultStreamFallbackDuration.String(), "time to poll for before streaming again", time.ParseDuration, func(c *Config) *time.Duration { return &c.StreamFallbackDuration }),
+	newSetting("updates_max_snapshots", itoa(DefaultUpdatesMaxSnapshots), "extra snapshots of each updated story", strconv.Atoi, func(c *Config) *int { return &c.UpdatesMaxSnapshots }),
+	newSetting("updates_max_story_age", DefaultUpdatesMaxStoryAge.String(), "age after which updates to stories are ignored", time.ParseDuration, func(c *Config) *time.Duration { return &c.UpdatesMaxStoryAge }),
+	newSetting("scheduler_enabled", "false", "schedule snapshots by the growth of stories", strconv.ParseBool, func(c *Config) *bool { return &c.SchedulerEnabled }),
+	newSetting("scheduler_base_interval", DefaultSchedulerBaseInterval.String(), "interval between snapshots at the reference velocity", time.ParseDuration, func(c *Config) *time.Duration { return &c.SchedulerBaseInterval }),
+	newSetting("scheduler_min_interval", DefaultSchedulerMinInterval.String(), "shortest interval between snapshots", time.ParseDuration, func(c *Config) *time.Duration { return &c.SchedulerMinInterval }),
+	newSetting("scheduler_max_interval", DefaultSchedulerMaxInterval.String(), "longest interval between snapshots", time.ParseDuration, func(c *Config) *time.Duration { return &c.SchedulerMaxInterval }),
+	newSetting("scheduler_reference_velocity", ftoa(DefaultSchedulerReferenceVelocity), "points plus comments per hour of the base interval", parseFloat, func(c *Config) *float64 { return &c.SchedulerReferenceVelocity }),
+	newSetting("scheduler_max_story_age", DefaultSchedulerMaxStoryAge.String(), "age after which stories aren't scheduled", time.ParseDuration, func(c *Config) *time.Duration { return &c.SchedulerMaxStoryAge }),
+	newSetting("users_capture_enabled", "false", "capture the profiles of authors and commenters", strconv.ParseBool, func(c *Config) *bool { return &c.UsersCaptureEnabled }),
+	newSetting("users_refresh_interval", DefaultUsersRefreshInterval.String(), "interval between captures of a user's profile", time.ParseDuration, func(c *Config) *time.Duration { return &c.UsersRefreshInterval }),
+	newSetting("users_max_per_story", itoa(DefaultUsersMaxPerStory), "profiles captured per story", strconv.Atoi, func(c *Config) *int { return &c.UsersMaxPerStory }),
+	newSetting("alerts_enabled", "false", "send alerts of fast growing stories", strconv.ParseBool, func(c *Config) *bool { return &c.AlertsEnabled }),
+	newSetting("alerts_webhook_urls", "", "comma separated URLs of webhooks to send alerts to", parseListSetting, func(c *Config) *[]string { return &c.AlertsWebhookURLs }).secret(),
+	newSetting("alerts_webhook_secret", "", "secret that alerts are signed with", parseString, func(c *Config) *string { return &c.AlertsWebhookSecret }).secret(),
+	newSetting("alerts_velocity_rules", "", "comma separated label:points per hour rules", ParseVelocityRules, func(c *Config) *[]VelocityRule { return &c.AlertsVelocityRules }),
+	newSetting("alerts_front_page", "false", "alert when stories reach the front page", strconv.ParseBool, func(c *Config) *bool { return &c.AlertsFrontPage }),
+	newSetting("alerts_front_page_max_rank", itoa(DefaultAlertsFrontPageMax), "lowest rank that counts as the front page", strconv.Atoi, func(c *Config) *int { return &c.AlertsFrontPageMaxRank }),
+	newSetting("alerts_dedup_ttl", DefaultAlertsDedupTTL.String(), "time during which an alert isn't repeated", time.ParseDuration, func(c *Config) *time.Duration { return &c.AlertsDedupTTL }),
+	newSetting("alerts_max_attempts", itoa(DefaultAlertsMaxAttempts), "attempts of each webhook delivery", strconv.Atoi, func(c *Config) *int { return &c.AlertsMaxAttempts }),
+	newSetting("alerts_backoff", DefaultAlertsBackoff.String(), "backoff between attempts of deliveries", time.ParseDuration, func(c *Config) *time.Duration { return &c.AlertsBackoff }),
+	newSetting("alerts_http_timeout", DefaultAlertsHTTPTimeout.String(), "timeout of each delivery", time.ParseDuration, func(c *Config) *time.Duration { return &c.AlertsHTTPTimeout }),
+	newSetting("watchlists", "", "watchlists, as JSON", ParseWatchlists, func(c *Config) *Watchlists { return &c.Watchlists }),
+	newSetting("watchlist_stages", formatDurations(DefaultWatchStages), "comma separated ages of extra snapshots of watched stories", ParseWatchStages, func(c *Config) *[]time.Duration { return &c.WatchlistStages }),
+	newSetting("watchlist_tags_ttl", DefaultWatchTagsTTL.String(), "time the tags of watched stories are kept for", time.ParseDuration, func(c *Config) *time.Duration { return &c.WatchlistTagsTTL }),
+	newSetting("watchlist_skip_unwatched_comments", "false", "skip the comments of unwatched stories", strconv.ParseBool, func(c *Config) *bool { return &c.WatchlistSkipUnwatched }),
+	newSetting("bulk_write_enabled", "false", "write snapshots in batches", strconv.ParseBool, func(c *Config) *bool { return &c.BulkWriteEnabled }),
+	newSetting("bulk_write_batch_size", itoa(DefaultBulkWriteBatchSize), "snapshots written in each batch", strconv.Atoi, func(c *Config) *int { return &c.BulkWriteBatchSize }),
+	newSetting("bulk_write_flush_interval", DefaultBulkWriteFlushInterval.String(), "longest wait before a batch is written", time.ParseDuration, func(c *Config) *time.Duration { return &c.BulkWriteFlushInterval }),
+	newSetting("bulk_write_max_pending", itoa(DefaultBulkWriteMaxPending), "snapshots pending before writes block", strconv.Atoi, func(c *Config) *int { return &c.BulkWriteMaxPending }),
+	newSetting("leader_lease_ttl", DefaultLeaseTTL.String(), "time the leadership lease is held for", time.ParseDuration, func(c *Config) *time.Duration { return &c.LeaderLeaseTTL }),
+	newSetting("metrics_addr", "", "address to serve metrics on, if any", parseString, func(c *Config) *string { return &c.MetricsAddr }),
+}
+
+// ConfigValue is the effective value of a setting, and where it was read
+// from.
+type ConfigValue struct {
+	Value  string
+	Source string
+}
+
+// ConfigValues are the effective values of settings, by key. Required
+// settings that weren't set are missing.
+type ConfigValues map[string]ConfigValue
+
+// ConfigLoader resolves the values of settings from each layer in turn: the
+// defaults, then the config file, then environment variables, then flags.
+// The config file is given by the -config flag, or the CONFIG_FILE
+// environment variable, and is YAML or TOML, by its extension.
+type ConfigLoader struct {
+	configFile *string
+	flagValues map[string]string
 }
 
-func LoadIntEnv(key string) int {
-	s := LoadEnv(key)
-	value, err := strconv.Atoi(s)
+// NewConfigLoader defines the flags of the settings, and -config, on flags.
+func NewConfigLoader(flags *flag.FlagSet) *ConfigLoader {
+	loader := &ConfigLoader{flagValues: make(map[string]string)}
+	loader.configFile = flags.String("config", "", "YAML or TOML config file (default $"+ConfigFileEnv+")")
+	for _, setting := range ConfigSettings {
+		set := func(s string) error {
+			loader.flagValues[setting.Key] = s
+			return nil
+		}
+		usage := setting.Usage
+		if setting.Required {
+			usage += " (required)"
+		} else if setting.Default != "" && !setting.isBool {
+			usage += fmt.Sprintf(" (default %s)", setting.Default)
+		}
+		if setting.isBool {
+			flags.BoolFunc(setting.Flag(), usage, set)
+		} else {
+			flags.Func(setting.Flag(), usage, set)
+		}
+	}
+	return loader
+}
+
+// Override sets the value of a setting, as if it were given by its flag.
+func (l *ConfigLoader) Override(key, value string) {
+	l.flagValues[key] = value
+}
+
+// Resolve resolves the values of settings, once the flags are parsed. Every
+// problem with the config file is returned, joined.
+func (l *ConfigLoader) Resolve(lookupEnv func(string) (string, bool)) (ConfigValues, error) {
+	values := make(ConfigValues)
+	for _, setting := range ConfigSettings {
+		if !setting.Required {
+			values[setting.Key] = ConfigValue{Value: setting.Default, Source: ConfigSourceDefault}
+		}
+	}
+
+	var errs []error
+	path := *l.configFile
+	if path == "" {
+		path, _ = lookupEnv(ConfigFileEnv)
+	}
+	if path != "" {
+		fileValues, err := ReadConfigFile(path)
+		errs = append(errs, err)
+		for key, value := range fileValues {
+			values[key] = ConfigValue{Value: value, Source: ConfigSourceFile}
+		}
+	}
+
+	for _, setting := range ConfigSettings {
+		if value, ok := lookupEnv(setting.Env()); ok {
+			values[setting.Key] = ConfigValue{Value: value, Source: ConfigSourceEnv}
+		}
+		if value, ok := l.flagValues[setting.Key]; ok {
+			values[setting.Key] = ConfigValue{Value: value, Source: ConfigSourceFlag}
+		}
+	}
+	return values, errors.Join(errs...)
+}
+
+// ResolveConfig resolves the values of settings of the worker that's run
+// without a subcommand, from its flags.
+func ResolveConfig(args []string, lookupEnv func(string) (string, bool), output io.Writer) (ConfigValues, error) {
+	flags := flag.NewFlagSet("worker", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: worker [flags]")
+		fmt.Fprintln(flags.Output(), "\nRuns the ingestion worker chosen by the source and destination queues. Settings are read from the config file, then environment variables, then flags, each overriding those before it. Environment variables are named as the flags, in upper case and with underscores.")
+		flags.PrintDefaults()
+	}
+	loader := NewConfigLoader(flags)
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("Unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+	return loader.Resolve(lookupEnv)
+}
+
+// ReadConfigFile reads the values of settings from a YAML or TOML file, by
+// its extension. Lists of values are read as comma separated values, and
+// other structured values as JSON, as they are from environment variables.
+func ReadConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		errorMsg := fmt.Sprintf("Unable to parse int environment variable `%s`: `%s`", key, s)
-		panic(errorMsg)
+		return nil, fmt.Errorf("Unable to read config file: %w", err)
 	}
-	return value
+
+	document := make(map[string]any)
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &document)
+	case ".toml":
+		err = toml.Unmarshal(data, &document)
+	default:
+		return nil, fmt.Errorf("Unsupported config file extension: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse config file %s: %w", path, err)
+	}
+
+	var errs []error
+	values := make(map[string]string)
+	for key, value := range document {
+		if !slices.ContainsFunc(ConfigSettings, func(s ConfigSetting) bool { return s.Key == key }) {
+			errs = append(errs, fmt.Errorf("Unknown setting in config file: %s", key))
+			continue
+		}
+		s, err := formatConfigFileValue(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Invalid %s in config file: %w", key, err))
+			continue
+		}
+		values[key] = s
+	}
+	return values, errors.Join(errs...)
 }
 
-type Config struct {
-	DatabaseURL          string
-	BrokerURL            string
-	SourceQueueName      string
-	DstQueueName         string
-	HNClientBaseURL      string
-	HNClientAPIVersion   string
-	HNClientBackoff      time.Duration
-	HNClientMaxAttempts  int
-	HNClientHTTPTimeout  time.Duration
-	ConsumerPollInterval time.Duration
-	ConsumerTimeout      time.Duration
-}
-
-func LoadConfig() *Config {
+// formatConfigFileValue formats a value of a config file as it would be
+// given in an environment variable.
+func formatConfigFileValue(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return ftoa(v), nil
+	case []any:
+		elements := make([]string, 0, len(v))
+		for _, element := range v {
+			kind := reflect.ValueOf(element).Kind()
+			if kind == reflect.Map || kind == reflect.Slice {
+				b, err := json.Marshal(v)
+				return string(b), err
+			}
+			s, err := formatConfigFileValue(element)
+			if err != nil {
+				return "", err
+			}
+			elements = append(elements, s)
+		}
+		return strings.Join(elements, ","), nil
+	default:
+		// Tables, and arrays of them, are read as JSON.
+		kind := reflect.ValueOf(v).Kind()
+		if kind != reflect.Map && kind != reflect.Slice {
+			return "", fmt.Errorf("Unsupported value: %v", v)
+		}
+		b, err := json.Marshal(v)
+		return string(b), err
+	}
+}
+
+// Config parses the values of settings into a Config, and validates it.
+// Every problem with the values is returned, joined, along with the Config.
+func (values ConfigValues) Config() (*Config, error) {
+	// Settings that are invalid are left at their defaults, so that they
+	// aren't reported again when the config is validated.
 	config := &Config{}
-	config.DatabaseURL = LoadEnv("DATABASE_URL")
-	config.BrokerURL = LoadEnv("BROKER_URL")
-	config.SourceQueueName = LoadEnv("SOURCE_QUEUE_NAME")
-	config.DstQueueName = LoadEnv("DST_QUEUE_NAME")
-	config.HNClientBaseURL = LoadEnv("HN_CLIENT_BASE_URL")
-	config.HNClientAPIVersion = LoadEnv("HN_CLIENT_API_VERSION")
-	config.HNClientBackoff = LoadDurationEnv("HN_CLIENT_BACKOFF")
-	config.HNClientMaxAttempts = LoadIntEnv("HN_CLIENT_MAX_ATTEMPTS")
-	config.HNClientHTTPTimeout = LoadDurationEnv("HN_CLIENT_HTTP_TIMEOUT")
-	config.ConsumerPollInterval = LoadDurationEnv("CONSUMER_POLL_INTERVAL")
-	config.ConsumerTimeout = LoadDurationEnv("CONSUMER_TIMEOUT")
-	return config
+	for _, setting := range ConfigSettings {
+		if !setting.Required {
+			setting.set(config, setting.Default)
+		}
+	}
+
+	var errs []error
+	for _, setting := range ConfigSettings {
+		value, ok := values[setting.Key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("Missing required setting %s (-%s or $%s)", setting.Key, setting.Flag(), setting.Env()))
+			continue
+		}
+		if err := setting.set(config, value.Value); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid %s from %s: %q: %w", setting.Key, value.Source, setting.Redact(value.Value), err))
+		}
+	}
+	return config, errors.Join(append(errs, config.Validate())...)
+}
+
+// Validate checks that the settings make a valid worker. Every problem is
+// returned, joined.
+func (c *Config) Validate() error {
+	var errs []error
+
+	if c.SourceQueueName != "" {
+		if _, err := MakeQueueConfig(c.SourceQueueName); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid source_queue_name: %s is neither a named queue nor a non-negative duration", c.SourceQueueName))
+		}
+	}
+	if c.DstQueueName != "" {
+		if _, err := MakeQueueConfig(c.DstQueueName); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid dst_queue_name: %s is neither a named queue nor a non-negative duration", c.DstQueueName))
+		}
+	}
+	if c.SourceQueueName == "" && c.DstQueueName != NewQueueName && c.DstQueueName != UpdatesQueueName {
+		errs = append(errs, fmt.Errorf("Invalid queue configuration: source=%s dst=%s: a source queue is required unless the destination is %s or %s", c.SourceQueueName, c.DstQueueName, NewQueueName, UpdatesQueueName))
+	}
+
+	if c.ItemSource != ItemSourceFirebase && c.ItemSource != ItemSourceAlgolia {
+		errs = append(errs, fmt.Errorf("Invalid item_source: %s", c.ItemSource))
+	}
+	if c.HNClientRateLimit < 0 || c.HNClientRateLimitBurst < 1 {
+		errs = append(errs, errors.New("Invalid hn_client_rate_limit: the limit can't be negative, and the burst must be at least 1"))
+	}
+	if c.AlertsEnabled && (len(c.AlertsWebhookURLs) == 0 || c.AlertsWebhookSecret == "") {
+		errs = append(errs, errors.New("Invalid alerts: alerts_webhook_urls and alerts_webhook_secret are required when alerts are enabled"))
+	}
+	counts := []struct {
+		key   string
+		value int
+	}{
+		{"hn_client_max_attempts", c.HNClientMaxAttempts},
+		{"updates_max_snapshots", c.UpdatesMaxSnapshots},
+		{"users_max_per_story", c.UsersMaxPerStory},
+		{"alerts_front_page_max_rank", c.AlertsFrontPageMaxRank},
+		{"alerts_max_attempts", c.AlertsMaxAttempts},
+	}
+	for _, count := range counts {
+		if count.value < 1 {
+			errs = append(errs, fmt.Errorf("Invalid %s: %d, at least 1 is required", count.key, count.value))
+		}
+	}
+	durations := []struct {
+		key   string
+		value time.Duration
+	}{
+		{"consumer_poll_interval", c.ConsumerPollInterval},
+		{"leader_lease_ttl", c.LeaderLeaseTTL},
+		{"watchlist_tags_ttl", c.WatchlistTagsTTL},
+	}
+	for _, duration := range durations {
+		if duration.value <= 0 {
+			errs = append(errs, fmt.Errorf("Invalid %s: %s, a positive duration is required", duration.key, duration.value))
+		}
+	}
+	if c.ConsumerConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("Invalid consumer_concurrency: %d, at least 1 is required", c.ConsumerConcurrency))
+	}
+	if c.SchedulerEnabled && (c.SchedulerMinInterval <= 0 || c.SchedulerMinInterval > c.SchedulerBaseInterval || c.SchedulerBaseInterval > c.SchedulerMaxInterval) {
+		errs = append(errs, errors.New("Invalid scheduler intervals: 0 < min <= base <= max is required"))
+	}
+	if c.BulkWriteEnabled && (c.BulkWriteBatchSize <= 0 || c.BulkWriteFlushInterval <= 0 || c.BulkWriteMaxPending < c.BulkWriteBatchSize) {
+		errs = append(errs, errors.New("Invalid bulk writes: a positive batch size and flush interval, and at least a batch's worth of pending writes, are required"))
+	}
+	return errors.Join(errs...)
+}
+
+// LoadConfig loads the worker's Config from its defaults, config file,
+// environment variables and flags, in that order.
+func LoadConfig(args []string, output io.Writer) (*Config, error) {
+	values, err := ResolveConfig(args, os.LookupEnv, output)
+	if values == nil {
+		return nil, err
+	}
+	config, configErr := values.Config()
+	if err = errors.Join(err, configErr); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// PrintConfig prints the effective values of settings as YAML, which can be
+// used as a config file, with secrets redacted and their sources as
+// comments.
+func PrintConfig(w io.Writer, values ConfigValues) {
+	for _, setting := range ConfigSettings {
+		value, ok := values[setting.Key]
+		if !ok {
+			fmt.Fprintf(w, "# %s: required, but missing\n", setting.Key)
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s  # %s\n", setting.Key, strconv.Quote(setting.Redact(value.Value)), value.Source)
+	}
 }
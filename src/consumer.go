@@ -4,6 +4,8 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
+	"sync"
 	"time"
 )
 
@@ -11,6 +13,17 @@ var (
 	ErrTimeoutExceeded = errors.New("Timeout exceeded")
 	ErrMessageExpired  = errors.New("Message expired")
 	ErrFetching        = errors.New("Unable to fetch")
+	// ErrStoryRemoved indicates that a story was snapshotted, but has since
+	// been removed, so shouldn't be snapshotted again.
+	ErrStoryRemoved = errors.New("Story removed")
+	// ErrStoryRequeued indicates that a story was found missing, and was put
+	// back on its queue to be tried again, as it may only be transiently so.
+	ErrStoryRequeued = errors.New("Story requeued")
+)
+
+const (
+	DefaultMissingBackoff     = time.Minute
+	DefaultMaxMissingAttempts = 3
 )
 
 // Repoer provides a method to store Hacker News stories and comments.
@@ -18,6 +31,35 @@ type Repoer interface {
 	WriteStory(context.Context, StoryModel) error
 }
 
+// StoryObserver is notified of each snapshot of a story that is written.
+type StoryObserver interface {
+	ObserveStory(context.Context, StoryItems, StoryModel) error
+}
+
+// StoryObservers notifies each of its observers of a snapshot, in order,
+// notifying the rest even if one fails.
+type StoryObservers []StoryObserver
+
+func (o StoryObservers) ObserveStory(ctx context.Context, items StoryItems, model StoryModel) error {
+	var errs []error
+	for _, observer := range o {
+		errs = append(errs, observer.ObserveStory(ctx, items, model))
+	}
+	return errors.Join(errs...)
+}
+
+// Flush waits until each of the observers that delivers in the background
+// has delivered what is pending.
+func (o StoryObservers) Flush(ctx context.Context) error {
+	var errs []error
+	for _, observer := range o {
+		if flusher, ok := observer.(Flusher); ok {
+			errs = append(errs, flusher.Flush(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
 // WindowWaiter provides a method to wait until a processing window has begun.
 type WindowWaiter interface {
 	WaitUntil(time.Time, time.Time) bool
@@ -35,17 +77,57 @@ func WaitUntil(now time.Time, windowStart time.Time, windowEnd time.Time) bool {
 	return false
 }
 
+// MessageConsumer consumes messages from a queue, snapshotting the story of
+// each. If an Observer is set, it is notified of each snapshot once written.
+// Errors from the Observer are logged, rather than failing the snapshot.
+//
+// If Tags is set, snapshots are stored with the story's watchlist tags, and
+// if SkipUnwatchedComments is also set, the comments of stories that didn't
+// match any watchlist aren't captured. If a Watcher is set, stories that
+// haven't been checked against the watchlists are checked with it, using
+// the snapshot's items, before the snapshot is stored.
+//
+// The API transiently returns `null` for items that exist, so a story that is
+// found missing is put back on the queue, after MissingBackoff times the
+// number of attempts so far, and is only recorded as missing once it has been
+// found so MaxMissingAttempts times.
 type MessageConsumer struct {
-	client *HNClient
-	src    *PriorityQueue
-	repo   Repoer
+	client                ItemSource
+	src                   *PriorityQueue
+	repo                  Repoer
+	Observer              StoryObserver
+	Tags                  WatchTagsLoader
+	Watcher               Watcher
+	SkipUnwatchedComments bool
+	MissingBackoff        time.Duration
+	MaxMissingAttempts    int
 }
 
-func NewMessageConsumer(client *HNClient, src *PriorityQueue, repo Repoer) *MessageConsumer {
-	return &MessageConsumer{client: client, src: src, repo: repo}
+func NewMessageConsumer(client ItemSource, src *PriorityQueue, repo Repoer) *MessageConsumer {
+	return &MessageConsumer{
+		client:             client,
+		src:                src,
+		repo:               repo,
+		MissingBackoff:     DefaultMissingBackoff,
+		MaxMissingAttempts: DefaultMaxMissingAttempts,
+	}
 }
 
 func (c *MessageConsumer) Fetch(ctx context.Context) (storyID int64, createdAt *time.Time, err error) {
+	// Don't take messages off of the queue while the API is unavailable, as
+	// they would only expire.
+	err = c.client.WaitAvailable(ctx)
+	if err != nil {
+		return
+	}
+	// Nor while the repo is backed up, as they would only wait on it.
+	if waiter, ok := c.repo.(CapacityWaiter); ok {
+		err = waiter.WaitCapacity(ctx)
+		if err != nil {
+			return
+		}
+	}
+
 	msg, err := c.src.Dequeue(ctx)
 	if err != nil {
 		return
@@ -62,43 +144,123 @@ func (c *MessageConsumer) Fetch(ctx context.Context) (storyID int64, createdAt *
 		return
 	}
 
-	story := HNStory{}
-	err = c.client.FetchItem(msg.StoryID, &story)
-	if err != nil {
-		err = fmt.Errorf("%w story: %w", ErrFetching, err)
-		return
-	}
+	defer func() {
+		// The API became unavailable part way through, put the message back
+		// so that it can be processed once it is available again. It's due
+		// then, rather than when it was due originally, so that it doesn't
+		// expire during a long outage. If the worker stops first, it's due
+		// when it stopped, and is put back regardless.
+		if errors.Is(err, ErrCircuitOpen) {
+			_ = c.client.WaitAvailable(ctx)
+			msg.ProcessAt = time.Now().UTC()
+			if requeueErr := c.src.Enqueue(context.WithoutCancel(ctx), msg); requeueErr != nil {
+				err = fmt.Errorf("%w: unable to requeue: %w", err, requeueErr)
+			}
+		}
+	}()
 
-	storyCreatedAt := time.Unix(story.Time, 0).UTC()
-	createdAt = &storyCreatedAt
+	label := c.src.QueueName()
+	if msg.Label != "" {
+		label = msg.Label
+	}
 
-	comments := make([]HNComment, len(story.Kids))
-	for _, commentID := range story.Kids {
-		comment := HNComment{}
-		err = c.client.FetchItem(commentID, &comment)
+	var tags []string
+	var checked bool
+	withComments := true
+	if c.Tags != nil {
+		tags, checked, err = c.Tags.Load(ctx, msg.StoryID)
 		if err != nil {
-			err = fmt.Errorf("%w comment: %w", ErrFetching, err)
 			return
 		}
+		// Stories that weren't checked against the watchlists, e.g. those
+		// first seen before they were configured, are captured in full.
+		withComments = !c.SkipUnwatchedComments || !checked || len(tags) > 0
+	}
 
-		comments = append(comments, comment)
+	items, err := FetchStoryItems(c.client, msg.StoryID, withComments)
+	if errors.Is(err, ErrItemMissing) && msg.MissingAttempts+1 < c.MaxMissingAttempts {
+		msg.MissingAttempts++
+		msg.ProcessAt = time.Now().UTC().Add(time.Duration(msg.MissingAttempts) * c.MissingBackoff)
+		err = c.src.Enqueue(ctx, msg)
+		if err == nil {
+			err = fmt.Errorf("%w: missing %d times", ErrStoryRequeued, msg.MissingAttempts)
+		}
+		return
+	}
+	if errors.Is(err, ErrItemMissing) {
+		// Record that the story is gone, rather than retrying it forever.
+		model := MakeMissingStoryModel(msg.StoryID, c.client.Version(), label, time.Now().UTC())
+		model.Tags = tags
+		err = c.repo.WriteStory(ctx, model)
+		if err == nil {
+			err = fmt.Errorf("%w: %s", ErrStoryRemoved, model.Status)
+		}
+		return
+	}
+	if err != nil {
+		return
 	}
 
+	storyCreatedAt := time.Unix(items.Story.Time, 0).UTC()
+	createdAt = &storyCreatedAt
+
 	model, err := MakeStoryModel(
-		story,
-		comments,
-		c.client.APIVersion,
-		c.src.QueueName(),
+		items.Story,
+		items.Comments,
+		c.client.Version(),
+		label,
 		time.Now().UTC(),
 	)
 	if err != nil {
 		return
 	}
 
+	model.PollOptions, err = MakePollOptionModels(items.PollOptions)
+	if err != nil {
+		return
+	}
+	if c.Watcher != nil && !checked {
+		// Errors are logged, rather than holding up the snapshot.
+		watched, watchErr := c.Watcher.Watch(ctx, items)
+		if watchErr != nil {
+			slog.Error("Error watching story", "story_id", storyID, "error", watchErr)
+		}
+		tags = watched
+	}
+	model.Tags = tags
+
 	err = c.repo.WriteStory(ctx, model)
+	if err != nil {
+		return
+	}
+
+	if c.Observer != nil {
+		if observeErr := c.Observer.ObserveStory(ctx, items, model); observeErr != nil {
+			slog.Error("Error observing story", "story_id", storyID, "error", observeErr)
+		}
+	}
+
+	if model.Status != StoryStatusOK {
+		err = fmt.Errorf("%w: %s", ErrStoryRemoved, model.Status)
+	}
 	return
 }
 
+// Flush waits until the snapshots pending in the repo have been written, if
+// it writes them in bulk, and then until the Observer has delivered what is
+// pending, if it delivers in the background.
+func (c *MessageConsumer) Flush(ctx context.Context) error {
+	if flusher, ok := c.repo.(Flusher); ok {
+		if err := flusher.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	if flusher, ok := c.Observer.(Flusher); ok {
+		return flusher.Flush(ctx)
+	}
+	return nil
+}
+
 func HasDeadline(timeout time.Duration) bool {
 	return timeout > 0
 }
@@ -113,22 +275,40 @@ func FilterNewStories(newStoryIDs []int64, maxSeenStoryID int64) []int64 {
 	return newStoryIDs
 }
 
-// LatestStoryConsumer consumes new story ids from the Hacker News API and
+// LatestStoryConsumer consumes new story ids from the item source and
 // provides a method to retrieve them, in order.
 //
 // A Timeout value of 0 indicates that the consumer should not timeout.
+//
+// If a HighWaterMark is set, consumption resumes from it after a restart or
+// Reset. The mark is raised by a MarkingProducer once each story is enqueued,
+// rather than when it's consumed, so that a story that is never enqueued is
+// consumed again.
+//
+// Fetch is safe for concurrent use, though calls are serialized.
 type LatestStoryConsumer struct {
-	client       *HNClient
-	buffer       []int64
-	PollInterval time.Duration
-	Timeout      time.Duration
+	client         ItemSource
+	mu             sync.Mutex
+	buffer         []int64
+	maxSeenStoryID int64
+	markLoaded     bool
+	PollInterval   time.Duration
+	Timeout        time.Duration
+	HighWaterMark  HighWaterMarker
+}
+
+// HighWaterMarker provides methods to persist the largest story id that has
+// been consumed.
+type HighWaterMarker interface {
+	Load(context.Context) (int64, error)
+	Save(context.Context, int64) error
 }
 
-func NewLatestStoryConsumer(client *HNClient, pollInterval, timeout time.Duration) *LatestStoryConsumer {
+func NewLatestStoryConsumer(client ItemSource, pollInterval, timeout time.Duration) *LatestStoryConsumer {
 	return &LatestStoryConsumer{client: client, PollInterval: pollInterval, Timeout: timeout}
 }
 
-// PollForNewStories fetches new story ids from the Hacker News API, polling
+// PollForNewStories fetches new story ids from the item source, polling
 // until new stories are found or the configured timeout is reached, as
 // necessary.
 func (c *LatestStoryConsumer) PollForNewStories() (ids []int64, err error) {
@@ -148,6 +328,8 @@ func (c *LatestStoryConsumer) PollForNewStories() (ids []int64, err error) {
 		// newest, etc. `c.buffer` follows this ordering, as well.
 		if len(c.buffer) > 0 {
 			ids = FilterNewStories(ids, c.buffer[0])
+		} else if c.maxSeenStoryID > 0 {
+			ids = FilterNewStories(ids, c.maxSeenStoryID)
 		}
 
 		if len(ids) > 0 {
@@ -166,10 +348,26 @@ func (c *LatestStoryConsumer) PollForNewStories() (ids []int64, err error) {
 }
 
 // Fetch returns the id of the next new story, fetching new story ids from the
-// Hacker News API as necessary. If no new story ids are available, it will
+// item source as necessary. If no new story ids are available, it will
 // block until new story ids become available or the configured deadline is
 // reached.
-func (c *LatestStoryConsumer) Fetch(_ context.Context) (storyID int64, _ *time.Time, err error) {
+func (c *LatestStoryConsumer) Fetch(ctx context.Context) (storyID int64, _ *time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err = c.client.WaitAvailable(ctx)
+	if err != nil {
+		return
+	}
+
+	if c.HighWaterMark != nil && !c.markLoaded {
+		c.maxSeenStoryID, err = c.HighWaterMark.Load(ctx)
+		if err != nil {
+			return
+		}
+		c.markLoaded = true
+	}
+
 	// Fill up the buffer of new story ids, using the last remaining buffered
 	// story id to filter out the API's returned new stories, if available.
 	if len(c.buffer) <= 1 {
@@ -184,5 +382,17 @@ func (c *LatestStoryConsumer) Fetch(_ context.Context) (storyID int64, _ *time.T
 
 	n := len(c.buffer)
 	c.buffer, storyID = c.buffer[:n-1], c.buffer[n-1]
+	c.maxSeenStoryID = storyID
 	return
 }
+
+// Reset discards buffered story ids, so that consumption resumes from the
+// persisted high-water mark, if any.
+func (c *LatestStoryConsumer) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buffer = nil
+	c.maxSeenStoryID = 0
+	c.markLoaded = false
+}
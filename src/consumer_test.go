@@ -21,6 +21,19 @@ func (m *mockRepo) WriteStory(ctx context.Context, model StoryModel) error {
 	return args.Error(0)
 }
 
+// newMockBrokerWithItem makes a mock broker from which the given item can be
+// claimed.
+func newMockBrokerWithItem(item redis.Z) *mockBroker {
+	broker := newMockBroker()
+	broker.On("ZRangeByScoreWithScores", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewZSliceCmdResult([]redis.Z{item}, nil),
+	)
+	broker.On("ZRem", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewIntResult(1, nil),
+	)
+	return broker
+}
+
 func TestWaitUntil(t *testing.T) {
 	now := time.Date(2020, 1, 1, 13, 0, 0, 0, time.UTC)
 
@@ -69,17 +82,12 @@ func TestMessageConsumerFetch(t *testing.T) {
 
 	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
 
-	item := redis.ZWithKey{
-		Z: redis.Z{
-			Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
-			Score:  float64(time.Now().UTC().Unix()), // Process immediately.
-		},
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
 	}
 
-	broker := new(mockBroker)
-	broker.On("BZPopMin", mock.Anything, mock.Anything, mock.Anything).Return(
-		redis.NewZWithKeyCmdResult(&item, nil),
-	)
+	broker := newMockBrokerWithItem(item)
 
 	repo := new(mockRepo)
 	repo.On("WriteStory", mock.Anything, mock.Anything).Return(nil)
@@ -104,9 +112,9 @@ func TestMessageConsumerFetchWhenDequeueErrorReturnsError(t *testing.T) {
 
 	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
 
-	broker := new(mockBroker)
-	broker.On("BZPopMin", mock.Anything, mock.Anything, mock.Anything).Return(
-		redis.NewZWithKeyCmdResult(&redis.ZWithKey{}, fmt.Errorf("Error")),
+	broker := newMockBroker()
+	broker.On("ZRangeByScoreWithScores", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewZSliceCmdResult(nil, fmt.Errorf("Error")),
 	)
 
 	repo := new(mockRepo)
@@ -132,17 +140,12 @@ func TestMessageConsumerFetchWhenProcessingWindowPassedEarlyReturn(t *testing.T)
 
 	expectedStoryID := int64(1)
 
-	item := redis.ZWithKey{
-		Z: redis.Z{
-			Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
-			Score:  float64(time.Now().UTC().Add(-12 * time.Hour).Unix()),
-		},
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(time.Now().UTC().Add(-12 * time.Hour).Unix()),
 	}
 
-	broker := new(mockBroker)
-	broker.On("BZPopMin", mock.Anything, mock.Anything, mock.Anything).Return(
-		redis.NewZWithKeyCmdResult(&item, nil),
-	)
+	broker := newMockBrokerWithItem(item)
 
 	repo := new(mockRepo)
 	repo.On("Save", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(nil)
@@ -311,3 +314,314 @@ func TestLatestStoryConsumerFetch(t *testing.T) {
 		httpClient.AssertNumberOfCalls(t, "Get", testCase.expectedGetCalls)
 	}
 }
+
+func TestLatestStoryConsumerFetchResumesFromHighWaterMark(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, "[10, 9, 8]"),
+		nil,
+	)
+
+	mark := new(mockHighWaterMark)
+	mark.On("Load", mock.Anything).Return(int64(8), nil)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+	consumer := NewLatestStoryConsumer(client, 0*time.Second, time.Nanosecond)
+	consumer.HighWaterMark = mark
+
+	actualStoryID, _, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	// Stories up to the high-water mark are skipped.
+	assert.Equal(t, int64(9), actualStoryID)
+	assert.Equal(t, []int64{10}, consumer.buffer)
+	// The mark is only raised once the story is enqueued.
+	mark.AssertNotCalled(t, "Save", mock.Anything, mock.Anything)
+}
+
+func TestLatestStoryConsumerReset(t *testing.T) {
+	mark := new(mockHighWaterMark)
+	mark.On("Load", mock.Anything).Return(int64(8), nil)
+
+	consumer := NewLatestStoryConsumer(nil, 0*time.Second, time.Nanosecond)
+	consumer.HighWaterMark = mark
+	consumer.buffer = []int64{10, 9}
+	consumer.maxSeenStoryID = 8
+	consumer.markLoaded = true
+
+	consumer.Reset()
+
+	assert.Empty(t, consumer.buffer)
+	assert.Equal(t, int64(0), consumer.maxSeenStoryID)
+	assert.False(t, consumer.markLoaded)
+}
+
+func TestMessageConsumerFetchWhenCircuitOpensRequeuesMessage(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusServiceUnavailable, ""),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 2)
+	client.Breaker = NewCircuitBreaker(1, 1, 100, time.Minute, time.Second)
+
+	// Due long enough ago that it would expire, were it put back as it was,
+	// before the breaker closes.
+	processAt := time.Now().UTC().Add(-time.Hour).Unix()
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(processAt),
+	}
+
+	broker := newMockBrokerWithItem(item)
+	broker.On("ZAddNX", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewIntResult(1, nil),
+	)
+
+	repo := new(mockRepo)
+
+	queueConfig := QueueConfig{Name: "pq", GracePeriod: time.Hour + time.Minute}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	consumer := NewMessageConsumer(client, src, repo)
+	_, _, err := consumer.Fetch(context.Background())
+	closedAt := time.Now().UTC()
+
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	broker.AssertCalled(t, "ZAddNX", mock.Anything, "ingestion-queue:pq", mock.MatchedBy(func(items []redis.Z) bool {
+		return len(items) == 1 &&
+			items[0].Member == item.Member &&
+			items[0].Score >= float64(closedAt.Add(-time.Second).Unix()) &&
+			items[0].Score <= float64(closedAt.Unix())
+	}))
+	repo.AssertNotCalled(t, "WriteStory", mock.Anything, mock.Anything)
+}
+
+func TestMessageConsumerFetchWhenCircuitOpensAndStoppingRequeuesMessage(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusServiceUnavailable, ""),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 2)
+	client.Breaker = NewCircuitBreaker(1, 1, 100, time.Minute, time.Hour)
+
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(time.Now().UTC().Unix()),
+	}
+
+	broker := newMockBrokerWithItem(item)
+	broker.On("ZAddNX", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewIntResult(1, nil),
+	)
+
+	queueConfig := QueueConfig{Name: "pq", GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	// The worker stops while waiting for the breaker to close.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	consumer := NewMessageConsumer(client, src, new(mockRepo))
+	_, _, err := consumer.Fetch(ctx)
+
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	broker.AssertNumberOfCalls(t, "ZAddNX", 1)
+}
+
+func TestMessageConsumerFetchLabelsSnapshotWithMessageLabel(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"time":1175714200,"type":"story"}`),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z","label":"update-2"}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
+	}
+
+	broker := newMockBrokerWithItem(item)
+
+	repo := new(mockRepo)
+	repo.On("WriteStory", mock.Anything, mock.Anything).Return(nil)
+
+	queueConfig := QueueConfig{Name: UpdatesQueueName, GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	consumer := NewMessageConsumer(client, src, repo)
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	repo.AssertCalled(t, "WriteStory", mock.Anything, mock.MatchedBy(func(model StoryModel) bool {
+		return model.QueueName == "update-2"
+	}))
+}
+
+type mockStoryObserver struct {
+	mock.Mock
+}
+
+func (m *mockStoryObserver) ObserveStory(ctx context.Context, items StoryItems, model StoryModel) error {
+	args := m.Called(ctx, items, model)
+	return args.Error(0)
+}
+
+func TestMessageConsumerFetchNotifiesObserver(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, `{"by":"pg","id":1,"time":1175714200,"type":"story"}`),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
+	}
+
+	broker := newMockBrokerWithItem(item)
+
+	repo := new(mockRepo)
+	repo.On("WriteStory", mock.Anything, mock.Anything).Return(nil)
+
+	// Errors observing don't fail the snapshot.
+	observer := new(mockStoryObserver)
+	observer.On("ObserveStory", mock.Anything, mock.Anything, mock.Anything).Return(fmt.Errorf("Error"))
+
+	queueConfig := QueueConfig{Name: "pq", GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	consumer := NewMessageConsumer(client, src, repo)
+	consumer.Observer = observer
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	observer.AssertCalled(t, "ObserveStory", mock.Anything, mock.MatchedBy(func(items StoryItems) bool {
+		return items.Story.By == "pg"
+	}), mock.Anything)
+}
+
+func TestMessageConsumerFetchWhenStoryRemovedReturnsErrStoryRemoved(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, `{"dead":true,"id":1,"time":1175714200,"type":"story"}`),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
+	}
+
+	broker := newMockBrokerWithItem(item)
+
+	repo := new(mockRepo)
+	repo.On("WriteStory", mock.Anything, mock.Anything).Return(nil)
+
+	queueConfig := QueueConfig{Name: "pq", GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	consumer := NewMessageConsumer(client, src, repo)
+	storyID, _, err := consumer.Fetch(context.Background())
+
+	assert.ErrorIs(t, err, ErrStoryRemoved)
+	assert.Equal(t, int64(1), storyID)
+	repo.AssertCalled(t, "WriteStory", mock.Anything, mock.MatchedBy(func(model StoryModel) bool {
+		return model.Status == StoryStatusDead
+	}))
+}
+
+func TestMessageConsumerFetchWhenStoryMissingRequeuesMessage(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, "null"),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
+	}
+
+	broker := newMockBrokerWithItem(item)
+	broker.On("ZAddNX", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewIntResult(1, nil),
+	)
+
+	repo := new(mockRepo)
+
+	queueConfig := QueueConfig{Name: "pq", GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	consumer := NewMessageConsumer(client, src, repo)
+	consumer.MissingBackoff = time.Hour
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.ErrorIs(t, err, ErrStoryRequeued)
+	broker.AssertCalled(t, "ZAddNX", mock.Anything, "ingestion-queue:pq", mock.MatchedBy(func(members []redis.Z) bool {
+		// Retried after the backoff, rather than immediately.
+		return len(members) == 1 &&
+			members[0].Member == `{"story_id":1,"created_at":"2020-01-01T00:00:00Z","missing_attempts":1}` &&
+			members[0].Score >= float64(time.Now().UTC().Add(59*time.Minute).Unix())
+	}))
+	repo.AssertNotCalled(t, "WriteStory", mock.Anything, mock.Anything)
+}
+
+func TestMessageConsumerFetchWhenStoryMissingRecordsMissing(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, "null"),
+		nil,
+	)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	// Found missing on each of the attempts before.
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z","missing_attempts":2}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
+	}
+
+	broker := newMockBrokerWithItem(item)
+
+	repo := new(mockRepo)
+	repo.On("WriteStory", mock.Anything, mock.Anything).Return(nil)
+
+	queueConfig := QueueConfig{Name: "pq", GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	consumer := NewMessageConsumer(client, src, repo)
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.ErrorIs(t, err, ErrStoryRemoved)
+	repo.AssertCalled(t, "WriteStory", mock.Anything, mock.MatchedBy(func(model StoryModel) bool {
+		return model.StoryID == 1 &&
+			model.QueueName == "pq" &&
+			model.Status == StoryStatusMissing &&
+			model.RawDocument == "null"
+	}))
+}
+
+func TestStoryObserversNotifiesEachObserver(t *testing.T) {
+	failing := new(mockStoryObserver)
+	failing.On("ObserveStory", mock.Anything, mock.Anything, mock.Anything).Return(fmt.Errorf("Error"))
+	observer := new(mockStoryObserver)
+	observer.On("ObserveStory", mock.Anything, mock.Anything, mock.Anything).Return(nil)
+
+	observers := StoryObservers{failing, observer}
+	err := observers.ObserveStory(context.Background(), StoryItems{}, StoryModel{StoryID: 1})
+
+	assert.NotNil(t, err)
+	observer.AssertCalled(t, "ObserveStory", mock.Anything, mock.Anything, mock.Anything)
+}
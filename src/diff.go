@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+const (
+	CommentAdded   = "added"
+	CommentRemoved = "removed"
+	CommentEdited  = "edited"
+	CommentDeleted = "deleted"
+	CommentKilled  = "dead"
+)
+
+// FieldChange is a change to a field's value.
+type FieldChange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// CommentDiff is a change to a top-level comment between snapshots.
+type CommentDiff struct {
+	CommentID int64  `json:"comment_id"`
+	Change    string `json:"change"`
+	FromText  string `json:"from_text,omitempty"`
+	ToText    string `json:"to_text,omitempty"`
+}
+
+// StoryDiff is what changed between two snapshots of a story, identified by
+// their labels.
+type StoryDiff struct {
+	StoryID          int64         `json:"story_id"`
+	From             string        `json:"from"`
+	To               string        `json:"to"`
+	ScoreDelta       int32         `json:"score_delta"`
+	DescendantsDelta int32         `json:"descendants_delta"`
+	Title            *FieldChange  `json:"title,omitempty"`
+	URL              *FieldChange  `json:"url,omitempty"`
+	Status           *FieldChange  `json:"status,omitempty"`
+	AddedKids        []int64       `json:"added_kids,omitempty"`
+	RemovedKids      []int64       `json:"removed_kids,omitempty"`
+	Comments         []CommentDiff `json:"comments,omitempty"`
+}
+
+func diffField(from, to string) *FieldChange {
+	if from == to {
+		return nil
+	}
+	return &FieldChange{From: from, To: to}
+}
+
+// difference returns the ids in a that aren't in b, in the order of a.
+func difference(a, b []int64) []int64 {
+	var ids []int64
+	for _, id := range a {
+		if !slices.Contains(b, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func parseComments(models []CommentModel) ([]HNComment, error) {
+	comments := make([]HNComment, 0, len(models))
+	for _, model := range models {
+		comment := HNComment{}
+		err := json.Unmarshal([]byte(model.RawDocument), &comment)
+		if err != nil {
+			return nil, err
+		}
+		comments = append(comments, comment)
+	}
+	return comments, nil
+}
+
+// DiffComments compares top-level comments between snapshots, in the order
+// they appear in the later snapshot, followed by those that were removed.
+func DiffComments(from, to []HNComment) []CommentDiff {
+	var diffs []CommentDiff
+
+	previous := make(map[int64]HNComment, len(from))
+	for _, comment := range from {
+		previous[comment.ID] = comment
+	}
+
+	seen := make(map[int64]bool, len(to))
+	for _, comment := range to {
+		seen[comment.ID] = true
+
+		old, ok := previous[comment.ID]
+		switch {
+		case !ok:
+			diffs = append(diffs, CommentDiff{CommentID: comment.ID, Change: CommentAdded, ToText: comment.Text})
+		case comment.Deleted && !old.Deleted:
+			diffs = append(diffs, CommentDiff{CommentID: comment.ID, Change: CommentDeleted, FromText: old.Text})
+		case comment.Dead && !old.Dead:
+			diffs = append(diffs, CommentDiff{CommentID: comment.ID, Change: CommentKilled, FromText: old.Text, ToText: comment.Text})
+		case comment.Text != old.Text:
+			diffs = append(diffs, CommentDiff{CommentID: comment.ID, Change: CommentEdited, FromText: old.Text, ToText: comment.Text})
+		}
+	}
+
+	for _, comment := range from {
+		if !seen[comment.ID] {
+			diffs = append(diffs, CommentDiff{CommentID: comment.ID, Change: CommentRemoved, FromText: comment.Text})
+		}
+	}
+
+	return diffs
+}
+
+// DiffStories compares two snapshots of a story, the earlier one first.
+func DiffStories(from, to StoryModel) (StoryDiff, error) {
+	diff := StoryDiff{StoryID: to.StoryID, From: from.QueueName, To: to.QueueName}
+
+	if from.StoryID != to.StoryID {
+		return diff, fmt.Errorf("Snapshots are of different stories: %d, %d", from.StoryID, to.StoryID)
+	}
+
+	fromStory, err := ParseStory(from)
+	if err != nil {
+		return diff, err
+	}
+	toStory, err := ParseStory(to)
+	if err != nil {
+		return diff, err
+	}
+
+	fromComments, err := parseComments(from.Comments)
+	if err != nil {
+		return diff, err
+	}
+	toComments, err := parseComments(to.Comments)
+	if err != nil {
+		return diff, err
+	}
+
+	diff.ScoreDelta = toStory.Score - fromStory.Score
+	diff.DescendantsDelta = toStory.Descendants - fromStory.Descendants
+	diff.Title = diffField(fromStory.Title, toStory.Title)
+	diff.URL = diffField(fromStory.URL, toStory.URL)
+	diff.Status = diffField(from.Status, to.Status)
+	diff.AddedKids = difference(toStory.Kids, fromStory.Kids)
+	diff.RemovedKids = difference(fromStory.Kids, toStory.Kids)
+	diff.Comments = DiffComments(fromComments, toComments)
+	return diff, nil
+}
+
+// WriteText writes the diff in a human readable form.
+func (d StoryDiff) WriteText(w io.Writer) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "story %d: %s -> %s\n", d.StoryID, d.From, d.To)
+	fmt.Fprintf(&b, "  score: %+d\n", d.ScoreDelta)
+	fmt.Fprintf(&b, "  descendants: %+d\n", d.DescendantsDelta)
+
+	for _, field := range []struct {
+		name   string
+		change *FieldChange
+	}{
+		{name: "title", change: d.Title},
+		{name: "url", change: d.URL},
+		{name: "status", change: d.Status},
+	} {
+		if field.change != nil {
+			fmt.Fprintf(&b, "  %s: %q -> %q\n", field.name, field.change.From, field.change.To)
+		}
+	}
+
+	if len(d.AddedKids) > 0 {
+		fmt.Fprintf(&b, "  added kids: %v\n", d.AddedKids)
+	}
+	if len(d.RemovedKids) > 0 {
+		fmt.Fprintf(&b, "  removed kids: %v\n", d.RemovedKids)
+	}
+	for _, comment := range d.Comments {
+		fmt.Fprintf(&b, "  comment %d: %s\n", comment.CommentID, comment.Change)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
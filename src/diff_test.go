@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffComments(t *testing.T) {
+	from := []HNComment{
+		{ID: 1, Text: "Unchanged"},
+		{ID: 2, Text: "Before"},
+		{ID: 3, Text: "Regret"},
+		{ID: 4, Text: "Gone"},
+		{ID: 5, Text: "Flagged"},
+	}
+	to := []HNComment{
+		{ID: 6, Text: "New"},
+		{ID: 1, Text: "Unchanged"},
+		{ID: 2, Text: "After"},
+		{ID: 3, Deleted: true},
+		{ID: 5, Dead: true, Text: "Flagged"},
+	}
+
+	expected := []CommentDiff{
+		{CommentID: 6, Change: CommentAdded, ToText: "New"},
+		{CommentID: 2, Change: CommentEdited, FromText: "Before", ToText: "After"},
+		{CommentID: 3, Change: CommentDeleted, FromText: "Regret"},
+		{CommentID: 5, Change: CommentKilled, FromText: "Flagged", ToText: "Flagged"},
+		{CommentID: 4, Change: CommentRemoved, FromText: "Gone"},
+	}
+
+	assert.Equal(t, expected, DiffComments(from, to))
+}
+
+func TestDiffStories(t *testing.T) {
+	from := StoryModel{
+		StoryID:     1,
+		QueueName:   "0m",
+		Status:      StoryStatusOK,
+		RawDocument: `{"id":1,"descendants":1,"kids":[2,3],"score":10,"title":"Before","url":"http://example.com","type":"story"}`,
+		Comments: []CommentModel{
+			{CommentID: 2, RawDocument: `{"id":2,"text":"First"}`},
+			{CommentID: 3, RawDocument: `{"id":3,"text":"Second"}`},
+		},
+	}
+	to := StoryModel{
+		StoryID:     1,
+		QueueName:   "30m",
+		Status:      StoryStatusOK,
+		RawDocument: `{"id":1,"descendants":3,"kids":[4,2],"score":25,"title":"After","url":"http://example.com","type":"story"}`,
+		Comments: []CommentModel{
+			{CommentID: 4, RawDocument: `{"id":4,"text":"Third"}`},
+			{CommentID: 2, RawDocument: `{"id":2,"text":"First, edited"}`},
+		},
+	}
+
+	expected := StoryDiff{
+		StoryID:          1,
+		From:             "0m",
+		To:               "30m",
+		ScoreDelta:       15,
+		DescendantsDelta: 2,
+		Title:            &FieldChange{From: "Before", To: "After"},
+		AddedKids:        []int64{4},
+		RemovedKids:      []int64{3},
+		Comments: []CommentDiff{
+			{CommentID: 4, Change: CommentAdded, ToText: "Third"},
+			{CommentID: 2, Change: CommentEdited, FromText: "First", ToText: "First, edited"},
+			{CommentID: 3, Change: CommentRemoved, FromText: "Second"},
+		},
+	}
+
+	actual, err := DiffStories(from, to)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestDiffStoriesWhenStoryRemoved(t *testing.T) {
+	from := StoryModel{StoryID: 1, QueueName: "0m", Status: StoryStatusOK, RawDocument: `{"id":1,"score":10}`}
+	to := StoryModel{StoryID: 1, QueueName: "30m", Status: StoryStatusMissing, RawDocument: "null"}
+
+	actual, err := DiffStories(from, to)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &FieldChange{From: StoryStatusOK, To: StoryStatusMissing}, actual.Status)
+}
+
+func TestDiffStoriesWhenDifferentStoriesReturnsError(t *testing.T) {
+	_, err := DiffStories(StoryModel{StoryID: 1}, StoryModel{StoryID: 2})
+
+	assert.NotNil(t, err)
+}
+
+func TestStoryDiffWriteText(t *testing.T) {
+	diff := StoryDiff{
+		StoryID:          1,
+		From:             "0m",
+		To:               "30m",
+		ScoreDelta:       15,
+		DescendantsDelta: -1,
+		Title:            &FieldChange{From: "Before", To: "After"},
+		AddedKids:        []int64{4},
+		Comments:         []CommentDiff{{CommentID: 4, Change: CommentAdded}},
+	}
+
+	expected := `story 1: 0m -> 30m
+  score: +15
+  descendants: -1
+  title: "Before" -> "After"
+  added kids: [4]
+  comment 4: added
+`
+
+	var b strings.Builder
+	err := diff.WriteText(&b)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, b.String())
+}
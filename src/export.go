@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ExportFormatCSV     = "csv"
+	ExportFormatParquet = "parquet"
+	ExportLayoutLong    = "long"
+	ExportLayoutWide    = "wide"
+)
+
+type ExportColumnType int
+
+const (
+	ExportInt64 ExportColumnType = iota
+	ExportString
+	ExportTime
+)
+
+type ExportColumn struct {
+	Name string
+	Type ExportColumnType
+}
+
+// RowWriter writes rows of an export. Close writes anything that is
+// buffered, but doesn't close the underlying writer.
+type RowWriter interface {
+	WriteRow([]any) error
+	Close() error
+}
+
+// ExportStore provides methods to read the snapshots of stories to export.
+type ExportStore interface {
+	ExportLabels(context.Context, StoryFilter) ([]string, error)
+	StreamSnapshots(context.Context, StoryFilter, func(StoryModel) error) error
+}
+
+// CSVWriter writes rows as CSV, with a header. Times are formatted as RFC
+// 3339, and nil values are empty.
+type CSVWriter struct {
+	w       *csv.Writer
+	columns []ExportColumn
+	record  []string
+}
+
+func NewCSVWriter(w io.Writer, columns []ExportColumn) (*CSVWriter, error) {
+	writer := &CSVWriter{w: csv.NewWriter(w), columns: columns, record: make([]string, len(columns))}
+
+	for idx, column := range columns {
+		writer.record[idx] = column.Name
+	}
+	err := writer.w.Write(writer.record)
+	return writer, err
+}
+
+func (c *CSVWriter) WriteRow(row []any) error {
+	if len(row) != len(c.columns) {
+		return fmt.Errorf("Expected %d values, got %d", len(c.columns), len(row))
+	}
+
+	for idx, value := range row {
+		switch v := value.(type) {
+		case nil:
+			c.record[idx] = ""
+		case int64:
+			c.record[idx] = strconv.FormatInt(v, 10)
+		case string:
+			c.record[idx] = v
+		case time.Time:
+			c.record[idx] = v.UTC().Format(time.RFC3339)
+		default:
+			return fmt.Errorf("Unsupported value for column %s: %T", c.columns[idx].Name, value)
+		}
+	}
+	return c.w.Write(c.record)
+}
+
+func (c *CSVWriter) Close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// NewRowWriter makes a writer of rows in the given format.
+func NewRowWriter(w io.Writer, format string, columns []ExportColumn) (RowWriter, error) {
+	switch format {
+	case ExportFormatCSV:
+		return NewCSVWriter(w, columns)
+	case ExportFormatParquet:
+		return NewParquetWriter(w, columns, DefaultParquetRowGroupSize), nil
+	default:
+		return nil, fmt.Errorf("Unsupported format: %s", format)
+	}
+}
+
+// LongColumns are the columns of the long layout, which has a row per
+// snapshot.
+var LongColumns = []ExportColumn{
+	{Name: "story_id", Type: ExportInt64},
+	{Name: "label", Type: ExportString},
+	{Name: "fetched_at", Type: ExportTime},
+	{Name: "created_at", Type: ExportTime},
+	{Name: "status", Type: ExportString},
+	{Name: "type", Type: ExportString},
+	{Name: "by", Type: ExportString},
+	{Name: "title", Type: ExportString},
+	{Name: "url", Type: ExportString},
+	{Name: "canonical_url", Type: ExportString},
+	{Name: "domain", Type: ExportString},
+	{Name: "score", Type: ExportInt64},
+	{Name: "descendants", Type: ExportInt64},
+	{Name: "tags", Type: ExportString},
+}
+
+// wideStoryColumns are the columns of the wide layout that describe the
+// story, as of its latest snapshot, which precede the columns per label.
+var wideStoryColumns = []ExportColumn{
+	{Name: "story_id", Type: ExportInt64},
+	{Name: "created_at", Type: ExportTime},
+	{Name: "status", Type: ExportString},
+	{Name: "type", Type: ExportString},
+	{Name: "by", Type: ExportString},
+	{Name: "title", Type: ExportString},
+	{Name: "url", Type: ExportString},
+	{Name: "canonical_url", Type: ExportString},
+	{Name: "domain", Type: ExportString},
+	{Name: "tags", Type: ExportString},
+	{Name: "snapshots", Type: ExportInt64},
+}
+
+var columnNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// WideColumns are the columns of the wide layout, which has a row per story
+// and the score, descendants and fetch time of each of the labelled
+// snapshots, e.g. `score_15m`.
+func WideColumns(labels []string) []ExportColumn {
+	columns := append([]ExportColumn{}, wideStoryColumns...)
+	for _, label := range labels {
+		suffix := columnNameInvalidChars.ReplaceAllString(label, "_")
+		columns = append(
+			columns,
+			ExportColumn{Name: "score_" + suffix, Type: ExportInt64},
+			ExportColumn{Name: "descendants_" + suffix, Type: ExportInt64},
+			ExportColumn{Name: "fetched_at_" + suffix, Type: ExportTime},
+		)
+	}
+	return columns
+}
+
+// nullIfEmpty returns nil for empty strings, so that they are exported as
+// nulls.
+func nullIfEmpty(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// exportFields are the values describing a story in a snapshot, which are
+// nil if the snapshot has no document, e.g. as the story was missing.
+type exportFields struct {
+	CreatedAt   any
+	Type        any
+	By          any
+	Title       any
+	URL         any
+	Score       any
+	Descendants any
+}
+
+func makeExportFields(model StoryModel) (exportFields, error) {
+	fields := exportFields{}
+	story, err := ParseStory(model)
+	if err != nil || story.ID == 0 {
+		return fields, err
+	}
+
+	fields.CreatedAt = time.Unix(story.Time, 0).UTC()
+	fields.Type = nullIfEmpty(story.Type)
+	fields.By = nullIfEmpty(story.By)
+	fields.Title = nullIfEmpty(story.Title)
+	fields.URL = nullIfEmpty(story.URL)
+	fields.Score = int64(story.Score)
+	fields.Descendants = int64(story.Descendants)
+	return fields, nil
+}
+
+// LongRow is the row of a snapshot in the long layout.
+func LongRow(model StoryModel) ([]any, error) {
+	fields, err := makeExportFields(model)
+	if err != nil {
+		return nil, err
+	}
+
+	return []any{
+		model.StoryID,
+		model.QueueName,
+		model.FetchedAt,
+		fields.CreatedAt,
+		model.Status,
+		fields.Type,
+		fields.By,
+		fields.Title,
+		fields.URL,
+		nullIfEmpty(model.CanonicalURL),
+		nullIfEmpty(model.Domain),
+		fields.Score,
+		fields.Descendants,
+		nullIfEmpty(strings.Join(model.Tags, ",")),
+	}, nil
+}
+
+// WideRow is the row of a story in the wide layout, given its snapshots in
+// the order they were taken. Labels without a snapshot are nil.
+func WideRow(labels []string, snapshots []StoryModel) ([]any, error) {
+	// Describe the story by its latest snapshot that has a document.
+	latest := snapshots[len(snapshots)-1]
+	fields := exportFields{}
+	for idx := len(snapshots) - 1; idx >= 0 && fields.CreatedAt == nil; idx-- {
+		var err error
+		fields, err = makeExportFields(snapshots[idx])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	row := []any{
+		latest.StoryID,
+		fields.CreatedAt,
+		latest.Status,
+		fields.Type,
+		fields.By,
+		fields.Title,
+		fields.URL,
+		nullIfEmpty(latest.CanonicalURL),
+		nullIfEmpty(latest.Domain),
+		nullIfEmpty(strings.Join(latest.Tags, ",")),
+		int64(len(snapshots)),
+	}
+
+	byLabel := make(map[string]StoryModel, len(snapshots))
+	for _, snapshot := range snapshots {
+		byLabel[snapshot.QueueName] = snapshot
+	}
+	for _, label := range labels {
+		snapshot, ok := byLabel[label]
+		if !ok {
+			row = append(row, nil, nil, nil)
+			continue
+		}
+		fields, err := makeExportFields(snapshot)
+		if err != nil {
+			return nil, err
+		}
+		row = append(row, fields.Score, fields.Descendants, snapshot.FetchedAt)
+	}
+	return row, nil
+}
+
+// Export streams the snapshots of the stories that match the filter, in the
+// given layout, to a row writer made for its columns. The wide layout has
+// columns for the given labels, or for every label in the export if there
+// are none. Only one story's snapshots are held in memory at a time. The
+// number of rows written is returned.
+func Export(
+	ctx context.Context,
+	store ExportStore,
+	filter StoryFilter,
+	layout string,
+	labels []string,
+	newWriter func([]ExportColumn) (RowWriter, error),
+) (int, error) {
+	var columns []ExportColumn
+	switch layout {
+	case ExportLayoutLong:
+		columns = LongColumns
+	case ExportLayoutWide:
+		if len(labels) == 0 {
+			var err error
+			labels, err = store.ExportLabels(ctx, filter)
+			if err != nil {
+				return 0, err
+			}
+		}
+		columns = WideColumns(labels)
+	default:
+		return 0, fmt.Errorf("Unsupported layout: %s", layout)
+	}
+
+	writer, err := newWriter(columns)
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		count     int
+		snapshots []StoryModel
+	)
+	writeStory := func() error {
+		if len(snapshots) == 0 {
+			return nil
+		}
+		row, err := WideRow(labels, snapshots)
+		if err != nil {
+			return err
+		}
+		snapshots = snapshots[:0]
+		count++
+		return writer.WriteRow(row)
+	}
+
+	err = store.StreamSnapshots(ctx, filter, func(model StoryModel) error {
+		if layout == ExportLayoutLong {
+			row, err := LongRow(model)
+			if err != nil {
+				return err
+			}
+			count++
+			return writer.WriteRow(row)
+		}
+
+		// Snapshots are grouped by story, so a story is complete once the
+		// next one's snapshots begin.
+		if len(snapshots) > 0 && snapshots[0].StoryID != model.StoryID {
+			if err := writeStory(); err != nil {
+				return err
+			}
+		}
+		snapshots = append(snapshots, model)
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+
+	err = writeStory()
+	if err != nil {
+		return count, err
+	}
+	return count, writer.Close()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockExportStore struct {
+	mock.Mock
+	snapshots []StoryModel
+}
+
+func (m *mockExportStore) ExportLabels(ctx context.Context, filter StoryFilter) ([]string, error) {
+	args := m.Called(ctx, filter)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockExportStore) StreamSnapshots(ctx context.Context, filter StoryFilter, fn func(StoryModel) error) error {
+	for _, snapshot := range m.snapshots {
+		if err := fn(snapshot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var testExportFetchedAt = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newMockExportStore() *mockExportStore {
+	store := new(mockExportStore)
+	store.snapshots = []StoryModel{
+		{
+			StoryID:      1,
+			QueueName:    "0m",
+			FetchedAt:    testExportFetchedAt,
+			Status:       StoryStatusOK,
+			RawDocument:  `{"id":1,"by":"pg","score":1,"time":1577836800,"title":"First, again","type":"story","url":"https://example.com/"}`,
+			CanonicalURL: "https://example.com/",
+			Domain:       "example.com",
+		},
+		{
+			StoryID:      1,
+			QueueName:    "1h",
+			FetchedAt:    testExportFetchedAt.Add(time.Hour),
+			Status:       StoryStatusOK,
+			RawDocument:  `{"id":1,"by":"pg","descendants":4,"score":9,"time":1577836800,"title":"First, again","type":"story","url":"https://example.com/"}`,
+			Tags:         []string{"founders", "rust"},
+			CanonicalURL: "https://example.com/",
+			Domain:       "example.com",
+		},
+		{
+			StoryID:     2,
+			QueueName:   "1h",
+			FetchedAt:   testExportFetchedAt.Add(2 * time.Hour),
+			Status:      StoryStatusMissing,
+			RawDocument: `null`,
+		},
+	}
+	store.On("ExportLabels", mock.Anything, mock.Anything).Return([]string{"0m", "1h"}, nil)
+	return store
+}
+
+func exportCSV(t *testing.T, store ExportStore, layout string, labels []string) (int, string) {
+	buf := &bytes.Buffer{}
+	count, err := Export(context.Background(), store, StoryFilter{}, layout, labels, func(columns []ExportColumn) (RowWriter, error) {
+		return NewRowWriter(buf, ExportFormatCSV, columns)
+	})
+	assert.Nil(t, err)
+	return count, buf.String()
+}
+
+func TestWideColumns(t *testing.T) {
+	columns := WideColumns([]string{"0m", "watch-5m"})
+
+	var names []string
+	for _, column := range columns[len(wideStoryColumns):] {
+		names = append(names, column.Name)
+	}
+	assert.Equal(t, []string{"score_0m", "descendants_0m", "fetched_at_0m", "score_watch_5m", "descendants_watch_5m", "fetched_at_watch_5m"}, names)
+	assert.Equal(t, ExportTime, columns[len(columns)-1].Type)
+}
+
+func TestCSVWriterWriteRow(t *testing.T) {
+	buf := &bytes.Buffer{}
+	columns := []ExportColumn{{Name: "id", Type: ExportInt64}, {Name: "title", Type: ExportString}, {Name: "at", Type: ExportTime}}
+	writer, err := NewCSVWriter(buf, columns)
+	assert.Nil(t, err)
+
+	assert.Nil(t, writer.WriteRow([]any{int64(1), "Hello, world", testExportFetchedAt}))
+	assert.Nil(t, writer.WriteRow([]any{int64(2), nil, nil}))
+	assert.NotNil(t, writer.WriteRow([]any{int64(3)}))
+	assert.NotNil(t, writer.WriteRow([]any{1, nil, nil}))
+	assert.Nil(t, writer.Close())
+
+	assert.Equal(t, "id,title,at\n1,\"Hello, world\",2020-01-01T00:00:00Z\n2,,\n", buf.String())
+}
+
+func TestExportLong(t *testing.T) {
+	store := newMockExportStore()
+
+	count, actual := exportCSV(t, store, ExportLayoutLong, nil)
+
+	expected := strings.Join([]string{
+		"story_id,label,fetched_at,created_at,status,type,by,title,url,canonical_url,domain,score,descendants,tags",
+		`1,0m,2020-01-01T00:00:00Z,2020-01-01T00:00:00Z,ok,story,pg,"First, again",https://example.com/,https://example.com/,example.com,1,0,`,
+		`1,1h,2020-01-01T01:00:00Z,2020-01-01T00:00:00Z,ok,story,pg,"First, again",https://example.com/,https://example.com/,example.com,9,4,"founders,rust"`,
+		"2,1h,2020-01-01T02:00:00Z,,missing,,,,,,,,,",
+		"",
+	}, "\n")
+	assert.Equal(t, 3, count)
+	assert.Equal(t, expected, actual)
+	store.AssertNotCalled(t, "ExportLabels", mock.Anything, mock.Anything)
+}
+
+func TestExportWide(t *testing.T) {
+	store := newMockExportStore()
+
+	count, actual := exportCSV(t, store, ExportLayoutWide, nil)
+
+	expected := strings.Join([]string{
+		"story_id,created_at,status,type,by,title,url,canonical_url,domain,tags,snapshots,score_0m,descendants_0m,fetched_at_0m,score_1h,descendants_1h,fetched_at_1h",
+		`1,2020-01-01T00:00:00Z,ok,story,pg,"First, again",https://example.com/,https://example.com/,example.com,"founders,rust",2,1,0,2020-01-01T00:00:00Z,9,4,2020-01-01T01:00:00Z`,
+		"2,,missing,,,,,,,,1,,,,,,2020-01-01T02:00:00Z",
+		"",
+	}, "\n")
+	assert.Equal(t, 2, count)
+	assert.Equal(t, expected, actual)
+}
+
+func TestExportWideWithLabels(t *testing.T) {
+	store := newMockExportStore()
+
+	_, actual := exportCSV(t, store, ExportLayoutWide, []string{"1h"})
+
+	lines := strings.Split(actual, "\n")
+	assert.True(t, strings.HasSuffix(lines[0], ",snapshots,score_1h,descendants_1h,fetched_at_1h"))
+	assert.True(t, strings.HasSuffix(lines[1], ",2,9,4,2020-01-01T01:00:00Z"))
+	store.AssertNotCalled(t, "ExportLabels", mock.Anything, mock.Anything)
+}
+
+func TestExportWhenUnsupportedReturnsError(t *testing.T) {
+	store := newMockExportStore()
+
+	_, err := Export(context.Background(), store, StoryFilter{}, "tall", nil, func(columns []ExportColumn) (RowWriter, error) {
+		return NewRowWriter(&bytes.Buffer{}, ExportFormatCSV, columns)
+	})
+	assert.NotNil(t, err)
+
+	_, err = Export(context.Background(), store, StoryFilter{}, ExportLayoutLong, nil, func(columns []ExportColumn) (RowWriter, error) {
+		return NewRowWriter(&bytes.Buffer{}, "xlsx", columns)
+	})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ImportFormatJSONL      = "jsonl"
+	ImportFormatParquet    = "parquet"
+	DefaultImportBatchSize = 1000
+)
+
+var storyStatuses = []string{StoryStatusOK, StoryStatusDeleted, StoryStatusDead, StoryStatusMissing, StoryStatusNotStory}
+
+// ArchivedComment is a comment of an archived snapshot.
+type ArchivedComment struct {
+	CommentID   int64           `json:"comment_id"`
+	RawDocument json.RawMessage `json:"raw_document"`
+}
+
+// ArchivedPollOption is a poll option of an archived snapshot.
+type ArchivedPollOption struct {
+	PollOptionID int64           `json:"poll_option_id"`
+	Score        int32           `json:"score"`
+	RawDocument  json.RawMessage `json:"raw_document"`
+}
+
+// ArchivedStory is an archived snapshot of a story, as a StoryModel with its
+// documents embedded as JSON. Its status, canonical URL and domain are found
+// from its document if they're empty.
+type ArchivedStory struct {
+	StoryID      int64                `json:"story_id"`
+	APIVersion   string               `json:"api_version"`
+	QueueName    string               `json:"queue_name"`
+	FetchedAt    time.Time            `json:"fetched_at"`
+	RawDocument  json.RawMessage      `json:"raw_document"`
+	Status       string               `json:"status,omitempty"`
+	Tags         []string             `json:"tags,omitempty"`
+	CanonicalURL string               `json:"canonical_url,omitempty"`
+	Domain       string               `json:"domain,omitempty"`
+	Comments     []ArchivedComment    `json:"comments,omitempty"`
+	PollOptions  []ArchivedPollOption `json:"poll_options,omitempty"`
+}
+
+// Model validates the snapshot, and makes its StoryModel.
+func (a ArchivedStory) Model() (StoryModel, error) {
+	model := StoryModel{
+		StoryID:      a.StoryID,
+		APIVersion:   a.APIVersion,
+		QueueName:    a.QueueName,
+		FetchedAt:    a.FetchedAt.UTC(),
+		RawDocument:  string(a.RawDocument),
+		Status:       a.Status,
+		Tags:         a.Tags,
+		CanonicalURL: a.CanonicalURL,
+		Domain:       a.Domain,
+	}
+
+	switch {
+	case a.StoryID <= 0:
+		return model, errors.New("A story id is required")
+	case a.APIVersion == "" || len(a.APIVersion) > 2:
+		return model, fmt.Errorf("Invalid API version: %q", a.APIVersion)
+	case a.QueueName == "":
+		return model, errors.New("A queue name is required")
+	case a.FetchedAt.IsZero():
+		return model, errors.New("A fetch time is required")
+	case !json.Valid(a.RawDocument):
+		return model, errors.New("A raw document is required")
+	case a.Status != "" && !slices.Contains(storyStatuses, a.Status):
+		return model, fmt.Errorf("Invalid status: %s", a.Status)
+	}
+
+	story, err := ParseStory(model)
+	if err != nil {
+		return model, err
+	}
+	if model.Status == "" {
+		model.Status = StoryStatus(story)
+		if story.ID == 0 {
+			model.Status = StoryStatusMissing
+		}
+	}
+	if model.CanonicalURL == "" && model.Domain == "" {
+		model.CanonicalURL, model.Domain = CanonicaliseStoryURL(story.URL)
+	}
+
+	for _, comment := range a.Comments {
+		model.Comments = append(model.Comments, CommentModel{CommentID: comment.CommentID, RawDocument: string(comment.RawDocument)})
+	}
+	for _, option := range a.PollOptions {
+		model.PollOptions = append(model.PollOptions, PollOptionModel{PollOptionID: option.PollOptionID, Score: option.Score, RawDocument: string(option.RawDocument)})
+	}
+	return model, nil
+}
+
+// ReadJSONL reads archived snapshots, one JSON object per line, calling fn
+// with each in turn.
+func ReadJSONL(r io.Reader, fn func(StoryModel) error) error {
+	decoder := json.NewDecoder(r)
+	for record := 1; ; record++ {
+		archived := ArchivedStory{}
+		err := decoder.Decode(&archived)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Invalid record %d: %w", record, err)
+		}
+
+		model, err := archived.Model()
+		if err != nil {
+			return fmt.Errorf("Invalid record %d: %w", record, err)
+		}
+		if err := fn(model); err != nil {
+			return err
+		}
+	}
+}
+
+// ArchiveColumns are the columns of archived snapshots in Parquet, named as
+// the fields of ArchivedStory. Tags are comma separated, and comments and
+// poll options are JSON arrays.
+var ArchiveColumns = []ExportColumn{
+	{Name: "story_id", Type: ExportInt64},
+	{Name: "api_version", Type: ExportString},
+	{Name: "queue_name", Type: ExportString},
+	{Name: "fetched_at", Type: ExportTime},
+	{Name: "raw_document", Type: ExportString},
+	{Name: "status", Type: ExportString},
+	{Name: "tags", Type: ExportString},
+	{Name: "canonical_url", Type: ExportString},
+	{Name: "domain", Type: ExportString},
+	{Name: "comments", Type: ExportString},
+	{Name: "poll_options", Type: ExportString},
+}
+
+// requiredArchiveColumns are the columns that archives in Parquet must have.
+var requiredArchiveColumns = []string{"story_id", "api_version", "queue_name", "fetched_at", "raw_document"}
+
+// archivedStoryFromRow makes an archived snapshot from a row of the
+// ArchiveColumns.
+func archivedStoryFromRow(row []any) (ArchivedStory, error) {
+	archived := ArchivedStory{}
+
+	var ok bool
+	if archived.StoryID, ok = row[0].(int64); !ok {
+		return archived, errors.New("A story id is required")
+	}
+	if archived.FetchedAt, ok = row[3].(time.Time); !ok {
+		return archived, errors.New("A fetch time, as a timestamp, is required")
+	}
+	archived.APIVersion, _ = row[1].(string)
+	archived.QueueName, _ = row[2].(string)
+	rawDocument, _ := row[4].(string)
+	archived.RawDocument = json.RawMessage(rawDocument)
+	archived.Status, _ = row[5].(string)
+	if tags, _ := row[6].(string); tags != "" {
+		archived.Tags = strings.Split(tags, watchTagsSeparator)
+	}
+	archived.CanonicalURL, _ = row[7].(string)
+	archived.Domain, _ = row[8].(string)
+
+	if comments, _ := row[9].(string); comments != "" {
+		if err := json.Unmarshal([]byte(comments), &archived.Comments); err != nil {
+			return archived, fmt.Errorf("Invalid comments: %w", err)
+		}
+	}
+	if options, _ := row[10].(string); options != "" {
+		if err := json.Unmarshal([]byte(options), &archived.PollOptions); err != nil {
+			return archived, fmt.Errorf("Invalid poll options: %w", err)
+		}
+	}
+	return archived, nil
+}
+
+// ReadParquet reads archived snapshots, with the ArchiveColumns, calling fn
+// with each in turn.
+func ReadParquet(reader *ParquetReader, fn func(StoryModel) error) error {
+	columns := reader.Columns()
+	for _, name := range requiredArchiveColumns {
+		if !slices.Contains(columns, name) {
+			return fmt.Errorf("Missing column: %s", name)
+		}
+	}
+
+	names := make([]string, 0, len(ArchiveColumns))
+	for _, column := range ArchiveColumns {
+		names = append(names, column.Name)
+	}
+
+	record := 0
+	return reader.ForEachRow(names, func(row []any) error {
+		record++
+		archived, err := archivedStoryFromRow(row)
+		if err != nil {
+			return fmt.Errorf("Invalid record %d: %w", record, err)
+		}
+		model, err := archived.Model()
+		if err != nil {
+			return fmt.Errorf("Invalid record %d: %w", record, err)
+		}
+		return fn(model)
+	})
+}
+
+// StoryCopier provides a method to write snapshots in bulk, returning the
+// indexes of those that conflict with stored snapshots.
+type StoryCopier interface {
+	CopyStories(context.Context, []StoryModel) ([]int, error)
+}
+
+// SnapshotKey identifies a snapshot, by its story and label.
+type SnapshotKey struct {
+	StoryID int64
+	Label   string
+}
+
+// ImportResult counts the snapshots that were imported, and lists those that
+// weren't as they conflict with stored snapshots, or earlier ones in the
+// import.
+type ImportResult struct {
+	Imported  int
+	Conflicts []SnapshotKey
+}
+
+// Import writes the snapshots read by read, in batches of batchSize. Each
+// batch is written in a transaction, so an import that fails part way
+// through can be resumed by importing it again, as the snapshots that were
+// written are skipped as conflicts.
+func Import(ctx context.Context, copier StoryCopier, read func(func(StoryModel) error) error, batchSize int) (ImportResult, error) {
+	result := ImportResult{}
+	batch := make([]StoryModel, 0, batchSize)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		conflicts, err := copier.CopyStories(ctx, batch)
+		if err != nil {
+			return err
+		}
+		for _, idx := range conflicts {
+			result.Conflicts = append(result.Conflicts, SnapshotKey{StoryID: batch[idx].StoryID, Label: batch[idx].QueueName})
+		}
+		result.Imported += len(batch) - len(conflicts)
+		batch = batch[:0]
+		return nil
+	}
+
+	err := read(func(model StoryModel) error {
+		batch = append(batch, model)
+		if len(batch) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	return result, flush()
+}
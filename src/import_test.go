@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockStoryCopier struct {
+	mock.Mock
+}
+
+func (m *mockStoryCopier) CopyStories(ctx context.Context, stories []StoryModel) ([]int, error) {
+	// Copy the batch, as it is reused.
+	args := m.Called(ctx, append([]StoryModel{}, stories...))
+	return args.Get(0).([]int), args.Error(1)
+}
+
+const testArchivedJSONL = `{"story_id":1,"api_version":"v0","queue_name":"0m","fetched_at":"2020-01-01T01:00:00+01:00","raw_document":{"id":1,"type":"story","url":"https://www.example.com/?utm_source=hn"},"comments":[{"comment_id":2,"raw_document":{"id":2,"parent":1}}]}
+{"story_id":1,"api_version":"v0","queue_name":"15m","fetched_at":"2020-01-01T00:15:00Z","raw_document":null,"tags":["rust"]}
+`
+
+func TestArchivedStoryModel(t *testing.T) {
+	var archived ArchivedStory
+	err := json.Unmarshal([]byte(strings.Split(testArchivedJSONL, "\n")[0]), &archived)
+	assert.Nil(t, err)
+
+	model, err := archived.Model()
+
+	expected := StoryModel{
+		StoryID:      1,
+		APIVersion:   "v0",
+		QueueName:    "0m",
+		FetchedAt:    time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		RawDocument:  `{"id":1,"type":"story","url":"https://www.example.com/?utm_source=hn"}`,
+		Status:       StoryStatusOK,
+		CanonicalURL: "https://example.com/",
+		Domain:       "example.com",
+		Comments:     []CommentModel{{CommentID: 2, RawDocument: `{"id":2,"parent":1}`}},
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, expected, model)
+}
+
+func TestArchivedStoryModelWhenInvalidReturnsError(t *testing.T) {
+	valid := ArchivedStory{StoryID: 1, APIVersion: "v0", QueueName: "0m", FetchedAt: time.Now(), RawDocument: json.RawMessage(`{"id":1}`)}
+	_, err := valid.Model()
+	assert.Nil(t, err)
+
+	for _, archived := range []ArchivedStory{
+		{APIVersion: "v0", QueueName: "0m", FetchedAt: time.Now(), RawDocument: json.RawMessage(`{"id":1}`)},
+		{StoryID: 1, APIVersion: "v10", QueueName: "0m", FetchedAt: time.Now(), RawDocument: json.RawMessage(`{"id":1}`)},
+		{StoryID: 1, APIVersion: "v0", FetchedAt: time.Now(), RawDocument: json.RawMessage(`{"id":1}`)},
+		{StoryID: 1, APIVersion: "v0", QueueName: "0m", RawDocument: json.RawMessage(`{"id":1}`)},
+		{StoryID: 1, APIVersion: "v0", QueueName: "0m", FetchedAt: time.Now()},
+		{StoryID: 1, APIVersion: "v0", QueueName: "0m", FetchedAt: time.Now(), RawDocument: json.RawMessage(`{"id":1}`), Status: "flagged"},
+	} {
+		_, err := archived.Model()
+		assert.NotNil(t, err, archived)
+	}
+}
+
+func TestReadJSONL(t *testing.T) {
+	var models []StoryModel
+	err := ReadJSONL(strings.NewReader(testArchivedJSONL), func(model StoryModel) error {
+		models = append(models, model)
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Len(t, models, 2)
+	assert.Equal(t, StoryStatusMissing, models[1].Status)
+	assert.Equal(t, []string{"rust"}, models[1].Tags)
+}
+
+func TestReadJSONLWhenInvalidReturnsError(t *testing.T) {
+	input := testArchivedJSONL + `{"story_id":2,"queue_name":"0m"}`
+
+	count := 0
+	err := ReadJSONL(strings.NewReader(input), func(model StoryModel) error {
+		count++
+		return nil
+	})
+
+	assert.ErrorContains(t, err, "Invalid record 3")
+	assert.Equal(t, 2, count)
+}
+
+func TestReadParquet(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewParquetWriter(buf, ArchiveColumns, 1)
+	fetchedAt := time.Date(2020, 1, 1, 0, 15, 0, 0, time.UTC)
+	assert.Nil(t, writer.WriteRow([]any{int64(1), "v0", "15m", fetchedAt, `{"id":1,"type":"poll"}`, nil, "founders,rust", nil, nil, `[{"comment_id":2,"raw_document":{"id":2}}]`, `[{"poll_option_id":3,"score":4,"raw_document":{"id":3}}]`}))
+	assert.Nil(t, writer.WriteRow([]any{int64(2), "v0", "0m", fetchedAt, `null`, StoryStatusMissing, nil, nil, nil, nil, nil}))
+	assert.Nil(t, writer.Close())
+
+	reader, err := NewParquetReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+
+	var models []StoryModel
+	err = ReadParquet(reader, func(model StoryModel) error {
+		models = append(models, model)
+		return nil
+	})
+
+	expected := []StoryModel{
+		{
+			StoryID:     1,
+			APIVersion:  "v0",
+			QueueName:   "15m",
+			FetchedAt:   fetchedAt,
+			RawDocument: `{"id":1,"type":"poll"}`,
+			Status:      StoryStatusOK,
+			Tags:        []string{"founders", "rust"},
+			Comments:    []CommentModel{{CommentID: 2, RawDocument: `{"id":2}`}},
+			PollOptions: []PollOptionModel{{PollOptionID: 3, Score: 4, RawDocument: `{"id":3}`}},
+		},
+		{StoryID: 2, APIVersion: "v0", QueueName: "0m", FetchedAt: fetchedAt, RawDocument: "null", Status: StoryStatusMissing},
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, expected, models)
+}
+
+func TestReadParquetWhenMissingColumnReturnsError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewParquetWriter(buf, LongColumns, DefaultParquetRowGroupSize)
+	assert.Nil(t, writer.Close())
+
+	reader, err := NewParquetReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+
+	err = ReadParquet(reader, func(model StoryModel) error { return nil })
+	assert.ErrorContains(t, err, "Missing column: api_version")
+}
+
+func TestImport(t *testing.T) {
+	models := []StoryModel{
+		{StoryID: 1, QueueName: "0m"},
+		{StoryID: 1, QueueName: "15m"},
+		{StoryID: 2, QueueName: "0m"},
+	}
+	read := func(fn func(StoryModel) error) error {
+		for _, model := range models {
+			if err := fn(model); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	copier := new(mockStoryCopier)
+	copier.On("CopyStories", mock.Anything, models[:2]).Return([]int{1}, nil)
+	copier.On("CopyStories", mock.Anything, models[2:]).Return([]int{}, nil)
+
+	result, err := Import(context.Background(), copier, read, 2)
+
+	assert.Nil(t, err)
+	assert.Equal(t, ImportResult{Imported: 2, Conflicts: []SnapshotKey{{StoryID: 1, Label: "15m"}}}, result)
+	copier.AssertNumberOfCalls(t, "CopyStories", 2)
+}
+
+func TestImportWhenCopyFailsReturnsError(t *testing.T) {
+	read := func(fn func(StoryModel) error) error {
+		return fn(StoryModel{StoryID: 1, QueueName: "0m"})
+	}
+
+	copier := new(mockStoryCopier)
+	copier.On("CopyStories", mock.Anything, mock.Anything).Return([]int{}, fmt.Errorf("Error"))
+
+	_, err := Import(context.Background(), copier, read, 2)
+
+	assert.NotNil(t, err)
+}
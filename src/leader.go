@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	LeaderKeyPrefix        = "ingestion-leader"
+	HighWaterMarkKeyPrefix = "ingestion-high-water-mark"
+	DefaultLeaseTTL        = 15 * time.Second
+)
+
+var ErrLeadershipLost = errors.New("Leadership lost")
+
+// renewLeaseScript extends the lease's TTL, provided that it is still held by
+// the given holder.
+const renewLeaseScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`
+
+// releaseLeaseScript deletes the lease, provided that it is still held by the
+// given holder.
+const releaseLeaseScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`
+
+// raiseHighWaterMarkScript sets the high-water mark, provided that the new
+// value is greater than the current one.
+const raiseHighWaterMarkScript = `
+local current = tonumber(redis.call("get", KEYS[1]) or "0")
+if tonumber(ARGV[1]) > current then
+	redis.call("set", KEYS[1], ARGV[1])
+	return 1
+end
+return 0
+`
+
+// LeaseClient is an interface to the store that leases are held in.
+type LeaseClient interface {
+	Eval(context.Context, string, []string, ...interface{}) *redis.Cmd
+	Get(context.Context, string) *redis.StringCmd
+	SetNX(context.Context, string, interface{}, time.Duration) *redis.BoolCmd
+}
+
+// MakeReplicaID makes an id that identifies the running process among
+// replicas.
+func MakeReplicaID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// LeaderElector elects a leader among replicas contending for the same lease.
+// The lease is renewed in the background while it is held, and expires after
+// its TTL if it is not, e.g. because its holder has died, so that another
+// replica can take over.
+type LeaderElector struct {
+	client        LeaseClient
+	key           string
+	id            string
+	TTL           time.Duration
+	RetryInterval time.Duration
+
+	mu        sync.Mutex
+	expiresAt time.Time
+}
+
+func NewLeaderElector(client LeaseClient, name, id string, ttl time.Duration) *LeaderElector {
+	if ttl <= 0 {
+		panic("Lease TTL must be positive")
+	}
+
+	return &LeaderElector{
+		client:        client,
+		key:           fmt.Sprintf("%s:%s", LeaderKeyPrefix, name),
+		id:            id,
+		TTL:           ttl,
+		RetryInterval: ttl / 3,
+	}
+}
+
+// IsLeader returns whether the lease is held. The lease is considered lost
+// once it has expired locally, even if it could not be confirmed as lost with
+// the store.
+func (e *LeaderElector) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return time.Now().Before(e.expiresAt)
+}
+
+func (e *LeaderElector) setExpiry(expiresAt time.Time) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expiresAt = expiresAt
+}
+
+// Acquire blocks until the lease has been acquired or the context is done.
+// It returns immediately if the lease is already held.
+func (e *LeaderElector) Acquire(ctx context.Context) error {
+	for {
+		if e.IsLeader() {
+			return nil
+		}
+
+		// The lease's expiry is measured from before the request was made, so
+		// that it does not outlive the lease held in the store.
+		requestedAt := time.Now()
+		acquired, err := e.client.SetNX(ctx, e.key, e.id, e.TTL).Result()
+		if err != nil {
+			return err
+		}
+
+		if acquired {
+			e.setExpiry(requestedAt.Add(e.TTL))
+			go e.renew(ctx)
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(e.RetryInterval):
+		}
+	}
+}
+
+// renew renews the lease until it is lost or the context is done.
+func (e *LeaderElector) renew(ctx context.Context) {
+	ticker := time.NewTicker(e.TTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if !e.IsLeader() {
+			slog.Error("Lease expired before it could be renewed", "key", e.key)
+			return
+		}
+
+		requestedAt := time.Now()
+		renewed, err := e.client.Eval(ctx, renewLeaseScript, []string{e.key}, e.id, e.TTL.Milliseconds()).Int()
+		if err != nil {
+			// Retry until the lease expires locally.
+			slog.Error("Error renewing lease", "key", e.key, "error", err)
+			continue
+		}
+
+		if renewed == 0 {
+			slog.Error("Lease lost to another replica", "key", e.key)
+			e.setExpiry(time.Time{})
+			return
+		}
+
+		e.setExpiry(requestedAt.Add(e.TTL))
+	}
+}
+
+// Release gives up the lease, if it is held.
+func (e *LeaderElector) Release(ctx context.Context) error {
+	e.setExpiry(time.Time{})
+	return e.client.Eval(ctx, releaseLeaseScript, []string{e.key}, e.id).Err()
+}
+
+// HighWaterMark persists the largest story id that has been consumed, so that
+// consumption can be resumed by another replica or after a restart.
+type HighWaterMark struct {
+	client LeaseClient
+	key    string
+}
+
+func NewHighWaterMark(client LeaseClient, name string) *HighWaterMark {
+	return &HighWaterMark{
+		client: client,
+		key:    fmt.Sprintf("%s:%s", HighWaterMarkKeyPrefix, name),
+	}
+}
+
+// Load loads the high-water mark, or 0 if none has been saved.
+func (m *HighWaterMark) Load(ctx context.Context) (int64, error) {
+	value, err := m.client.Get(ctx, m.key).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// Save raises the high-water mark to the given story id. Lower values are
+// ignored, so that a replica that has lost leadership can not move the mark
+// backwards.
+func (m *HighWaterMark) Save(ctx context.Context, storyID int64) error {
+	return m.client.Eval(ctx, raiseHighWaterMarkScript, []string{m.key}, storyID).Err()
+}
+
+// MarkingProducer raises the high-water mark to each story once it's been
+// sent, so that a story that is discarded, or can't be sent, is consumed
+// again after a restart or by the next leader. Stories must be sent one at a
+// time, in the order they were consumed, or the mark may be raised past a
+// story that is yet to be sent.
+type MarkingProducer struct {
+	producer Producer
+	mark     HighWaterMarker
+}
+
+func NewMarkingProducer(producer Producer, mark HighWaterMarker) *MarkingProducer {
+	return &MarkingProducer{producer: producer, mark: mark}
+}
+
+func (p *MarkingProducer) SendMessage(ctx context.Context, storyID int64, createdAt *time.Time) error {
+	err := p.producer.SendMessage(ctx, storyID, createdAt)
+	if err != nil {
+		return err
+	}
+	return p.mark.Save(ctx, storyID)
+}
+
+// ResettableConsumer is a consumer whose state can be discarded.
+type ResettableConsumer interface {
+	Consumer
+	Reset()
+}
+
+// LeaderConsumer only consumes from the wrapped consumer while holding the
+// leadership lease, blocking until it is acquired otherwise.
+type LeaderConsumer struct {
+	elector  *LeaderElector
+	consumer ResettableConsumer
+}
+
+func NewLeaderConsumer(elector *LeaderElector, consumer ResettableConsumer) *LeaderConsumer {
+	return &LeaderConsumer{elector: elector, consumer: consumer}
+}
+
+func (c *LeaderConsumer) Fetch(ctx context.Context) (storyID int64, createdAt *time.Time, err error) {
+	if !c.elector.IsLeader() {
+		// Another replica may have made progress since leadership was last
+		// held, so any state from then is stale.
+		c.consumer.Reset()
+
+		slog.Info("Waiting to acquire leadership")
+		err = c.elector.Acquire(ctx)
+		if err != nil {
+			return
+		}
+		slog.Info("Acquired leadership")
+	}
+
+	storyID, createdAt, err = c.consumer.Fetch(ctx)
+	if err == nil && !c.elector.IsLeader() {
+		err = fmt.Errorf("%w: discarding story %d", ErrLeadershipLost, storyID)
+	}
+	return
+}
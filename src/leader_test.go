@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockLeaseClient struct {
+	mock.Mock
+}
+
+func (m *mockLeaseClient) Eval(ctx context.Context, script string, keys []string, args ...interface{}) *redis.Cmd {
+	callArgs := m.Called(ctx, script, keys, args)
+	return callArgs.Get(0).(*redis.Cmd)
+}
+
+func (m *mockLeaseClient) Get(ctx context.Context, key string) *redis.StringCmd {
+	args := m.Called(ctx, key)
+	return args.Get(0).(*redis.StringCmd)
+}
+
+func (m *mockLeaseClient) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	args := m.Called(ctx, key, value, expiration)
+	return args.Get(0).(*redis.BoolCmd)
+}
+
+type mockHighWaterMark struct {
+	mock.Mock
+}
+
+func (m *mockHighWaterMark) Load(ctx context.Context) (int64, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockHighWaterMark) Save(ctx context.Context, storyID int64) error {
+	args := m.Called(ctx, storyID)
+	return args.Error(0)
+}
+
+func TestLeaderElectorAcquire(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("SetNX", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewBoolResult(true, nil),
+	)
+
+	elector := NewLeaderElector(client, "new", "replica", time.Minute)
+	assert.False(t, elector.IsLeader())
+
+	err := elector.Acquire(context.Background())
+
+	assert.Nil(t, err)
+	assert.True(t, elector.IsLeader())
+	client.AssertCalled(t, "SetNX", mock.Anything, "ingestion-leader:new", "replica", time.Minute)
+}
+
+func TestLeaderElectorAcquireWhenHeldByAnotherReplicaRetries(t *testing.T) {
+	client := new(mockLeaseClient)
+	mock.InOrder(
+		client.On("SetNX", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+			redis.NewBoolResult(false, nil),
+		).Once(),
+		client.On("SetNX", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+			redis.NewBoolResult(true, nil),
+		).Once(),
+	)
+
+	elector := NewLeaderElector(client, "new", "replica", time.Minute)
+	elector.RetryInterval = time.Millisecond
+
+	err := elector.Acquire(context.Background())
+
+	assert.Nil(t, err)
+	assert.True(t, elector.IsLeader())
+	client.AssertNumberOfCalls(t, "SetNX", 2)
+}
+
+func TestLeaderElectorAcquireWhenContextDoneReturnsError(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("SetNX", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewBoolResult(false, nil),
+	)
+
+	elector := NewLeaderElector(client, "new", "replica", time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := elector.Acquire(ctx)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, elector.IsLeader())
+}
+
+func TestLeaderElectorRenewsLease(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("SetNX", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewBoolResult(true, nil),
+	)
+	client.On("Eval", mock.Anything, renewLeaseScript, mock.Anything, mock.Anything).Return(
+		redis.NewCmdResult(int64(1), nil),
+	)
+
+	ttl := 30 * time.Millisecond
+	elector := NewLeaderElector(client, "new", "replica", ttl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := elector.Acquire(ctx)
+	assert.Nil(t, err)
+
+	// Leadership is held past the initial lease's expiry.
+	time.Sleep(2 * ttl)
+	assert.True(t, elector.IsLeader())
+	client.AssertCalled(t, "Eval", mock.Anything, renewLeaseScript, []string{"ingestion-leader:new"}, []interface{}{"replica", ttl.Milliseconds()})
+}
+
+func TestLeaderElectorWhenLeaseLostIsNotLeader(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("SetNX", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewBoolResult(true, nil),
+	)
+	client.On("Eval", mock.Anything, renewLeaseScript, mock.Anything, mock.Anything).Return(
+		redis.NewCmdResult(int64(0), nil),
+	)
+
+	ttl := 30 * time.Millisecond
+	elector := NewLeaderElector(client, "new", "replica", ttl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := elector.Acquire(ctx)
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool { return !elector.IsLeader() }, time.Second, time.Millisecond)
+}
+
+func TestLeaderElectorWhenRenewalFailsLeaseExpires(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("SetNX", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewBoolResult(true, nil),
+	)
+	client.On("Eval", mock.Anything, renewLeaseScript, mock.Anything, mock.Anything).Return(
+		redis.NewCmdResult(nil, fmt.Errorf("Error")),
+	)
+
+	ttl := 30 * time.Millisecond
+	elector := NewLeaderElector(client, "new", "replica", ttl)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := elector.Acquire(ctx)
+	assert.Nil(t, err)
+
+	assert.Eventually(t, func() bool { return !elector.IsLeader() }, time.Second, time.Millisecond)
+}
+
+func TestHighWaterMarkLoad(t *testing.T) {
+	for _, testCase := range []struct {
+		cmd      *redis.StringCmd
+		expected int64
+	}{
+		{cmd: redis.NewStringResult("10", nil), expected: 10},
+		// No mark has been saved.
+		{cmd: redis.NewStringResult("", redis.Nil), expected: 0},
+	} {
+		client := new(mockLeaseClient)
+		client.On("Get", mock.Anything, mock.Anything).Return(testCase.cmd)
+
+		mark := NewHighWaterMark(client, "new")
+		actual, err := mark.Load(context.Background())
+
+		assert.Nil(t, err)
+		assert.Equal(t, testCase.expected, actual)
+		client.AssertCalled(t, "Get", mock.Anything, "ingestion-high-water-mark:new")
+	}
+}
+
+func TestHighWaterMarkSave(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("Eval", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewCmdResult(int64(1), nil),
+	)
+
+	mark := NewHighWaterMark(client, "new")
+	err := mark.Save(context.Background(), 10)
+
+	assert.Nil(t, err)
+	client.AssertCalled(t, "Eval", mock.Anything, raiseHighWaterMarkScript, []string{"ingestion-high-water-mark:new"}, []interface{}{int64(10)})
+}
+
+func TestLeaderConsumerFetchAcquiresLeadership(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("SetNX", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewBoolResult(true, nil),
+	)
+
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", mock.Anything).Return(
+		makeMockResponse(http.StatusOK, "[10, 9, 8]"),
+		nil,
+	)
+
+	hnClient := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+	latest := NewLatestStoryConsumer(hnClient, 0*time.Second, time.Nanosecond)
+	// Stale state from a previous term.
+	latest.buffer = []int64{5, 4}
+
+	elector := NewLeaderElector(client, "new", "replica", time.Minute)
+	consumer := NewLeaderConsumer(elector, latest)
+
+	storyID, _, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8), storyID)
+	assert.True(t, elector.IsLeader())
+}
+
+// leaseLosingConsumer loses the elector's lease while fetching.
+type leaseLosingConsumer struct {
+	elector *LeaderElector
+	resets  int
+}
+
+func (c *leaseLosingConsumer) Fetch(_ context.Context) (int64, *time.Time, error) {
+	c.elector.setExpiry(time.Time{})
+	return 1, nil, nil
+}
+
+func (c *leaseLosingConsumer) Reset() {
+	c.resets++
+}
+
+func TestLeaderConsumerFetchWhenLeadershipLostReturnsError(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("SetNX", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewBoolResult(true, nil),
+	)
+
+	elector := NewLeaderElector(client, "new", "replica", time.Minute)
+	inner := &leaseLosingConsumer{elector: elector}
+	consumer := NewLeaderConsumer(elector, inner)
+
+	_, _, err := consumer.Fetch(context.Background())
+	assert.ErrorIs(t, err, ErrLeadershipLost)
+
+	// State is discarded before leadership is reacquired.
+	_, _, err = consumer.Fetch(context.Background())
+	assert.ErrorIs(t, err, ErrLeadershipLost)
+	assert.Equal(t, 2, inner.resets)
+	client.AssertNumberOfCalls(t, "SetNX", 2)
+}
+
+// failingProducer fails to send every message.
+type failingProducer struct{}
+
+func (p failingProducer) SendMessage(_ context.Context, _ int64, _ *time.Time) error {
+	return fmt.Errorf("Error")
+}
+
+func TestMarkingProducerSendMessage(t *testing.T) {
+	mark := new(mockHighWaterMark)
+	mark.On("Save", mock.Anything, int64(9)).Return(nil)
+	producer := &recordingProducer{}
+
+	err := NewMarkingProducer(producer, mark).SendMessage(context.Background(), 9, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{9}, producer.storyIDs)
+	mark.AssertExpectations(t)
+}
+
+func TestMarkingProducerSendMessageWhenErrorDoesNotRaiseMark(t *testing.T) {
+	mark := new(mockHighWaterMark)
+
+	err := NewMarkingProducer(failingProducer{}, mark).SendMessage(context.Background(), 9, nil)
+
+	assert.NotNil(t, err)
+	mark.AssertNotCalled(t, "Save", mock.Anything, mock.Anything)
+}
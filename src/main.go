@@ -2,86 +2,344 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
 
-	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/redis/go-redis/v9"
 )
 
-func main() {
-	config := LoadConfig()
+// MakeHNClient makes a client for the API at the given base URL, which is rate
+// limited and circuit broken as configured.
+func MakeHNClient(config *Config, redisClient *redis.Client, baseURL, apiVersion, limiterName string) *HNClient {
+	httpClient := &http.Client{Timeout: config.HNClientHTTPTimeout}
+	client := NewHNClient(
+		httpClient,
+		baseURL,
+		apiVersion,
+		config.HNClientBackoff,
+		config.HNClientMaxAttempts,
+	)
+
+	// A rate limit of 0 indicates that requests are not limited.
+	if config.HNClientRateLimit > 0 && config.HNClientRateLimitDistributed {
+		client.Limiter = NewRedisTokenBucket(redisClient, limiterName, config.HNClientRateLimit, config.HNClientRateLimitBurst)
+	} else if config.HNClientRateLimit > 0 {
+		client.Limiter = NewTokenBucket(config.HNClientRateLimit, config.HNClientRateLimitBurst)
+	}
+
+	client.Breaker = NewCircuitBreaker(
+		config.HNClientBreakerMaxFailures,
+		config.HNClientBreakerMaxErrorRate,
+		config.HNClientBreakerMinRequests,
+		config.HNClientBreakerWindow,
+		config.HNClientBreakerOpenDuration,
+	)
+
+	return client
+}
+
+// FirebaseClient returns the client for the Firebase API, reusing the item
+// source's if it is one, so that they share a rate limiter and breaker.
+func FirebaseClient(config *Config, redisClient *redis.Client, client ItemSource) *HNClient {
+	if hnClient, ok := client.(*HNClient); ok {
+		return hnClient
+	}
+	return MakeHNClient(config, redisClient, config.HNClientBaseURL, config.HNClientAPIVersion, "hn-api")
+}
+
+// MakeAlerter makes an alerter for the configured rules and webhooks.
+func MakeAlerter(config *Config, redisClient *redis.Client, client ItemSource, repo *Repo) *Alerter {
+	if len(config.AlertsWebhookURLs) == 0 || config.AlertsWebhookSecret == "" {
+		panic("Alerts require webhook URLs and a secret to sign payloads with")
+	}
+
+	httpClient := &http.Client{Timeout: config.AlertsHTTPTimeout}
+	var webhooks []*Webhook
+	for _, url := range config.AlertsWebhookURLs {
+		webhook := NewWebhook(httpClient, url, []byte(config.AlertsWebhookSecret), config.AlertsMaxAttempts, config.AlertsBackoff)
+		webhooks = append(webhooks, webhook)
+	}
+
+	alerter := NewAlerter(repo, redisClient, webhooks, config.AlertsDedupTTL)
+	alerter.VelocityRules = config.AlertsVelocityRules
+	if config.AlertsFrontPage {
+		// Rankings are only available from the Firebase API.
+		alerter.FrontPage = NewFrontPage(FirebaseClient(config, redisClient, client), config.AlertsFrontPageMaxRank, DefaultAlertsFrontPageTTL)
+	}
+	return alerter
+}
+
+// MakeMessageConsumer makes a consumer of messages from the source queue,
+// which captures the profiles of users and sends alerts if configured to, and
+// writes snapshots in bulk if configured to.
+func MakeMessageConsumer(config *Config, redisClient *redis.Client, client ItemSource, src *PriorityQueue, repo *Repo) *MessageConsumer {
+	var writer Repoer = repo
+	if config.BulkWriteEnabled {
+		writer = NewBulkWriter(repo, config.BulkWriteBatchSize, config.BulkWriteFlushInterval, config.BulkWriteMaxPending)
+	}
+	consumer := NewMessageConsumer(client, src, writer)
 
-	conn, err := pgx.Connect(context.Background(), config.DatabaseURL)
+	var observers StoryObservers
+	if config.UsersCaptureEnabled {
+		// Profiles are only available from the Firebase API.
+		capturer := NewUserCapturer(FirebaseClient(config, redisClient, client), repo, redisClient, config.UsersRefreshInterval)
+		capturer.MaxPerStory = config.UsersMaxPerStory
+		observers = append(observers, capturer)
+	}
+	if config.AlertsEnabled {
+		observers = append(observers, MakeAlerter(config, redisClient, client, repo))
+	}
+	if len(observers) > 0 {
+		consumer.Observer = observers
+	}
+	if len(config.Watchlists) > 0 {
+		consumer.Tags = NewWatchTags(redisClient, config.WatchlistTagsTTL)
+		consumer.SkipUnwatchedComments = config.WatchlistSkipUnwatched
+		if src.QueueName() == NewQueueName {
+			// Stories are first snapshotted from the "new" queue.
+			consumer.Watcher = MakeStoryWatcher(config, redisClient)
+		}
+	}
+	return consumer
+}
+
+// MakeStoryWatcher makes a watcher of new stories for the configured
+// watchlists.
+func MakeStoryWatcher(config *Config, redisClient *redis.Client) *StoryWatcher {
+	queueConfig, err := MakeQueueConfig(WatchQueueName)
 	if err != nil {
 		panic(err)
 	}
-	defer conn.Close(context.Background())
+	queue := NewPriorityQueue(redisClient, queueConfig, config.ConsumerTimeout)
+	tags := NewWatchTags(redisClient, config.WatchlistTagsTTL)
+	return NewStoryWatcher(config.Watchlists, tags, queue, config.WatchlistStages)
+}
+
+// MakeItemSource makes the configured item source.
+func MakeItemSource(config *Config, redisClient *redis.Client) ItemSource {
+	switch config.ItemSource {
+	case ItemSourceFirebase:
+		return MakeHNClient(config, redisClient, config.HNClientBaseURL, config.HNClientAPIVersion, "hn-api")
+	case ItemSourceAlgolia:
+		client := MakeHNClient(config, redisClient, config.AlgoliaBaseURL, AlgoliaAPIVersion, "algolia-api")
+		return NewAlgoliaClient(client)
+	default:
+		panic(fmt.Sprintf("Invalid item source: %s", config.ItemSource))
+	}
+}
 
-	repo := NewRepo(conn)
+// runCommand runs the named subcommand, exiting once it is done.
+func runCommand(name string, args []string) {
+	command, ok := Commands[name]
+	if !ok {
+		if name != "help" {
+			fmt.Fprintf(os.Stderr, "Unknown command: %s\n", name)
+		}
+		names := make([]string, 0, len(Commands))
+		for name := range Commands {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		fmt.Fprintf(os.Stderr, "Usage: worker [COMMAND] [flags]\n\nCommands: %s. Run `COMMAND -help` for a command's flags, or `-help` for those of the worker that's run without a command.\n", strings.Join(names, ", "))
+		if name == "help" {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+
+	err := command(context.Background(), args, os.Stdout)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func main() {
+	// Arguments that aren't flags name a subcommand.
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		runCommand(os.Args[1], os.Args[2:])
+	}
+
+	config, err := LoadConfig(os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	err = RunWorker(context.Background(), config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// RunWorker runs the ingestion worker chosen by the configured source and
+// destination queues:
+//
+//   - Without a source, and with the "new" queue as the destination, new
+//     stories are polled for.
+//   - Without a source, and with the "updates" queue as the destination, the
+//     updates feed is watched.
+//   - With a source, snapshots are taken of the stories on it, and passed on
+//     to the destination, if there is one.
+//
+// The worker stops on SIGINT or SIGTERM, writing what is pending first.
+func RunWorker(ctx context.Context, config *Config) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	pool, err := pgxpool.New(ctx, config.DatabaseURL)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	if config.DatabaseMigrate {
+		err = Migrate(ctx, pool)
+		if err != nil {
+			return err
+		}
+	}
+
+	repo := NewRepo(pool)
 
 	opts, err := redis.ParseURL(config.BrokerURL)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	redisClient := redis.NewClient(opts)
 	defer redisClient.Close()
 
-	httpClient := &http.Client{Timeout: config.HNClientHTTPTimeout}
-	client := NewHNClient(
-		httpClient,
-		config.HNClientBaseURL,
-		config.HNClientAPIVersion,
-		config.HNClientBackoff,
-		config.HNClientMaxAttempts,
-	)
+	client := MakeItemSource(config, redisClient)
+
+	if config.MetricsAddr != "" {
+		ServeMetrics(config.MetricsAddr)
+	}
 
 	var (
-		consumer Consumer
-		producer Producer
+		consumer    Consumer
+		producer    Producer
+		concurrency = config.ConsumerConcurrency
 	)
 
 	if config.SourceQueueName == "" && config.DstQueueName == NewQueueName {
-		// Fetch new stories and put them on the "new" queue as messages.
+		// Fetch new stories and put them on the "new" queue as messages. Only
+		// the replica holding the leadership lease fetches new stories.
 		dstQueueConfig := MakeNewQueueConfig()
 		dstQueue := NewPriorityQueue(redisClient, dstQueueConfig, config.ConsumerTimeout)
-		consumer = NewLatestStoryConsumer(client, config.ConsumerPollInterval, config.ConsumerTimeout)
-		producer = NewMessageProducer(dstQueue)
+		highWaterMark := NewHighWaterMark(redisClient, NewQueueName)
+		latestStoryConsumer := NewLatestStoryConsumer(client, config.ConsumerPollInterval, config.ConsumerTimeout)
+		latestStoryConsumer.HighWaterMark = highWaterMark
+
+		var newStoryConsumer ResettableConsumer = latestStoryConsumer
+		if config.ConsumerStreaming {
+			// Stream new stories from the Firebase API, falling back to
+			// polling for them. Streams are long-lived, so requests can't
+			// have a timeout, and idle streams are closed instead.
+			url := MakeStreamURL(config.HNClientBaseURL, config.HNClientAPIVersion, config.StreamResource)
+			stream := NewFirebaseStream(&http.Client{}, url)
+			streamingConsumer := NewStreamingStoryConsumer(stream, config.StreamResource, latestStoryConsumer, config.HNClientBackoff)
+			streamingConsumer.MaxReconnectAttempts = config.StreamMaxReconnectAttempts
+			streamingConsumer.FallbackDuration = config.StreamFallbackDuration
+			streamingConsumer.HighWaterMark = highWaterMark
+			// Items are only available from the Firebase API.
+			streamingConsumer.Items = FirebaseClient(config, redisClient, client)
+			newStoryConsumer = streamingConsumer
+		}
+
+		elector := NewLeaderElector(redisClient, NewQueueName, MakeReplicaID(), config.LeaderLeaseTTL)
+		defer elector.Release(context.Background())
+		consumer = NewLeaderConsumer(elector, newStoryConsumer)
+		producer = NewMarkingProducer(NewMessageProducer(dstQueue), highWaterMark)
+		// New stories are enqueued in order, so that the high-water mark is
+		// never raised past a story that is yet to be enqueued.
+		concurrency = 1
+	} else if config.SourceQueueName == "" && config.DstQueueName == UpdatesQueueName {
+		// Watch the updates feed for changes to tracked stories, and put
+		// them on the "updates" queue for an extra snapshot. The feed is
+		// only available from the Firebase API, and only the replica holding
+		// the leadership lease watches it.
+		dstQueueConfig, err := MakeQueueConfig(UpdatesQueueName)
+		if err != nil {
+			return err
+		}
+		dstQueue := NewPriorityQueue(redisClient, dstQueueConfig, config.ConsumerTimeout)
+		hnClient := FirebaseClient(config, redisClient, client)
+
+		var updates UpdatedItemsFetcher = NewPolledUpdates(hnClient, config.ConsumerPollInterval)
+		if config.ConsumerStreaming {
+			url := MakeStreamURL(config.HNClientBaseURL, config.HNClientAPIVersion, ResourceNameUpdates)
+			stream := NewFirebaseStream(&http.Client{}, url)
+			updates = NewStreamedUpdates(stream, config.HNClientBackoff)
+		}
+
+		elector := NewLeaderElector(redisClient, UpdatesQueueName, MakeReplicaID(), config.LeaderLeaseTTL)
+		defer elector.Release(context.Background())
+		updatesConsumer := NewUpdatesConsumer(hnClient, updates, repo, config.UpdatesMaxStoryAge)
+		consumer = NewLeaderConsumer(elector, updatesConsumer)
+		producer = NewUpdateProducer(dstQueue, redisClient, config.UpdatesMaxSnapshots, config.UpdatesMaxStoryAge)
 	} else if config.SourceQueueName != "" && config.DstQueueName != "" {
 		// Consume messages from source queue and put new messages onto
 		// destination queue.
 		sourceQueueConfig, err := MakeQueueConfig(config.SourceQueueName)
 		if err != nil {
-			panic(err)
+			return err
 		}
 		dstQueueConfig, err := MakeQueueConfig(config.DstQueueName)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		sourceQueue := NewPriorityQueue(redisClient, sourceQueueConfig, config.ConsumerTimeout)
 		dstQueue := NewPriorityQueue(redisClient, dstQueueConfig, config.ConsumerTimeout)
-		consumer = NewMessageConsumer(client, sourceQueue, repo)
+		consumer = MakeMessageConsumer(config, redisClient, client, sourceQueue, repo)
 		producer = NewMessageProducer(dstQueue)
+		if config.SchedulerEnabled {
+			// Schedule the next snapshot based on the story's growth.
+			schedule := ScheduleConfig{
+				BaseInterval:      config.SchedulerBaseInterval,
+				MinInterval:       config.SchedulerMinInterval,
+				MaxInterval:       config.SchedulerMaxInterval,
+				ReferenceVelocity: config.SchedulerReferenceVelocity,
+				MaxStoryAge:       config.SchedulerMaxStoryAge,
+			}
+			producer = NewAdaptiveProducer(dstQueue, repo, schedule)
+		}
 	} else if config.SourceQueueName != "" && config.DstQueueName == "" {
 		// Consume messages from last source queue and do not produce any new
 		// messages.
 		sourceQueueConfig, err := MakeQueueConfig(config.SourceQueueName)
 		if err != nil {
-			panic(err)
+			return err
 		}
 
 		sourceQueue := NewPriorityQueue(redisClient, sourceQueueConfig, config.ConsumerTimeout)
-		consumer = NewMessageConsumer(client, sourceQueue, repo)
+		consumer = MakeMessageConsumer(config, redisClient, client, sourceQueue, repo)
 		producer = &NopProducer{}
 	} else {
-		errorMsg := fmt.Sprintf(
-			"Invalid queue configuration: source=%s dst=%s",
-			config.SourceQueueName,
-			config.DstQueueName,
-		)
-		panic(errorMsg)
+		return fmt.Errorf("Invalid queue configuration: source=%s dst=%s", config.SourceQueueName, config.DstQueueName)
 	}
 
-	Run(context.Background(), consumer, producer)
+	RunConcurrently(ctx, consumer, producer, concurrency)
+
+	if flusher, ok := consumer.(Flusher); ok {
+		// Don't lose the snapshots that are pending when shutting down.
+		return flusher.Flush(context.WithoutCancel(ctx))
+	}
+	return nil
 }
@@ -17,6 +17,7 @@ func MakeStoryModel(
 		APIVersion: apiVersion,
 		QueueName:  queueName,
 		FetchedAt:  fetchedAt,
+		Status:     StoryStatus(story),
 	}
 
 	raw, err := json.Marshal(story)
@@ -25,6 +26,7 @@ func MakeStoryModel(
 	}
 
 	model.RawDocument = string(raw)
+	model.CanonicalURL, model.Domain = CanonicaliseStoryURL(story.URL)
 
 	for _, comment := range comments {
 		raw, err := json.Marshal(comment)
@@ -40,3 +42,72 @@ func MakeStoryModel(
 
 	return model, nil
 }
+
+// MakeMissingStoryModel makes a StoryModel recording that a story is missing.
+func MakeMissingStoryModel(storyID int64, apiVersion string, queueName string, fetchedAt time.Time) StoryModel {
+	return StoryModel{
+		StoryID:     storyID,
+		APIVersion:  apiVersion,
+		QueueName:   queueName,
+		FetchedAt:   fetchedAt,
+		RawDocument: "null",
+		Status:      StoryStatusMissing,
+	}
+}
+
+func MakePollOptionModels(options []HNPollOpt) ([]PollOptionModel, error) {
+	var models []PollOptionModel
+	for _, option := range options {
+		raw, err := json.Marshal(option)
+		if err != nil {
+			return models, err
+		}
+
+		models = append(models, PollOptionModel{
+			PollOptionID: option.ID,
+			Score:        option.Score,
+			RawDocument:  string(raw),
+		})
+	}
+	return models, nil
+}
+
+// ParseStory parses the story that a StoryModel was made from.
+func ParseStory(model StoryModel) (HNStory, error) {
+	story := HNStory{}
+	err := json.Unmarshal([]byte(model.RawDocument), &story)
+	return story, err
+}
+
+func MakeUserModel(user HNUser, apiVersion string, fetchedAt time.Time) (UserModel, error) {
+	model := UserModel{
+		UserID:     user.ID,
+		APIVersion: apiVersion,
+		FetchedAt:  fetchedAt,
+	}
+
+	raw, err := json.Marshal(user)
+	if err != nil {
+		return model, err
+	}
+
+	model.RawDocument = string(raw)
+	return model, nil
+}
+
+// MakeStoryPoint makes a StoryPoint from a snapshot of a story.
+func MakeStoryPoint(model StoryModel) (StoryPoint, error) {
+	story, err := ParseStory(model)
+	if err != nil {
+		return StoryPoint{}, err
+	}
+
+	return StoryPoint{
+		StoryID:     model.StoryID,
+		Label:       model.QueueName,
+		CreatedAt:   time.Unix(story.Time, 0).UTC(),
+		FetchedAt:   model.FetchedAt,
+		Score:       story.Score,
+		Descendants: story.Descendants,
+	}, nil
+}
@@ -36,11 +36,14 @@ func TestMakeStoryModel(t *testing.T) {
 	fetchedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
 
 	expected := StoryModel{
-		StoryID:     8863,
-		APIVersion:  apiVersion,
-		QueueName:   queueName,
-		FetchedAt:   fetchedAt,
-		RawDocument: `{"by":"author2","descendants":71,"id":8863,"kids":[8952,9224,8917],"score":111,"time":1175714200,"title":"My YC app: Dropbox","type":"story","url":"http://www.getdropbox.com/u/2/screencast.html"}`,
+		StoryID:      8863,
+		APIVersion:   apiVersion,
+		QueueName:    queueName,
+		FetchedAt:    fetchedAt,
+		Status:       StoryStatusOK,
+		RawDocument:  `{"by":"author2","descendants":71,"id":8863,"kids":[8952,9224,8917],"score":111,"time":1175714200,"title":"My YC app: Dropbox","type":"story","url":"http://www.getdropbox.com/u/2/screencast.html"}`,
+		CanonicalURL: "https://getdropbox.com/u/2/screencast.html",
+		Domain:       "getdropbox.com",
 		Comments: []CommentModel{
 			{
 				CommentID:   2921983,
@@ -54,3 +57,65 @@ func TestMakeStoryModel(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, expected, actual)
 }
+
+func TestParseStory(t *testing.T) {
+	model := StoryModel{
+		StoryID:     8863,
+		RawDocument: `{"by":"author2","descendants":71,"id":8863,"score":111,"time":1175714200,"title":"My YC app: Dropbox","type":"story"}`,
+	}
+	expected := HNStory{
+		By:          "author2",
+		Descendants: 71,
+		ID:          8863,
+		Score:       111,
+		Time:        1175714200,
+		Title:       "My YC app: Dropbox",
+		Type:        "story",
+	}
+
+	actual, err := ParseStory(model)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestMakeUserModel(t *testing.T) {
+	user := HNUser{
+		Created:   1160418092,
+		ID:        "pg",
+		Karma:     155111,
+		Submitted: []int64{8863},
+	}
+	fetchedAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	expected := UserModel{
+		UserID:      "pg",
+		APIVersion:  "v0",
+		FetchedAt:   fetchedAt,
+		RawDocument: `{"created":1160418092,"id":"pg","karma":155111,"submitted":[8863]}`,
+	}
+
+	actual, err := MakeUserModel(user, "v0", fetchedAt)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestMakePollOptionModels(t *testing.T) {
+	options := []HNPollOpt{
+		{By: "author", ID: 3, Poll: 1, Score: 10, Text: "Yes", Time: 1175714200, Type: "pollopt"},
+	}
+
+	expected := []PollOptionModel{
+		{
+			PollOptionID: 3,
+			Score:        10,
+			RawDocument:  `{"by":"author","id":3,"poll":1,"score":10,"text":"Yes","time":1175714200,"type":"pollopt"}`,
+		},
+	}
+
+	actual, err := MakePollOptionModels(options)
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
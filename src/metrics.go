@@ -0,0 +1,53 @@
+package main
+
+import (
+	"expvar"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Metrics are published as JSON by the `expvar` package, under `/debug/vars`.
+var (
+	rateLimiterWaits       = expvar.NewInt("hn_client_rate_limiter_waits_total")
+	rateLimiterWaitSeconds = expvar.NewFloat("hn_client_rate_limiter_wait_seconds_total")
+	circuitBreakerState    = expvar.NewString("hn_client_circuit_breaker_state")
+	circuitBreakerTrips    = expvar.NewInt("hn_client_circuit_breaker_trips_total")
+	bulkWritePending       = expvar.NewInt("bulk_write_pending")
+	bulkWriteFlushes       = expvar.NewInt("bulk_write_flushes_total")
+	bulkWriteFailures      = expvar.NewInt("bulk_write_flush_failures_total")
+	bulkWriteSnapshots     = expvar.NewInt("bulk_write_snapshots_total")
+	bulkWriteErrors        = expvar.NewInt("bulk_write_errors_total")
+	bulkWriteFlushSeconds  = expvar.NewFloat("bulk_write_flush_seconds_total")
+)
+
+// ObserveRateLimiterWait records time spent waiting on a rate limiter.
+func ObserveRateLimiterWait(wait time.Duration) {
+	rateLimiterWaits.Add(1)
+	rateLimiterWaitSeconds.Add(wait.Seconds())
+}
+
+// ObserveBulkWriteFlush records a flush of a batch of snapshots, and whether
+// it failed.
+func ObserveBulkWriteFlush(snapshots int, duration time.Duration, failed bool) {
+	bulkWriteFlushes.Add(1)
+	bulkWriteSnapshots.Add(int64(snapshots))
+	bulkWriteFlushSeconds.Add(duration.Seconds())
+	if failed {
+		bulkWriteFailures.Add(1)
+	}
+}
+
+// ObserveBulkWriteError records a snapshot that couldn't be written in bulk.
+func ObserveBulkWriteError() {
+	bulkWriteErrors.Add(1)
+}
+
+// ServeMetrics serves metrics over HTTP at the given address, in the
+// background.
+func ServeMetrics(addr string) {
+	go func() {
+		err := http.ListenAndServe(addr, nil)
+		slog.Error("Metrics server stopped", "error", err)
+	}()
+}
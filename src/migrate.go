@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"embed"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrationsLockID identifies the advisory lock held while migrating, so that
+// replicas starting at the same time don't apply migrations concurrently.
+const migrationsLockID = 7265738
+
+const createMigrationsTableStmt = `
+create table if not exists schema_migrations (
+    version text not null,
+    applied_at timestamp without time zone not null default (now() at time zone 'utc'),
+
+    primary key (version)
+)
+`
+
+const readMigrationsStmt = `select version from schema_migrations`
+
+const writeMigrationStmt = `insert into schema_migrations (version) values ($1)`
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a versioned change to the database schema.
+type Migration struct {
+	Version string
+	SQL     string
+}
+
+// LoadMigrations loads migrations from the given directory, ordered by
+// version. A migration's version is its file name, without the extension.
+func LoadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, entry := range entries {
+		if entry.IsDir() || path.Ext(entry.Name()) != ".sql" {
+			continue
+		}
+
+		contents, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{
+			Version: strings.TrimSuffix(entry.Name(), ".sql"),
+			SQL:     string(contents),
+		})
+	}
+
+	slices.SortFunc(migrations, func(a, b Migration) int { return strings.Compare(a.Version, b.Version) })
+	return migrations, nil
+}
+
+// PendingMigrations returns the migrations that have not been applied, in
+// order.
+func PendingMigrations(migrations []Migration, applied []string) []Migration {
+	var pending []Migration
+	for _, migration := range migrations {
+		if !slices.Contains(applied, migration.Version) {
+			pending = append(pending, migration)
+		}
+	}
+	return pending
+}
+
+// Migrate applies the embedded migrations that have not yet been applied,
+// each in its own transaction.
+func Migrate(ctx context.Context, pool *pgxpool.Pool) error {
+	migrations, err := LoadMigrations(migrationFiles, "migrations")
+	if err != nil {
+		return err
+	}
+
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	// Session level advisory locks are held by the connection, so must be
+	// released on the same one.
+	_, err = conn.Exec(ctx, "select pg_advisory_lock($1)", migrationsLockID)
+	if err != nil {
+		return err
+	}
+	defer conn.Exec(context.Background(), "select pg_advisory_unlock($1)", migrationsLockID)
+
+	_, err = conn.Exec(ctx, createMigrationsTableStmt)
+	if err != nil {
+		return err
+	}
+
+	rows, err := conn.Query(ctx, readMigrationsStmt)
+	if err != nil {
+		return err
+	}
+	applied, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range PendingMigrations(migrations, applied) {
+		slog.Info("Applying migration", "version", migration.Version)
+
+		err = pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, migration.SQL)
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, writeMigrationStmt, migration.Version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
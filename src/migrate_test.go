@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	fsys := fstest.MapFS{
+		"migrations/0002_second.sql": {Data: []byte("select 2;")},
+		"migrations/0001_first.sql":  {Data: []byte("select 1;")},
+		"migrations/README.md":       {Data: []byte("Not a migration.")},
+	}
+
+	expected := []Migration{
+		{Version: "0001_first", SQL: "select 1;"},
+		{Version: "0002_second", SQL: "select 2;"},
+	}
+
+	actual, err := LoadMigrations(fsys, "migrations")
+
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestLoadMigrationsEmbedded(t *testing.T) {
+	migrations, err := LoadMigrations(migrationFiles, "migrations")
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, migrations)
+	assert.Equal(t, "0001_create_stories_and_comments", migrations[0].Version)
+}
+
+func TestPendingMigrations(t *testing.T) {
+	migrations := []Migration{
+		{Version: "0001_first"},
+		{Version: "0002_second"},
+		{Version: "0003_third"},
+	}
+
+	actual := PendingMigrations(migrations, []string{"0001_first", "0003_third"})
+
+	assert.Equal(t, []Migration{{Version: "0002_second"}}, actual)
+}
@@ -0,0 +1,11 @@
+/* Versioned snapshots of the profiles of story authors and commenters. */
+create table users (
+    id int generated always as identity,
+    user_id text not null,
+    api_version char(2) not null,
+    fetched_at timestamp without time zone not null,
+    raw_document jsonb not null,
+
+    primary key (id),
+    unique (user_id, fetched_at)
+);
@@ -0,0 +1,12 @@
+/* Options of polls, with their scores at each snapshot of the poll. */
+create table poll_options (
+    id int generated always as identity,
+    internal_story_id int not null,
+    poll_option_id int not null,
+    score int not null,
+    raw_document jsonb not null,
+
+    primary key (id),
+    foreign key (internal_story_id) references stories (id),
+    unique (internal_story_id, poll_option_id)
+);
@@ -0,0 +1,4 @@
+/* Lifecycle status of the story at the time of the snapshot. */
+alter table stories
+    add column status text not null default 'ok'
+    check (status in ('ok', 'deleted', 'dead', 'missing', 'not_story'));
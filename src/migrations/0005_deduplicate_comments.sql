@@ -0,0 +1,47 @@
+/*
+ * Comments are stored once per version, keyed by a hash of their content, and
+ * linked to each snapshot of a story that they appeared in. The hash is taken
+ * over the normalised `jsonb` text, so that equivalent documents hash equally.
+ */
+create table comment_versions (
+    id int generated always as identity,
+    comment_id int not null,
+    content_hash bytea not null,
+    raw_document jsonb not null,
+
+    primary key (id),
+    unique (content_hash)
+);
+
+create index comment_versions_comment_id_idx on comment_versions (comment_id);
+
+create table snapshot_comments (
+    internal_story_id int not null,
+    comment_version_id int not null,
+    /* Position of the comment amongst the story's comments. */
+    position int not null,
+
+    primary key (internal_story_id, comment_version_id),
+    foreign key (internal_story_id) references stories (id),
+    foreign key (comment_version_id) references comment_versions (id)
+);
+
+insert into comment_versions (comment_id, content_hash, raw_document)
+select distinct on (content_hash) comment_id, content_hash, raw_document
+from (
+    select comment_id, sha256(convert_to(raw_document::text, 'UTF8')) as content_hash, raw_document, id
+    from comments
+) as hashed
+order by content_hash, id;
+
+insert into snapshot_comments (internal_story_id, comment_version_id, position)
+select
+    comments.internal_story_id,
+    comment_versions.id,
+    row_number() over (partition by comments.internal_story_id order by comments.id) - 1
+from comments
+join comment_versions
+    on comment_versions.content_hash = sha256(convert_to(comments.raw_document::text, 'UTF8'))
+on conflict do nothing;
+
+drop table comments;
@@ -0,0 +1,34 @@
+/*
+ * Metrics of stories, computed in batches by the `analytics` subcommand. The
+ * growth of a story between snapshots, per hour, and its percentile rank
+ * amongst snapshots of stories of the same age, are null if they couldn't be
+ * computed.
+ */
+create table snapshot_analytics (
+    story_id int not null,
+    label text not null,
+    fetched_at timestamp without time zone not null,
+    age_seconds int not null,
+    score int not null,
+    descendants int not null,
+    score_velocity double precision,
+    comment_velocity double precision,
+    score_percentile double precision,
+    descendants_percentile double precision,
+
+    primary key (story_id, label)
+);
+
+create table story_analytics (
+    story_id int not null,
+    classification text not null
+        check (classification in ('none', 'breakout', 'late_breakout')),
+    peak_score_percentile double precision,
+    peak_age_seconds int,
+    max_score_velocity double precision,
+    computed_at timestamp without time zone not null,
+
+    primary key (story_id)
+);
+
+create index story_analytics_classification_idx on story_analytics (classification);
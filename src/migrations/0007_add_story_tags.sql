@@ -0,0 +1,5 @@
+/* Tags of the watchlists that the story matched when it was first seen. */
+alter table stories
+    add column tags text[] not null default '{}';
+
+create index stories_tags_idx on stories using gin (tags);
@@ -0,0 +1,12 @@
+/*
+ * Canonical URL of the story, which is the same for submissions of the same
+ * article, and its registrable domain. Both are null if the story has no URL.
+ * Snapshots written before these were added are backfilled by the
+ * `canonicalise` subcommand.
+ */
+alter table stories
+    add column canonical_url text,
+    add column domain text;
+
+create index stories_canonical_url_idx on stories (canonical_url);
+create index stories_domain_idx on stories (domain);
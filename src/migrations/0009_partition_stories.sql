@@ -0,0 +1,121 @@
+/*
+ * Snapshots of stories, and the links between snapshots and their comments,
+ * are partitioned by the month they were fetched in, so that old months can
+ * be archived and dropped by the `retention` subcommand. Partitions are named
+ * for their month, as in `stories_202401`, and rows outside of them fall into
+ * the default partitions.
+ *
+ * Unique keys of partitioned tables must include the partition key, so a
+ * snapshot's story and label can no longer be unique. Instead, a trigger
+ * skips the insert of a duplicate snapshot, as `on conflict do nothing` did.
+ * Poll options and comment versions no longer reference snapshots, as their
+ * partitions are dropped, and are deleted once orphaned.
+ */
+create table stories_partitioned (
+    id int generated always as identity,
+    story_id int not null,
+    api_version char(2) not null,
+    queue_name text not null,
+    fetched_at timestamp without time zone not null,
+    raw_document jsonb not null,
+    status text not null default 'ok'
+        constraint stories_status_check
+        check (status in ('ok', 'deleted', 'dead', 'missing', 'not_story')),
+    tags text[] not null default '{}',
+    canonical_url text,
+    domain text,
+
+    primary key (id, fetched_at)
+) partition by range (fetched_at);
+
+create table snapshot_comments_partitioned (
+    internal_story_id int not null,
+    comment_version_id int not null,
+    /* Position of the comment amongst the story's comments. */
+    position int not null,
+    /* Fetch time of the snapshot, by which the table is partitioned. */
+    fetched_at timestamp without time zone not null,
+
+    primary key (internal_story_id, comment_version_id, fetched_at),
+    foreign key (comment_version_id) references comment_versions (id)
+) partition by range (fetched_at);
+
+/* Partitions for each month of stored snapshots, and the next. */
+do $$
+declare
+    month timestamp;
+begin
+    for month in
+        select generate_series(first_month, last_month, interval '1 month')
+        from (
+            select
+                date_trunc('month', coalesce(min(fetched_at), now() at time zone 'utc')) as first_month,
+                date_trunc('month', greatest(max(fetched_at), now() at time zone 'utc')) + interval '1 month' as last_month
+            from stories
+        ) as bounds
+    loop
+        execute format(
+            'create table %I partition of stories_partitioned for values from (%L) to (%L)',
+            'stories_' || to_char(month, 'YYYYMM'), month, month + interval '1 month'
+        );
+        execute format(
+            'create table %I partition of snapshot_comments_partitioned for values from (%L) to (%L)',
+            'snapshot_comments_' || to_char(month, 'YYYYMM'), month, month + interval '1 month'
+        );
+    end loop;
+end
+$$;
+
+create table stories_default partition of stories_partitioned default;
+create table snapshot_comments_default partition of snapshot_comments_partitioned default;
+
+insert into stories_partitioned (id, story_id, api_version, queue_name, fetched_at, raw_document, status, tags, canonical_url, domain)
+overriding system value
+select id, story_id, api_version, queue_name, fetched_at, raw_document, status, tags, canonical_url, domain
+from stories;
+
+insert into snapshot_comments_partitioned (internal_story_id, comment_version_id, position, fetched_at)
+select snapshot_comments.internal_story_id, snapshot_comments.comment_version_id, snapshot_comments.position, stories.fetched_at
+from snapshot_comments
+join stories on stories.id = snapshot_comments.internal_story_id;
+
+alter table poll_options drop constraint poll_options_internal_story_id_fkey;
+drop table snapshot_comments;
+drop table stories;
+
+alter table stories_partitioned rename to stories;
+alter index stories_partitioned_pkey rename to stories_pkey;
+alter table snapshot_comments_partitioned rename to snapshot_comments;
+alter index snapshot_comments_partitioned_pkey rename to snapshot_comments_pkey;
+
+select setval(pg_get_serial_sequence('stories', 'id'), coalesce(max(id), 0) + 1, false) from stories;
+
+create index stories_story_id_queue_name_idx on stories (story_id, queue_name);
+create index stories_tags_idx on stories using gin (tags);
+create index stories_canonical_url_idx on stories (canonical_url);
+create index stories_domain_idx on stories (domain);
+/* Finds the comment versions that are no longer linked to any snapshot. */
+create index snapshot_comments_comment_version_id_idx on snapshot_comments (comment_version_id);
+
+/*
+ * Skips the insert of a snapshot of a story that was already taken under the
+ * same label. Inserts of the same snapshot are serialised by an advisory
+ * lock, which is held until the end of the transaction, so that the check
+ * sees snapshots inserted by concurrent transactions once they commit.
+ */
+create function skip_duplicate_snapshot() returns trigger as $$
+begin
+    perform pg_advisory_xact_lock(new.story_id, hashtext(new.queue_name));
+    if exists (
+        select 1 from stories
+        where story_id = new.story_id and queue_name = new.queue_name
+    ) then
+        return null;
+    end if;
+    return new;
+end
+$$ language plpgsql;
+
+create trigger stories_skip_duplicate_snapshot
+    before insert on stories
+    for each row execute function skip_duplicate_snapshot();
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+)
+
+// Parquet files are written, and read, with parquet-go. Exports have a flat
+// schema of optional columns, in the order of their ExportColumns, with
+// timestamps in milliseconds.
+
+const DefaultParquetRowGroupSize = 10000
+
+// parquetField is a column of an export's schema.
+type parquetField struct {
+	parquet.Node
+	name string
+}
+
+func (f *parquetField) Name() string { return f.name }
+
+func (f *parquetField) Value(base reflect.Value) reflect.Value {
+	return base.MapIndex(reflect.ValueOf(f.name))
+}
+
+// parquetColumns is the root of an export's schema. Unlike parquet.Group,
+// which orders its fields by name, it keeps the order of the columns.
+type parquetColumns struct {
+	parquet.Group
+	fields []parquet.Field
+}
+
+func (c *parquetColumns) Fields() []parquet.Field { return c.fields }
+
+func parquetSchema(columns []ExportColumn) *parquet.Schema {
+	root := &parquetColumns{Group: parquet.Group{}}
+	for _, column := range columns {
+		var node parquet.Node
+		switch column.Type {
+		case ExportInt64:
+			node = parquet.Int(64)
+		case ExportTime:
+			node = parquet.Timestamp(parquet.Millisecond)
+		case ExportString:
+			// parquet-go would otherwise use DELTA_LENGTH_BYTE_ARRAY, which
+			// fewer readers support.
+			node = parquet.Encoded(parquet.String(), &parquet.Plain)
+		}
+		node = parquet.Optional(node)
+		root.Group[column.Name] = node
+		root.fields = append(root.fields, &parquetField{Node: node, name: column.Name})
+	}
+	return parquet.NewSchema("schema", root)
+}
+
+// ParquetWriter writes rows as a Parquet file, compressed with Snappy, in row
+// groups of up to rowGroupSize rows. Values are int64, string or time.Time,
+// as per their column, or nil.
+type ParquetWriter struct {
+	writer  *parquet.Writer
+	columns []ExportColumn
+	row     parquet.Row
+}
+
+func NewParquetWriter(w io.Writer, columns []ExportColumn, rowGroupSize int) *ParquetWriter {
+	writer := parquet.NewWriter(
+		w,
+		parquetSchema(columns),
+		parquet.Compression(&parquet.Snappy),
+		parquet.MaxRowsPerRowGroup(int64(rowGroupSize)),
+		parquet.CreatedBy("hn-stories", "", ""),
+	)
+	return &ParquetWriter{writer: writer, columns: columns}
+}
+
+// WriteRow buffers a row, writing a row group once enough are buffered.
+func (p *ParquetWriter) WriteRow(row []any) error {
+	if len(row) != len(p.columns) {
+		return fmt.Errorf("Expected %d values, got %d", len(p.columns), len(row))
+	}
+
+	// Check every value before buffering any, so that a bad row isn't
+	// partially written.
+	p.row = p.row[:0]
+	for idx, value := range row {
+		var v parquet.Value
+		switch t := value.(type) {
+		case nil:
+			p.row = append(p.row, parquet.NullValue().Level(0, 0, idx))
+			continue
+		case int64:
+			if p.columns[idx].Type == ExportInt64 {
+				v = parquet.Int64Value(t)
+			}
+		case time.Time:
+			if p.columns[idx].Type == ExportTime {
+				v = parquet.Int64Value(t.UnixMilli())
+			}
+		case string:
+			if p.columns[idx].Type == ExportString {
+				v = parquet.ByteArrayValue([]byte(t))
+			}
+		}
+		if v.IsNull() {
+			return fmt.Errorf("Unsupported value for column %s: %T", p.columns[idx].Name, value)
+		}
+		p.row = append(p.row, v.Level(0, 1, idx))
+	}
+
+	_, err := p.writer.WriteRows([]parquet.Row{p.row})
+	return err
+}
+
+// Close writes any buffered rows, and then the file's metadata. It doesn't
+// close the underlying writer.
+func (p *ParquetWriter) Close() error {
+	return p.writer.Close()
+}
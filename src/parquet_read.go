@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+)
+
+var ErrInvalidParquet = errors.New("Invalid Parquet file")
+
+// julianDayOfEpoch is the Julian day of 1970-01-01, for INT96 timestamps.
+const julianDayOfEpoch = 2440588
+
+// ParquetReader reads rows of a Parquet file, a row group at a time. Only
+// flat schemas are supported. Values are int64, for integers, string, for
+// byte arrays, time.Time, for timestamps, or nil.
+type ParquetReader struct {
+	file    *parquet.File
+	NumRows int64
+}
+
+func NewParquetReader(r io.ReaderAt, size int64) (*ParquetReader, error) {
+	file, err := parquet.OpenFile(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidParquet, err)
+	}
+	for _, field := range file.Schema().Fields() {
+		if !field.Leaf() {
+			return nil, fmt.Errorf("Unsupported nested column: %s", field.Name())
+		}
+		if field.Repeated() {
+			return nil, fmt.Errorf("Unsupported repeated column: %s", field.Name())
+		}
+	}
+	return &ParquetReader{file: file, NumRows: file.NumRows()}, nil
+}
+
+// Columns returns the names of the file's columns.
+func (p *ParquetReader) Columns() []string {
+	fields := p.file.Schema().Fields()
+	names := make([]string, 0, len(fields))
+	for _, field := range fields {
+		names = append(names, field.Name())
+	}
+	return names
+}
+
+// parquetValue converts a value of a column to int64, string or time.Time.
+func parquetValue(typ parquet.Type, value parquet.Value) (any, error) {
+	if value.IsNull() {
+		return nil, nil
+	}
+
+	var unit time.Duration
+	if logical := typ.LogicalType(); logical != nil && logical.Timestamp != nil {
+		unit = timestampUnit(logical.Timestamp)
+	}
+
+	switch typ.Kind() {
+	case parquet.Int32:
+		return int64(value.Int32()), nil
+	case parquet.Int64:
+		if unit > 0 {
+			return time.Unix(0, 0).UTC().Add(time.Duration(value.Int64()) * unit), nil
+		}
+		return value.Int64(), nil
+	case parquet.Int96:
+		// Nanoseconds of the day, then the Julian day.
+		v := value.Int96()
+		nanos := int64(v[1])<<32 | int64(v[0])
+		days := int64(v[2]) - julianDayOfEpoch
+		return time.Unix(days*24*60*60, nanos).UTC(), nil
+	case parquet.ByteArray, parquet.FixedLenByteArray:
+		return string(value.ByteArray()), nil
+	}
+	return nil, fmt.Errorf("Unsupported type: %s", typ)
+}
+
+func timestampUnit(timestamp *format.TimestampType) time.Duration {
+	switch {
+	case timestamp.Unit.Millis != nil:
+		return time.Millisecond
+	case timestamp.Unit.Micros != nil:
+		return time.Microsecond
+	}
+	return time.Nanosecond
+}
+
+// ForEachRow calls fn with the values of the named columns of each row in
+// turn. Columns that aren't in the file are nil. Only one row group is read
+// at a time.
+func (p *ParquetReader) ForEachRow(names []string, fn func([]any) error) error {
+	fields := p.file.Schema().Fields()
+	indexes := make([]int, len(names))
+	for idx, name := range names {
+		indexes[idx] = -1
+		for fieldIdx, field := range fields {
+			if field.Name() == name {
+				indexes[idx] = fieldIdx
+			}
+		}
+	}
+
+	row := make([]any, len(names))
+	for _, rowGroup := range p.file.RowGroups() {
+		rows := rowGroup.Rows()
+		err := forEachParquetRow(rows, func(values parquet.Row) error {
+			for idx, fieldIdx := range indexes {
+				row[idx] = nil
+				if fieldIdx < 0 {
+					continue
+				}
+				value, err := parquetValue(fields[fieldIdx].Type(), values[fieldIdx])
+				if err != nil {
+					return fmt.Errorf("Error reading column %s: %w", names[idx], err)
+				}
+				row[idx] = value
+			}
+			return fn(row)
+		})
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachParquetRow calls fn with each of the rows in turn.
+func forEachParquetRow(rows parquet.Rows, fn func(parquet.Row) error) error {
+	buf := make([]parquet.Row, 100)
+	for {
+		n, err := rows.ReadRows(buf)
+		for _, values := range buf[:n] {
+			if err := fn(values); err != nil {
+				return err
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidParquet, err)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	"github.com/parquet-go/parquet-go/deprecated"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParquetWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	columns := []ExportColumn{{Name: "id", Type: ExportInt64}, {Name: "title", Type: ExportString}, {Name: "at", Type: ExportTime}}
+	writer := NewParquetWriter(buf, columns, 2)
+	assert.Nil(t, writer.WriteRow([]any{int64(1), "First", testExportFetchedAt}))
+	assert.Nil(t, writer.WriteRow([]any{int64(2), nil, nil}))
+	assert.Nil(t, writer.WriteRow([]any{int64(3), "Third", testExportFetchedAt.Add(time.Second)}))
+	assert.NotNil(t, writer.WriteRow([]any{int64(4), nil, "2020"}))
+	assert.NotNil(t, writer.WriteRow([]any{int64(4)}))
+	assert.Nil(t, writer.Close())
+
+	file, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), file.NumRows())
+	assert.Len(t, file.RowGroups(), 2)
+
+	// Columns are in the order given, rather than by name.
+	fields := file.Schema().Fields()
+	assert.Len(t, fields, 3)
+	for idx, column := range columns {
+		assert.Equal(t, column.Name, fields[idx].Name())
+		assert.True(t, fields[idx].Optional())
+	}
+	timestamp := fields[2].Type().LogicalType().Timestamp
+	assert.NotNil(t, timestamp.Unit.Millis)
+
+	reader := parquet.NewReader(file)
+	rows := make([]parquet.Row, 4)
+	n, err := reader.ReadRows(rows)
+	if !errors.Is(err, io.EOF) {
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 3, n)
+
+	assert.Equal(t, int64(1), rows[0][0].Int64())
+	assert.Equal(t, "First", rows[0][1].String())
+	assert.Equal(t, testExportFetchedAt.UnixMilli(), rows[0][2].Int64())
+	assert.Equal(t, int64(2), rows[1][0].Int64())
+	assert.True(t, rows[1][1].IsNull())
+	assert.True(t, rows[1][2].IsNull())
+	assert.Equal(t, "Third", rows[2][1].String())
+	assert.Equal(t, testExportFetchedAt.Add(time.Second).UnixMilli(), rows[2][2].Int64())
+}
+
+func TestParquetWriterWhenEmpty(t *testing.T) {
+	buf := &bytes.Buffer{}
+	writer := NewParquetWriter(buf, LongColumns, DefaultParquetRowGroupSize)
+
+	assert.Nil(t, writer.Close())
+
+	file, err := parquet.OpenFile(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), file.NumRows())
+	assert.Len(t, file.Schema().Fields(), len(LongColumns))
+}
+
+func TestParquetReader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	columns := []ExportColumn{{Name: "id", Type: ExportInt64}, {Name: "title", Type: ExportString}, {Name: "at", Type: ExportTime}}
+	writer := NewParquetWriter(buf, columns, 2)
+	rows := [][]any{
+		{int64(1), "First", testExportFetchedAt},
+		{int64(2), nil, nil},
+		{int64(3), "Third", testExportFetchedAt.Add(time.Second)},
+	}
+	for _, row := range rows {
+		assert.Nil(t, writer.WriteRow(row))
+	}
+	assert.Nil(t, writer.Close())
+
+	reader, err := NewParquetReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), reader.NumRows)
+	assert.Equal(t, []string{"id", "title", "at"}, reader.Columns())
+
+	var actual [][]any
+	err = reader.ForEachRow([]string{"at", "id", "title", "missing"}, func(row []any) error {
+		actual = append(actual, append([]any{}, row...))
+		return nil
+	})
+
+	expected := [][]any{
+		{testExportFetchedAt, int64(1), "First", nil},
+		{nil, int64(2), nil, nil},
+		{testExportFetchedAt.Add(time.Second), int64(3), "Third", nil},
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, expected, actual)
+}
+
+func TestNewParquetReaderWhenInvalidReturnsError(t *testing.T) {
+	for _, file := range []string{"", "PAR1PAR1", "PAR1\x00\x00\x00\x00\xff\x00\x00\x00PAR1", "PAR1\x00\x00\x00\x00\x04\x00\x00\x00PAR2"} {
+		_, err := NewParquetReader(bytes.NewReader([]byte(file)), int64(len(file)))
+		assert.NotNil(t, err, file)
+	}
+}
+
+// externalRow is a row of files written by parquet-go directly, rather than
+// by ParquetWriter.
+type externalRow struct {
+	ID    int64      `parquet:"id"`
+	Title *string    `parquet:"title,optional,dict"`
+	At    *time.Time `parquet:"at,optional"`
+}
+
+func TestParquetReaderReadsParquetGoFiles(t *testing.T) {
+	first, third := "First", "Third"
+	at := testExportFetchedAt.Add(time.Millisecond)
+	rows := []externalRow{
+		{ID: 1, Title: &first, At: &at},
+		{ID: 2},
+		{ID: 3, Title: &third, At: &at},
+		{ID: 4, Title: &first},
+	}
+
+	type testCase struct {
+		Name  string
+		Codec compress.Codec
+	}
+
+	// Only v2 data pages are written, as this version of parquet-go writes
+	// v1 pages of optional columns with a spurious repetition level section.
+	testCases := []testCase{
+		{Name: "Uncompressed", Codec: &parquet.Uncompressed},
+		{Name: "Snappy", Codec: &parquet.Snappy},
+		{Name: "Gzip", Codec: &parquet.Gzip},
+		{Name: "Zstd", Codec: &parquet.Zstd},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			writer := parquet.NewGenericWriter[externalRow](
+				buf,
+				parquet.Compression(tc.Codec),
+				parquet.DataPageVersion(2),
+				parquet.MaxRowsPerRowGroup(3),
+			)
+			_, err := writer.Write(rows)
+			assert.Nil(t, err)
+			assert.Nil(t, writer.Close())
+
+			reader, err := NewParquetReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			assert.Nil(t, err)
+			assert.Equal(t, int64(len(rows)), reader.NumRows)
+			assert.Equal(t, []string{"id", "title", "at"}, reader.Columns())
+
+			var actual [][]any
+			err = reader.ForEachRow([]string{"id", "title", "at"}, func(row []any) error {
+				actual = append(actual, append([]any{}, row...))
+				return nil
+			})
+
+			expected := [][]any{
+				{int64(1), "First", at},
+				{int64(2), nil, nil},
+				{int64(3), "Third", at},
+				{int64(4), "First", nil},
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, expected, actual)
+		})
+	}
+}
+
+func TestParquetReaderReadsInt96Timestamps(t *testing.T) {
+	type int96Row struct {
+		At deprecated.Int96 `parquet:"at"`
+	}
+
+	// 2020-01-01 is Julian day 2458850, and the time of day is in
+	// nanoseconds.
+	nanos := uint64(90*time.Minute + 1500*time.Millisecond)
+	buf := &bytes.Buffer{}
+	writer := parquet.NewGenericWriter[int96Row](buf)
+	_, err := writer.Write([]int96Row{{At: deprecated.Int96{uint32(nanos), uint32(nanos >> 32), 2458850}}})
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	reader, err := NewParquetReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.Nil(t, err)
+
+	var actual []any
+	err = reader.ForEachRow([]string{"at"}, func(row []any) error {
+		actual = append(actual, row[0])
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []any{testExportFetchedAt.Add(90*time.Minute + 1500*time.Millisecond)}, actual)
+}
+
+func TestNewParquetReaderWhenNestedReturnsError(t *testing.T) {
+	type nestedRow struct {
+		Story struct {
+			ID int64 `parquet:"id"`
+		} `parquet:"story"`
+	}
+
+	buf := &bytes.Buffer{}
+	writer := parquet.NewGenericWriter[nestedRow](buf)
+	_, err := writer.Write([]nestedRow{{}})
+	assert.Nil(t, err)
+	assert.Nil(t, writer.Close())
+
+	_, err = NewParquetReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	assert.NotNil(t, err)
+}
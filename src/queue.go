@@ -5,15 +5,22 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
 const (
-	QueueKeyPrefix     = "ingestion-queue"
-	DefaultGracePeriod = 1 * time.Minute
-	NewQueueName       = "new"
+	QueueKeyPrefix             = "ingestion-queue"
+	QueueControlKeyPrefix      = "ingestion-queue-control"
+	DefaultGracePeriod         = 1 * time.Minute
+	DefaultDequeuePollInterval = 1 * time.Second
+	NewQueueName               = "new"
+	UpdatesQueueName           = "updates"
+	// ClaimBatchSize is the number of due messages considered, per attempt,
+	// when claiming a message from the queue.
+	ClaimBatchSize = 10
 )
 
 var ErrTimeout = errors.New("Timeout expired")
@@ -32,6 +39,11 @@ func (c QueueConfig) MakeKey() string {
 	return fmt.Sprintf("%s:%s", QueueKeyPrefix, c.Name)
 }
 
+// MakePausedKey makes the key that is set while the queue is paused.
+func (c QueueConfig) MakePausedKey() string {
+	return fmt.Sprintf("%s:%s:paused", QueueControlKeyPrefix, c.Name)
+}
+
 // MakeNewQueueConfig makes a QueueConfig for the "new" queue.
 func MakeNewQueueConfig() QueueConfig {
 	return QueueConfig{
@@ -41,15 +53,21 @@ func MakeNewQueueConfig() QueueConfig {
 	}
 }
 
-// MakeQueueConfig makes a QueueConfig based on the queue's name.
+// MakeQueueConfig makes a QueueConfig based on the queue's name. Queues are
+// named after the time to wait before processing, except for the "new",
+// "updates", "adaptive" and "watch" queues, whose messages are processed at
+// the time they were scheduled for. The time to wait can't be negative.
 func MakeQueueConfig(name string) (QueueConfig, error) {
 	var (
 		err          error
 		processAfter = 0 * time.Second
 	)
 
-	if name != NewQueueName {
+	if name != NewQueueName && name != UpdatesQueueName && name != AdaptiveQueueName && name != WatchQueueName {
 		processAfter, err = time.ParseDuration(name)
+		if err == nil && processAfter < 0 {
+			err = fmt.Errorf("Negative time to wait: %s", name)
+		}
 	}
 
 	return QueueConfig{
@@ -66,6 +84,12 @@ type Message struct {
 	// CreatedAt gives the time the story was created at, or nil if it is
 	// unknown. The latter case occurs when fetching new story ids.
 	CreatedAt *time.Time `json:"created_at"`
+	// Label overrides the label that the story's snapshot is stored under,
+	// which is otherwise the name of the queue it was consumed from.
+	Label string `json:"label,omitempty"`
+	// MissingAttempts counts the attempts at snapshotting the story that
+	// found it missing, which may only be transient.
+	MissingAttempts int `json:"missing_attempts,omitempty"`
 	// ProcessAt gives the time at which the message should be processed.
 	ProcessAt time.Time `json:"-"`
 }
@@ -90,20 +114,37 @@ func (msg *Message) Decode(data string, processAt float64) error {
 
 // Broker is an interface to the message broker.
 type Broker interface {
-	BZPopMin(context.Context, time.Duration, ...string) *redis.ZWithKeyCmd
 	ZAddNX(context.Context, string, ...redis.Z) *redis.IntCmd
+	ZRangeByScoreWithScores(context.Context, string, *redis.ZRangeBy) *redis.ZSliceCmd
+	ZRem(context.Context, string, ...interface{}) *redis.IntCmd
+	ZCard(context.Context, string) *redis.IntCmd
+	ZRangeWithScores(context.Context, string, int64, int64) *redis.ZSliceCmd
+	ZAddXX(context.Context, string, ...redis.Z) *redis.IntCmd
+	Exists(context.Context, ...string) *redis.IntCmd
+	Get(context.Context, string) *redis.StringCmd
+	SetNX(context.Context, string, interface{}, time.Duration) *redis.BoolCmd
+	Del(context.Context, ...string) *redis.IntCmd
 }
 
 // PriorityQueue represents a persistent priority queue. Enqueued messages are
 // unique and ordered by the time at which they should be processed
+//
+// A Timeout value of 0 indicates that dequeuing should block until a message
+// is available.
 type PriorityQueue struct {
-	client  Broker
-	config  QueueConfig
-	Timeout time.Duration
+	client       Broker
+	config       QueueConfig
+	Timeout      time.Duration
+	PollInterval time.Duration
 }
 
 func NewPriorityQueue(client Broker, config QueueConfig, timeout time.Duration) *PriorityQueue {
-	return &PriorityQueue{client: client, config: config, Timeout: timeout}
+	return &PriorityQueue{
+		client:       client,
+		config:       config,
+		Timeout:      timeout,
+		PollInterval: DefaultDequeuePollInterval,
+	}
 }
 
 func (pq *PriorityQueue) QueueName() string {
@@ -129,22 +170,76 @@ func (pq *PriorityQueue) Enqueue(ctx context.Context, msg Message) error {
 	return pq.client.ZAddNX(ctx, key, redis.Z{Member: member, Score: float64(score)}).Err()
 }
 
-// Dequeue dequeues the next message to be processed, blocking until a new
-// message is available or the configured timeout is reached. Note that this
-// implies at-most once message delivery semantics.
-func (pq *PriorityQueue) Dequeue(ctx context.Context) (Message, error) {
-	msg := Message{}
-
+// claim attempts to claim a message that is due for processing at the given
+// time. Due messages are removed from the queue one at a time, and a message
+// is only claimed by the consumer that succeeds in removing it, so that no
+// message is claimed more than once across concurrent consumers. If no
+// message could be claimed, nil is returned.
+func (pq *PriorityQueue) claim(ctx context.Context, now time.Time) (*redis.Z, error) {
 	key := pq.config.MakeKey()
-	item, err := pq.client.BZPopMin(ctx, pq.Timeout, key).Result()
+	due, err := pq.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: ClaimBatchSize,
+	}).Result()
 	if err != nil {
-		return msg, err
+		return nil, err
 	}
 
-	if item == nil {
-		return msg, ErrTimeout
+	for _, item := range due {
+		removed, err := pq.client.ZRem(ctx, key, item.Member).Result()
+		if err != nil {
+			return nil, err
+		}
+		if removed == 1 {
+			return &item, nil
+		}
+		// Claimed by another consumer, try the next one.
 	}
 
-	err = msg.Decode(item.Member.(string), item.Score)
-	return msg, err
+	return nil, nil
+}
+
+// Dequeue dequeues the next message that is due to be processed, polling
+// until such a message is available or the configured timeout is reached.
+// Messages that are not yet due are left on the queue, so that they are
+// available to other consumers and do not hold back messages that are due
+// sooner. No messages are dequeued while the queue is paused. Note that this
+// implies at-most once message delivery semantics.
+func (pq *PriorityQueue) Dequeue(ctx context.Context) (Message, error) {
+	msg := Message{}
+
+	deadline := time.Now().UTC().Add(pq.Timeout)
+	hasDeadline := HasDeadline(pq.Timeout)
+
+	for {
+		now := time.Now().UTC()
+		paused, err := pq.Paused(ctx)
+		if err != nil {
+			return msg, err
+		}
+
+		var item *redis.Z
+		if !paused {
+			item, err = pq.claim(ctx, now)
+			if err != nil {
+				return msg, err
+			}
+		}
+
+		if item != nil {
+			err = msg.Decode(item.Member.(string), item.Score)
+			return msg, err
+		}
+
+		if hasDeadline && !now.Before(deadline) {
+			return msg, ErrTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return msg, ctx.Err()
+		case <-time.After(pq.PollInterval):
+		}
+	}
 }
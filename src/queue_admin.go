@@ -0,0 +1,393 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// queueScanCount is the number of keys scanned at a time when finding
+	// queues.
+	queueScanCount = 100
+	// queuePageSize is the number of messages read at a time when reading
+	// every message on a queue.
+	queuePageSize = 1000
+)
+
+// DefaultLagBuckets are the upper bounds of the buckets of lag histograms.
+var DefaultLagBuckets = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	15 * time.Minute,
+	time.Hour,
+	6 * time.Hour,
+	24 * time.Hour,
+}
+
+// QueueAdminBroker provides methods to find and inspect queues.
+type QueueAdminBroker interface {
+	Broker
+	Scan(context.Context, uint64, string, int64) *redis.ScanCmd
+}
+
+// QueueStats describes a queue. Oldest and Newest are the times that the
+// first and last messages on the queue are to be processed at, and are zero
+// if the queue is empty.
+type QueueStats struct {
+	Name   string
+	Depth  int64
+	Oldest time.Time
+	Newest time.Time
+	Paused bool
+}
+
+// scanKeys finds the keys matching a pattern, calling fn with each. Keys may
+// be found more than once.
+func scanKeys(ctx context.Context, client QueueAdminBroker, match string, fn func(string)) error {
+	var cursor uint64
+	for {
+		keys, next, err := client.Scan(ctx, cursor, match, queueScanCount).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			fn(key)
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// QueueNames finds the names of the queues with messages on them, or that
+// are paused, in order.
+func QueueNames(ctx context.Context, client QueueAdminBroker) ([]string, error) {
+	var names []string
+	add := func(name string) {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+
+	err := scanKeys(ctx, client, QueueKeyPrefix+":*", func(key string) {
+		add(strings.TrimPrefix(key, QueueKeyPrefix+":"))
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = scanKeys(ctx, client, QueueControlKeyPrefix+":*:paused", func(key string) {
+		add(strings.TrimSuffix(strings.TrimPrefix(key, QueueControlKeyPrefix+":"), ":paused"))
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Sort(names)
+	return names, nil
+}
+
+// ListQueues describes the queues with messages on them, or that are paused,
+// in order of their names.
+func ListQueues(ctx context.Context, client QueueAdminBroker) ([]QueueStats, error) {
+	names, err := QueueNames(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]QueueStats, 0, len(names))
+	for _, name := range names {
+		queue := NewPriorityQueue(client, QueueConfig{Name: name}, 0)
+		queueStats, err := queue.Stats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, queueStats)
+	}
+	return stats, nil
+}
+
+// Stats describes the queue.
+func (pq *PriorityQueue) Stats(ctx context.Context) (QueueStats, error) {
+	stats := QueueStats{Name: pq.QueueName()}
+	key := pq.config.MakeKey()
+
+	depth, err := pq.client.ZCard(ctx, key).Result()
+	if err != nil {
+		return stats, err
+	}
+	stats.Depth = depth
+
+	for _, bound := range []struct {
+		rank int64
+		dst  *time.Time
+	}{{0, &stats.Oldest}, {-1, &stats.Newest}} {
+		items, err := pq.client.ZRangeWithScores(ctx, key, bound.rank, bound.rank).Result()
+		if err != nil {
+			return stats, err
+		}
+		if len(items) > 0 {
+			*bound.dst = time.Unix(int64(items[0].Score), 0).UTC()
+		}
+	}
+
+	stats.Paused, err = pq.Paused(ctx)
+	return stats, err
+}
+
+// Peek reads, without removing them, up to count messages from the front of
+// the queue, in the order they're due to be processed.
+func (pq *PriorityQueue) Peek(ctx context.Context, count int64) ([]Message, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+
+	items, err := pq.client.ZRangeWithScores(ctx, pq.config.MakeKey(), 0, count-1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make([]Message, 0, len(items))
+	for _, item := range items {
+		msg := Message{}
+		if err := msg.Decode(item.Member.(string), item.Score); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+// scan reads every message on the queue, a page at a time, in the order
+// they're due to be processed, calling fn with each and the member it's
+// stored as. Messages that are added or removed while the queue is scanned
+// may be missed, or read more than once.
+func (pq *PriorityQueue) scan(ctx context.Context, fn func(Message, redis.Z) error) error {
+	key := pq.config.MakeKey()
+	for start := int64(0); ; start += queuePageSize {
+		items, err := pq.client.ZRangeWithScores(ctx, key, start, start+queuePageSize-1).Result()
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			msg := Message{}
+			if err := msg.Decode(item.Member.(string), item.Score); err != nil {
+				return err
+			}
+			if err := fn(msg, item); err != nil {
+				return err
+			}
+		}
+		if len(items) < queuePageSize {
+			return nil
+		}
+	}
+}
+
+// find finds the members of the queue that are messages about a story.
+func (pq *PriorityQueue) find(ctx context.Context, storyID int64) ([]redis.Z, error) {
+	var found []redis.Z
+	err := pq.scan(ctx, func(msg Message, item redis.Z) error {
+		if msg.StoryID == storyID {
+			found = append(found, item)
+		}
+		return nil
+	})
+	return found, err
+}
+
+// Remove removes every message about a story from the queue, returning the
+// number removed.
+func (pq *PriorityQueue) Remove(ctx context.Context, storyID int64) (int64, error) {
+	found, err := pq.find(ctx, storyID)
+	if err != nil || len(found) == 0 {
+		return 0, err
+	}
+
+	members := make([]interface{}, 0, len(found))
+	for _, item := range found {
+		members = append(members, item.Member)
+	}
+	return pq.client.ZRem(ctx, pq.config.MakeKey(), members...).Result()
+}
+
+// Move moves every message about a story from the queue onto dst, which may
+// be the queue itself, returning the number moved. Messages keep the time
+// they're to be processed at, unless processAt is given. Each message is
+// removed before it's enqueued onto dst, so that a message that is claimed by
+// a consumer while it's being moved isn't also moved, and it's put back if it
+// can't be enqueued.
+func (pq *PriorityQueue) Move(ctx context.Context, storyID int64, dst *PriorityQueue, processAt *time.Time) (int64, error) {
+	found, err := pq.find(ctx, storyID)
+	if err != nil {
+		return 0, err
+	}
+
+	key := pq.config.MakeKey()
+	var moved int64
+	for _, item := range found {
+		removed, err := pq.client.ZRem(ctx, key, item.Member).Result()
+		if err != nil {
+			return moved, err
+		}
+		if removed == 0 {
+			// Claimed by a consumer.
+			continue
+		}
+
+		msg := Message{}
+		if err := msg.Decode(item.Member.(string), item.Score); err != nil {
+			return moved, errors.Join(err, pq.client.ZAddNX(ctx, key, item).Err())
+		}
+		if processAt != nil {
+			msg.ProcessAt = *processAt
+		}
+		if err := dst.Enqueue(ctx, msg); err != nil {
+			return moved, errors.Join(err, pq.client.ZAddNX(ctx, key, item).Err())
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// Pause pauses the queue, so that no messages are dequeued from it until
+// it's resumed. Messages may still be enqueued onto it. Pausing a queue that
+// is already paused has no effect.
+func (pq *PriorityQueue) Pause(ctx context.Context) error {
+	pausedAt := time.Now().UTC().Format(time.RFC3339)
+	return pq.client.SetNX(ctx, pq.config.MakePausedKey(), pausedAt, 0).Err()
+}
+
+// Resume resumes the queue after it's been paused, returning the number of
+// messages that were rescheduled.
+//
+// Messages that fell due while the queue was paused, or that were still
+// within their grace period when it was paused, would otherwise expire as
+// soon as they're dequeued. They're rescheduled for as long after they were
+// due as the queue was paused, so that they're spread out as they were.
+func (pq *PriorityQueue) Resume(ctx context.Context) (int64, error) {
+	key := pq.config.MakePausedKey()
+	value, err := pq.client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	pausedAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid time the %s queue was paused at: %s", pq.QueueName(), value)
+	}
+
+	now := time.Now().UTC()
+	paused := now.Sub(pausedAt).Truncate(time.Second)
+	rescheduled, err := pq.delay(ctx, pausedAt.Add(-pq.GracePeriod()), now, paused)
+	if err != nil {
+		return rescheduled, err
+	}
+
+	// The queue stays paused until its messages are rescheduled, so that
+	// none are dequeued in the meantime.
+	return rescheduled, pq.client.Del(ctx, key).Err()
+}
+
+// delay delays the messages due between from and to, inclusive, by the given
+// duration.
+func (pq *PriorityQueue) delay(ctx context.Context, from, to time.Time, by time.Duration) (int64, error) {
+	if by <= 0 {
+		return 0, nil
+	}
+
+	key := pq.config.MakeKey()
+	due, err := pq.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min: strconv.FormatInt(from.Unix(), 10),
+		Max: strconv.FormatInt(to.Unix(), 10),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var delayed int64
+	for page := range slices.Chunk(due, queuePageSize) {
+		items := make([]redis.Z, 0, len(page))
+		for _, item := range page {
+			items = append(items, redis.Z{Member: item.Member, Score: item.Score + by.Seconds()})
+		}
+		// Only messages still on the queue are updated.
+		if err := pq.client.ZAddXX(ctx, key, items...).Err(); err != nil {
+			return delayed, err
+		}
+		delayed += int64(len(items))
+	}
+	return delayed, nil
+}
+
+// Paused reports whether the queue is paused.
+func (pq *PriorityQueue) Paused(ctx context.Context) (bool, error) {
+	exists, err := pq.client.Exists(ctx, pq.config.MakePausedKey()).Result()
+	return exists > 0, err
+}
+
+// LagHistogram counts the messages on a queue by how long they're overdue,
+// relative to the time at which they're to be processed. Counts[idx] is the
+// number of due messages that are overdue by at most Buckets[idx], and more
+// than the bucket before it, with those overdue by more than the last bucket
+// counted last. Messages that aren't yet due are counted by NotDue.
+type LagHistogram struct {
+	Buckets []time.Duration
+	Counts  []int64
+	NotDue  int64
+}
+
+// NewLagHistogram makes an empty LagHistogram from the upper bounds of its
+// buckets, which are sorted.
+func NewLagHistogram(buckets []time.Duration) *LagHistogram {
+	buckets = slices.Clone(buckets)
+	slices.Sort(buckets)
+	return &LagHistogram{
+		Buckets: buckets,
+		Counts:  make([]int64, len(buckets)+1),
+	}
+}
+
+// Observe counts a message by its lag.
+func (h *LagHistogram) Observe(lag time.Duration) {
+	if lag < 0 {
+		h.NotDue++
+		return
+	}
+	idx, _ := slices.BinarySearch(h.Buckets, lag)
+	h.Counts[idx]++
+}
+
+// Labels labels each bucket of the histogram, in the order of its counts.
+func (h *LagHistogram) Labels() []string {
+	labels := make([]string, 0, len(h.Counts))
+	for _, bucket := range h.Buckets {
+		labels = append(labels, fmt.Sprintf("<= %s", bucket))
+	}
+	if len(h.Buckets) > 0 {
+		labels = append(labels, fmt.Sprintf("> %s", h.Buckets[len(h.Buckets)-1]))
+	} else {
+		labels = append(labels, "due")
+	}
+	return labels
+}
+
+// Lag counts every message on the queue by how long it's overdue at the
+// given time.
+func (pq *PriorityQueue) Lag(ctx context.Context, now time.Time, buckets []time.Duration) (*LagHistogram, error) {
+	histogram := NewLagHistogram(buckets)
+	err := pq.scan(ctx, func(msg Message, _ redis.Z) error {
+		histogram.Observe(now.Sub(msg.ProcessAt))
+		return nil
+	})
+	return histogram, err
+}
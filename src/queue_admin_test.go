@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockQueueAdminBroker struct {
+	mockBroker
+}
+
+func (m *mockQueueAdminBroker) Scan(ctx context.Context, cursor uint64, match string, count int64) *redis.ScanCmd {
+	args := m.Called(ctx, cursor, match, count)
+	cmd := redis.NewScanCmd(ctx, nil)
+	cmd.SetVal(args.Get(0).([]string), args.Get(1).(uint64))
+	return cmd
+}
+
+func TestListQueues(t *testing.T) {
+	broker := new(mockQueueAdminBroker)
+	broker.On("Scan", mock.Anything, uint64(0), "ingestion-queue:*", int64(queueScanCount)).Return([]string{"ingestion-queue:new", "ingestion-queue:15m"}, uint64(7))
+	// Keys may be returned more than once by a scan.
+	broker.On("Scan", mock.Anything, uint64(7), "ingestion-queue:*", int64(queueScanCount)).Return([]string{"ingestion-queue:new"}, uint64(0))
+	broker.On("Scan", mock.Anything, uint64(0), "ingestion-queue-control:*:paused", int64(queueScanCount)).Return([]string{"ingestion-queue-control:30m:paused", "ingestion-queue-control:new:paused"}, uint64(0))
+	broker.On("ZCard", mock.Anything, "ingestion-queue:15m").Return(int64(2), nil)
+	broker.On("ZCard", mock.Anything, "ingestion-queue:30m").Return(int64(0), nil)
+	broker.On("ZCard", mock.Anything, "ingestion-queue:new").Return(int64(5), nil)
+	broker.On("ZRangeWithScores", mock.Anything, "ingestion-queue:15m", int64(0), int64(0)).Return([]redis.Z{{Member: "", Score: 1577836800}}, nil)
+	broker.On("ZRangeWithScores", mock.Anything, "ingestion-queue:15m", int64(-1), int64(-1)).Return([]redis.Z{{Member: "", Score: 1577840400}}, nil)
+	broker.On("ZRangeWithScores", mock.Anything, "ingestion-queue:30m", mock.Anything, mock.Anything).Return([]redis.Z{}, nil)
+	broker.On("ZRangeWithScores", mock.Anything, "ingestion-queue:new", mock.Anything, mock.Anything).Return([]redis.Z{{Member: "", Score: 1577836800}}, nil)
+	broker.On("Exists", mock.Anything, []string{"ingestion-queue-control:15m:paused"}).Return(int64(0), nil)
+	broker.On("Exists", mock.Anything, []string{"ingestion-queue-control:30m:paused"}).Return(int64(1), nil)
+	broker.On("Exists", mock.Anything, []string{"ingestion-queue-control:new:paused"}).Return(int64(1), nil)
+
+	stats, err := ListQueues(context.Background(), broker)
+
+	expected := []QueueStats{
+		{Name: "15m", Depth: 2, Oldest: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Newest: time.Date(2020, 1, 1, 1, 0, 0, 0, time.UTC)},
+		{Name: "30m", Depth: 0, Paused: true},
+		{Name: "new", Depth: 5, Oldest: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Newest: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), Paused: true},
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, expected, stats)
+}
+
+func TestPriorityQueuePeek(t *testing.T) {
+	items := []redis.Z{
+		{Member: `{"story_id":1,"created_at":null}`, Score: 1577836800},
+		{Member: `{"story_id":2,"created_at":null,"label":"backfill"}`, Score: 1577836860},
+	}
+
+	broker := newMockBroker()
+	broker.On("ZRangeWithScores", mock.Anything, "ingestion-queue:pq", int64(0), int64(1)).Return(items, nil)
+
+	pq := NewPriorityQueue(broker, QueueConfig{Name: "pq"}, 0)
+	messages, err := pq.Peek(context.Background(), 2)
+
+	expected := []Message{
+		{StoryID: 1, ProcessAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{StoryID: 2, Label: "backfill", ProcessAt: time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC)},
+	}
+	assert.Nil(t, err)
+	assert.Equal(t, expected, messages)
+	broker.AssertNotCalled(t, "ZRem", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPriorityQueueRemove(t *testing.T) {
+	items := []redis.Z{
+		{Member: `{"story_id":1,"created_at":null}`, Score: 1577836800},
+		{Member: `{"story_id":2,"created_at":null}`, Score: 1577836800},
+		{Member: `{"story_id":1,"created_at":null,"label":"backfill"}`, Score: 1577840400},
+	}
+
+	broker := newMockBroker()
+	broker.On("ZRangeWithScores", mock.Anything, "ingestion-queue:pq", int64(0), int64(queuePageSize-1)).Return(items, nil)
+	broker.On("ZRem", mock.Anything, "ingestion-queue:pq", []interface{}{items[0].Member, items[2].Member}).Return(redis.NewIntResult(2, nil))
+
+	pq := NewPriorityQueue(broker, QueueConfig{Name: "pq"}, 0)
+	removed, err := pq.Remove(context.Background(), 1)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), removed)
+}
+
+func TestPriorityQueueMove(t *testing.T) {
+	item := redis.Z{Member: `{"story_id":1,"created_at":null}`, Score: 1577836800}
+	processAt := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	broker := newMockBroker()
+	broker.On("ZRangeWithScores", mock.Anything, "ingestion-queue:15m", int64(0), int64(queuePageSize-1)).Return([]redis.Z{item}, nil)
+	broker.On("ZRem", mock.Anything, "ingestion-queue:15m", []interface{}{item.Member}).Return(redis.NewIntResult(1, nil))
+	broker.On("ZAddNX", mock.Anything, "ingestion-queue:30m", mock.Anything).Return(redis.NewIntResult(1, nil))
+
+	src := NewPriorityQueue(broker, QueueConfig{Name: "15m"}, 0)
+	dst := NewPriorityQueue(broker, QueueConfig{Name: "30m"}, 0)
+	moved, err := src.Move(context.Background(), 1, dst, &processAt)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), moved)
+	broker.AssertCalled(t, "ZAddNX", mock.Anything, "ingestion-queue:30m", []redis.Z{{Member: item.Member, Score: float64(processAt.Unix())}})
+}
+
+func TestPriorityQueueMoveSkipsClaimedMessages(t *testing.T) {
+	item := redis.Z{Member: `{"story_id":1,"created_at":null}`, Score: 1577836800}
+
+	broker := newMockBroker()
+	broker.On("ZRangeWithScores", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return([]redis.Z{item}, nil)
+	broker.On("ZRem", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewIntResult(0, nil))
+
+	pq := NewPriorityQueue(broker, QueueConfig{Name: "pq"}, 0)
+	moved, err := pq.Move(context.Background(), 1, pq, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), moved)
+	broker.AssertNotCalled(t, "ZAddNX", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPriorityQueueMoveWhenEnqueueFailsRestoresMessage(t *testing.T) {
+	item := redis.Z{Member: `{"story_id":1,"created_at":null}`, Score: 1577836800}
+
+	broker := newMockBroker()
+	broker.On("ZRangeWithScores", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return([]redis.Z{item}, nil)
+	broker.On("ZRem", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewIntResult(1, nil))
+	broker.On("ZAddNX", mock.Anything, "ingestion-queue:30m", mock.Anything).Return(redis.NewIntResult(0, fmt.Errorf("Error")))
+	broker.On("ZAddNX", mock.Anything, "ingestion-queue:15m", []redis.Z{item}).Return(redis.NewIntResult(1, nil))
+
+	src := NewPriorityQueue(broker, QueueConfig{Name: "15m"}, 0)
+	dst := NewPriorityQueue(broker, QueueConfig{Name: "30m"}, 0)
+	moved, err := src.Move(context.Background(), 1, dst, nil)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(0), moved)
+	broker.AssertCalled(t, "ZAddNX", mock.Anything, "ingestion-queue:15m", []redis.Z{item})
+}
+
+func TestPriorityQueuePause(t *testing.T) {
+	broker := new(mockBroker)
+	broker.On("SetNX", mock.Anything, "ingestion-queue-control:pq:paused", mock.Anything, time.Duration(0)).Return(true, nil)
+
+	pq := NewPriorityQueue(broker, QueueConfig{Name: "pq"}, 0)
+
+	assert.Nil(t, pq.Pause(context.Background()))
+	broker.AssertExpectations(t)
+}
+
+func TestPriorityQueueResumeReschedulesOverdueMessages(t *testing.T) {
+	pausedAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+	items := []redis.Z{
+		{Member: `{"story_id":1,"created_at":null}`, Score: float64(pausedAt.Add(-30 * time.Second).Unix())},
+		{Member: `{"story_id":2,"created_at":null}`, Score: float64(pausedAt.Add(30 * time.Minute).Unix())},
+	}
+
+	broker := new(mockBroker)
+	broker.On("Get", mock.Anything, "ingestion-queue-control:pq:paused").Return(pausedAt.Format(time.RFC3339), nil)
+	broker.On("ZRangeByScoreWithScores", mock.Anything, "ingestion-queue:pq", mock.Anything).Return(redis.NewZSliceCmdResult(items, nil))
+	broker.On("ZAddXX", mock.Anything, "ingestion-queue:pq", mock.Anything).Return(int64(0), nil)
+	broker.On("Del", mock.Anything, []string{"ingestion-queue-control:pq:paused"}).Return(int64(1), nil)
+
+	pq := NewPriorityQueue(broker, QueueConfig{Name: "pq", GracePeriod: time.Minute}, 0)
+	rescheduled, err := pq.Resume(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), rescheduled)
+
+	// Messages still within their grace period when paused are included.
+	opt := broker.Calls[1].Arguments.Get(2).(*redis.ZRangeBy)
+	assert.Equal(t, strconv.FormatInt(pausedAt.Add(-time.Minute).Unix(), 10), opt.Min)
+
+	// Each is delayed by as long as the queue was paused.
+	delayed := broker.Calls[2].Arguments.Get(2).([]redis.Z)
+	assert.Len(t, delayed, 2)
+	for idx, item := range delayed {
+		assert.Equal(t, items[idx].Member, item.Member)
+		assert.InDelta(t, items[idx].Score+time.Hour.Seconds(), item.Score, 5)
+	}
+	broker.AssertExpectations(t)
+}
+
+func TestPriorityQueueResumeWhenNotPausedDoesNothing(t *testing.T) {
+	broker := new(mockBroker)
+	broker.On("Get", mock.Anything, "ingestion-queue-control:pq:paused").Return("", redis.Nil)
+
+	pq := NewPriorityQueue(broker, QueueConfig{Name: "pq"}, 0)
+	rescheduled, err := pq.Resume(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), rescheduled)
+	broker.AssertNotCalled(t, "ZAddXX", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestLagHistogram(t *testing.T) {
+	histogram := NewLagHistogram([]time.Duration{time.Hour, time.Minute})
+	for _, lag := range []time.Duration{-time.Second, 0, time.Minute, time.Minute + time.Second, 2 * time.Hour} {
+		histogram.Observe(lag)
+	}
+
+	assert.Equal(t, []time.Duration{time.Minute, time.Hour}, histogram.Buckets)
+	assert.Equal(t, []int64{2, 1, 1}, histogram.Counts)
+	assert.Equal(t, int64(1), histogram.NotDue)
+	assert.Equal(t, []string{"<= 1m0s", "<= 1h0m0s", "> 1h0m0s"}, histogram.Labels())
+}
+
+func TestPriorityQueueLag(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 10, 0, 0, time.UTC)
+	items := []redis.Z{
+		{Member: `{"story_id":1,"created_at":null}`, Score: float64(now.Add(-time.Hour).Unix())},
+		{Member: `{"story_id":2,"created_at":null}`, Score: float64(now.Add(-time.Minute).Unix())},
+		{Member: `{"story_id":3,"created_at":null}`, Score: float64(now.Add(time.Minute).Unix())},
+	}
+
+	broker := newMockBroker()
+	broker.On("ZRangeWithScores", mock.Anything, "ingestion-queue:pq", int64(0), int64(queuePageSize-1)).Return(items, nil)
+
+	pq := NewPriorityQueue(broker, QueueConfig{Name: "pq"}, 0)
+	histogram, err := pq.Lag(context.Background(), now, []time.Duration{5 * time.Minute})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{1, 1}, histogram.Counts)
+	assert.Equal(t, int64(1), histogram.NotDue)
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"strconv"
 	"testing"
 	"time"
 
@@ -15,16 +16,63 @@ type mockBroker struct {
 	mock.Mock
 }
 
-func (m *mockBroker) BZPopMin(ctx context.Context, timeout time.Duration, keys ...string) *redis.ZWithKeyCmd {
-	args := m.Called(ctx, timeout, keys)
-	return args.Get(0).(*redis.ZWithKeyCmd)
+func (m *mockBroker) ZAddNX(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd {
+	args := m.Called(ctx, key, members)
+	return args.Get(0).(*redis.IntCmd)
 }
 
-func (m *mockBroker) ZAddNX(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd {
+func (m *mockBroker) ZRangeByScoreWithScores(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.ZSliceCmd {
+	args := m.Called(ctx, key, opt)
+	return args.Get(0).(*redis.ZSliceCmd)
+}
+
+func (m *mockBroker) ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
 	args := m.Called(ctx, key, members)
 	return args.Get(0).(*redis.IntCmd)
 }
 
+func (m *mockBroker) ZCard(ctx context.Context, key string) *redis.IntCmd {
+	args := m.Called(ctx, key)
+	return redis.NewIntResult(args.Get(0).(int64), args.Error(1))
+}
+
+func (m *mockBroker) ZRangeWithScores(ctx context.Context, key string, start, stop int64) *redis.ZSliceCmd {
+	args := m.Called(ctx, key, start, stop)
+	return redis.NewZSliceCmdResult(args.Get(0).([]redis.Z), args.Error(1))
+}
+
+func (m *mockBroker) Exists(ctx context.Context, keys ...string) *redis.IntCmd {
+	args := m.Called(ctx, keys)
+	return redis.NewIntResult(args.Get(0).(int64), args.Error(1))
+}
+
+func (m *mockBroker) ZAddXX(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd {
+	args := m.Called(ctx, key, members)
+	return redis.NewIntResult(args.Get(0).(int64), args.Error(1))
+}
+
+func (m *mockBroker) Get(ctx context.Context, key string) *redis.StringCmd {
+	args := m.Called(ctx, key)
+	return redis.NewStringResult(args.String(0), args.Error(1))
+}
+
+func (m *mockBroker) SetNX(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.BoolCmd {
+	args := m.Called(ctx, key, value, expiration)
+	return redis.NewBoolResult(args.Bool(0), args.Error(1))
+}
+
+func (m *mockBroker) Del(ctx context.Context, keys ...string) *redis.IntCmd {
+	args := m.Called(ctx, keys)
+	return redis.NewIntResult(args.Get(0).(int64), args.Error(1))
+}
+
+// newMockBroker makes a mockBroker whose queues aren't paused.
+func newMockBroker() *mockBroker {
+	broker := new(mockBroker)
+	broker.On("Exists", mock.Anything, mock.Anything).Return(int64(0), nil).Maybe()
+	return broker
+}
+
 func TestPriorityQueueQueueName(t *testing.T) {
 	config := QueueConfig{Name: "pq"}
 	pq := PriorityQueue{config: config}
@@ -44,7 +92,7 @@ func TestPriorityQueueGracePeriod(t *testing.T) {
 }
 
 func TestPriorityQueueEnqueue(t *testing.T) {
-	broker := new(mockBroker)
+	broker := newMockBroker()
 	broker.On("ZAddNX", mock.Anything, mock.Anything, mock.Anything).Return(
 		redis.NewIntResult(0, nil),
 	)
@@ -71,7 +119,7 @@ func TestPriorityQueueEnqueue(t *testing.T) {
 }
 
 func TestPriorityQueueEnqueueWhenErrorReturnsError(t *testing.T) {
-	broker := new(mockBroker)
+	broker := newMockBroker()
 	broker.On("ZAddNX", mock.Anything, mock.Anything, mock.Anything).Return(
 		redis.NewIntResult(0, fmt.Errorf("Error")),
 	)
@@ -98,11 +146,9 @@ func TestPriorityQueueEnqueueWhenErrorReturnsError(t *testing.T) {
 }
 
 func TestPriorityQueueDequeue(t *testing.T) {
-	item := redis.ZWithKey{
-		Z: redis.Z{
-			Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
-			Score:  float64(1577836800),
-		},
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(1577836800),
 	}
 
 	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
@@ -112,53 +158,144 @@ func TestPriorityQueueDequeue(t *testing.T) {
 		ProcessAt: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
 	}
 
-	broker := new(mockBroker)
-	broker.On("BZPopMin", mock.Anything, mock.Anything, mock.Anything).Return(
-		redis.NewZWithKeyCmdResult(&item, nil),
+	broker := newMockBroker()
+	broker.On("ZRangeByScoreWithScores", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewZSliceCmdResult([]redis.Z{item}, nil),
+	)
+	broker.On("ZRem", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewIntResult(1, nil),
 	)
 
 	config := QueueConfig{Name: "pq"}
-	timeout := 0 * time.Second
-	pq := NewPriorityQueue(broker, config, timeout)
+	pq := NewPriorityQueue(broker, config, 0*time.Second)
 
 	ctx := context.Background()
 	actual, err := pq.Dequeue(ctx)
 
 	assert.Nil(t, err)
 	assert.Equal(t, expected, actual)
-	broker.AssertCalled(t, "BZPopMin", ctx, timeout, []string{"ingestion-queue:pq"})
+	broker.AssertCalled(t, "ZRem", ctx, "ingestion-queue:pq", []interface{}{item.Member})
+}
+
+func TestPriorityQueueDequeueOnlyConsidersDueMessages(t *testing.T) {
+	broker := newMockBroker()
+	broker.On("ZRangeByScoreWithScores", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewZSliceCmdResult([]redis.Z{}, nil),
+	)
+
+	config := QueueConfig{Name: "pq"}
+	pq := NewPriorityQueue(broker, config, time.Nanosecond)
+
+	calledAt := time.Now().UTC().Unix()
+	_, err := pq.Dequeue(context.Background())
+
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	// The first call checks whether the queue is paused.
+	opt := broker.Calls[1].Arguments.Get(2).(*redis.ZRangeBy)
+	maxScore, err := strconv.ParseInt(opt.Max, 10, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, "-inf", opt.Min)
+	assert.GreaterOrEqual(t, maxScore, calledAt)
+	assert.LessOrEqual(t, maxScore, time.Now().UTC().Unix())
+	broker.AssertNotCalled(t, "ZRem", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPriorityQueueDequeueWhenClaimedByAnotherConsumerTriesNext(t *testing.T) {
+	claimed := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(1577836800),
+	}
+	available := redis.Z{
+		Member: `{"story_id":2,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(1577836800),
+	}
+
+	broker := newMockBroker()
+	broker.On("ZRangeByScoreWithScores", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewZSliceCmdResult([]redis.Z{claimed, available}, nil),
+	)
+	broker.On("ZRem", mock.Anything, mock.Anything, []interface{}{claimed.Member}).Return(
+		redis.NewIntResult(0, nil),
+	)
+	broker.On("ZRem", mock.Anything, mock.Anything, []interface{}{available.Member}).Return(
+		redis.NewIntResult(1, nil),
+	)
+
+	config := QueueConfig{Name: "pq"}
+	pq := NewPriorityQueue(broker, config, 0*time.Second)
+
+	actual, err := pq.Dequeue(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), actual.StoryID)
+	broker.AssertNumberOfCalls(t, "ZRem", 2)
 }
 
 func TestPriorityQueueDequeueWhenErrorReturnsError(t *testing.T) {
-	broker := new(mockBroker)
-	broker.On("BZPopMin", mock.Anything, mock.Anything, mock.Anything).Return(
-		redis.NewZWithKeyCmdResult(nil, fmt.Errorf("Error")),
+	broker := newMockBroker()
+	broker.On("ZRangeByScoreWithScores", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewZSliceCmdResult(nil, fmt.Errorf("Error")),
 	)
 
 	config := QueueConfig{Name: "pq"}
-	timeout := 0 * time.Second
-	pq := NewPriorityQueue(broker, config, timeout)
+	pq := NewPriorityQueue(broker, config, 0*time.Second)
 
-	ctx := context.Background()
-	_, err := pq.Dequeue(ctx)
+	_, err := pq.Dequeue(context.Background())
 
 	assert.NotNil(t, err)
-	broker.AssertCalled(t, "BZPopMin", ctx, timeout, []string{"ingestion-queue:pq"})
+	broker.AssertNotCalled(t, "ZRem", mock.Anything, mock.Anything, mock.Anything)
 }
 
 func TestPriorityQueueDequeueWhenTimeoutReturnsErrtimeout(t *testing.T) {
-	broker := new(mockBroker)
-	broker.On("BZPopMin", mock.Anything, mock.Anything, mock.Anything).Return(
-		redis.NewZWithKeyCmdResult(nil, nil),
+	broker := newMockBroker()
+	broker.On("ZRangeByScoreWithScores", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewZSliceCmdResult([]redis.Z{}, nil),
 	)
 
 	config := QueueConfig{Name: "pq"}
-	timeout := 0 * time.Second
-	pq := NewPriorityQueue(broker, config, timeout)
+	pq := NewPriorityQueue(broker, config, time.Millisecond)
+	pq.PollInterval = time.Millisecond
 
-	ctx := context.Background()
-	_, err := pq.Dequeue(ctx)
+	_, err := pq.Dequeue(context.Background())
 
 	assert.ErrorIs(t, ErrTimeout, err)
-	broker.AssertCalled(t, "BZPopMin", ctx, timeout, []string{"ingestion-queue:pq"})
+}
+
+func TestPriorityQueueDequeueWhenContextCancelledReturnsError(t *testing.T) {
+	broker := newMockBroker()
+	broker.On("ZRangeByScoreWithScores", mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewZSliceCmdResult([]redis.Z{}, nil),
+	)
+
+	config := QueueConfig{Name: "pq"}
+	pq := NewPriorityQueue(broker, config, 0*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := pq.Dequeue(ctx)
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestPriorityQueueDequeueWhenPausedDoesNotClaim(t *testing.T) {
+	broker := new(mockBroker)
+	broker.On("Exists", mock.Anything, []string{"ingestion-queue-control:pq:paused"}).Return(int64(1), nil)
+
+	config := QueueConfig{Name: "pq"}
+	pq := NewPriorityQueue(broker, config, time.Nanosecond)
+
+	_, err := pq.Dequeue(context.Background())
+
+	assert.ErrorIs(t, err, ErrTimeout)
+	broker.AssertNotCalled(t, "ZRangeByScoreWithScores", mock.Anything, mock.Anything, mock.Anything)
+	broker.AssertNotCalled(t, "ZRem", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestMakeQueueConfigForUpdatesQueue(t *testing.T) {
+	config, err := MakeQueueConfig(UpdatesQueueName)
+
+	assert.Nil(t, err)
+	assert.Equal(t, UpdatesQueueName, config.Name)
+	assert.Equal(t, time.Duration(0), config.ProcessAfter)
 }
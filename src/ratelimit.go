@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const RateLimitKeyPrefix = "ingestion-rate-limit"
+
+// RateLimiter limits the rate at which requests are made.
+type RateLimiter interface {
+	// Wait blocks until a request may be made.
+	Wait(context.Context) error
+}
+
+// ScriptRunner runs Lua scripts against the broker.
+type ScriptRunner interface {
+	Eval(context.Context, string, []string, ...interface{}) *redis.Cmd
+}
+
+func validateRateLimit(rate float64, burst int) {
+	if rate <= 0 {
+		panic("Rate limit must be positive")
+	}
+	if burst <= 0 {
+		panic("Rate limit burst must be positive")
+	}
+}
+
+// sleepCtx sleeps for the given duration, returning early if the context is
+// done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// TokenBucket is a token bucket rate limiter, local to the process. Tokens are
+// added at Rate tokens per second, up to Burst tokens, and each request takes
+// a token. Requests that can't take a token wait their turn in the order that
+// they were made.
+type TokenBucket struct {
+	Rate  float64
+	Burst int
+
+	mu        sync.Mutex
+	tokens    float64
+	updatedAt time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	validateRateLimit(rate, burst)
+	return &TokenBucket{Rate: rate, Burst: burst, tokens: float64(burst)}
+}
+
+// reserve takes a token at the given time, returning how long to wait until
+// the token is available.
+func (b *TokenBucket) reserve(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.updatedAt.IsZero() {
+		elapsed := now.Sub(b.updatedAt).Seconds()
+		b.tokens = math.Min(float64(b.Burst), b.tokens+elapsed*b.Rate)
+	}
+	b.updatedAt = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.Rate * float64(time.Second))
+}
+
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	wait := b.reserve(time.Now())
+	ObserveRateLimiterWait(wait)
+	return sleepCtx(ctx, wait)
+}
+
+// reserveTokenScript takes a token from a token bucket stored in a hash,
+// returning the number of milliseconds to wait until the token is available.
+// The broker's clock is used, so that clock skew between replicas does not
+// matter. The bucket expires once it would have refilled, including any debt
+// from tokens reserved ahead of time, as it is then the same as a new bucket.
+const reserveTokenScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local time = redis.call("time")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call("hmget", KEYS[1], "tokens", "updated_at")
+local tokens = tonumber(state[1]) or burst
+local updated_at = tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + (now - updated_at) / 1000 * rate) - 1
+redis.call("hset", KEYS[1], "tokens", tokens, "updated_at", now)
+redis.call("pexpire", KEYS[1], math.ceil((burst - tokens) / rate * 1000) + 1000)
+
+if tokens >= 0 then
+	return 0
+end
+return math.ceil(-tokens / rate * 1000)
+`
+
+// RedisTokenBucket is a token bucket rate limiter that is stored in the
+// broker, so that its limit is shared by every process using the same bucket.
+type RedisTokenBucket struct {
+	client ScriptRunner
+	key    string
+	Rate   float64
+	Burst  int
+}
+
+func NewRedisTokenBucket(client ScriptRunner, name string, rate float64, burst int) *RedisTokenBucket {
+	validateRateLimit(rate, burst)
+	return &RedisTokenBucket{
+		client: client,
+		key:    fmt.Sprintf("%s:%s", RateLimitKeyPrefix, name),
+		Rate:   rate,
+		Burst:  burst,
+	}
+}
+
+func (b *RedisTokenBucket) Wait(ctx context.Context) error {
+	waitMilliseconds, err := b.client.Eval(ctx, reserveTokenScript, []string{b.key}, b.Rate, b.Burst).Int64()
+	if err != nil {
+		return err
+	}
+
+	wait := time.Duration(waitMilliseconds) * time.Millisecond
+	ObserveRateLimiterWait(wait)
+	return sleepCtx(ctx, wait)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockRateLimiter struct {
+	mock.Mock
+}
+
+func (m *mockRateLimiter) Wait(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	bucket := NewTokenBucket(2, 2)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// Burst is available immediately.
+	assert.Equal(t, time.Duration(0), bucket.reserve(now))
+	assert.Equal(t, time.Duration(0), bucket.reserve(now))
+	// Subsequent requests wait their turn.
+	assert.Equal(t, 500*time.Millisecond, bucket.reserve(now))
+	assert.Equal(t, time.Second, bucket.reserve(now))
+	// Tokens are replenished over time.
+	assert.Equal(t, 500*time.Millisecond, bucket.reserve(now.Add(time.Second)))
+}
+
+func TestTokenBucketReserveDoesNotExceedBurst(t *testing.T) {
+	bucket := NewTokenBucket(1, 1)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, time.Duration(0), bucket.reserve(now))
+	// Idle time beyond what fills the bucket is not accumulated.
+	later := now.Add(time.Hour)
+	assert.Equal(t, time.Duration(0), bucket.reserve(later))
+	assert.Equal(t, time.Second, bucket.reserve(later))
+}
+
+func TestTokenBucketWaitWhenContextDoneReturnsError(t *testing.T) {
+	bucket := NewTokenBucket(0.001, 1)
+	bucket.reserve(time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := bucket.Wait(ctx)
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestNewTokenBucketWhenInvalidPanics(t *testing.T) {
+	assert.Panics(t, func() { NewTokenBucket(0, 1) })
+	assert.Panics(t, func() { NewTokenBucket(1, 0) })
+}
+
+func TestRedisTokenBucketWait(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("Eval", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewCmdResult(int64(1), nil),
+	)
+
+	bucket := NewRedisTokenBucket(client, "hn-api", 10, 5)
+	err := bucket.Wait(context.Background())
+
+	assert.Nil(t, err)
+	client.AssertCalled(t, "Eval", mock.Anything, reserveTokenScript, []string{"ingestion-rate-limit:hn-api"}, []interface{}{float64(10), 5})
+}
+
+func TestRedisTokenBucketWaitWhenErrorReturnsError(t *testing.T) {
+	client := new(mockLeaseClient)
+	client.On("Eval", mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(
+		redis.NewCmdResult(nil, fmt.Errorf("Error")),
+	)
+
+	bucket := NewRedisTokenBucket(client, "hn-api", 10, 5)
+	err := bucket.Wait(context.Background())
+
+	assert.NotNil(t, err)
+}
@@ -8,54 +8,221 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 )
 
 const writeStoryStmt = `
-insert into stories (story_id, api_version, queue_name, fetched_at, raw_document)
-values ($1, $2, $3, $4, $5)
+insert into stories (story_id, api_version, queue_name, fetched_at, raw_document, status, tags, canonical_url, domain)
+values ($1, $2, $3, $4, $5, $6, $7, nullif($8::text, ''), nullif($9::text, ''))
 on conflict do nothing
 returning id
 `
 
-const writeCommentStmt = `
-insert into comments (internal_story_id, comment_id, raw_document)
-values ($1, $2, $3)
+// writeCommentVersionStmt writes a comment's version, if it hasn't been seen
+// before. If a concurrent transaction is writing the same version, it waits
+// for that to commit, rather than writing it again.
+const writeCommentVersionStmt = `
+insert into comment_versions (comment_id, content_hash, raw_document)
+values ($1, sha256(convert_to($2::jsonb::text, 'UTF8')), $2)
+on conflict (content_hash) do nothing
 `
 
+// linkCommentStmt links a snapshot to a comment's version. It runs after
+// writeCommentVersionStmt, as a separate statement, so that it sees the
+// version whether that was just written or written by another transaction.
+const linkCommentStmt = `
+insert into snapshot_comments (internal_story_id, comment_version_id, position, fetched_at)
+select $1, id, $3, $4
+from comment_versions
+where content_hash = sha256(convert_to($2::jsonb::text, 'UTF8'))
+on conflict do nothing
+`
+
+const writePollOptionStmt = `
+insert into poll_options (internal_story_id, poll_option_id, score, raw_document)
+values ($1, $2, $3, $4)
+`
+
+const readLatestSnapshotsStmt = `
+select story_id, api_version, queue_name, fetched_at, raw_document::text, status, tags, coalesce(canonical_url, ''), coalesce(domain, '')
+from stories
+where story_id = $1
+order by fetched_at desc
+limit $2
+`
+
+const readSnapshotStmt = `
+select id, story_id, api_version, queue_name, fetched_at, raw_document::text, status, tags, coalesce(canonical_url, ''), coalesce(domain, '')
+from stories
+where story_id = $1 and queue_name = $2
+`
+
+const readSnapshotCommentsStmt = `
+select comment_versions.comment_id, comment_versions.raw_document::text
+from snapshot_comments
+join comment_versions on comment_versions.id = snapshot_comments.comment_version_id
+where snapshot_comments.internal_story_id = $1
+order by snapshot_comments.position
+`
+
+const readSnapshotPollOptionsStmt = `
+select poll_option_id, score, raw_document::text
+from poll_options
+where internal_story_id = $1
+order by id
+`
+
+const readSnapshotLabelsStmt = `
+select queue_name
+from stories
+where story_id = $1
+order by fetched_at
+`
+
+// readUncanonicalisedStmt reads the URLs of snapshots written before
+// canonical URLs were, in batches.
+const readUncanonicalisedStmt = `
+select id, raw_document->>'url'
+from stories
+where id > $1 and canonical_url is null and coalesce(raw_document->>'url', '') <> ''
+order by id
+limit $2
+`
+
+const writeCanonicalURLStmt = `
+update stories
+set canonical_url = $2, domain = $3
+where id = $1
+`
+
+const writeUserStmt = `
+insert into users (user_id, api_version, fetched_at, raw_document)
+values ($1, $2, $3, $4)
+on conflict do nothing
+`
+
+const writeSnapshotAnalyticsStmt = `
+insert into snapshot_analytics (
+    story_id,
+    label,
+    fetched_at,
+    age_seconds,
+    score,
+    descendants,
+    score_velocity,
+    comment_velocity,
+    score_percentile,
+    descendants_percentile
+)
+values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+on conflict (story_id, label) do update set
+    fetched_at = excluded.fetched_at,
+    age_seconds = excluded.age_seconds,
+    score = excluded.score,
+    descendants = excluded.descendants,
+    score_velocity = excluded.score_velocity,
+    comment_velocity = excluded.comment_velocity,
+    score_percentile = excluded.score_percentile,
+    descendants_percentile = excluded.descendants_percentile
+`
+
+const writeStoryAnalyticsStmt = `
+insert into story_analytics (
+    story_id,
+    classification,
+    peak_score_percentile,
+    peak_age_seconds,
+    max_score_velocity,
+    computed_at
+)
+values ($1, $2, $3, $4, $5, $6)
+on conflict (story_id) do update set
+    classification = excluded.classification,
+    peak_score_percentile = excluded.peak_score_percentile,
+    peak_age_seconds = excluded.peak_age_seconds,
+    max_score_velocity = excluded.max_score_velocity,
+    computed_at = excluded.computed_at
+`
+
+var ErrSnapshotNotFound = errors.New("Snapshot not found")
+
 type CommentModel struct {
 	CommentID   int64
 	RawDocument string
 }
 
+type PollOptionModel struct {
+	PollOptionID int64
+	Score        int32
+	RawDocument  string
+}
+
 type StoryModel struct {
 	StoryID     int64
 	APIVersion  string
 	QueueName   string
 	FetchedAt   time.Time
 	RawDocument string
-	Comments    []CommentModel
+	Status      string
+	Tags        []string
+	// CanonicalURL and Domain are empty if the story has no URL.
+	CanonicalURL string
+	Domain       string
+	Comments     []CommentModel
+	PollOptions  []PollOptionModel
+}
+
+// SnapshotURL is the URL of a snapshot of a story, and its canonical form.
+type SnapshotURL struct {
+	ID           int64
+	URL          string
+	CanonicalURL string
+	Domain       string
+}
+
+type UserModel struct {
+	UserID      string
+	APIVersion  string
+	FetchedAt   time.Time
+	RawDocument string
+}
+
+// collectSnapshots collects rows of snapshots, without their comments.
+func collectSnapshots(rows pgx.Rows) ([]StoryModel, error) {
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (StoryModel, error) {
+		model := StoryModel{}
+		err := row.Scan(&model.StoryID, &model.APIVersion, &model.QueueName, &model.FetchedAt, &model.RawDocument, &model.Status, &model.Tags, &model.CanonicalURL, &model.Domain)
+		return model, err
+	})
 }
 
 // Repo provides access to a persistent data store for News stories and
-// comments.
+// comments. It is safe for concurrent use.
 type Repo struct {
-	conn *pgx.Conn
+	pool *pgxpool.Pool
 }
 
-func NewRepo(conn *pgx.Conn) *Repo {
-	return &Repo{conn: conn}
+func NewRepo(pool *pgxpool.Pool) *Repo {
+	return &Repo{pool: pool}
 }
 
-// WriteStory writes a story and its comments.
+// WriteStory writes a story and its comments, and its options if it is a
+// poll.
 func (r *Repo) WriteStory(ctx context.Context, story StoryModel) error {
-	tx, err := r.conn.Begin(ctx)
+	tx, err := r.pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback(ctx)
 
+	// Untagged stories are stored with an empty array, rather than null.
+	tags := story.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
 	var id int32
-	row := tx.QueryRow(ctx, writeStoryStmt, story.StoryID, story.APIVersion, story.QueueName, story.FetchedAt, story.RawDocument)
+	row := tx.QueryRow(ctx, writeStoryStmt, story.StoryID, story.APIVersion, story.QueueName, story.FetchedAt, story.RawDocument, story.Status, tags, story.CanonicalURL, story.Domain)
 	err = row.Scan(&id)
 
 	if errors.Is(err, sql.ErrNoRows) {
@@ -67,14 +234,153 @@ func (r *Repo) WriteStory(ctx context.Context, story StoryModel) error {
 	}
 
 	batch := &pgx.Batch{}
-	for _, comment := range story.Comments {
-		batch.Queue(writeCommentStmt, id, comment.CommentID, comment.RawDocument)
+	if len(story.Comments) > 0 {
+		batch.Queue(lockOrphansSharedStmt, orphansLockID)
+	}
+	for position, comment := range story.Comments {
+		batch.Queue(writeCommentVersionStmt, comment.CommentID, comment.RawDocument)
+		batch.Queue(linkCommentStmt, id, comment.RawDocument, position, story.FetchedAt)
+	}
+	for _, option := range story.PollOptions {
+		batch.Queue(writePollOptionStmt, id, option.PollOptionID, option.Score, option.RawDocument)
 	}
 
-	err = r.conn.SendBatch(ctx, batch).Close()
+	err = tx.SendBatch(ctx, batch).Close()
 	if err != nil {
 		return err
 	}
 
 	return tx.Commit(ctx)
 }
+
+// LatestSnapshots reads up to n of the most recent snapshots of a story, most
+// recent first. Comments are not read.
+func (r *Repo) LatestSnapshots(ctx context.Context, storyID int64, n int) ([]StoryModel, error) {
+	rows, err := r.pool.Query(ctx, readLatestSnapshotsStmt, storyID, n)
+	if err != nil {
+		return nil, err
+	}
+	return collectSnapshots(rows)
+}
+
+// ReadSnapshot reads the snapshot of a story taken under the given label,
+// rebuilding it with its comments and poll options. ErrSnapshotNotFound is
+// returned if there is no such snapshot.
+func (r *Repo) ReadSnapshot(ctx context.Context, storyID int64, label string) (StoryModel, error) {
+	model := StoryModel{}
+
+	var id int32
+	row := r.pool.QueryRow(ctx, readSnapshotStmt, storyID, label)
+	err := row.Scan(&id, &model.StoryID, &model.APIVersion, &model.QueueName, &model.FetchedAt, &model.RawDocument, &model.Status, &model.Tags, &model.CanonicalURL, &model.Domain)
+	if errors.Is(err, sql.ErrNoRows) {
+		return model, ErrSnapshotNotFound
+	}
+	if err != nil {
+		return model, err
+	}
+
+	rows, err := r.pool.Query(ctx, readSnapshotCommentsStmt, id)
+	if err != nil {
+		return model, err
+	}
+	model.Comments, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (CommentModel, error) {
+		comment := CommentModel{}
+		err := row.Scan(&comment.CommentID, &comment.RawDocument)
+		return comment, err
+	})
+	if err != nil {
+		return model, err
+	}
+
+	rows, err = r.pool.Query(ctx, readSnapshotPollOptionsStmt, id)
+	if err != nil {
+		return model, err
+	}
+	model.PollOptions, err = pgx.CollectRows(rows, func(row pgx.CollectableRow) (PollOptionModel, error) {
+		option := PollOptionModel{}
+		err := row.Scan(&option.PollOptionID, &option.Score, &option.RawDocument)
+		return option, err
+	})
+	return model, err
+}
+
+// SnapshotLabels reads the labels of a story's snapshots, in the order they
+// were taken.
+func (r *Repo) SnapshotLabels(ctx context.Context, storyID int64) ([]string, error) {
+	rows, err := r.pool.Query(ctx, readSnapshotLabelsStmt, storyID)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// WriteUser writes a snapshot of a user's profile.
+func (r *Repo) WriteUser(ctx context.Context, user UserModel) error {
+	_, err := r.pool.Exec(ctx, writeUserStmt, user.UserID, user.APIVersion, user.FetchedAt, user.RawDocument)
+	return err
+}
+
+// WriteAnalytics writes the metrics of stories and their snapshots, replacing
+// any that were computed before.
+func (r *Repo) WriteAnalytics(ctx context.Context, metrics []SnapshotMetrics, stories []StoryAnalytics, computedAt time.Time) error {
+	batch := &pgx.Batch{}
+	for _, m := range metrics {
+		batch.Queue(
+			writeSnapshotAnalyticsStmt,
+			m.StoryID,
+			m.Label,
+			m.FetchedAt,
+			int64(m.Age().Seconds()),
+			m.Score,
+			m.Descendants,
+			m.ScoreVelocity,
+			m.CommentVelocity,
+			m.ScorePercentile,
+			m.DescendantsPercentile,
+		)
+	}
+	for _, story := range stories {
+		var peakAgeSeconds *int64
+		if story.PeakAge != nil {
+			seconds := int64(story.PeakAge.Seconds())
+			peakAgeSeconds = &seconds
+		}
+		batch.Queue(
+			writeStoryAnalyticsStmt,
+			story.StoryID,
+			story.Classification,
+			story.PeakScorePercentile,
+			peakAgeSeconds,
+			story.MaxScoreVelocity,
+			computedAt,
+		)
+	}
+
+	return pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		return tx.SendBatch(ctx, batch).Close()
+	})
+}
+
+// ReadUncanonicalised reads the URLs of up to limit snapshots without a
+// canonical URL, after the snapshot with the given internal id, in order.
+func (r *Repo) ReadUncanonicalised(ctx context.Context, afterID int64, limit int) ([]SnapshotURL, error) {
+	rows, err := r.pool.Query(ctx, readUncanonicalisedStmt, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (SnapshotURL, error) {
+		snapshot := SnapshotURL{}
+		err := row.Scan(&snapshot.ID, &snapshot.URL)
+		return snapshot, err
+	})
+}
+
+// WriteCanonicalURLs writes the canonical URLs and domains of snapshots.
+func (r *Repo) WriteCanonicalURLs(ctx context.Context, snapshots []SnapshotURL) error {
+	batch := &pgx.Batch{}
+	for _, snapshot := range snapshots {
+		batch.Queue(writeCanonicalURLStmt, snapshot.ID, snapshot.CanonicalURL, snapshot.Domain)
+	}
+	return r.pool.SendBatch(ctx, batch).Close()
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// createSnapshotStagingStmt creates the table that snapshots are copied into
+// before they're merged into `stories`. Comments and poll options are staged
+// as JSON arrays, alongside their snapshot.
+const createSnapshotStagingStmt = `
+create temporary table snapshot_staging (
+    ordinal int not null,
+    story_id int not null,
+    api_version char(2) not null,
+    queue_name text not null,
+    fetched_at timestamp without time zone not null,
+    raw_document jsonb not null,
+    status text not null,
+    tags text[] not null,
+    canonical_url text,
+    domain text,
+    comments jsonb not null,
+    poll_options jsonb not null,
+    internal_story_id int
+) on commit drop
+`
+
+var snapshotStagingColumns = []string{
+	"ordinal",
+	"story_id",
+	"api_version",
+	"queue_name",
+	"fetched_at",
+	"raw_document",
+	"status",
+	"tags",
+	"canonical_url",
+	"domain",
+	"comments",
+	"poll_options",
+}
+
+// dropStagedDuplicatesStmt drops all but the first of the staged snapshots
+// with the same story and label, returning the rest.
+const dropStagedDuplicatesStmt = `
+delete from snapshot_staging as later
+using snapshot_staging as earlier
+where later.story_id = earlier.story_id
+    and later.queue_name = earlier.queue_name
+    and later.ordinal > earlier.ordinal
+returning later.ordinal
+`
+
+// mergeSnapshotStagingStmt inserts the staged snapshots that don't conflict
+// with stored ones, along with their poll options, as `WriteStory` does, and
+// returns those that conflict. The id of each inserted snapshot is recorded
+// in the staging table, for its comments to be linked to. Snapshots are
+// inserted in order of their key, so that concurrent merges take locks in
+// the same order.
+const mergeSnapshotStagingStmt = `
+with inserted as (
+    insert into stories (story_id, api_version, queue_name, fetched_at, raw_document, status, tags, canonical_url, domain)
+    select story_id, api_version, queue_name, fetched_at, raw_document, status, tags, canonical_url, domain
+    from snapshot_staging
+    order by story_id, queue_name
+    on conflict do nothing
+    returning id, story_id, queue_name
+),
+staged as (
+    update snapshot_staging
+    set internal_story_id = inserted.id
+    from inserted
+    where inserted.story_id = snapshot_staging.story_id and inserted.queue_name = snapshot_staging.queue_name
+    returning snapshot_staging.internal_story_id, snapshot_staging.poll_options
+),
+options as (
+    insert into poll_options (internal_story_id, poll_option_id, score, raw_document)
+    select staged.internal_story_id, (option.value->>'poll_option_id')::int, (option.value->>'score')::int, option.value->'raw_document'
+    from staged, jsonb_array_elements(staged.poll_options) as option(value)
+)
+select ordinal
+from snapshot_staging
+where not exists (
+    select 1 from inserted
+    where inserted.story_id = snapshot_staging.story_id and inserted.queue_name = snapshot_staging.queue_name
+)
+order by ordinal
+`
+
+// stageCommentsStmt stages the comments of the inserted snapshots, one row
+// per comment, with the hash that their versions are deduplicated by.
+const stageCommentsStmt = `
+create temporary table comment_staging on commit drop as
+select
+    snapshot_staging.internal_story_id,
+    snapshot_staging.fetched_at,
+    (comment.value->>'comment_id')::int as comment_id,
+    comment.value->'raw_document' as raw_document,
+    sha256(convert_to((comment.value->'raw_document')::text, 'UTF8')) as content_hash,
+    comment.position - 1 as position
+from snapshot_staging, jsonb_array_elements(snapshot_staging.comments) with ordinality as comment(value, position)
+where snapshot_staging.internal_story_id is not null
+`
+
+// mergeCommentVersionsStmt writes the versions of the staged comments that
+// haven't been seen before, as `writeCommentVersionStmt` does.
+const mergeCommentVersionsStmt = `
+insert into comment_versions (comment_id, content_hash, raw_document)
+select distinct on (content_hash) comment_id, content_hash, raw_document
+from comment_staging
+order by content_hash
+on conflict (content_hash) do nothing
+`
+
+// linkStagedCommentsStmt links the inserted snapshots to the versions of their
+// comments. It runs after mergeCommentVersionsStmt, as a separate statement,
+// so that it sees versions written by other transactions.
+const linkStagedCommentsStmt = `
+insert into snapshot_comments (internal_story_id, comment_version_id, position, fetched_at)
+select comment_staging.internal_story_id, comment_versions.id, comment_staging.position, comment_staging.fetched_at
+from comment_staging
+join comment_versions using (content_hash)
+on conflict do nothing
+`
+
+// stagedRow makes the row of a snapshot in the staging table, with its
+// comments and poll options as they're archived.
+func stagedRow(ordinal int, story StoryModel) ([]any, error) {
+	if !json.Valid([]byte(story.RawDocument)) {
+		return nil, fmt.Errorf("Invalid raw document of story %d", story.StoryID)
+	}
+
+	comments := make([]ArchivedComment, 0, len(story.Comments))
+	for _, comment := range story.Comments {
+		comments = append(comments, ArchivedComment{CommentID: comment.CommentID, RawDocument: json.RawMessage(comment.RawDocument)})
+	}
+	commentsJSON, err := json.Marshal(comments)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid comments of story %d: %w", story.StoryID, err)
+	}
+
+	options := make([]ArchivedPollOption, 0, len(story.PollOptions))
+	for _, option := range story.PollOptions {
+		options = append(options, ArchivedPollOption{PollOptionID: option.PollOptionID, Score: option.Score, RawDocument: json.RawMessage(option.RawDocument)})
+	}
+	optionsJSON, err := json.Marshal(options)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid poll options of story %d: %w", story.StoryID, err)
+	}
+
+	// Untagged stories are stored with an empty array, rather than null.
+	tags := story.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	return []any{
+		ordinal,
+		story.StoryID,
+		story.APIVersion,
+		story.QueueName,
+		story.FetchedAt,
+		story.RawDocument,
+		story.Status,
+		tags,
+		nullIfEmpty(story.CanonicalURL),
+		nullIfEmpty(story.Domain),
+		string(commentsJSON),
+		string(optionsJSON),
+	}, nil
+}
+
+// CopyStories writes snapshots of stories, with their comments and poll
+// options, in bulk. They're copied into a staging table, and then merged in
+// a single transaction. The indexes of the snapshots that weren't written,
+// as a snapshot of the story with the same label is already stored or comes
+// earlier in the batch, are returned.
+func (r *Repo) CopyStories(ctx context.Context, stories []StoryModel) ([]int, error) {
+	staged := make([][]any, 0, len(stories))
+	for ordinal, story := range stories {
+		row, err := stagedRow(ordinal, story)
+		if err != nil {
+			return nil, err
+		}
+		staged = append(staged, row)
+	}
+
+	tx, err := r.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, createSnapshotStagingStmt)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.CopyFrom(ctx, pgx.Identifier{"snapshot_staging"}, snapshotStagingColumns, pgx.CopyFromRows(staged))
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(ctx, dropStagedDuplicatesStmt)
+	if err != nil {
+		return nil, err
+	}
+	duplicates, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query(ctx, mergeSnapshotStagingStmt)
+	if err != nil {
+		return nil, err
+	}
+	conflicts, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(ctx, lockOrphansSharedStmt, orphansLockID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, stmt := range []string{stageCommentsStmt, mergeCommentVersionsStmt, linkStagedCommentsStmt} {
+		_, err = tx.Exec(ctx, stmt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conflicts = append(conflicts, duplicates...)
+	slices.Sort(conflicts)
+	return conflicts, nil
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// partitionedTables are the tables partitioned by month of `fetched_at`.
+// Partitions of `snapshot_comments` hold the links of the snapshots in the
+// partitions of `stories` for the same month.
+var partitionedTables = []string{"stories", "snapshot_comments"}
+
+// partitionMonthLayout formats the month of a partition in its name.
+const partitionMonthLayout = "200601"
+
+const readPartitionsStmt = `
+select child.relname
+from pg_inherits
+join pg_class as parent on parent.oid = pg_inherits.inhparent
+join pg_class as child on child.oid = pg_inherits.inhrelid
+where parent.relname = 'stories'
+order by child.relname
+`
+
+// createPartitionStmt creates the partition of a table for a month, moving
+// into it any rows that fell into the default partition before it was
+// created, as the partition can't be attached while they're there.
+const createPartitionStmt = `
+create table %[1]s (like %[2]s including defaults including constraints);
+
+with moved as (
+    delete from %[3]s
+    where fetched_at >= '%[4]s' and fetched_at < '%[5]s'
+    returning *
+)
+insert into %[1]s select * from moved;
+
+alter table %[2]s attach partition %[1]s for values from ('%[4]s') to ('%[5]s');
+`
+
+// streamPartitionStmt reads the snapshots of a partition of `stories`, with
+// their comments and poll options as they're archived.
+const streamPartitionStmt = `
+select
+    stories.story_id,
+    stories.api_version,
+    stories.queue_name,
+    stories.fetched_at,
+    stories.raw_document::text,
+    stories.status,
+    stories.tags,
+    coalesce(stories.canonical_url, ''),
+    coalesce(stories.domain, ''),
+    coalesce((
+        select jsonb_agg(
+            jsonb_build_object('comment_id', comment_versions.comment_id, 'raw_document', comment_versions.raw_document)
+            order by snapshot_comments.position
+        )
+        from snapshot_comments
+        join comment_versions on comment_versions.id = snapshot_comments.comment_version_id
+        where snapshot_comments.internal_story_id = stories.id and snapshot_comments.fetched_at = stories.fetched_at
+    ), '[]')::text,
+    coalesce((
+        select jsonb_agg(
+            jsonb_build_object('poll_option_id', poll_options.poll_option_id, 'score', poll_options.score, 'raw_document', poll_options.raw_document)
+            order by poll_options.id
+        )
+        from poll_options
+        where poll_options.internal_story_id = stories.id
+    ), '[]')::text
+from %s as stories
+order by stories.id
+`
+
+// orphansLockID identifies the advisory lock that serialises deleting orphans
+// with linking snapshots to comment versions. Writers hold it shared, and
+// DeleteOrphans exclusively, until their transactions end, as otherwise a
+// version that a writer found, and is linking to, could be deleted before
+// the link is committed.
+const orphansLockID = 7265739
+
+const lockOrphansSharedStmt = "select pg_advisory_xact_lock_shared($1)"
+
+// deleteOrphansStmt deletes the poll options and comment versions that are
+// no longer linked to any snapshot, once their partitions are dropped.
+const deleteOrphansStmt = `
+with options as (
+    delete from poll_options
+    where not exists (select 1 from stories where stories.id = poll_options.internal_story_id)
+    returning 1
+),
+versions as (
+    delete from comment_versions
+    where not exists (select 1 from snapshot_comments where snapshot_comments.comment_version_id = comment_versions.id)
+    returning 1
+)
+select (select count(*) from options) + (select count(*) from versions)
+`
+
+// PartitionName names the partition of a table for the month of t.
+func PartitionName(table string, t time.Time) string {
+	return table + "_" + t.Format(partitionMonthLayout)
+}
+
+// MonthStart truncates t to the start of its month, in UTC.
+func MonthStart(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// parsePartitionMonth parses the month of a partition of `stories` from its
+// name. The default partition, and any others that aren't named for a month,
+// aren't parsed.
+func parsePartitionMonth(name string) (time.Time, bool) {
+	suffix, ok := strings.CutPrefix(name, "stories_")
+	if !ok || len(suffix) != len(partitionMonthLayout) {
+		return time.Time{}, false
+	}
+	month, err := time.Parse(partitionMonthLayout, suffix)
+	return month, err == nil
+}
+
+// Partitions reads the months of the partitions of snapshots, in order.
+func (r *Repo) Partitions(ctx context.Context) ([]time.Time, error) {
+	rows, err := r.pool.Query(ctx, readPartitionsStmt)
+	if err != nil {
+		return nil, err
+	}
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		return nil, err
+	}
+
+	var months []time.Time
+	for _, name := range names {
+		if month, ok := parsePartitionMonth(name); ok {
+			months = append(months, month)
+		}
+	}
+	return months, nil
+}
+
+// CreatePartition creates the partitions of snapshots and their comments for
+// a month.
+func (r *Repo) CreatePartition(ctx context.Context, month time.Time) error {
+	from := MonthStart(month)
+	to := from.AddDate(0, 1, 0)
+
+	return pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		for _, table := range partitionedTables {
+			stmt := fmt.Sprintf(
+				createPartitionStmt,
+				pgx.Identifier{PartitionName(table, from)}.Sanitize(),
+				pgx.Identifier{table}.Sanitize(),
+				pgx.Identifier{table + "_default"}.Sanitize(),
+				from.Format(time.DateOnly),
+				to.Format(time.DateOnly),
+			)
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("Error creating partition %s: %w", PartitionName(table, from), err)
+			}
+		}
+		return nil
+	})
+}
+
+// StreamPartition reads every snapshot in the partition for a month, with its
+// comments and poll options, calling fn with each in turn.
+func (r *Repo) StreamPartition(ctx context.Context, month time.Time, fn func(ArchivedStory) error) error {
+	stmt := fmt.Sprintf(streamPartitionStmt, pgx.Identifier{PartitionName("stories", month)}.Sanitize())
+	rows, err := r.pool.Query(ctx, stmt)
+	if err != nil {
+		return err
+	}
+
+	var (
+		archived    ArchivedStory
+		rawDocument string
+		comments    string
+		options     string
+	)
+	_, err = pgx.ForEachRow(
+		rows,
+		[]any{&archived.StoryID, &archived.APIVersion, &archived.QueueName, &archived.FetchedAt, &rawDocument, &archived.Status, &archived.Tags, &archived.CanonicalURL, &archived.Domain, &comments, &options},
+		func() error {
+			snapshot := archived
+			// Don't let the next row's tags be scanned into this one's.
+			archived.Tags = nil
+			snapshot.RawDocument = json.RawMessage(rawDocument)
+			if err := json.Unmarshal([]byte(comments), &snapshot.Comments); err != nil {
+				return err
+			}
+			if err := json.Unmarshal([]byte(options), &snapshot.PollOptions); err != nil {
+				return err
+			}
+			return fn(snapshot)
+		},
+	)
+	return err
+}
+
+// DropPartition drops the partitions of snapshots and their comments for a
+// month. Their poll options and comment versions are left to DeleteOrphans.
+func (r *Repo) DropPartition(ctx context.Context, month time.Time) error {
+	return pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		for _, table := range partitionedTables {
+			stmt := "drop table " + pgx.Identifier{PartitionName(table, month)}.Sanitize()
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("Error dropping partition %s: %w", PartitionName(table, month), err)
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteOrphans deletes the poll options and comment versions that are no
+// longer linked to any snapshot, returning the number deleted. It waits for
+// writes of snapshots with comments that are in progress.
+func (r *Repo) DeleteOrphans(ctx context.Context) (int64, error) {
+	var deleted int64
+	err := pgx.BeginFunc(ctx, r.pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "select pg_advisory_xact_lock($1)", orphansLockID); err != nil {
+			return err
+		}
+		return tx.QueryRow(ctx, deleteOrphansStmt).Scan(&deleted)
+	})
+	return deleted, err
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// storyFilterClause filters stories by the time they were created and by
+// their registrable domain, which covers subdomains. Zero values are unset.
+const storyFilterClause = `
+    ($1::bigint = 0 or (raw_document->>'time')::bigint >= $1)
+    and ($2::bigint = 0 or (raw_document->>'time')::bigint < $2)
+    and ($3::text = '' or domain = $3)
+`
+
+// listStoriesStmt walks down the ids of stories from the cursor, one at a
+// time using the index on story_id, and checks the latest snapshot of each
+// against the filter, stopping once enough stories match. This avoids reading
+// the latest snapshot of every story, as a distinct on over the table would.
+// Each row of the walk counts the matches among the stories before it. The
+// walk starts from the latest story created before the filter's end, if it
+// has one, found by scanning down the index rather than walking.
+const listStoriesStmt = `
+with recursive walk (story_id, found) as (
+    select max(story_id), 0
+    from stories
+    where ($4::bigint = 0 or story_id < $4)
+        and ($2::bigint = 0 or (raw_document->>'time')::bigint < $2)
+    union all
+    select
+        (select max(stories.story_id) from stories where stories.story_id < walk.story_id),
+        walk.found + (
+            select count(*)::int
+            from (
+                select raw_document, domain
+                from stories
+                where stories.story_id = walk.story_id
+                order by fetched_at desc
+                limit 1
+            ) latest
+            where` + storyFilterClause + `
+                and coalesce((raw_document->>'score')::int, 0) >= $5
+        )
+    from walk
+    where walk.story_id is not null and walk.found < $6
+)
+select latest.story_id, api_version, queue_name, fetched_at, raw_document::text, status, tags, coalesce(canonical_url, ''), coalesce(domain, '')
+from walk
+cross join lateral (
+    select story_id, api_version, queue_name, fetched_at, raw_document, status, tags, canonical_url, domain
+    from stories
+    where stories.story_id = walk.story_id
+    order by fetched_at desc
+    limit 1
+) latest
+where` + storyFilterClause + `
+    and coalesce((raw_document->>'score')::int, 0) >= $5
+order by latest.story_id desc
+limit $6
+`
+
+const readStorySnapshotsStmt = `
+select story_id, api_version, queue_name, fetched_at, raw_document::text, status, tags, coalesce(canonical_url, ''), coalesce(domain, '')
+from stories
+where story_id = $1
+order by fetched_at
+`
+
+// growthCurvesStmt buckets snapshots of live stories by the age of the story
+// when they were taken.
+const growthCurvesStmt = `
+with aged as (
+    select
+        floor((extract(epoch from fetched_at) - (raw_document->>'time')::bigint) / $5)::int as bucket,
+        coalesce((raw_document->>'score')::int, 0) as score,
+        coalesce((raw_document->>'descendants')::int, 0) as descendants
+    from stories
+    where status = 'ok' and` + storyFilterClause + `
+)
+select
+    bucket,
+    count(*),
+    avg(score),
+    percentile_cont(0.5) within group (order by score),
+    avg(descendants),
+    percentile_cont(0.5) within group (order by descendants)
+from aged
+where bucket >= 0 and bucket < $4
+group by bucket
+order by bucket
+`
+
+const readStoryPointsStmt = `
+select
+    story_id,
+    queue_name,
+    fetched_at,
+    (raw_document->>'time')::bigint,
+    coalesce((raw_document->>'score')::int, 0),
+    coalesce((raw_document->>'descendants')::int, 0)
+from stories
+where status = 'ok' and` + storyFilterClause + `
+order by story_id, fetched_at
+`
+
+const readStoryAnalyticsStmt = `
+select classification, peak_score_percentile, peak_age_seconds, max_score_velocity
+from story_analytics
+where story_id = $1
+`
+
+const readSnapshotAnalyticsStmt = `
+select
+    label,
+    fetched_at,
+    age_seconds,
+    score,
+    descendants,
+    score_velocity,
+    comment_velocity,
+    score_percentile,
+    descendants_percentile
+from snapshot_analytics
+where story_id = $1
+order by fetched_at
+`
+
+// readStoryDuplicatesStmt reads the latest snapshot of each story that has
+// the same canonical URL as the given story, as of its latest snapshot.
+const readStoryDuplicatesStmt = `
+with target as (
+    select canonical_url
+    from stories
+    where story_id = $1 and canonical_url is not null
+    order by fetched_at desc
+    limit 1
+)
+select distinct on (story_id) story_id, api_version, queue_name, fetched_at, raw_document::text, status, tags, coalesce(canonical_url, ''), coalesce(domain, '')
+from stories
+where canonical_url = (select canonical_url from target)
+order by story_id, fetched_at desc
+`
+
+// domainStatsStmt aggregates the latest snapshots of live stories by their
+// registrable domain.
+const domainStatsStmt = `
+with latest as (
+    select distinct on (story_id)
+        domain,
+        canonical_url,
+        coalesce((raw_document->>'score')::int, 0) as score,
+        coalesce((raw_document->>'descendants')::int, 0) as descendants
+    from stories
+    where status = 'ok' and domain is not null and` + storyFilterClause + `
+    order by story_id, fetched_at desc
+)
+select
+    domain,
+    count(*),
+    count(distinct canonical_url),
+    avg(score),
+    percentile_cont(0.5) within group (order by score),
+    max(score),
+    avg(descendants)
+from latest
+group by domain
+having count(*) >= $4
+order by count(*) desc, domain
+limit $5
+`
+
+// exportSnapshotsStmt reads every snapshot of the stories that match the
+// filter, grouped by story, in the order they were taken.
+const exportSnapshotsStmt = `
+select story_id, api_version, queue_name, fetched_at, raw_document::text, status, tags, coalesce(canonical_url, ''), coalesce(domain, '')
+from stories
+where` + storyFilterClause + `
+order by story_id, fetched_at
+`
+
+// exportLabelsStmt reads the labels of the snapshots of the stories that
+// match the filter, ordered by the mean age of the stories when they were
+// taken.
+const exportLabelsStmt = `
+select queue_name
+from stories
+where` + storyFilterClause + `
+group by queue_name
+order by avg(extract(epoch from fetched_at) - (raw_document->>'time')::bigint) nulls last, queue_name
+`
+
+var ErrAnalyticsNotFound = errors.New("Analytics not found")
+
+// StoryFilter selects stories to read. Zero values are unset.
+type StoryFilter struct {
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	MinScore      int
+	Domain        string
+	// BeforeID pages through stories, which are ordered by id descending.
+	BeforeID int64
+	Limit    int
+}
+
+// GrowthPoint aggregates the snapshots of stories taken at a given age.
+type GrowthPoint struct {
+	Age               time.Duration
+	Snapshots         int64
+	MeanScore         float64
+	MedianScore       float64
+	MeanDescendants   float64
+	MedianDescendants float64
+}
+
+// DomainStats aggregates the stories submitted from a registrable domain.
+// Articles counts distinct canonical URLs, so duplicate submissions of an
+// article are counted once.
+type DomainStats struct {
+	Domain          string
+	Stories         int64
+	Articles        int64
+	MeanScore       float64
+	MedianScore     float64
+	MaxScore        int32
+	MeanDescendants float64
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// ListStories reads the latest snapshot of each story that matches the
+// filter, most recent story first. Comments are not read.
+func (r *Repo) ListStories(ctx context.Context, filter StoryFilter) ([]StoryModel, error) {
+	rows, err := r.pool.Query(
+		ctx,
+		listStoriesStmt,
+		unixOrZero(filter.CreatedAfter),
+		unixOrZero(filter.CreatedBefore),
+		filter.Domain,
+		filter.BeforeID,
+		filter.MinScore,
+		filter.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectSnapshots(rows)
+}
+
+// StorySnapshots reads every snapshot of a story, in the order they were
+// taken. Comments are not read.
+func (r *Repo) StorySnapshots(ctx context.Context, storyID int64) ([]StoryModel, error) {
+	rows, err := r.pool.Query(ctx, readStorySnapshotsStmt, storyID)
+	if err != nil {
+		return nil, err
+	}
+	return collectSnapshots(rows)
+}
+
+// GrowthCurves aggregates the snapshots of live stories that match the
+// filter, by the age of the story when they were taken, in buckets of the
+// given width up to the maximum age. Score and paging filters are ignored.
+func (r *Repo) GrowthCurves(ctx context.Context, filter StoryFilter, bucket, maxAge time.Duration) ([]GrowthPoint, error) {
+	rows, err := r.pool.Query(
+		ctx,
+		growthCurvesStmt,
+		unixOrZero(filter.CreatedAfter),
+		unixOrZero(filter.CreatedBefore),
+		filter.Domain,
+		int(maxAge/bucket),
+		bucket.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (GrowthPoint, error) {
+		point := GrowthPoint{}
+		var idx int
+		err := row.Scan(&idx, &point.Snapshots, &point.MeanScore, &point.MedianScore, &point.MeanDescendants, &point.MedianDescendants)
+		point.Age = time.Duration(idx) * bucket
+		return point, err
+	})
+}
+
+// ReadStoryPoints reads the points of the snapshots of live stories that
+// match the filter, grouped by story in the order they were taken. Score and
+// paging filters are ignored.
+func (r *Repo) ReadStoryPoints(ctx context.Context, filter StoryFilter) ([]StoryPoint, error) {
+	rows, err := r.pool.Query(
+		ctx,
+		readStoryPointsStmt,
+		unixOrZero(filter.CreatedAfter),
+		unixOrZero(filter.CreatedBefore),
+		filter.Domain,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (StoryPoint, error) {
+		point := StoryPoint{}
+		var createdAt int64
+		err := row.Scan(&point.StoryID, &point.Label, &point.FetchedAt, &createdAt, &point.Score, &point.Descendants)
+		point.CreatedAt = time.Unix(createdAt, 0).UTC()
+		return point, err
+	})
+}
+
+// ReadAnalytics reads the stored metrics of a story, and of each of its
+// snapshots in the order they were taken. ErrAnalyticsNotFound is returned
+// if they haven't been computed.
+func (r *Repo) ReadAnalytics(ctx context.Context, storyID int64) (StoryAnalytics, []SnapshotMetrics, error) {
+	analytics := StoryAnalytics{StoryID: storyID}
+
+	var peakAgeSeconds *int64
+	row := r.pool.QueryRow(ctx, readStoryAnalyticsStmt, storyID)
+	err := row.Scan(&analytics.Classification, &analytics.PeakScorePercentile, &peakAgeSeconds, &analytics.MaxScoreVelocity)
+	if errors.Is(err, sql.ErrNoRows) {
+		return analytics, nil, ErrAnalyticsNotFound
+	}
+	if err != nil {
+		return analytics, nil, err
+	}
+	if peakAgeSeconds != nil {
+		peakAge := time.Duration(*peakAgeSeconds) * time.Second
+		analytics.PeakAge = &peakAge
+	}
+
+	rows, err := r.pool.Query(ctx, readSnapshotAnalyticsStmt, storyID)
+	if err != nil {
+		return analytics, nil, err
+	}
+	metrics, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (SnapshotMetrics, error) {
+		m := SnapshotMetrics{StoryPoint: StoryPoint{StoryID: storyID}}
+		var ageSeconds int64
+		err := row.Scan(
+			&m.Label,
+			&m.FetchedAt,
+			&ageSeconds,
+			&m.Score,
+			&m.Descendants,
+			&m.ScoreVelocity,
+			&m.CommentVelocity,
+			&m.ScorePercentile,
+			&m.DescendantsPercentile,
+		)
+		m.CreatedAt = m.FetchedAt.Add(-time.Duration(ageSeconds) * time.Second)
+		return m, err
+	})
+	return analytics, metrics, err
+}
+
+// StoryDuplicates reads the latest snapshot of each submission of the same
+// article as a story, including the story itself, in the order they were
+// submitted. No snapshots are returned if the story has no URL.
+func (r *Repo) StoryDuplicates(ctx context.Context, storyID int64) ([]StoryModel, error) {
+	rows, err := r.pool.Query(ctx, readStoryDuplicatesStmt, storyID)
+	if err != nil {
+		return nil, err
+	}
+	return collectSnapshots(rows)
+}
+
+// DomainStats aggregates the live stories that match the filter by their
+// registrable domain, for domains with at least minStories stories, those
+// with the most stories first. Score and paging filters are ignored, other
+// than the limit.
+func (r *Repo) DomainStats(ctx context.Context, filter StoryFilter, minStories int) ([]DomainStats, error) {
+	rows, err := r.pool.Query(
+		ctx,
+		domainStatsStmt,
+		unixOrZero(filter.CreatedAfter),
+		unixOrZero(filter.CreatedBefore),
+		filter.Domain,
+		minStories,
+		filter.Limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (DomainStats, error) {
+		stats := DomainStats{}
+		err := row.Scan(
+			&stats.Domain,
+			&stats.Stories,
+			&stats.Articles,
+			&stats.MeanScore,
+			&stats.MedianScore,
+			&stats.MaxScore,
+			&stats.MeanDescendants,
+		)
+		return stats, err
+	})
+}
+
+// StreamSnapshots reads every snapshot of the stories that match the filter,
+// grouped by story and in the order they were taken, calling fn with each
+// in turn rather than holding them all in memory. Comments are not read, and
+// score and paging filters are ignored.
+func (r *Repo) StreamSnapshots(ctx context.Context, filter StoryFilter, fn func(StoryModel) error) error {
+	rows, err := r.pool.Query(
+		ctx,
+		exportSnapshotsStmt,
+		unixOrZero(filter.CreatedAfter),
+		unixOrZero(filter.CreatedBefore),
+		filter.Domain,
+	)
+	if err != nil {
+		return err
+	}
+
+	model := StoryModel{}
+	_, err = pgx.ForEachRow(
+		rows,
+		[]any{&model.StoryID, &model.APIVersion, &model.QueueName, &model.FetchedAt, &model.RawDocument, &model.Status, &model.Tags, &model.CanonicalURL, &model.Domain},
+		func() error {
+			snapshot := model
+			// Don't let the next row's tags be scanned into this one's.
+			model.Tags = nil
+			return fn(snapshot)
+		},
+	)
+	return err
+}
+
+// ExportLabels reads the labels of the snapshots of the stories that match
+// the filter, those taken earliest in a story's life first.
+func (r *Repo) ExportLabels(ctx context.Context, filter StoryFilter) ([]string, error) {
+	rows, err := r.pool.Query(
+		ctx,
+		exportLabelsStmt,
+		unixOrZero(filter.CreatedAfter),
+		unixOrZero(filter.CreatedBefore),
+		filter.Domain,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testRepo connects to the database given by TEST_DATABASE_URL, migrating it,
+// and skips the test if there is none.
+func testRepo(t *testing.T) (*Repo, *pgxpool.Pool) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL is not set")
+	}
+
+	ctx := context.Background()
+	pool, err := pgxpool.New(ctx, url)
+	require.Nil(t, err)
+	t.Cleanup(pool.Close)
+	require.Nil(t, Migrate(ctx, pool))
+	return NewRepo(pool), pool
+}
+
+// testStoryID returns a story id that no other test run uses, and deletes the
+// story's snapshots once the test is done.
+func testStoryID(t *testing.T, pool *pgxpool.Pool) int64 {
+	storyID := time.Now().UnixNano() % 1_000_000_000
+	t.Cleanup(func() {
+		ctx := context.Background()
+		pool.Exec(ctx, "delete from snapshot_comments where internal_story_id in (select id from stories where story_id = $1)", storyID)
+		pool.Exec(ctx, "delete from poll_options where internal_story_id in (select id from stories where story_id = $1)", storyID)
+		pool.Exec(ctx, "delete from stories where story_id = $1", storyID)
+	})
+	return storyID
+}
+
+func makeTestSnapshot(storyID int64, label string, fetchedAt time.Time, comments ...string) StoryModel {
+	model := StoryModel{
+		StoryID:     storyID,
+		APIVersion:  "v0",
+		QueueName:   label,
+		FetchedAt:   fetchedAt,
+		RawDocument: fmt.Sprintf(`{"id": %d}`, storyID),
+		Status:      StoryStatusOK,
+		Tags:        []string{},
+	}
+	for idx, text := range comments {
+		model.Comments = append(model.Comments, CommentModel{
+			CommentID:   storyID + int64(idx) + 1,
+			RawDocument: fmt.Sprintf(`{"id": %d, "text": "%s"}`, storyID+int64(idx)+1, text),
+		})
+	}
+	return model
+}
+
+func countCommentVersions(t *testing.T, pool *pgxpool.Pool, comments []CommentModel) int {
+	var ids []int64
+	for _, comment := range comments {
+		ids = append(ids, comment.CommentID)
+	}
+
+	var count int
+	err := pool.QueryRow(context.Background(), "select count(*) from comment_versions where comment_id = any($1)", ids).Scan(&count)
+	require.Nil(t, err)
+	return count
+}
+
+func assertCommentsEqual(t *testing.T, expected, actual []CommentModel) {
+	require.Len(t, actual, len(expected))
+	for idx := range expected {
+		assert.Equal(t, expected[idx].CommentID, actual[idx].CommentID)
+		assert.JSONEq(t, expected[idx].RawDocument, actual[idx].RawDocument)
+	}
+}
+
+func TestRepoWriteStoryDeduplicatesCommentVersions(t *testing.T) {
+	repo, pool := testRepo(t)
+	storyID := testStoryID(t, pool)
+	ctx := context.Background()
+	fetchedAt := time.Now().UTC().Truncate(time.Second)
+
+	first := makeTestSnapshot(storyID, "new", fetchedAt, "First", "Second")
+	second := makeTestSnapshot(storyID, "0m", fetchedAt.Add(time.Minute), "First", "Edited")
+
+	require.Nil(t, repo.WriteStory(ctx, first))
+	require.Nil(t, repo.WriteStory(ctx, second))
+
+	// The unchanged comment is stored once, and the edited one twice.
+	assert.Equal(t, 3, countCommentVersions(t, pool, first.Comments))
+
+	for _, expected := range []StoryModel{first, second} {
+		actual, err := repo.ReadSnapshot(ctx, storyID, expected.QueueName)
+		require.Nil(t, err)
+		assert.Equal(t, expected.QueueName, actual.QueueName)
+		assert.JSONEq(t, expected.RawDocument, actual.RawDocument)
+		assertCommentsEqual(t, expected.Comments, actual.Comments)
+	}
+}
+
+func TestRepoWriteStoryWhenCommentVersionExistsKeepsIt(t *testing.T) {
+	repo, pool := testRepo(t)
+	storyID := testStoryID(t, pool)
+	ctx := context.Background()
+	fetchedAt := time.Now().UTC().Truncate(time.Second)
+
+	first := makeTestSnapshot(storyID, "new", fetchedAt, "First")
+	require.Nil(t, repo.WriteStory(ctx, first))
+
+	var before int
+	err := pool.QueryRow(ctx, "select id from comment_versions where comment_id = $1", first.Comments[0].CommentID).Scan(&before)
+	require.Nil(t, err)
+
+	second := makeTestSnapshot(storyID, "0m", fetchedAt.Add(time.Minute), "First")
+	require.Nil(t, repo.WriteStory(ctx, second))
+
+	var after int
+	var xmin string
+	err = pool.QueryRow(ctx, "select id, xmin::text from comment_versions where comment_id = $1", first.Comments[0].CommentID).Scan(&after, &xmin)
+	require.Nil(t, err)
+	assert.Equal(t, before, after)
+
+	// The existing version isn't rewritten by the second snapshot.
+	var firstXmin string
+	err = pool.QueryRow(ctx, "select xmin::text from stories where story_id = $1 and queue_name = 'new'", storyID).Scan(&firstXmin)
+	require.Nil(t, err)
+	assert.Equal(t, firstXmin, xmin)
+}
+
+func TestRepoCopyStoriesDeduplicatesCommentVersions(t *testing.T) {
+	repo, pool := testRepo(t)
+	storyID := testStoryID(t, pool)
+	ctx := context.Background()
+	fetchedAt := time.Now().UTC().Truncate(time.Second)
+
+	stored := makeTestSnapshot(storyID, "new", fetchedAt, "First", "Second")
+	require.Nil(t, repo.WriteStory(ctx, stored))
+
+	copied := []StoryModel{
+		makeTestSnapshot(storyID, "0m", fetchedAt.Add(time.Minute), "First", "Edited"),
+		// Conflicts with the stored snapshot.
+		makeTestSnapshot(storyID, "new", fetchedAt.Add(2*time.Minute), "Other"),
+	}
+	conflicts, err := repo.CopyStories(ctx, copied)
+	require.Nil(t, err)
+	assert.Equal(t, []int{1}, conflicts)
+
+	assert.Equal(t, 3, countCommentVersions(t, pool, stored.Comments))
+
+	actual, err := repo.ReadSnapshot(ctx, storyID, "0m")
+	require.Nil(t, err)
+	assertCommentsEqual(t, copied[0].Comments, actual.Comments)
+
+	actual, err = repo.ReadSnapshot(ctx, storyID, "new")
+	require.Nil(t, err)
+	assertCommentsEqual(t, stored.Comments, actual.Comments)
+}
+
+func TestRepoReadSnapshotWhenMissingReturnsError(t *testing.T) {
+	repo, pool := testRepo(t)
+	storyID := testStoryID(t, pool)
+
+	_, err := repo.ReadSnapshot(context.Background(), storyID, "new")
+
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
+
+func TestRepoListStoriesPagesThroughMatchingStories(t *testing.T) {
+	repo, pool := testRepo(t)
+	ctx := context.Background()
+	fetchedAt := time.Now().UTC().Truncate(time.Second)
+
+	// Ids above any others, so that the cursor bounds the stories read.
+	base := int64(2_100_000_000) + time.Now().UnixNano()%10_000_000
+	t.Cleanup(func() {
+		pool.Exec(ctx, "delete from stories where story_id between $1 and $2", base, base+4)
+	})
+
+	for idx, score := range []int{10, 1, 10, 10, 1} {
+		storyID := base + int64(idx)
+		// The latest snapshot of each story is filtered on.
+		earlier := makeTestSnapshot(storyID, "new", fetchedAt)
+		earlier.RawDocument = fmt.Sprintf(`{"id": %d, "score": 100}`, storyID)
+		require.Nil(t, repo.WriteStory(ctx, earlier))
+
+		latest := makeTestSnapshot(storyID, "0m", fetchedAt.Add(time.Minute))
+		latest.RawDocument = fmt.Sprintf(`{"id": %d, "score": %d}`, storyID, score)
+		require.Nil(t, repo.WriteStory(ctx, latest))
+	}
+
+	filter := StoryFilter{MinScore: 5, BeforeID: base + 5, Limit: 2}
+	models, err := repo.ListStories(ctx, filter)
+	require.Nil(t, err)
+	require.Len(t, models, 2)
+	assert.Equal(t, base+3, models[0].StoryID)
+	assert.Equal(t, "0m", models[0].QueueName)
+	assert.Equal(t, base+2, models[1].StoryID)
+
+	filter.BeforeID = base + 2
+	models, err = repo.ListStories(ctx, filter)
+	require.Nil(t, err)
+	require.Len(t, models, 1)
+	assert.Equal(t, base, models[0].StoryID)
+}
+
+func TestRepoDeleteOrphansWaitsForWriters(t *testing.T) {
+	repo, pool := testRepo(t)
+	ctx := context.Background()
+
+	// A writer that is linking comment versions holds the lock shared.
+	tx, err := pool.Begin(ctx)
+	require.Nil(t, err)
+	_, err = tx.Exec(ctx, lockOrphansSharedStmt, orphansLockID)
+	require.Nil(t, err)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = repo.DeleteOrphans(waitCtx)
+	assert.NotNil(t, err)
+
+	require.Nil(t, tx.Rollback(ctx))
+	_, err = repo.DeleteOrphans(ctx)
+	assert.Nil(t, err)
+}
+
+func TestRepoListStoriesWhenCreatedBeforeStartsFromEarlierStories(t *testing.T) {
+	repo, pool := testRepo(t)
+	ctx := context.Background()
+	fetchedAt := time.Now().UTC().Truncate(time.Second)
+
+	// Ids above any others, so that the walk would otherwise start from them.
+	base := int64(2_110_000_000) + time.Now().UnixNano()%10_000_000
+	t.Cleanup(func() {
+		pool.Exec(ctx, "delete from stories where story_id between $1 and $2", base, base+3)
+	})
+
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for idx := range 4 {
+		storyID := base + int64(idx)
+		snapshot := makeTestSnapshot(storyID, "new", fetchedAt)
+		snapshot.RawDocument = fmt.Sprintf(`{"id": %d, "time": %d}`, storyID, createdAt.Add(time.Duration(idx)*time.Hour).Unix())
+		require.Nil(t, repo.WriteStory(ctx, snapshot))
+	}
+
+	filter := StoryFilter{CreatedAfter: createdAt, CreatedBefore: createdAt.Add(2 * time.Hour), Limit: 1}
+	models, err := repo.ListStories(ctx, filter)
+	require.Nil(t, err)
+	require.Len(t, models, 1)
+	assert.Equal(t, base+1, models[0].StoryID)
+
+	filter.BeforeID = base + 1
+	models, err = repo.ListStories(ctx, filter)
+	require.Nil(t, err)
+	require.Len(t, models, 1)
+	assert.Equal(t, base, models[0].StoryID)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const DefaultRetentionAhead = 3
+
+// PartitionStore provides methods to manage the monthly partitions of
+// snapshots, each identified by the start of its month.
+type PartitionStore interface {
+	Partitions(context.Context) ([]time.Time, error)
+	CreatePartition(context.Context, time.Time) error
+	StreamPartition(context.Context, time.Time, func(ArchivedStory) error) error
+	DropPartition(context.Context, time.Time) error
+	DeleteOrphans(context.Context) (int64, error)
+}
+
+// ArchiveSink archives the snapshots of a partition before it's dropped. The
+// partition's snapshots are read by calling read.
+type ArchiveSink interface {
+	Archive(ctx context.Context, name string, read func(func(ArchivedStory) error) error) error
+}
+
+// DirectorySink archives each partition to a gzipped JSONL file in Dir, named
+// for the partition, which can be imported by the `import` subcommand. Files
+// are written in full before they're given their name, so that an archive
+// that exists is complete.
+type DirectorySink struct {
+	Dir string
+}
+
+// Path is the path of the archive of a partition.
+func (s DirectorySink) Path(name string) string {
+	return filepath.Join(s.Dir, name+".jsonl.gz")
+}
+
+func (s DirectorySink) Archive(ctx context.Context, name string, read func(func(ArchivedStory) error) error) error {
+	f, err := os.CreateTemp(s.Dir, name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	encoder := json.NewEncoder(gz)
+	err = read(func(archived ArchivedStory) error {
+		return encoder.Encode(archived)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.Path(name))
+}
+
+// RetentionPlan lists the months whose partitions are to be created, and
+// those whose partitions are to be dropped, in order.
+type RetentionPlan struct {
+	Create []time.Time
+	Drop   []time.Time
+}
+
+// PlanRetention plans the partitions to create, for the current month and
+// the ahead months after it, and those to drop, as every snapshot in them
+// was taken longer than horizon ago. No partitions are dropped if horizon is
+// zero.
+func PlanRetention(existing []time.Time, now time.Time, ahead int, horizon time.Duration) RetentionPlan {
+	plan := RetentionPlan{}
+
+	current := MonthStart(now)
+	for idx := 0; idx <= ahead; idx++ {
+		month := current.AddDate(0, idx, 0)
+		if !slices.ContainsFunc(existing, month.Equal) {
+			plan.Create = append(plan.Create, month)
+		}
+	}
+
+	if horizon > 0 {
+		cutoff := now.Add(-horizon)
+		for _, month := range existing {
+			if !month.AddDate(0, 1, 0).After(cutoff) {
+				plan.Drop = append(plan.Drop, month)
+			}
+		}
+		slices.SortFunc(plan.Drop, time.Time.Compare)
+	}
+	return plan
+}
+
+// RetentionResult lists the months whose partitions were created and
+// dropped, and counts the orphaned poll options and comment versions that
+// were deleted.
+type RetentionResult struct {
+	Created []time.Time
+	Dropped []time.Time
+	Orphans int64
+}
+
+// ApplyRetention creates and drops the partitions of the plan. If sink isn't
+// nil, each partition is archived before it's dropped, and isn't dropped if
+// it can't be archived. The result lists the changes made, even if an error
+// is returned part way through.
+func ApplyRetention(ctx context.Context, store PartitionStore, sink ArchiveSink, plan RetentionPlan) (RetentionResult, error) {
+	result := RetentionResult{}
+
+	for _, month := range plan.Create {
+		if err := store.CreatePartition(ctx, month); err != nil {
+			return result, err
+		}
+		result.Created = append(result.Created, month)
+	}
+
+	for _, month := range plan.Drop {
+		if sink != nil {
+			read := func(fn func(ArchivedStory) error) error {
+				return store.StreamPartition(ctx, month, fn)
+			}
+			if err := sink.Archive(ctx, PartitionName("stories", month), read); err != nil {
+				return result, err
+			}
+		}
+		if err := store.DropPartition(ctx, month); err != nil {
+			return result, err
+		}
+		result.Dropped = append(result.Dropped, month)
+	}
+
+	if len(result.Dropped) > 0 {
+		orphans, err := store.DeleteOrphans(ctx)
+		if err != nil {
+			return result, err
+		}
+		result.Orphans = orphans
+	}
+	return result, nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockPartitionStore struct {
+	mock.Mock
+}
+
+func (m *mockPartitionStore) Partitions(ctx context.Context) ([]time.Time, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]time.Time), args.Error(1)
+}
+
+func (m *mockPartitionStore) CreatePartition(ctx context.Context, month time.Time) error {
+	args := m.Called(ctx, month)
+	return args.Error(0)
+}
+
+func (m *mockPartitionStore) StreamPartition(ctx context.Context, month time.Time, fn func(ArchivedStory) error) error {
+	args := m.Called(ctx, month, fn)
+	for _, archived := range args.Get(0).([]ArchivedStory) {
+		if err := fn(archived); err != nil {
+			return err
+		}
+	}
+	return args.Error(1)
+}
+
+func (m *mockPartitionStore) DropPartition(ctx context.Context, month time.Time) error {
+	args := m.Called(ctx, month)
+	return args.Error(0)
+}
+
+func (m *mockPartitionStore) DeleteOrphans(ctx context.Context) (int64, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+type mockArchiveSink struct {
+	mock.Mock
+	archived []ArchivedStory
+}
+
+func (m *mockArchiveSink) Archive(ctx context.Context, name string, read func(func(ArchivedStory) error) error) error {
+	args := m.Called(ctx, name)
+	if err := args.Error(0); err != nil {
+		return err
+	}
+	return read(func(archived ArchivedStory) error {
+		m.archived = append(m.archived, archived)
+		return nil
+	})
+}
+
+func month(year int, m time.Month) time.Time {
+	return time.Date(year, m, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParsePartitionMonth(t *testing.T) {
+	parsed, ok := parsePartitionMonth("stories_202402")
+	assert.True(t, ok)
+	assert.Equal(t, month(2024, time.February), parsed)
+	assert.Equal(t, "snapshot_comments_202402", PartitionName("snapshot_comments", parsed))
+
+	for _, name := range []string{"stories_default", "stories_2024", "snapshot_comments_202402"} {
+		_, ok := parsePartitionMonth(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestPlanRetention(t *testing.T) {
+	existing := []time.Time{month(2024, time.February), month(2023, time.December), month(2024, time.January), month(2024, time.March)}
+	now := time.Date(2024, time.March, 15, 12, 0, 0, 0, time.UTC)
+
+	plan := PlanRetention(existing, now, 2, 60*24*time.Hour)
+
+	expected := RetentionPlan{
+		Create: []time.Time{month(2024, time.April), month(2024, time.May)},
+		// January ended less than 60 days ago.
+		Drop: []time.Time{month(2023, time.December)},
+	}
+	assert.Equal(t, expected, plan)
+}
+
+func TestPlanRetentionWithoutHorizonKeepsPartitions(t *testing.T) {
+	existing := []time.Time{month(2000, time.January)}
+	now := time.Date(2024, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+	plan := PlanRetention(existing, now, 1, 0)
+
+	expected := RetentionPlan{Create: []time.Time{month(2024, time.December), month(2025, time.January)}}
+	assert.Equal(t, expected, plan)
+}
+
+func TestApplyRetention(t *testing.T) {
+	archived := []ArchivedStory{{StoryID: 1, QueueName: "0m"}, {StoryID: 1, QueueName: "15m"}}
+
+	store := new(mockPartitionStore)
+	store.On("CreatePartition", mock.Anything, month(2024, time.April)).Return(nil)
+	store.On("StreamPartition", mock.Anything, month(2023, time.December), mock.Anything).Return(archived, nil)
+	store.On("DropPartition", mock.Anything, month(2023, time.December)).Return(nil)
+	store.On("DeleteOrphans", mock.Anything).Return(int64(3), nil)
+
+	sink := new(mockArchiveSink)
+	sink.On("Archive", mock.Anything, "stories_202312").Return(nil)
+
+	plan := RetentionPlan{Create: []time.Time{month(2024, time.April)}, Drop: []time.Time{month(2023, time.December)}}
+	result, err := ApplyRetention(context.Background(), store, sink, plan)
+
+	expected := RetentionResult{Created: plan.Create, Dropped: plan.Drop, Orphans: 3}
+	assert.Nil(t, err)
+	assert.Equal(t, expected, result)
+	assert.Equal(t, archived, sink.archived)
+	store.AssertExpectations(t)
+}
+
+func TestApplyRetentionWhenArchiveFailsKeepsPartition(t *testing.T) {
+	store := new(mockPartitionStore)
+
+	sink := new(mockArchiveSink)
+	sink.On("Archive", mock.Anything, "stories_202312").Return(fmt.Errorf("Error"))
+
+	plan := RetentionPlan{Drop: []time.Time{month(2023, time.December)}}
+	result, err := ApplyRetention(context.Background(), store, sink, plan)
+
+	assert.NotNil(t, err)
+	assert.Empty(t, result.Dropped)
+	store.AssertNotCalled(t, "DropPartition", mock.Anything, mock.Anything)
+	store.AssertNotCalled(t, "DeleteOrphans", mock.Anything)
+}
+
+func TestDirectorySink(t *testing.T) {
+	sink := DirectorySink{Dir: t.TempDir()}
+	archived := ArchivedStory{
+		StoryID:     1,
+		APIVersion:  "v0",
+		QueueName:   "0m",
+		FetchedAt:   time.Date(2023, time.December, 1, 0, 0, 0, 0, time.UTC),
+		RawDocument: json.RawMessage(`{"id":1}`),
+		Status:      StoryStatusOK,
+		Comments:    []ArchivedComment{{CommentID: 2, RawDocument: json.RawMessage(`{"id":2}`)}},
+	}
+
+	err := sink.Archive(context.Background(), "stories_202312", func(fn func(ArchivedStory) error) error {
+		return fn(archived)
+	})
+	assert.Nil(t, err)
+
+	// Archives can be read back as they're imported.
+	f, err := os.Open(sink.Path("stories_202312"))
+	assert.Nil(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+
+	var models []StoryModel
+	err = ReadJSONL(gz, func(model StoryModel) error {
+		models = append(models, model)
+		return nil
+	})
+	assert.Nil(t, err)
+	expected, _ := archived.Model()
+	assert.Equal(t, []StoryModel{expected}, models)
+}
+
+func TestDirectorySinkWhenReadFailsLeavesNoArchive(t *testing.T) {
+	sink := DirectorySink{Dir: t.TempDir()}
+
+	err := sink.Archive(context.Background(), "stories_202312", func(fn func(ArchivedStory) error) error {
+		return fmt.Errorf("Error")
+	})
+
+	assert.NotNil(t, err)
+	entries, _ := os.ReadDir(sink.Dir)
+	assert.Empty(t, entries)
+}
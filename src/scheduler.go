@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+const (
+	AdaptiveQueueName                 = "adaptive"
+	DefaultSchedulerBaseInterval      = 30 * time.Minute
+	DefaultSchedulerMinInterval       = 5 * time.Minute
+	DefaultSchedulerMaxInterval       = 6 * time.Hour
+	DefaultSchedulerReferenceVelocity = 10.0
+	DefaultSchedulerMaxStoryAge       = 7 * 24 * time.Hour
+)
+
+// ScheduleConfig bounds the adaptive scheduling of snapshots.
+type ScheduleConfig struct {
+	// BaseInterval is the time between snapshots of a story growing at
+	// ReferenceVelocity.
+	BaseInterval time.Duration
+	// MinInterval and MaxInterval bound the time between snapshots.
+	MinInterval time.Duration
+	MaxInterval time.Duration
+	// ReferenceVelocity is the growth, in points plus comments per hour, at
+	// which a story is snapshotted every BaseInterval.
+	ReferenceVelocity float64
+	// MaxStoryAge is the age after which a story is no longer snapshotted.
+	MaxStoryAge time.Duration
+}
+
+// MakeDefaultScheduleConfig makes a ScheduleConfig with the default limits.
+func MakeDefaultScheduleConfig() ScheduleConfig {
+	return ScheduleConfig{
+		BaseInterval:      DefaultSchedulerBaseInterval,
+		MinInterval:       DefaultSchedulerMinInterval,
+		MaxInterval:       DefaultSchedulerMaxInterval,
+		ReferenceVelocity: DefaultSchedulerReferenceVelocity,
+		MaxStoryAge:       DefaultSchedulerMaxStoryAge,
+	}
+}
+
+// Velocity returns the growth of a story's score and number of comments, per
+// hour, between two snapshots.
+func Velocity(previous, current HNStory, elapsed time.Duration) float64 {
+	growth := (current.Score - previous.Score) + (current.Descendants - previous.Descendants)
+	return float64(growth) / elapsed.Hours()
+}
+
+// PlanInterval plans the time until the next snapshot of a story growing at
+// the given velocity. The interval is inversely proportional to the velocity,
+// so that roughly the same amount of growth is captured between snapshots.
+func (c ScheduleConfig) PlanInterval(velocity float64) time.Duration {
+	if velocity <= 0 {
+		return c.MaxInterval
+	}
+
+	interval := time.Duration(float64(c.BaseInterval) * c.ReferenceVelocity / velocity)
+	return min(max(interval, c.MinInterval), c.MaxInterval)
+}
+
+// AdaptiveProducer schedules the next snapshot of a story according to how
+// quickly it has grown between its last two snapshots, rather than at a fixed
+// offset. Hot stories are snapshotted sooner and stagnant ones later, and
+// stories are retired once they stop growing or reach the maximum age.
+type AdaptiveProducer struct {
+	producer *MessageProducer
+	dst      Enqueuer
+	repo     SnapshotReader
+	Schedule ScheduleConfig
+}
+
+func NewAdaptiveProducer(dst Enqueuer, repo SnapshotReader, schedule ScheduleConfig) *AdaptiveProducer {
+	if schedule.MinInterval <= 0 || schedule.MinInterval > schedule.MaxInterval {
+		panic("Scheduler intervals must be positive, with min no greater than max")
+	}
+	if schedule.ReferenceVelocity <= 0 {
+		panic("Scheduler reference velocity must be positive")
+	}
+
+	return &AdaptiveProducer{
+		producer: NewMessageProducer(dst),
+		dst:      dst,
+		repo:     repo,
+		Schedule: schedule,
+	}
+}
+
+// MakeAdaptiveLabel labels an adaptive snapshot by the age of the story it's
+// planned to be taken at, to the second, so that each of a story's adaptive
+// snapshots is stored under its own label.
+func MakeAdaptiveLabel(age time.Duration) string {
+	return fmt.Sprintf("%s-%s", AdaptiveQueueName, age.Round(time.Second))
+}
+
+// PlanMessage plans the message for the next snapshot of a story, given its
+// most recent snapshots, most recent first. False is returned if the story
+// should be retired instead.
+func (p *AdaptiveProducer) PlanMessage(storyID int64, createdAt *time.Time, snapshots []StoryModel, now time.Time) (Message, bool, error) {
+	msg, ok, err := p.planMessage(storyID, createdAt, snapshots, now)
+	if ok && err == nil {
+		if createdAt != nil {
+			msg.Label = MakeAdaptiveLabel(msg.ProcessAt.Sub(*createdAt))
+		} else {
+			// Without the story's age, label by when it's planned instead.
+			msg.Label = fmt.Sprintf("%s-%s", AdaptiveQueueName, msg.ProcessAt.Format(time.RFC3339))
+		}
+	}
+	return msg, ok, err
+}
+
+func (p *AdaptiveProducer) planMessage(storyID int64, createdAt *time.Time, snapshots []StoryModel, now time.Time) (Message, bool, error) {
+	msg := p.producer.MakeMessage(storyID, createdAt)
+	if createdAt == nil {
+		return msg, true, nil
+	}
+
+	if now.Sub(*createdAt) >= p.Schedule.MaxStoryAge {
+		return msg, false, nil
+	}
+
+	// Without two snapshots far enough apart to measure growth, the fixed
+	// schedule is kept, though no sooner than the minimum interval.
+	earliest := now.Add(p.Schedule.MinInterval)
+	if len(snapshots) < 2 || snapshots[0].FetchedAt.Sub(snapshots[1].FetchedAt) < p.Schedule.MinInterval {
+		if msg.ProcessAt.Before(earliest) {
+			msg.ProcessAt = earliest
+		}
+		return msg, true, nil
+	}
+
+	current, err := ParseStory(snapshots[0])
+	if err != nil {
+		return msg, false, err
+	}
+	previous, err := ParseStory(snapshots[1])
+	if err != nil {
+		return msg, false, err
+	}
+
+	velocity := Velocity(previous, current, snapshots[0].FetchedAt.Sub(snapshots[1].FetchedAt))
+	if velocity <= 0 {
+		return msg, false, nil
+	}
+
+	msg.ProcessAt = now.Add(p.Schedule.PlanInterval(velocity))
+	return msg, true, nil
+}
+
+func (p *AdaptiveProducer) SendMessage(ctx context.Context, storyID int64, createdAt *time.Time) error {
+	snapshots, err := p.repo.LatestSnapshots(ctx, storyID, 2)
+	if err != nil {
+		return err
+	}
+
+	msg, ok, err := p.PlanMessage(storyID, createdAt, snapshots, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if !ok {
+		slog.Info("Retiring story", "story_id", storyID)
+		return nil
+	}
+
+	return p.dst.Enqueue(ctx, msg)
+}
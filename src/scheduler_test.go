@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func makeFetchedSnapshot(storyID int64, createdAt, fetchedAt time.Time, score, descendants int) StoryModel {
+	model := makeSnapshot(storyID, createdAt, score, descendants)
+	model.FetchedAt = fetchedAt
+	return model
+}
+
+func TestVelocity(t *testing.T) {
+	previous := HNStory{Score: 10, Descendants: 5}
+	current := HNStory{Score: 30, Descendants: 15}
+
+	assert.Equal(t, 60.0, Velocity(previous, current, 30*time.Minute))
+}
+
+func TestScheduleConfigPlanInterval(t *testing.T) {
+	schedule := MakeDefaultScheduleConfig()
+
+	for _, testCase := range []struct {
+		velocity float64
+		expected time.Duration
+	}{
+		{velocity: 10, expected: 30 * time.Minute},
+		{velocity: 20, expected: 15 * time.Minute},
+		{velocity: 5, expected: time.Hour},
+		// Bounded by the min and max intervals.
+		{velocity: 1000, expected: 5 * time.Minute},
+		{velocity: 0.01, expected: 6 * time.Hour},
+		{velocity: 0, expected: 6 * time.Hour},
+	} {
+		assert.Equal(t, testCase.expected, schedule.PlanInterval(testCase.velocity))
+	}
+}
+
+func TestAdaptiveProducerPlanMessage(t *testing.T) {
+	now := time.Date(2020, 1, 1, 2, 0, 0, 0, time.UTC)
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	dst := &PriorityQueue{config: QueueConfig{Name: AdaptiveQueueName}}
+	producer := NewAdaptiveProducer(dst, nil, MakeDefaultScheduleConfig())
+
+	for _, testCase := range []struct {
+		name              string
+		snapshots         []StoryModel
+		expectedProcessAt time.Time
+		expectedOk        bool
+	}{
+		{
+			name: "hot story is snapshotted sooner",
+			snapshots: []StoryModel{
+				makeFetchedSnapshot(1, createdAt, now, 30, 25),
+				makeFetchedSnapshot(1, createdAt, now.Add(-30*time.Minute), 20, 20),
+			},
+			expectedProcessAt: now.Add(10 * time.Minute),
+			expectedOk:        true,
+		},
+		{
+			name: "slow story is snapshotted later",
+			snapshots: []StoryModel{
+				makeFetchedSnapshot(1, createdAt, now, 21, 20),
+				makeFetchedSnapshot(1, createdAt, now.Add(-time.Hour), 20, 20),
+			},
+			expectedProcessAt: now.Add(5 * time.Hour),
+			expectedOk:        true,
+		},
+		{
+			name: "stagnant story is retired",
+			snapshots: []StoryModel{
+				makeFetchedSnapshot(1, createdAt, now, 20, 20),
+				makeFetchedSnapshot(1, createdAt, now.Add(-time.Hour), 20, 20),
+			},
+			expectedOk: false,
+		},
+		{
+			name: "single snapshot is scheduled no sooner than min interval",
+			snapshots: []StoryModel{
+				makeFetchedSnapshot(1, createdAt, now, 20, 20),
+			},
+			expectedProcessAt: now.Add(5 * time.Minute),
+			expectedOk:        true,
+		},
+		{
+			name: "snapshots too close together to measure growth",
+			snapshots: []StoryModel{
+				makeFetchedSnapshot(1, createdAt, now, 20, 20),
+				makeFetchedSnapshot(1, createdAt, now.Add(-time.Minute), 20, 20),
+			},
+			expectedProcessAt: now.Add(5 * time.Minute),
+			expectedOk:        true,
+		},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			msg, ok, err := producer.PlanMessage(1, &createdAt, testCase.snapshots, now)
+
+			assert.Nil(t, err)
+			assert.Equal(t, testCase.expectedOk, ok)
+			if testCase.expectedOk {
+				assert.Equal(t, testCase.expectedProcessAt, msg.ProcessAt)
+				assert.Equal(t, int64(1), msg.StoryID)
+				assert.Equal(t, &createdAt, msg.CreatedAt)
+			}
+		})
+	}
+}
+
+func TestAdaptiveProducerPlanMessageLabelsEachSnapshot(t *testing.T) {
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	dst := &PriorityQueue{config: QueueConfig{Name: AdaptiveQueueName}}
+	producer := NewAdaptiveProducer(dst, nil, MakeDefaultScheduleConfig())
+
+	now := createdAt.Add(time.Hour)
+	first, ok, err := producer.PlanMessage(1, &createdAt, []StoryModel{
+		makeFetchedSnapshot(1, createdAt, now, 30, 25),
+		makeFetchedSnapshot(1, createdAt, now.Add(-30*time.Minute), 20, 20),
+	}, now)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// The next is planned from the snapshot taken for the first.
+	next := first.ProcessAt
+	second, ok, err := producer.PlanMessage(1, &createdAt, []StoryModel{
+		makeFetchedSnapshot(1, createdAt, next, 40, 30),
+		makeFetchedSnapshot(1, createdAt, now, 30, 25),
+	}, next)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Equal(t, "adaptive-1h10m0s", first.Label)
+	assert.Equal(t, "adaptive-1h15m0s", second.Label)
+}
+
+func TestAdaptiveProducerPlanMessageRetiresStoriesOlderThanMaxAge(t *testing.T) {
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := createdAt.Add(8 * 24 * time.Hour)
+	dst := &PriorityQueue{config: QueueConfig{Name: AdaptiveQueueName}}
+	producer := NewAdaptiveProducer(dst, nil, MakeDefaultScheduleConfig())
+
+	snapshots := []StoryModel{
+		makeFetchedSnapshot(1, createdAt, now, 500, 300),
+		makeFetchedSnapshot(1, createdAt, now.Add(-time.Hour), 20, 20),
+	}
+	_, ok, err := producer.PlanMessage(1, &createdAt, snapshots, now)
+
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestAdaptiveProducerPlanMessageKeepsLaterFixedSchedule(t *testing.T) {
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := createdAt.Add(time.Minute)
+	dst := &PriorityQueue{config: QueueConfig{Name: "1h", ProcessAfter: time.Hour}}
+	producer := NewAdaptiveProducer(dst, nil, MakeDefaultScheduleConfig())
+
+	msg, ok, err := producer.PlanMessage(1, &createdAt, nil, now)
+
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, createdAt.Add(time.Hour), msg.ProcessAt)
+}
+
+func TestAdaptiveProducerSendMessage(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-time.Hour)
+	fetchedAt := time.Now().UTC()
+
+	repo := new(mockSnapshotReader)
+	repo.On("LatestSnapshots", mock.Anything, int64(1), 2).Return([]StoryModel{
+		makeFetchedSnapshot(1, createdAt, fetchedAt, 30, 10),
+		makeFetchedSnapshot(1, createdAt, fetchedAt.Add(-time.Hour), 20, 10),
+	}, nil)
+
+	dst := new(mockEnqueuer)
+	dst.On("Enqueue", mock.Anything, mock.Anything).Return(nil)
+	dst.On("ProcessAfter").Return(time.Duration(0))
+
+	producer := NewAdaptiveProducer(dst, repo, MakeDefaultScheduleConfig())
+	err := producer.SendMessage(context.Background(), 1, &createdAt)
+
+	assert.Nil(t, err)
+	dst.AssertCalled(t, "Enqueue", mock.Anything, mock.MatchedBy(func(msg Message) bool {
+		return msg.StoryID == 1 && msg.ProcessAt.Sub(fetchedAt).Round(time.Minute) == 30*time.Minute
+	}))
+}
+
+func TestAdaptiveProducerSendMessageWhenRetiredDoesNotEnqueue(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-time.Hour)
+	fetchedAt := time.Now().UTC()
+
+	repo := new(mockSnapshotReader)
+	repo.On("LatestSnapshots", mock.Anything, int64(1), 2).Return([]StoryModel{
+		makeFetchedSnapshot(1, createdAt, fetchedAt, 20, 10),
+		makeFetchedSnapshot(1, createdAt, fetchedAt.Add(-time.Hour), 20, 10),
+	}, nil)
+
+	dst := new(mockEnqueuer)
+	dst.On("ProcessAfter").Return(time.Duration(0))
+
+	producer := NewAdaptiveProducer(dst, repo, MakeDefaultScheduleConfig())
+	err := producer.SendMessage(context.Background(), 1, &createdAt)
+
+	assert.Nil(t, err)
+	dst.AssertNotCalled(t, "Enqueue", mock.Anything, mock.Anything)
+}
+
+func TestAdaptiveProducerSendMessageWhenErrorReadingSnapshotsReturnsError(t *testing.T) {
+	createdAt := time.Now().UTC()
+
+	repo := new(mockSnapshotReader)
+	repo.On("LatestSnapshots", mock.Anything, int64(1), 2).Return([]StoryModel{}, fmt.Errorf("Error"))
+
+	dst := new(mockEnqueuer)
+
+	producer := NewAdaptiveProducer(dst, repo, MakeDefaultScheduleConfig())
+	err := producer.SendMessage(context.Background(), 1, &createdAt)
+
+	assert.NotNil(t, err)
+	dst.AssertNotCalled(t, "Enqueue", mock.Anything, mock.Anything)
+}
+
+func TestNewAdaptiveProducerWhenInvalidScheduleConfigPanics(t *testing.T) {
+	schedule := MakeDefaultScheduleConfig()
+	schedule.MinInterval = 2 * schedule.MaxInterval
+
+	assert.Panics(t, func() { NewAdaptiveProducer(nil, nil, schedule) })
+}
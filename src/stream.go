@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ResourceNameMaxItem = "maxitem"
+	ResourceNameUpdates = "updates"
+
+	EventTypePut         = "put"
+	EventTypePatch       = "patch"
+	EventTypeKeepAlive   = "keep-alive"
+	EventTypeCancel      = "cancel"
+	EventTypeAuthRevoked = "auth_revoked"
+
+	DefaultStreamMaxReconnectAttempts = 5
+	DefaultStreamFallbackDuration     = 5 * time.Minute
+	// DefaultStreamIdleTimeout allows for a couple of missed keep-alives,
+	// which Firebase sends every 30 seconds.
+	DefaultStreamIdleTimeout = 90 * time.Second
+)
+
+var (
+	ErrStreamClosed = errors.New("Stream closed")
+	ErrStreamIdle   = errors.New("Stream idle")
+)
+
+// ItemFetcher provides a method to fetch an item.
+type ItemFetcher interface {
+	FetchItem(int64, interface{}) error
+}
+
+// HTTPDoer makes HTTP requests.
+type HTTPDoer interface {
+	Do(*http.Request) (*http.Response, error)
+}
+
+// Event is a server-sent event.
+type Event struct {
+	Type string
+	Data string
+}
+
+// ReadEvent reads the next server-sent event. Comments and fields other than
+// `event` and `data` are ignored.
+func ReadEvent(r *bufio.Reader) (Event, error) {
+	event := Event{}
+	var data []string
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				err = ErrStreamClosed
+			}
+			return event, err
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			// A blank line dispatches the event, if there is one.
+			if event.Type == "" && len(data) == 0 {
+				continue
+			}
+			event.Data = strings.Join(data, "\n")
+			return event, nil
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "event":
+			event.Type = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+}
+
+// firebaseEventData is the data of a `put` or `patch` event from the Firebase
+// streaming API.
+type firebaseEventData struct {
+	Path string          `json:"path"`
+	Data json.RawMessage `json:"data"`
+}
+
+// setPath sets the value at the given path within the document, returning the
+// updated document. Arrays are indexed by their positions.
+func setPath(doc interface{}, path []string, value interface{}) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+
+	key, rest := path[0], path[1:]
+
+	if array, ok := doc.([]interface{}); ok {
+		idx, err := strconv.Atoi(key)
+		if err == nil && idx >= 0 {
+			for len(array) <= idx {
+				array = append(array, nil)
+			}
+			array[idx] = setPath(array[idx], rest, value)
+			return array
+		}
+
+		// Not an index, so the document can't be an array.
+		obj := make(map[string]interface{}, len(array))
+		for idx, element := range array {
+			obj[strconv.Itoa(idx)] = element
+		}
+		doc = obj
+	}
+
+	obj, ok := doc.(map[string]interface{})
+	if !ok {
+		obj = make(map[string]interface{})
+	}
+	obj[key] = setPath(obj[key], rest, value)
+	return obj
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// FirebaseStream subscribes to a resource of the Firebase API, keeping an up
+// to date copy of it. Streams are long-lived, so requests can't have a
+// timeout; instead, a connection that goes without any event, including
+// keep-alives, for IdleTimeout is taken to be dead, and closed.
+type FirebaseStream struct {
+	client      HTTPDoer
+	URL         string
+	IdleTimeout time.Duration
+
+	body     io.ReadCloser
+	reader   *bufio.Reader
+	doc      interface{}
+	cancel   context.CancelFunc
+	watchdog *time.Timer
+	idle     atomic.Bool
+}
+
+func NewFirebaseStream(client HTTPDoer, url string) *FirebaseStream {
+	return &FirebaseStream{client: client, URL: url, IdleTimeout: DefaultStreamIdleTimeout}
+}
+
+// MakeStreamURL makes the URL of a resource of the Firebase API.
+func MakeStreamURL(baseURL, apiVersion, resourceName string) string {
+	return strings.Join([]string{baseURL, apiVersion, resourceName}, "/") + ".json"
+}
+
+func (s *FirebaseStream) connect(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.URL, nil)
+	if err != nil {
+		cancel()
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	rsp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	if rsp.StatusCode != http.StatusOK {
+		rsp.Body.Close()
+		cancel()
+		return fmt.Errorf("HTTP Error: %d", rsp.StatusCode)
+	}
+
+	s.body = rsp.Body
+	s.reader = bufio.NewReader(rsp.Body)
+	s.cancel = cancel
+	s.idle.Store(false)
+	if s.IdleTimeout > 0 {
+		// Cancelling the request unblocks reads of the body.
+		s.watchdog = time.AfterFunc(s.IdleTimeout, func() {
+			s.idle.Store(true)
+			cancel()
+		})
+	}
+	return nil
+}
+
+// Close closes the stream, if it is open.
+func (s *FirebaseStream) Close() {
+	if s.watchdog != nil {
+		s.watchdog.Stop()
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if s.body != nil {
+		s.body.Close()
+	}
+	s.body = nil
+	s.reader = nil
+	s.doc = nil
+	s.cancel = nil
+	s.watchdog = nil
+}
+
+// Next blocks until the resource changes, connecting to the stream if
+// necessary, and returns the resource's updated value. The first value after
+// connecting is the resource's current value.
+func (s *FirebaseStream) Next(ctx context.Context) (interface{}, error) {
+	if s.body == nil {
+		err := s.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		event, err := ReadEvent(s.reader)
+		if err != nil && s.idle.Load() {
+			return nil, fmt.Errorf("%w: no events for %s", ErrStreamIdle, s.IdleTimeout)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if s.watchdog != nil {
+			s.watchdog.Reset(s.IdleTimeout)
+		}
+
+		switch event.Type {
+		case EventTypePut, EventTypePatch:
+		case EventTypeKeepAlive:
+			continue
+		case EventTypeCancel, EventTypeAuthRevoked:
+			return nil, fmt.Errorf("%w: %s", ErrStreamClosed, event.Type)
+		default:
+			continue
+		}
+
+		data := firebaseEventData{}
+		err = json.Unmarshal([]byte(event.Data), &data)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		err = json.Unmarshal(data.Data, &value)
+		if err != nil {
+			return nil, err
+		}
+
+		path := splitPath(data.Path)
+		if event.Type == EventTypePut {
+			s.doc = setPath(s.doc, path, value)
+		} else if children, ok := value.(map[string]interface{}); ok {
+			// A patch updates each of the children at the path.
+			for key, child := range children {
+				s.doc = setPath(s.doc, append(slices.Clone(path), key), child)
+			}
+		}
+
+		return s.doc, nil
+	}
+}
+
+// ExtractNewIDs extracts the ids of items newer than maxSeenID from a
+// resource's value, in ascending order. For `newstories`, these are the new
+// stories that are listed, and for `maxitem`, every item created since, which
+// includes comments and other items that aren't stories.
+func ExtractNewIDs(resourceName string, value interface{}, maxSeenID int64) ([]int64, error) {
+	var ids []int64
+
+	switch resourceName {
+	case ResourceNameNewStories:
+		// The list may be partially populated, or have gaps, part way
+		// through an update.
+		values, _ := value.([]interface{})
+		for _, v := range values {
+			if id, ok := v.(float64); ok && int64(id) > maxSeenID {
+				ids = append(ids, int64(id))
+			}
+		}
+		slices.Sort(ids)
+		return slices.Compact(ids), nil
+	case ResourceNameMaxItem:
+		maxItem, ok := value.(float64)
+		if !ok {
+			return ids, nil
+		}
+		for id := maxSeenID + 1; id <= int64(maxItem); id++ {
+			ids = append(ids, id)
+		}
+		return ids, nil
+	default:
+		return ids, fmt.Errorf("Unsupported stream resource: %s", resourceName)
+	}
+}
+
+// StreamingStoryConsumer consumes new item ids from the Firebase streaming
+// API, rather than polling for them. The stream is reconnected to after
+// errors, resuming from the largest id seen. After MaxReconnectAttempts
+// consecutive errors, the fallback consumer is used instead for
+// FallbackDuration, before streaming is tried again.
+//
+// Streaming `maxitem` yields every new item, so each is looked up with Items
+// to skip those that aren't stories. This costs a request per item, so
+// `newstories` should be preferred unless its lag matters.
+//
+// If a HighWaterMark is set, consumption resumes from it after a restart or
+// Reset, as it's raised by a MarkingProducer. The fallback consumer should
+// share the same HighWaterMark.
+//
+// Fetch is safe for concurrent use, though calls are serialized.
+type StreamingStoryConsumer struct {
+	stream               *FirebaseStream
+	fallback             ResettableConsumer
+	mu                   sync.Mutex
+	buffer               []int64
+	maxSeenID            int64
+	markLoaded           bool
+	failures             int
+	fallbackUntil        time.Time
+	ResourceName         string
+	ReconnectBackoff     time.Duration
+	MaxReconnectAttempts int
+	FallbackDuration     time.Duration
+	HighWaterMark        HighWaterMarker
+	Items                ItemFetcher
+}
+
+func NewStreamingStoryConsumer(stream *FirebaseStream, resourceName string, fallback ResettableConsumer, reconnectBackoff time.Duration) *StreamingStoryConsumer {
+	return &StreamingStoryConsumer{
+		stream:               stream,
+		fallback:             fallback,
+		ResourceName:         resourceName,
+		ReconnectBackoff:     reconnectBackoff,
+		MaxReconnectAttempts: DefaultStreamMaxReconnectAttempts,
+		FallbackDuration:     DefaultStreamFallbackDuration,
+	}
+}
+
+// fillBuffer reads changes from the stream until there are new ids.
+func (c *StreamingStoryConsumer) fillBuffer(ctx context.Context) error {
+	for len(c.buffer) == 0 {
+		value, err := c.stream.Next(ctx)
+		if err != nil {
+			return err
+		}
+		c.failures = 0
+
+		// Without a starting point, items are consumed from the current
+		// max item onwards.
+		if c.ResourceName == ResourceNameMaxItem && c.maxSeenID == 0 {
+			if maxItem, ok := value.(float64); ok {
+				c.maxSeenID = int64(maxItem)
+			}
+			continue
+		}
+
+		ids, err := ExtractNewIDs(c.ResourceName, value, c.maxSeenID)
+		if err != nil {
+			return err
+		}
+		if c.ResourceName == ResourceNameMaxItem && len(ids) > 0 {
+			ids, err = c.filterStories(ids)
+			if err != nil {
+				return err
+			}
+		}
+		c.buffer = ids
+	}
+	return nil
+}
+
+// filterStories returns the ids of the items that are stories. The items
+// that have been looked up are seen, so that they aren't looked up again;
+// the stories are still consumed, as they're buffered.
+func (c *StreamingStoryConsumer) filterStories(ids []int64) ([]int64, error) {
+	if c.Items == nil {
+		return nil, errors.New("Items are required to stream maxitem")
+	}
+
+	var stories []int64
+	for _, id := range ids {
+		item := HNStory{}
+		err := c.Items.FetchItem(id, &item)
+		// Items that are still missing after retries are skipped, rather
+		// than holding up the stream.
+		if errors.Is(err, ErrItemMissing) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w item: %w", ErrFetching, err)
+		}
+		if IsStoryType(item.Type) {
+			stories = append(stories, id)
+		}
+	}
+	c.maxSeenID = ids[len(ids)-1]
+	return stories, nil
+}
+
+// Fetch returns the id of the next new item, reading from the stream as
+// necessary.
+func (c *StreamingStoryConsumer) Fetch(ctx context.Context) (storyID int64, _ *time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Now().Before(c.fallbackUntil) {
+		return c.fallback.Fetch(ctx)
+	}
+
+	if c.HighWaterMark != nil && !c.markLoaded {
+		c.maxSeenID, err = c.HighWaterMark.Load(ctx)
+		if err != nil {
+			return
+		}
+		c.markLoaded = true
+	}
+
+	for {
+		err = c.fillBuffer(ctx)
+		if err == nil {
+			break
+		}
+
+		c.stream.Close()
+		if ctx.Err() != nil {
+			return
+		}
+
+		c.failures++
+		slog.Error("Error streaming", "resource", c.ResourceName, "failures", c.failures, "error", err)
+
+		if c.failures >= c.MaxReconnectAttempts {
+			slog.Error("Falling back to polling", "resource", c.ResourceName, "duration", c.FallbackDuration)
+			c.failures = 0
+			c.fallbackUntil = time.Now().Add(c.FallbackDuration)
+			// Progress made while polling is picked up from the high-water
+			// mark once streaming resumes.
+			c.buffer = nil
+			c.markLoaded = false
+			c.fallback.Reset()
+			return c.fallback.Fetch(ctx)
+		}
+
+		err = sleepCtx(ctx, time.Duration(c.failures)*c.ReconnectBackoff)
+		if err != nil {
+			return
+		}
+	}
+
+	storyID, c.buffer = c.buffer[0], c.buffer[1:]
+	c.maxSeenID = max(c.maxSeenID, storyID)
+	return
+}
+
+// Reset closes the stream and discards buffered ids, so that consumption
+// resumes from the persisted high-water mark, if any.
+func (c *StreamingStoryConsumer) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stream.Close()
+	c.buffer = nil
+	c.maxSeenID = 0
+	c.markLoaded = false
+	c.failures = 0
+	c.fallbackUntil = time.Time{}
+	c.fallback.Reset()
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newFakeStreamServer serves a stream of the given events per connection, in
+// order. Once a connection's events have been written, it is either held open
+// or closed.
+func newFakeStreamServer(t *testing.T, connections [][]string, holdOpen bool) (*httptest.Server, *atomic.Int32) {
+	var count atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "text/event-stream", r.Header.Get("Accept"))
+
+		n := int(count.Add(1)) - 1
+		if n >= len(connections) {
+			http.Error(w, "", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, event := range connections[n] {
+			fmt.Fprint(w, event)
+			w.(http.Flusher).Flush()
+		}
+
+		if holdOpen && n == len(connections)-1 {
+			<-r.Context().Done()
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, &count
+}
+
+func makePutEvent(path, data string) string {
+	return fmt.Sprintf("event: put\ndata: {\"path\":%q,\"data\":%s}\n\n", path, data)
+}
+
+func makePatchEvent(path, data string) string {
+	return fmt.Sprintf("event: patch\ndata: {\"path\":%q,\"data\":%s}\n\n", path, data)
+}
+
+// stubConsumer always returns the same story id.
+type stubConsumer struct {
+	storyID int64
+	resets  int
+}
+
+func (c *stubConsumer) Fetch(_ context.Context) (int64, *time.Time, error) {
+	return c.storyID, nil, nil
+}
+
+func (c *stubConsumer) Reset() {
+	c.resets++
+}
+
+type mockItemFetcher struct {
+	mock.Mock
+}
+
+// FetchItem sets the type of the item, as given.
+func (m *mockItemFetcher) FetchItem(id int64, o interface{}) error {
+	args := m.Called(id, o)
+	o.(*HNStory).Type = args.String(0)
+	return args.Error(1)
+}
+
+func TestReadEvent(t *testing.T) {
+	payload := ": comment\n" +
+		"event: keep-alive\ndata: null\n\n" +
+		"event: put\ndata: {\"path\":\"/\",\ndata: \"data\":1}\r\n\r\n"
+	r := bufio.NewReader(strings.NewReader(payload))
+
+	event, err := ReadEvent(r)
+	assert.Nil(t, err)
+	assert.Equal(t, Event{Type: "keep-alive", Data: "null"}, event)
+
+	event, err = ReadEvent(r)
+	assert.Nil(t, err)
+	assert.Equal(t, Event{Type: "put", Data: "{\"path\":\"/\",\n\"data\":1}"}, event)
+
+	_, err = ReadEvent(r)
+	assert.ErrorIs(t, err, ErrStreamClosed)
+}
+
+func TestSetPath(t *testing.T) {
+	for _, testCase := range []struct {
+		doc      interface{}
+		path     []string
+		value    interface{}
+		expected interface{}
+	}{
+		// Replace the whole document.
+		{doc: []interface{}{1.0}, path: nil, value: []interface{}{2.0}, expected: []interface{}{2.0}},
+		// Set an array element.
+		{doc: []interface{}{1.0, 2.0}, path: []string{"1"}, value: 3.0, expected: []interface{}{1.0, 3.0}},
+		// Extend an array.
+		{doc: []interface{}{1.0}, path: []string{"2"}, value: 3.0, expected: []interface{}{1.0, nil, 3.0}},
+		// Set an object's key.
+		{doc: nil, path: []string{"items"}, value: []interface{}{1.0}, expected: map[string]interface{}{"items": []interface{}{1.0}}},
+		// Set a nested key.
+		{
+			doc:      map[string]interface{}{"items": []interface{}{1.0}},
+			path:     []string{"items", "0"},
+			value:    2.0,
+			expected: map[string]interface{}{"items": []interface{}{2.0}},
+		},
+	} {
+		actual := setPath(testCase.doc, testCase.path, testCase.value)
+		assert.Equal(t, testCase.expected, actual)
+	}
+}
+
+func TestExtractNewIDs(t *testing.T) {
+	for _, testCase := range []struct {
+		resourceName string
+		value        interface{}
+		maxSeenID    int64
+		expected     []int64
+	}{
+		{resourceName: "newstories", value: []interface{}{10.0, 9.0, 8.0}, maxSeenID: 0, expected: []int64{8, 9, 10}},
+		{resourceName: "newstories", value: []interface{}{10.0, nil, 8.0}, maxSeenID: 8, expected: []int64{10}},
+		{resourceName: "newstories", value: []interface{}{10.0, 9.0}, maxSeenID: 10, expected: nil},
+		{resourceName: "maxitem", value: 12.0, maxSeenID: 9, expected: []int64{10, 11, 12}},
+		{resourceName: "maxitem", value: 9.0, maxSeenID: 9, expected: nil},
+	} {
+		actual, err := ExtractNewIDs(testCase.resourceName, testCase.value, testCase.maxSeenID)
+		assert.Nil(t, err)
+		assert.Equal(t, testCase.expected, actual)
+	}
+}
+
+func TestExtractNewIDsWhenUnsupportedResourceReturnsError(t *testing.T) {
+	_, err := ExtractNewIDs("topstories", []interface{}{}, 0)
+	assert.NotNil(t, err)
+}
+
+func TestStreamingStoryConsumerFetch(t *testing.T) {
+	server, _ := newFakeStreamServer(t, [][]string{{
+		makePutEvent("/", "[10, 9, 8]"),
+		"event: keep-alive\ndata: null\n\n",
+		makePatchEvent("/", `{"0": 12, "1": 11, "2": 10}`),
+	}}, true)
+
+	mark := new(mockHighWaterMark)
+	mark.On("Load", mock.Anything).Return(int64(8), nil)
+
+	stream := NewFirebaseStream(server.Client(), server.URL)
+	consumer := NewStreamingStoryConsumer(stream, "newstories", &stubConsumer{}, 0*time.Second)
+	consumer.HighWaterMark = mark
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var actual []int64
+	for range 4 {
+		storyID, _, err := consumer.Fetch(ctx)
+		assert.Nil(t, err)
+		actual = append(actual, storyID)
+	}
+
+	assert.Equal(t, []int64{9, 10, 11, 12}, actual)
+	mark.AssertNotCalled(t, "Save", mock.Anything, mock.Anything)
+}
+
+func TestStreamingStoryConsumerFetchReconnectsAndResumes(t *testing.T) {
+	server, count := newFakeStreamServer(t, [][]string{
+		{makePutEvent("/", "[10, 9]")},
+		{makePutEvent("/", "[11, 10, 9]")},
+	}, true)
+
+	stream := NewFirebaseStream(server.Client(), server.URL)
+	consumer := NewStreamingStoryConsumer(stream, "newstories", &stubConsumer{}, 0*time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var actual []int64
+	for range 3 {
+		storyID, _, err := consumer.Fetch(ctx)
+		assert.Nil(t, err)
+		actual = append(actual, storyID)
+	}
+
+	// Stories seen before reconnecting are not consumed again.
+	assert.Equal(t, []int64{9, 10, 11}, actual)
+	assert.Equal(t, int32(2), count.Load())
+}
+
+func TestStreamingStoryConsumerFetchFallsBackToPolling(t *testing.T) {
+	server, count := newFakeStreamServer(t, [][]string{}, false)
+
+	fallback := &stubConsumer{storyID: 42}
+	stream := NewFirebaseStream(server.Client(), server.URL)
+	consumer := NewStreamingStoryConsumer(stream, "newstories", fallback, 0*time.Second)
+	consumer.MaxReconnectAttempts = 2
+	consumer.FallbackDuration = time.Hour
+
+	storyID, _, err := consumer.Fetch(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), storyID)
+	assert.Equal(t, int32(2), count.Load())
+
+	// The fallback continues to be used, without reconnecting.
+	storyID, _, err = consumer.Fetch(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(42), storyID)
+	assert.Equal(t, int32(2), count.Load())
+	assert.Equal(t, 1, fallback.resets)
+}
+
+func TestStreamingStoryConsumerFetchFromMaxItem(t *testing.T) {
+	server, _ := newFakeStreamServer(t, [][]string{{
+		makePutEvent("/", "100"),
+		makePutEvent("/", "103"),
+		makePutEvent("/", "105"),
+	}}, true)
+
+	items := new(mockItemFetcher)
+	items.On("FetchItem", int64(101), mock.Anything).Return(ItemTypeStory, nil)
+	items.On("FetchItem", int64(102), mock.Anything).Return("comment", nil)
+	items.On("FetchItem", int64(103), mock.Anything).Return(ItemTypePoll, nil)
+	items.On("FetchItem", int64(104), mock.Anything).Return("", ErrItemMissing)
+	items.On("FetchItem", int64(105), mock.Anything).Return(ItemTypeStory, nil)
+
+	stream := NewFirebaseStream(server.Client(), server.URL)
+	consumer := NewStreamingStoryConsumer(stream, "maxitem", &stubConsumer{}, 0*time.Second)
+	consumer.Items = items
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var actual []int64
+	for range 3 {
+		storyID, _, err := consumer.Fetch(ctx)
+		assert.Nil(t, err)
+		actual = append(actual, storyID)
+	}
+
+	// Items are consumed from the max item at the time of connecting, and
+	// only stories are consumed.
+	assert.Equal(t, []int64{101, 103, 105}, actual)
+	items.AssertNumberOfCalls(t, "FetchItem", 5)
+}
+
+func TestStreamingStoryConsumerFetchFromMaxItemWhenErrorFetchingRetries(t *testing.T) {
+	server, _ := newFakeStreamServer(t, [][]string{
+		{makePutEvent("/", "100"), makePutEvent("/", "101")},
+		{makePutEvent("/", "101")},
+	}, true)
+
+	items := new(mockItemFetcher)
+	items.On("FetchItem", int64(101), mock.Anything).Return("", fmt.Errorf("Error")).Once()
+	items.On("FetchItem", int64(101), mock.Anything).Return(ItemTypeStory, nil)
+
+	stream := NewFirebaseStream(server.Client(), server.URL)
+	consumer := NewStreamingStoryConsumer(stream, "maxitem", &stubConsumer{}, 0*time.Second)
+	consumer.Items = items
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	storyID, _, err := consumer.Fetch(ctx)
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(101), storyID)
+}
+
+func TestFirebaseStreamNextWhenIdleReturnsError(t *testing.T) {
+	server, _ := newFakeStreamServer(t, [][]string{{
+		makePutEvent("/", "[1]"),
+	}}, true)
+
+	stream := NewFirebaseStream(server.Client(), server.URL)
+	stream.IdleTimeout = 50 * time.Millisecond
+	defer stream.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := stream.Next(ctx)
+	assert.Nil(t, err)
+
+	_, err = stream.Next(ctx)
+	assert.ErrorIs(t, err, ErrStreamIdle)
+	assert.Nil(t, ctx.Err())
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	UpdateCountKeyPrefix          = "ingestion-update-count"
+	UpdateLabelPrefix             = "update"
+	DefaultUpdatesMaxSnapshots    = 5
+	DefaultUpdatesMaxStoryAge     = 24 * time.Hour
+	maxUpdatesStreamReconnectWait = time.Minute
+)
+
+// SnapshotReader provides a method to read stored snapshots of a story.
+type SnapshotReader interface {
+	LatestSnapshots(context.Context, int64, int) ([]StoryModel, error)
+}
+
+// UpdatedItemsFetcher provides a method to fetch the ids of items that have
+// recently changed.
+type UpdatedItemsFetcher interface {
+	// Next blocks until the next batch of updated items is available.
+	Next(context.Context) ([]int64, error)
+	// Reset discards any state, such as an open connection.
+	Reset()
+}
+
+// PolledUpdates polls the Hacker News API for updated items.
+type PolledUpdates struct {
+	client       *HNClient
+	polledAt     time.Time
+	PollInterval time.Duration
+}
+
+func NewPolledUpdates(client *HNClient, pollInterval time.Duration) *PolledUpdates {
+	return &PolledUpdates{client: client, PollInterval: pollInterval}
+}
+
+func (u *PolledUpdates) Next(ctx context.Context) ([]int64, error) {
+	err := sleepCtx(ctx, time.Until(u.polledAt.Add(u.PollInterval)))
+	if err != nil {
+		return nil, err
+	}
+	u.polledAt = time.Now()
+
+	updates, err := u.client.FetchUpdates()
+	return updates.Items, err
+}
+
+func (u *PolledUpdates) Reset() {}
+
+// StreamedUpdates streams updated items from the Firebase streaming API,
+// reconnecting after errors.
+type StreamedUpdates struct {
+	stream           *FirebaseStream
+	failures         int
+	ReconnectBackoff time.Duration
+}
+
+func NewStreamedUpdates(stream *FirebaseStream, reconnectBackoff time.Duration) *StreamedUpdates {
+	return &StreamedUpdates{stream: stream, ReconnectBackoff: reconnectBackoff}
+}
+
+func (u *StreamedUpdates) Next(ctx context.Context) ([]int64, error) {
+	for {
+		value, err := u.stream.Next(ctx)
+		if err == nil {
+			u.failures = 0
+			return ExtractUpdatedItems(value), nil
+		}
+
+		u.stream.Close()
+		if ctx.Err() != nil {
+			return nil, err
+		}
+
+		u.failures++
+		slog.Error("Error streaming updates", "failures", u.failures, "error", err)
+
+		wait := min(time.Duration(u.failures)*u.ReconnectBackoff, maxUpdatesStreamReconnectWait)
+		err = sleepCtx(ctx, wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *StreamedUpdates) Reset() {
+	u.stream.Close()
+	u.failures = 0
+}
+
+// ExtractUpdatedItems extracts the ids of updated items from the value of the
+// `updates` resource.
+func ExtractUpdatedItems(value interface{}) []int64 {
+	var ids []int64
+
+	doc, _ := value.(map[string]interface{})
+	items, _ := doc["items"].([]interface{})
+	for _, item := range items {
+		if id, ok := item.(float64); ok {
+			ids = append(ids, int64(id))
+		}
+	}
+	return ids
+}
+
+// HasChanged returns whether a story's popularity has changed.
+func HasChanged(previous, current HNStory) bool {
+	return previous.Score != current.Score || previous.Descendants != current.Descendants
+}
+
+// UpdatesConsumer consumes the ids of tracked stories whose score or number
+// of comments has changed since their last snapshot. A story is tracked if it
+// has been snapshotted before, and is no older than MaxStoryAge.
+//
+// Fetch is safe for concurrent use, though calls are serialized.
+type UpdatesConsumer struct {
+	client      *HNClient
+	updates     UpdatedItemsFetcher
+	repo        SnapshotReader
+	mu          sync.Mutex
+	buffer      []int64
+	MaxStoryAge time.Duration
+}
+
+func NewUpdatesConsumer(client *HNClient, updates UpdatedItemsFetcher, repo SnapshotReader, maxStoryAge time.Duration) *UpdatesConsumer {
+	return &UpdatesConsumer{client: client, updates: updates, repo: repo, MaxStoryAge: maxStoryAge}
+}
+
+// checkChanged checks whether the item is a tracked story that has changed,
+// or been removed, since its last snapshot, returning the story's creation
+// time if so.
+func (c *UpdatesConsumer) checkChanged(ctx context.Context, id int64) (*time.Time, error) {
+	snapshots, err := c.repo.LatestSnapshots(ctx, id, 1)
+	if err != nil || len(snapshots) == 0 {
+		return nil, err
+	}
+
+	// Removed stories are no longer tracked.
+	if snapshots[0].Status != StoryStatusOK {
+		return nil, nil
+	}
+
+	previous, err := ParseStory(snapshots[0])
+	if err != nil {
+		return nil, err
+	}
+
+	createdAt := time.Unix(previous.Time, 0).UTC()
+	if time.Since(createdAt) > c.MaxStoryAge {
+		return nil, nil
+	}
+
+	current := HNStory{}
+	err = c.client.FetchItem(id, &current)
+	if err != nil {
+		return nil, fmt.Errorf("%w story: %w", ErrFetching, err)
+	}
+
+	// A story that has since been removed is snapshotted once more, to
+	// record its removal.
+	if StoryStatus(current) == StoryStatusOK && !HasChanged(previous, current) {
+		return nil, nil
+	}
+	return &createdAt, nil
+}
+
+// Fetch returns the id of the next changed story, blocking until one is
+// available.
+func (c *UpdatesConsumer) Fetch(ctx context.Context) (storyID int64, createdAt *time.Time, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if len(c.buffer) == 0 {
+			err = c.client.WaitAvailable(ctx)
+			if err != nil {
+				return
+			}
+
+			var ids []int64
+			ids, err = c.updates.Next(ctx)
+			if err != nil {
+				return
+			}
+
+			slices.Sort(ids)
+			c.buffer = slices.Compact(ids)
+			continue
+		}
+
+		storyID, c.buffer = c.buffer[0], c.buffer[1:]
+		createdAt, err = c.checkChanged(ctx, storyID)
+		if err != nil || createdAt != nil {
+			return
+		}
+	}
+}
+
+// Reset discards buffered ids, and resets the updates feed.
+func (c *UpdatesConsumer) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.buffer = nil
+	c.updates.Reset()
+}
+
+// Counter provides methods to count occurrences in the broker.
+type Counter interface {
+	Incr(context.Context, string) *redis.IntCmd
+	Expire(context.Context, string, time.Duration) *redis.BoolCmd
+}
+
+// UpdateProducer produces messages for extra snapshots of stories, labelled
+// in the order they were taken. At most MaxSnapshots extra snapshots are
+// produced per story.
+type UpdateProducer struct {
+	dst          Enqueuer
+	counter      Counter
+	MaxSnapshots int
+	// CountTTL is how long a story's count of snapshots is kept for. It
+	// should be at least as long as stories are tracked for.
+	CountTTL time.Duration
+}
+
+func NewUpdateProducer(dst Enqueuer, counter Counter, maxSnapshots int, countTTL time.Duration) *UpdateProducer {
+	return &UpdateProducer{dst: dst, counter: counter, MaxSnapshots: maxSnapshots, CountTTL: countTTL}
+}
+
+func MakeUpdateLabel(n int64) string {
+	return fmt.Sprintf("%s-%d", UpdateLabelPrefix, n)
+}
+
+func (p *UpdateProducer) SendMessage(ctx context.Context, storyID int64, createdAt *time.Time) error {
+	key := fmt.Sprintf("%s:%d", UpdateCountKeyPrefix, storyID)
+	n, err := p.counter.Incr(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+
+	if n == 1 {
+		err = p.counter.Expire(ctx, key, p.CountTTL).Err()
+		if err != nil {
+			return err
+		}
+	}
+
+	if n > int64(p.MaxSnapshots) {
+		slog.Info("Skipping extra snapshot, cap reached", "story_id", storyID, "max_snapshots", p.MaxSnapshots)
+		return nil
+	}
+
+	msg := Message{
+		StoryID:   storyID,
+		CreatedAt: createdAt,
+		Label:     MakeUpdateLabel(n),
+		ProcessAt: time.Now().UTC(),
+	}
+	return p.dst.Enqueue(ctx, msg)
+}
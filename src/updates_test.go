@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockSnapshotReader struct {
+	mock.Mock
+}
+
+func (m *mockSnapshotReader) LatestSnapshots(ctx context.Context, storyID int64, n int) ([]StoryModel, error) {
+	args := m.Called(ctx, storyID, n)
+	return args.Get(0).([]StoryModel), args.Error(1)
+}
+
+type mockUpdatedItemsFetcher struct {
+	mock.Mock
+}
+
+func (m *mockUpdatedItemsFetcher) Next(ctx context.Context) ([]int64, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]int64), args.Error(1)
+}
+
+func (m *mockUpdatedItemsFetcher) Reset() {
+	m.Called()
+}
+
+type mockCounter struct {
+	mock.Mock
+}
+
+func (m *mockCounter) Incr(ctx context.Context, key string) *redis.IntCmd {
+	args := m.Called(ctx, key)
+	return args.Get(0).(*redis.IntCmd)
+}
+
+func (m *mockCounter) Expire(ctx context.Context, key string, expiration time.Duration) *redis.BoolCmd {
+	args := m.Called(ctx, key, expiration)
+	return args.Get(0).(*redis.BoolCmd)
+}
+
+func makeSnapshot(storyID int64, createdAt time.Time, score, descendants int) StoryModel {
+	return StoryModel{
+		StoryID: storyID,
+		Status:  StoryStatusOK,
+		RawDocument: fmt.Sprintf(
+			`{"id":%d,"time":%d,"score":%d,"descendants":%d,"type":"story"}`,
+			storyID,
+			createdAt.Unix(),
+			score,
+			descendants,
+		),
+	}
+}
+
+func TestExtractUpdatedItems(t *testing.T) {
+	value := map[string]interface{}{
+		"items":    []interface{}{float64(3), float64(1), nil},
+		"profiles": []interface{}{"pg"},
+	}
+
+	assert.Equal(t, []int64{3, 1}, ExtractUpdatedItems(value))
+	assert.Nil(t, ExtractUpdatedItems(nil))
+}
+
+func TestHasChanged(t *testing.T) {
+	story := HNStory{Score: 10, Descendants: 5}
+
+	assert.False(t, HasChanged(story, HNStory{Score: 10, Descendants: 5}))
+	assert.True(t, HasChanged(story, HNStory{Score: 11, Descendants: 5}))
+	assert.True(t, HasChanged(story, HNStory{Score: 10, Descendants: 6}))
+}
+
+func TestUpdatesConsumerFetch(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/2.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":2,"score":10,"descendants":5,"type":"story"}`),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/3.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":3,"score":11,"descendants":5,"type":"story"}`),
+		nil,
+	)
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	updates := new(mockUpdatedItemsFetcher)
+	updates.On("Next", mock.Anything).Return([]int64{3, 1, 2, 3}, nil).Once()
+
+	repo := new(mockSnapshotReader)
+	// Untracked.
+	repo.On("LatestSnapshots", mock.Anything, int64(1), 1).Return([]StoryModel{}, nil)
+	// Unchanged.
+	repo.On("LatestSnapshots", mock.Anything, int64(2), 1).Return([]StoryModel{makeSnapshot(2, createdAt, 10, 5)}, nil)
+	// Changed.
+	repo.On("LatestSnapshots", mock.Anything, int64(3), 1).Return([]StoryModel{makeSnapshot(3, createdAt, 10, 5)}, nil)
+
+	consumer := NewUpdatesConsumer(client, updates, repo, DefaultUpdatesMaxStoryAge)
+	storyID, actualCreatedAt, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), storyID)
+	assert.Equal(t, createdAt, *actualCreatedAt)
+	// Duplicate ids are only checked once.
+	assert.Empty(t, consumer.buffer)
+	httpClient.AssertNotCalled(t, "Get", "http://localhost/v0/item/1.json")
+}
+
+func TestUpdatesConsumerFetchSkipsStoriesOlderThanMaxAge(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-48 * time.Hour)
+
+	httpClient := new(mockHTTPClient)
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	updates := new(mockUpdatedItemsFetcher)
+	updates.On("Next", mock.Anything).Return([]int64{1}, nil).Once()
+	updates.On("Next", mock.Anything).Return([]int64{}, context.Canceled)
+
+	repo := new(mockSnapshotReader)
+	repo.On("LatestSnapshots", mock.Anything, int64(1), 1).Return([]StoryModel{makeSnapshot(1, createdAt, 10, 5)}, nil)
+
+	consumer := NewUpdatesConsumer(client, updates, repo, 24*time.Hour)
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.ErrorIs(t, err, context.Canceled)
+	httpClient.AssertNotCalled(t, "Get", mock.Anything)
+}
+
+func TestUpdatesConsumerFetchWhenErrorReadingSnapshots(t *testing.T) {
+	client := NewHNClient(new(mockHTTPClient), "http://localhost", "v0", 0*time.Second, 1)
+
+	updates := new(mockUpdatedItemsFetcher)
+	updates.On("Next", mock.Anything).Return([]int64{1}, nil).Once()
+
+	repo := new(mockSnapshotReader)
+	repo.On("LatestSnapshots", mock.Anything, int64(1), 1).Return([]StoryModel{}, fmt.Errorf("Error"))
+
+	consumer := NewUpdatesConsumer(client, updates, repo, DefaultUpdatesMaxStoryAge)
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.NotNil(t, err)
+}
+
+func TestUpdatesConsumerReset(t *testing.T) {
+	updates := new(mockUpdatedItemsFetcher)
+	updates.On("Reset").Return()
+
+	consumer := NewUpdatesConsumer(nil, updates, nil, DefaultUpdatesMaxStoryAge)
+	consumer.buffer = []int64{1, 2}
+	consumer.Reset()
+
+	assert.Empty(t, consumer.buffer)
+	updates.AssertCalled(t, "Reset")
+}
+
+func TestUpdateProducerSendMessage(t *testing.T) {
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	counter := new(mockCounter)
+	counter.On("Incr", mock.Anything, "ingestion-update-count:1").Return(redis.NewIntResult(1, nil))
+	counter.On("Expire", mock.Anything, "ingestion-update-count:1", time.Hour).Return(redis.NewBoolResult(true, nil))
+
+	dst := new(mockEnqueuer)
+	dst.On("Enqueue", mock.Anything, mock.Anything).Return(nil)
+
+	producer := NewUpdateProducer(dst, counter, 5, time.Hour)
+	err := producer.SendMessage(context.Background(), 1, &createdAt)
+
+	assert.Nil(t, err)
+	dst.AssertCalled(t, "Enqueue", mock.Anything, mock.MatchedBy(func(msg Message) bool {
+		return msg.StoryID == 1 && *msg.CreatedAt == createdAt && msg.Label == "update-1"
+	}))
+	counter.AssertCalled(t, "Expire", mock.Anything, "ingestion-update-count:1", time.Hour)
+}
+
+func TestUpdateProducerSendMessageWhenCapReachedSkips(t *testing.T) {
+	createdAt := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	counter := new(mockCounter)
+	counter.On("Incr", mock.Anything, "ingestion-update-count:1").Return(redis.NewIntResult(6, nil))
+
+	dst := new(mockEnqueuer)
+
+	producer := NewUpdateProducer(dst, counter, 5, time.Hour)
+	err := producer.SendMessage(context.Background(), 1, &createdAt)
+
+	assert.Nil(t, err)
+	dst.AssertNotCalled(t, "Enqueue", mock.Anything, mock.Anything)
+	counter.AssertNotCalled(t, "Expire", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUpdateProducerSendMessageWhenErrorCountingReturnsError(t *testing.T) {
+	counter := new(mockCounter)
+	counter.On("Incr", mock.Anything, mock.Anything).Return(redis.NewIntResult(0, fmt.Errorf("Error")))
+
+	dst := new(mockEnqueuer)
+
+	producer := NewUpdateProducer(dst, counter, 5, time.Hour)
+	err := producer.SendMessage(context.Background(), 1, nil)
+
+	assert.NotNil(t, err)
+	dst.AssertNotCalled(t, "Enqueue", mock.Anything, mock.Anything)
+}
+
+func TestUpdatesConsumerFetchWhenStoryRemovedSinceSnapshot(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-time.Hour).Truncate(time.Second)
+
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"deleted":true,"id":1,"score":10,"descendants":5,"type":"story"}`),
+		nil,
+	)
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	updates := new(mockUpdatedItemsFetcher)
+	updates.On("Next", mock.Anything).Return([]int64{1}, nil).Once()
+
+	repo := new(mockSnapshotReader)
+	repo.On("LatestSnapshots", mock.Anything, int64(1), 1).Return([]StoryModel{makeSnapshot(1, createdAt, 10, 5)}, nil)
+
+	consumer := NewUpdatesConsumer(client, updates, repo, DefaultUpdatesMaxStoryAge)
+	storyID, _, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), storyID)
+}
+
+func TestUpdatesConsumerFetchSkipsRemovedStories(t *testing.T) {
+	createdAt := time.Now().UTC().Add(-time.Hour)
+
+	httpClient := new(mockHTTPClient)
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+
+	updates := new(mockUpdatedItemsFetcher)
+	updates.On("Next", mock.Anything).Return([]int64{1}, nil).Once()
+	updates.On("Next", mock.Anything).Return([]int64{}, context.Canceled)
+
+	snapshot := makeSnapshot(1, createdAt, 10, 5)
+	snapshot.Status = StoryStatusDeleted
+
+	repo := new(mockSnapshotReader)
+	repo.On("LatestSnapshots", mock.Anything, int64(1), 1).Return([]StoryModel{snapshot}, nil)
+
+	consumer := NewUpdatesConsumer(client, updates, repo, DefaultUpdatesMaxStoryAge)
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.ErrorIs(t, err, context.Canceled)
+	httpClient.AssertNotCalled(t, "Get", mock.Anything)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// maxRedirects bounds how many redirectors are unwrapped, as their targets
+// may themselves be redirectors.
+const maxRedirects = 5
+
+var ErrInvalidURL = errors.New("Invalid URL")
+
+// trackingParams are query parameters that identify the referrer rather than
+// the resource, and so are dropped. Parameters prefixed with `utm_` are
+// dropped as well.
+var trackingParams = map[string]bool{
+	"_hsenc":      true,
+	"_hsmi":       true,
+	"dclid":       true,
+	"fbclid":      true,
+	"gbraid":      true,
+	"gclid":       true,
+	"igshid":      true,
+	"mc_cid":      true,
+	"mc_eid":      true,
+	"mkt_tok":     true,
+	"msclkid":     true,
+	"oly_anon_id": true,
+	"oly_enc_id":  true,
+	"ref":         true,
+	"ref_src":     true,
+	"ref_url":     true,
+	"vero_id":     true,
+	"wbraid":      true,
+	"yclid":       true,
+}
+
+// hostAliases are hosts that serve the same resources as another, such as
+// mobile sites.
+var hostAliases = map[string]string{
+	"m.youtube.com":      "youtube.com",
+	"mobile.twitter.com": "x.com",
+	"mobile.x.com":       "x.com",
+	"twitter.com":        "x.com",
+	"np.reddit.com":      "reddit.com",
+	"old.reddit.com":     "reddit.com",
+	"m.facebook.com":     "facebook.com",
+}
+
+var (
+	mobileWikipediaHost = regexp.MustCompile(`^([a-z\-]+)\.m\.(wikipedia\.org|wiktionary\.org)$`)
+	arxivPath           = regexp.MustCompile(`^/(?:abs|pdf)/([^/]+?)(?:v\d+)?(?:\.pdf)?$`)
+)
+
+// redirector resolves a URL from a known redirector or link shortener to its
+// target, without making any requests. It returns false if the URL isn't
+// resolvable.
+type redirector func(u *url.URL) (string, bool)
+
+func queryTarget(param string) redirector {
+	return func(u *url.URL) (string, bool) {
+		target := u.Query().Get(param)
+		return target, target != ""
+	}
+}
+
+var redirectors = map[string]redirector{
+	"youtu.be": func(u *url.URL) (string, bool) {
+		id := strings.Trim(u.Path, "/")
+		if id == "" {
+			return "", false
+		}
+		return "https://youtube.com/watch?v=" + url.QueryEscape(id), true
+	},
+	"google.com": func(u *url.URL) (string, bool) {
+		if u.Path != "/url" {
+			return "", false
+		}
+		if target := u.Query().Get("q"); target != "" {
+			return target, true
+		}
+		return queryTarget("url")(u)
+	},
+	"duckduckgo.com": func(u *url.URL) (string, bool) {
+		if u.Path != "/l/" {
+			return "", false
+		}
+		return queryTarget("uddg")(u)
+	},
+	"href.li":         func(u *url.URL) (string, bool) { return u.RawQuery, u.RawQuery != "" },
+	"l.facebook.com":  queryTarget("u"),
+	"lm.facebook.com": queryTarget("u"),
+	"out.reddit.com":  queryTarget("url"),
+	"slack-redir.net": queryTarget("url"),
+}
+
+// canonicalHost lowercases a host and strips its `www.` prefix, along with
+// any alias.
+func canonicalHost(host string) string {
+	host = strings.TrimPrefix(strings.ToLower(strings.TrimSuffix(host, ".")), "www.")
+	if alias, ok := hostAliases[host]; ok {
+		return alias
+	}
+	if match := mobileWikipediaHost.FindStringSubmatch(host); match != nil {
+		return match[1] + "." + match[2]
+	}
+	return host
+}
+
+// canonicalPath cleans a path, and strips its trailing slash.
+func canonicalPath(host, p string) string {
+	if p == "" || p == "/" {
+		return "/"
+	}
+	p = path.Clean(p)
+	if host == "arxiv.org" {
+		// Abstracts and PDFs, of any version, are the same article.
+		if match := arxivPath.FindStringSubmatch(p); match != nil {
+			return "/abs/" + match[1]
+		}
+	}
+	return p
+}
+
+// canonicalQuery drops tracking parameters and sorts the rest.
+func canonicalQuery(query url.Values) string {
+	for key := range query {
+		if trackingParams[strings.ToLower(key)] || strings.HasPrefix(strings.ToLower(key), "utm_") {
+			delete(query, key)
+		}
+	}
+	return query.Encode()
+}
+
+// CanonicalURL normalises a URL, so that submissions of the same article
+// have the same URL. Schemes are normalised to https, hosts are lowercased
+// and stripped of `www.`, default ports, fragments, tracking parameters and
+// trailing slashes are dropped, the remaining parameters are sorted, and
+// known redirectors are resolved to their targets.
+func CanonicalURL(rawURL string) (string, error) {
+	for range maxRedirects + 1 {
+		u, err := url.Parse(strings.TrimSpace(rawURL))
+		if err != nil {
+			return "", errors.Join(ErrInvalidURL, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+			return "", ErrInvalidURL
+		}
+
+		host := canonicalHost(u.Hostname())
+		if redirect, ok := redirectors[host]; ok {
+			if target, ok := redirect(u); ok {
+				rawURL = target
+				continue
+			}
+		}
+
+		// Paths are canonicalised by the bare host, whatever the port.
+		urlPath := canonicalPath(host, u.Path)
+		if port := u.Port(); port != "" && port != "80" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		canonical := url.URL{
+			Scheme:   "https",
+			Host:     host,
+			Path:     urlPath,
+			RawQuery: canonicalQuery(u.Query()),
+		}
+		return canonical.String(), nil
+	}
+	return "", ErrInvalidURL
+}
+
+// RegistrableDomain returns the registrable domain of a host, i.e. the
+// public suffix and the label before it, e.g. `example.co.uk` for
+// `blog.example.co.uk`. Hosts without one, such as IP addresses, are
+// returned as they are.
+func RegistrableDomain(host string) string {
+	host = canonicalHost(host)
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// CanonicaliseStoryURL returns the canonical URL and registrable domain of a
+// story's URL, or empty strings if it has none or it is invalid.
+func CanonicaliseStoryURL(rawURL string) (canonicalURL, domain string) {
+	if rawURL == "" {
+		return "", ""
+	}
+	canonicalURL, err := CanonicalURL(rawURL)
+	if err != nil {
+		return "", ""
+	}
+	return canonicalURL, RegistrableDomain(URLHost(canonicalURL))
+}
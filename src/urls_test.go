@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalURL(t *testing.T) {
+	for _, testCase := range []struct {
+		url      string
+		expected string
+	}{
+		{url: "https://example.com", expected: "https://example.com/"},
+		{url: "HTTP://WWW.Example.COM/Path/", expected: "https://example.com/Path"},
+		{url: "https://example.com:443/a//b/../c#section", expected: "https://example.com/a/c"},
+		{url: "http://example.com:8080/a", expected: "https://example.com:8080/a"},
+		{url: "https://example.com/a?utm_source=hn&b=2&fbclid=x&a=1", expected: "https://example.com/a?a=1&b=2"},
+		{url: "https://youtu.be/dQw4w9WgXcQ?si=abc", expected: "https://youtube.com/watch?v=dQw4w9WgXcQ"},
+		{url: "https://m.youtube.com/watch?v=dQw4w9WgXcQ", expected: "https://youtube.com/watch?v=dQw4w9WgXcQ"},
+		{url: "https://www.google.com/url?q=https://www.example.com/a/%3Futm_medium%3Dx", expected: "https://example.com/a"},
+		{url: "https://mobile.twitter.com/user/status/1", expected: "https://x.com/user/status/1"},
+		{url: "https://en.m.wikipedia.org/wiki/Go", expected: "https://en.wikipedia.org/wiki/Go"},
+		{url: "https://arxiv.org/pdf/2401.00001v2.pdf", expected: "https://arxiv.org/abs/2401.00001"},
+		{url: "https://arxiv.org:8080/pdf/2401.00001v2", expected: "https://arxiv.org:8080/abs/2401.00001"},
+		{url: "http://[::1]/a/", expected: "https://[::1]/a"},
+	} {
+		actual, err := CanonicalURL(testCase.url)
+
+		assert.Nil(t, err, testCase.url)
+		assert.Equal(t, testCase.expected, actual, testCase.url)
+	}
+}
+
+func TestCanonicalURLResolvesRedirectors(t *testing.T) {
+	for _, testCase := range []struct {
+		url      string
+		expected string
+	}{
+		{url: "https://youtu.be/", expected: "https://youtu.be/"},
+		{url: "https://google.com/url?url=https://example.com/a", expected: "https://example.com/a"},
+		{url: "https://google.com/search?q=https://example.com/a", expected: "https://google.com/search?q=https%3A%2F%2Fexample.com%2Fa"},
+		{url: "https://duckduckgo.com/l/?uddg=https%3A%2F%2Fexample.com%2Fa", expected: "https://example.com/a"},
+		{url: "https://duckduckgo.com/?uddg=https%3A%2F%2Fexample.com%2Fa", expected: "https://duckduckgo.com/?uddg=https%3A%2F%2Fexample.com%2Fa"},
+		{url: "https://href.li/?https://example.com/a", expected: "https://example.com/a"},
+		{url: "https://href.li/", expected: "https://href.li/"},
+		{url: "https://l.facebook.com/l.php?u=https%3A%2F%2Fexample.com%2Fa&h=x", expected: "https://example.com/a"},
+		{url: "https://lm.facebook.com/l.php?u=https%3A%2F%2Fexample.com%2Fa", expected: "https://example.com/a"},
+		{url: "https://out.reddit.com/t3_1?url=https%3A%2F%2Fexample.com%2Fa&token=x", expected: "https://example.com/a"},
+		{url: "https://slack-redir.net/link?url=https%3A%2F%2Fexample.com%2Fa", expected: "https://example.com/a"},
+		// Redirectors to redirectors are unwrapped in turn.
+		{url: "https://href.li/?https://l.facebook.com/l.php?u=https%3A%2F%2Fyoutu.be%2FdQw4w9WgXcQ", expected: "https://youtube.com/watch?v=dQw4w9WgXcQ"},
+	} {
+		actual, err := CanonicalURL(testCase.url)
+
+		assert.Nil(t, err, testCase.url)
+		assert.Equal(t, testCase.expected, actual, testCase.url)
+	}
+}
+
+func TestCanonicalURLLimitsRedirects(t *testing.T) {
+	url := "https://example.com/a"
+	for range maxRedirects {
+		url = "https://href.li/?" + url
+	}
+
+	actual, err := CanonicalURL(url)
+	assert.Nil(t, err)
+	assert.Equal(t, "https://example.com/a", actual)
+
+	_, err = CanonicalURL("https://href.li/?" + url)
+	assert.ErrorIs(t, err, ErrInvalidURL)
+}
+
+func TestCanonicalURLWhenInvalidReturnsError(t *testing.T) {
+	for _, url := range []string{"", "example.com/a", "ftp://example.com", "https://", "http://%zz"} {
+		_, err := CanonicalURL(url)
+
+		assert.ErrorIs(t, err, ErrInvalidURL, url)
+	}
+}
+
+func TestRegistrableDomain(t *testing.T) {
+	assert.Equal(t, "example.com", RegistrableDomain("blog.example.com"))
+	assert.Equal(t, "example.co.uk", RegistrableDomain("www.news.example.co.uk"))
+	assert.Equal(t, "user.github.io", RegistrableDomain("user.github.io"))
+	assert.Equal(t, "127.0.0.1", RegistrableDomain("127.0.0.1"))
+	assert.Equal(t, "localhost", RegistrableDomain("localhost"))
+}
+
+func TestCanonicaliseStoryURL(t *testing.T) {
+	canonicalURL, domain := CanonicaliseStoryURL("https://blog.Example.com/post/?ref=hn")
+	assert.Equal(t, "https://blog.example.com/post", canonicalURL)
+	assert.Equal(t, "example.com", domain)
+
+	canonicalURL, domain = CanonicaliseStoryURL("")
+	assert.Empty(t, canonicalURL)
+	assert.Empty(t, domain)
+}
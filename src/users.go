@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// UsersRefreshKey is a sorted set of users, scored by when their profiles
+	// are next due a snapshot.
+	UsersRefreshKey = "ingestion-users-refresh"
+	// UsersLastSeenKey is a sorted set of users, scored by when they were
+	// last seen as the author of a story or comment.
+	UsersLastSeenKey             = "ingestion-users-last-seen"
+	DefaultUsersRefreshInterval  = 24 * time.Hour
+	DefaultUsersMaxPerStory      = 50
+	DefaultUsersMaxIdle          = 30 * 24 * time.Hour
+	DefaultUsersRefreshBatchSize = 1000
+	// DefaultUsersRefreshRateLimit is the rate of requests per second made to
+	// refresh profiles, which leaves most of the API's rate limit to workers.
+	DefaultUsersRefreshRateLimit = 1.0
+)
+
+// UserFetcher provides a method to fetch a user's profile.
+type UserFetcher interface {
+	FetchUser(string) (HNUser, error)
+	Version() string
+}
+
+// UserRepoer provides a method to store snapshots of users' profiles.
+type UserRepoer interface {
+	WriteUser(context.Context, UserModel) error
+}
+
+// UserSchedule provides methods to schedule when users' profiles are next
+// snapshotted.
+type UserSchedule interface {
+	ZAdd(context.Context, string, ...redis.Z) *redis.IntCmd
+	ZAddNX(context.Context, string, ...redis.Z) *redis.IntCmd
+	ZRangeByScore(context.Context, string, *redis.ZRangeBy) *redis.StringSliceCmd
+	ZRem(context.Context, string, ...interface{}) *redis.IntCmd
+}
+
+// Authors returns the distinct authors of a story and its comments, the
+// story's author first. Deleted items have no author, and are skipped.
+func Authors(items StoryItems) []string {
+	var authors []string
+	seen := make(map[string]bool)
+
+	add := func(author string) {
+		if author != "" && !seen[author] {
+			seen[author] = true
+			authors = append(authors, author)
+		}
+	}
+
+	add(items.Story.By)
+	for _, comment := range items.Comments {
+		add(comment.By)
+	}
+	return authors
+}
+
+// UserCapturer snapshots the profiles of the authors of stories and their
+// comments. A profile is snapshotted when its user is first seen, and is then
+// scheduled to be refreshed every RefreshInterval by Refresh, for as long as
+// the user has been seen within MaxIdle. Users seen in the meantime are
+// skipped, so that prolific commenters aren't fetched for every snapshot of
+// every story they comment on.
+type UserCapturer struct {
+	client          UserFetcher
+	repo            UserRepoer
+	schedule        UserSchedule
+	RefreshInterval time.Duration
+	MaxIdle         time.Duration
+	// MaxPerStory bounds the number of profiles fetched per snapshot.
+	MaxPerStory int
+}
+
+func NewUserCapturer(client UserFetcher, repo UserRepoer, schedule UserSchedule, refreshInterval time.Duration) *UserCapturer {
+	return &UserCapturer{
+		client:          client,
+		repo:            repo,
+		schedule:        schedule,
+		RefreshInterval: refreshInterval,
+		MaxIdle:         DefaultUsersMaxIdle,
+		MaxPerStory:     DefaultUsersMaxPerStory,
+	}
+}
+
+func userScore(t time.Time) float64 {
+	return float64(t.Unix())
+}
+
+func (c *UserCapturer) capture(ctx context.Context, userID string) error {
+	user, err := c.client.FetchUser(userID)
+	// Users that don't exist, such as deleted accounts, aren't snapshotted.
+	if errors.Is(err, ErrItemMissing) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("%w user: %w", ErrFetching, err)
+	}
+
+	model, err := MakeUserModel(user, c.client.Version(), time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	return c.repo.WriteUser(ctx, model)
+}
+
+// ObserveStory snapshots the profiles of the story's author and commenters
+// that haven't been seen before, and schedules them to be refreshed.
+func (c *UserCapturer) ObserveStory(ctx context.Context, items StoryItems, _ StoryModel) error {
+	authors := Authors(items)
+	if len(authors) == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	seen := make([]redis.Z, 0, len(authors))
+	for _, userID := range authors {
+		seen = append(seen, redis.Z{Score: userScore(now), Member: userID})
+	}
+	err := c.schedule.ZAdd(ctx, UsersLastSeenKey, seen...).Err()
+	if err != nil {
+		return err
+	}
+
+	captured := 0
+	for _, userID := range authors {
+		if captured >= c.MaxPerStory {
+			break
+		}
+
+		due := redis.Z{Score: userScore(now.Add(c.RefreshInterval)), Member: userID}
+		added, err := c.schedule.ZAddNX(ctx, UsersRefreshKey, due).Result()
+		if err != nil {
+			return err
+		}
+		if added == 0 {
+			continue
+		}
+
+		captured++
+		err = c.capture(ctx, userID)
+		if err != nil {
+			// Forget the user, so that they're captured when next seen.
+			if remErr := c.schedule.ZRem(ctx, UsersRefreshKey, userID).Err(); remErr != nil {
+				slog.Error("Unable to forget user", "user_id", userID, "error", remErr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Refresh snapshots the profiles of up to limit users that are due to be
+// refreshed, and reschedules them. Users that haven't been seen within
+// MaxIdle are dropped from the schedule first, until they're seen again.
+// Users whose profiles can't be fetched are left due, to be retried. It
+// returns the number of profiles refreshed.
+func (c *UserCapturer) Refresh(ctx context.Context, now time.Time, limit int) (int, error) {
+	idle, err := c.schedule.ZRangeByScore(ctx, UsersLastSeenKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(userScore(now.Add(-c.MaxIdle)), 'f', -1, 64),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(idle) > 0 {
+		members := make([]interface{}, 0, len(idle))
+		for _, userID := range idle {
+			members = append(members, userID)
+		}
+		err = c.schedule.ZRem(ctx, UsersRefreshKey, members...).Err()
+		if err != nil {
+			return 0, err
+		}
+		err = c.schedule.ZRem(ctx, UsersLastSeenKey, members...).Err()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	due, err := c.schedule.ZRangeByScore(ctx, UsersRefreshKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(userScore(now), 'f', -1, 64),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	refreshed := 0
+	var errs []error
+	for _, userID := range due {
+		if err := ctx.Err(); err != nil {
+			return refreshed, err
+		}
+
+		err = c.capture(ctx, userID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", userID, err))
+			continue
+		}
+
+		next := redis.Z{Score: userScore(now.Add(c.RefreshInterval)), Member: userID}
+		err = c.schedule.ZAdd(ctx, UsersRefreshKey, next).Err()
+		if err != nil {
+			return refreshed, err
+		}
+		refreshed++
+	}
+	return refreshed, errors.Join(errs...)
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockUserFetcher struct {
+	mock.Mock
+}
+
+func (m *mockUserFetcher) FetchUser(id string) (HNUser, error) {
+	args := m.Called(id)
+	return args.Get(0).(HNUser), args.Error(1)
+}
+
+func (m *mockUserFetcher) Version() string {
+	return "v0"
+}
+
+type mockUserRepo struct {
+	mock.Mock
+}
+
+func (m *mockUserRepo) WriteUser(ctx context.Context, model UserModel) error {
+	args := m.Called(ctx, model)
+	return args.Error(0)
+}
+
+type mockUserSchedule struct {
+	mock.Mock
+}
+
+func (m *mockUserSchedule) ZAdd(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd {
+	args := m.Called(ctx, key, members)
+	return args.Get(0).(*redis.IntCmd)
+}
+
+func (m *mockUserSchedule) ZAddNX(ctx context.Context, key string, members ...redis.Z) *redis.IntCmd {
+	args := m.Called(ctx, key, members)
+	return args.Get(0).(*redis.IntCmd)
+}
+
+func (m *mockUserSchedule) ZRangeByScore(ctx context.Context, key string, opt *redis.ZRangeBy) *redis.StringSliceCmd {
+	args := m.Called(ctx, key, opt)
+	return args.Get(0).(*redis.StringSliceCmd)
+}
+
+func (m *mockUserSchedule) ZRem(ctx context.Context, key string, members ...interface{}) *redis.IntCmd {
+	args := m.Called(ctx, key, members)
+	return args.Get(0).(*redis.IntCmd)
+}
+
+// scheduled matches a single member being added to a user schedule.
+func scheduled(userID string) interface{} {
+	return mock.MatchedBy(func(members []redis.Z) bool {
+		return len(members) == 1 && members[0].Member == userID
+	})
+}
+
+func TestAuthors(t *testing.T) {
+	items := StoryItems{
+		Story: HNStory{By: "pg"},
+		Comments: []HNComment{
+			{By: "dang"},
+			{By: "pg"},
+			{By: ""}, // Deleted.
+			{By: "tptacek"},
+			{By: "dang"},
+		},
+	}
+
+	assert.Equal(t, []string{"pg", "dang", "tptacek"}, Authors(items))
+}
+
+func TestUserCapturerObserveStory(t *testing.T) {
+	items := StoryItems{
+		Story:    HNStory{By: "pg"},
+		Comments: []HNComment{{By: "dang"}},
+	}
+
+	client := new(mockUserFetcher)
+	client.On("FetchUser", "pg").Return(HNUser{ID: "pg", Created: 1160418092, Karma: 155111}, nil)
+
+	repo := new(mockUserRepo)
+	repo.On("WriteUser", mock.Anything, mock.Anything).Return(nil)
+
+	schedule := new(mockUserSchedule)
+	schedule.On("ZAdd", mock.Anything, UsersLastSeenKey, mock.Anything).Return(redis.NewIntResult(0, nil))
+	schedule.On("ZAddNX", mock.Anything, UsersRefreshKey, scheduled("pg")).Return(redis.NewIntResult(1, nil))
+	// Already scheduled.
+	schedule.On("ZAddNX", mock.Anything, UsersRefreshKey, scheduled("dang")).Return(redis.NewIntResult(0, nil))
+
+	capturer := NewUserCapturer(client, repo, schedule, time.Hour)
+	err := capturer.ObserveStory(context.Background(), items, StoryModel{})
+
+	assert.Nil(t, err)
+	schedule.AssertCalled(t, "ZAdd", mock.Anything, UsersLastSeenKey, mock.MatchedBy(func(members []redis.Z) bool {
+		return len(members) == 2 && members[0].Member == "pg" && members[1].Member == "dang"
+	}))
+	client.AssertNotCalled(t, "FetchUser", "dang")
+	repo.AssertNumberOfCalls(t, "WriteUser", 1)
+	repo.AssertCalled(t, "WriteUser", mock.Anything, mock.MatchedBy(func(model UserModel) bool {
+		return model.UserID == "pg" &&
+			model.APIVersion == "v0" &&
+			model.RawDocument == `{"created":1160418092,"id":"pg","karma":155111}`
+	}))
+}
+
+func TestUserCapturerObserveStoryWhenUserMissingSkipsWrite(t *testing.T) {
+	items := StoryItems{Story: HNStory{By: "ghost"}}
+
+	client := new(mockUserFetcher)
+	client.On("FetchUser", "ghost").Return(HNUser{}, ErrItemMissing)
+
+	repo := new(mockUserRepo)
+
+	schedule := new(mockUserSchedule)
+	schedule.On("ZAdd", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewIntResult(1, nil))
+	schedule.On("ZAddNX", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewIntResult(1, nil))
+
+	capturer := NewUserCapturer(client, repo, schedule, time.Hour)
+	err := capturer.ObserveStory(context.Background(), items, StoryModel{})
+
+	assert.Nil(t, err)
+	repo.AssertNotCalled(t, "WriteUser", mock.Anything, mock.Anything)
+}
+
+func TestUserCapturerObserveStoryWhenErrorFetchingForgetsUser(t *testing.T) {
+	items := StoryItems{Story: HNStory{By: "pg"}}
+
+	client := new(mockUserFetcher)
+	client.On("FetchUser", "pg").Return(HNUser{}, fmt.Errorf("Error"))
+
+	repo := new(mockUserRepo)
+
+	schedule := new(mockUserSchedule)
+	schedule.On("ZAdd", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewIntResult(1, nil))
+	schedule.On("ZAddNX", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewIntResult(1, nil))
+	schedule.On("ZRem", mock.Anything, UsersRefreshKey, []interface{}{"pg"}).Return(redis.NewIntResult(1, nil))
+
+	capturer := NewUserCapturer(client, repo, schedule, time.Hour)
+	err := capturer.ObserveStory(context.Background(), items, StoryModel{})
+
+	assert.ErrorIs(t, err, ErrFetching)
+	schedule.AssertCalled(t, "ZRem", mock.Anything, UsersRefreshKey, []interface{}{"pg"})
+}
+
+func TestUserCapturerObserveStoryCapsFetchesPerStory(t *testing.T) {
+	items := StoryItems{
+		Story:    HNStory{By: "a"},
+		Comments: []HNComment{{By: "b"}, {By: "c"}},
+	}
+
+	client := new(mockUserFetcher)
+	client.On("FetchUser", mock.Anything).Return(HNUser{ID: "x"}, nil)
+
+	repo := new(mockUserRepo)
+	repo.On("WriteUser", mock.Anything, mock.Anything).Return(nil)
+
+	schedule := new(mockUserSchedule)
+	schedule.On("ZAdd", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewIntResult(1, nil))
+	schedule.On("ZAddNX", mock.Anything, mock.Anything, mock.Anything).Return(redis.NewIntResult(1, nil))
+
+	capturer := NewUserCapturer(client, repo, schedule, time.Hour)
+	capturer.MaxPerStory = 2
+	err := capturer.ObserveStory(context.Background(), items, StoryModel{})
+
+	assert.Nil(t, err)
+	client.AssertNumberOfCalls(t, "FetchUser", 2)
+	client.AssertNotCalled(t, "FetchUser", "c")
+}
+
+func TestUserCapturerRefresh(t *testing.T) {
+	now := time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)
+
+	client := new(mockUserFetcher)
+	client.On("FetchUser", "pg").Return(HNUser{ID: "pg"}, nil)
+	client.On("FetchUser", "dang").Return(HNUser{}, fmt.Errorf("Error"))
+
+	repo := new(mockUserRepo)
+	repo.On("WriteUser", mock.Anything, mock.Anything).Return(nil)
+
+	schedule := new(mockUserSchedule)
+	schedule.On("ZRangeByScore", mock.Anything, UsersLastSeenKey, mock.Anything).Return(redis.NewStringSliceResult([]string{"idle"}, nil))
+	schedule.On("ZRem", mock.Anything, mock.Anything, []interface{}{"idle"}).Return(redis.NewIntResult(1, nil))
+	schedule.On("ZRangeByScore", mock.Anything, UsersRefreshKey, mock.Anything).Return(redis.NewStringSliceResult([]string{"pg", "dang"}, nil))
+	schedule.On("ZAdd", mock.Anything, UsersRefreshKey, mock.Anything).Return(redis.NewIntResult(0, nil))
+
+	capturer := NewUserCapturer(client, repo, schedule, time.Hour)
+	capturer.MaxIdle = 24 * time.Hour
+	refreshed, err := capturer.Refresh(context.Background(), now, 10)
+
+	assert.ErrorIs(t, err, ErrFetching)
+	assert.Equal(t, 1, refreshed)
+	schedule.AssertCalled(t, "ZRangeByScore", mock.Anything, UsersLastSeenKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Add(-24*time.Hour).Unix(), 10),
+		Count: 10,
+	})
+	schedule.AssertCalled(t, "ZRem", mock.Anything, UsersRefreshKey, []interface{}{"idle"})
+	schedule.AssertCalled(t, "ZRem", mock.Anything, UsersLastSeenKey, []interface{}{"idle"})
+	repo.AssertNumberOfCalls(t, "WriteUser", 1)
+	// Only the refreshed user is rescheduled; the other is left due.
+	schedule.AssertNumberOfCalls(t, "ZAdd", 1)
+	schedule.AssertCalled(t, "ZAdd", mock.Anything, UsersRefreshKey, []redis.Z{
+		{Score: float64(now.Add(time.Hour).Unix()), Member: "pg"},
+	})
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	WatchQueueName       = "watch"
+	WatchLabelPrefix     = "watch"
+	WatchTagsKeyPrefix   = "ingestion-watch-tags"
+	DefaultWatchTagsTTL  = 7 * 24 * time.Hour
+	watchTagsUnwatched   = ""
+	watchTagsSeparator   = ","
+	maxWatchlistTagChars = 64
+)
+
+// DefaultWatchStages are the offsets of the extra snapshots of watched
+// stories, closing the gaps between the default queues early in a story's
+// life.
+var DefaultWatchStages = []time.Duration{5 * time.Minute, 10 * time.Minute, 2 * time.Hour, 4 * time.Hour}
+
+// Watchlist tags stories whose title matches any of its patterns, or whose
+// URL is on any of its domains, or whose author is any of its authors.
+type Watchlist struct {
+	Tag           string           `json:"tag"`
+	TitlePatterns []string         `json:"titles,omitempty"`
+	Domains       []string         `json:"domains,omitempty"`
+	Authors       []string         `json:"authors,omitempty"`
+	titles        []*regexp.Regexp `json:"-"`
+}
+
+// Watchlists are the rules that stories are tagged by.
+type Watchlists []Watchlist
+
+// ParseWatchlists parses watchlists from a JSON array, compiling their title
+// patterns. Domains and authors are matched case insensitively.
+func ParseWatchlists(s string) (Watchlists, error) {
+	var watchlists Watchlists
+	if strings.TrimSpace(s) == "" {
+		return watchlists, nil
+	}
+
+	err := json.Unmarshal([]byte(s), &watchlists)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for idx := range watchlists {
+		w := &watchlists[idx]
+		if w.Tag == "" || len(w.Tag) > maxWatchlistTagChars || strings.Contains(w.Tag, watchTagsSeparator) {
+			return nil, fmt.Errorf("Invalid watchlist tag: %q", w.Tag)
+		}
+		if seen[w.Tag] {
+			return nil, fmt.Errorf("Duplicate watchlist tag: %s", w.Tag)
+		}
+		seen[w.Tag] = true
+
+		for _, pattern := range w.TitlePatterns {
+			re, err := regexp.Compile(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid title pattern for watchlist %s: %w", w.Tag, err)
+			}
+			w.titles = append(w.titles, re)
+		}
+		for i, domain := range w.Domains {
+			w.Domains[i] = strings.TrimPrefix(strings.ToLower(domain), "www.")
+		}
+		for i, author := range w.Authors {
+			w.Authors[i] = strings.ToLower(author)
+		}
+	}
+	return watchlists, nil
+}
+
+// URLHost returns the lowercased host of a URL, without any port, or an empty
+// string if it has none.
+func URLHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// OnDomain returns whether the host is the domain or one of its subdomains.
+func OnDomain(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// Matches returns whether the story is on the watchlist.
+func (w Watchlist) Matches(story HNStory) bool {
+	for _, re := range w.titles {
+		if re.MatchString(story.Title) {
+			return true
+		}
+	}
+
+	if host := URLHost(story.URL); host != "" {
+		for _, domain := range w.Domains {
+			if OnDomain(host, domain) {
+				return true
+			}
+		}
+	}
+
+	return slices.Contains(w.Authors, strings.ToLower(story.By))
+}
+
+// Match returns the tags of the watchlists that the story is on, sorted.
+func (ws Watchlists) Match(story HNStory) []string {
+	var tags []string
+	for _, w := range ws {
+		if w.Matches(story) {
+			tags = append(tags, w.Tag)
+		}
+	}
+	slices.Sort(tags)
+	return tags
+}
+
+// ParseWatchStages parses the offsets of the extra snapshots of watched
+// stories, from the time they were created, from a comma separated list of
+// durations.
+func ParseWatchStages(s string) ([]time.Duration, error) {
+	var stages []time.Duration
+	for _, value := range strings.Split(s, ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		stage, err := time.ParseDuration(value)
+		if err != nil || stage <= 0 {
+			return nil, fmt.Errorf("Invalid watch stage: %s", value)
+		}
+		stages = append(stages, stage)
+	}
+	return stages, nil
+}
+
+// TagCache provides methods to get and set keys.
+type TagCache interface {
+	Get(context.Context, string) *redis.StringCmd
+	Set(context.Context, string, interface{}, time.Duration) *redis.StatusCmd
+}
+
+// WatchTags stores the tags of watched stories, for the lifetime of their
+// snapshots. Whether a story is watched is only known once it has been
+// checked against the watchlists.
+type WatchTags struct {
+	cache TagCache
+	TTL   time.Duration
+}
+
+func NewWatchTags(cache TagCache, ttl time.Duration) *WatchTags {
+	return &WatchTags{cache: cache, TTL: ttl}
+}
+
+func (t *WatchTags) key(storyID int64) string {
+	return fmt.Sprintf("%s:%d", WatchTagsKeyPrefix, storyID)
+}
+
+// Save stores the tags of a story, which are empty if it isn't watched.
+func (t *WatchTags) Save(ctx context.Context, storyID int64, tags []string) error {
+	value := watchTagsUnwatched
+	if len(tags) > 0 {
+		value = strings.Join(tags, watchTagsSeparator)
+	}
+	return t.cache.Set(ctx, t.key(storyID), value, t.TTL).Err()
+}
+
+// Load returns the tags of a story, and whether it has been checked against
+// the watchlists.
+func (t *WatchTags) Load(ctx context.Context, storyID int64) ([]string, bool, error) {
+	value, err := t.cache.Get(ctx, t.key(storyID)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if value == watchTagsUnwatched {
+		return nil, true, nil
+	}
+	return strings.Split(value, watchTagsSeparator), true, nil
+}
+
+// WatchTagsLoader provides a method to load the watchlist tags of a story.
+type WatchTagsLoader interface {
+	Load(context.Context, int64) ([]string, bool, error)
+}
+
+// Watcher provides a method to check a story against the watchlists when it
+// is first snapshotted, returning its tags.
+type Watcher interface {
+	Watch(context.Context, StoryItems) ([]string, error)
+}
+
+// StoryWatcher checks new stories against the watchlists. The tags of each
+// story are stored, and watched stories are scheduled for an extra snapshot
+// at each of the Stages. Watching only adds snapshots; watched stories
+// aren't snapshotted any sooner than others at the stages they share.
+type StoryWatcher struct {
+	watchlists Watchlists
+	tags       *WatchTags
+	dst        Enqueuer
+	Stages     []time.Duration
+}
+
+func NewStoryWatcher(watchlists Watchlists, tags *WatchTags, dst Enqueuer, stages []time.Duration) *StoryWatcher {
+	return &StoryWatcher{watchlists: watchlists, tags: tags, dst: dst, Stages: stages}
+}
+
+// Watch checks a new story against the watchlists, using the items of its
+// first snapshot, and returns the tags of those it matched.
+func (w *StoryWatcher) Watch(ctx context.Context, items StoryItems) ([]string, error) {
+	if !IsStoryType(items.Story.Type) {
+		return nil, nil
+	}
+
+	storyID := items.Story.ID
+	tags := w.watchlists.Match(items.Story)
+	err := w.tags.Save(ctx, storyID, tags)
+	if err != nil || len(tags) == 0 {
+		return tags, err
+	}
+
+	slog.Info("Watching story", "story_id", storyID, "tags", tags)
+
+	createdAt := time.Unix(items.Story.Time, 0).UTC()
+	for _, stage := range w.Stages {
+		msg := Message{
+			StoryID:   storyID,
+			CreatedAt: &createdAt,
+			Label:     WatchStageLabel(stage),
+			ProcessAt: createdAt.Add(stage),
+		}
+		err = w.dst.Enqueue(ctx, msg)
+		if err != nil {
+			return tags, err
+		}
+	}
+	return tags, nil
+}
+
+// WatchStageLabel returns the label of a watched story's snapshot at the
+// given offset, e.g. `watch-5m`.
+func WatchStageLabel(stage time.Duration) string {
+	label := strconv.FormatFloat(stage.Minutes(), 'f', -1, 64) + "m"
+	if stage%time.Hour == 0 {
+		label = strconv.FormatInt(int64(stage/time.Hour), 10) + "h"
+	}
+	return fmt.Sprintf("%s-%s", WatchLabelPrefix, label)
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type mockTagCache struct {
+	mock.Mock
+}
+
+func (m *mockTagCache) Get(ctx context.Context, key string) *redis.StringCmd {
+	args := m.Called(ctx, key)
+	return args.Get(0).(*redis.StringCmd)
+}
+
+func (m *mockTagCache) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) *redis.StatusCmd {
+	args := m.Called(ctx, key, value, expiration)
+	return args.Get(0).(*redis.StatusCmd)
+}
+
+type mockWatcher struct {
+	mock.Mock
+}
+
+func (m *mockWatcher) Watch(ctx context.Context, items StoryItems) ([]string, error) {
+	args := m.Called(ctx, items)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+const testWatchlists = `[
+    {"tag": "rust", "titles": ["(?i)\\brust\\b"], "domains": ["www.Rust-Lang.org"]},
+    {"tag": "founders", "authors": ["PG"]}
+]`
+
+func TestParseWatchlists(t *testing.T) {
+	watchlists, err := ParseWatchlists(testWatchlists)
+
+	assert.Nil(t, err)
+	assert.Len(t, watchlists, 2)
+	assert.Equal(t, []string{"rust-lang.org"}, watchlists[0].Domains)
+	assert.Equal(t, []string{"pg"}, watchlists[1].Authors)
+}
+
+func TestParseWatchlistsWhenEmpty(t *testing.T) {
+	watchlists, err := ParseWatchlists("")
+
+	assert.Nil(t, err)
+	assert.Empty(t, watchlists)
+}
+
+func TestParseWatchlistsWhenInvalidReturnsError(t *testing.T) {
+	for _, s := range []string{
+		`{"tag": "rust"}`,
+		`[{"tag": ""}]`,
+		`[{"tag": "a,b"}]`,
+		`[{"tag": "rust"}, {"tag": "rust"}]`,
+		`[{"tag": "rust", "titles": ["("]}]`,
+	} {
+		_, err := ParseWatchlists(s)
+		assert.NotNil(t, err, s)
+	}
+}
+
+func TestWatchlistsMatch(t *testing.T) {
+	watchlists, err := ParseWatchlists(testWatchlists)
+	assert.Nil(t, err)
+
+	for _, testCase := range []struct {
+		story    HNStory
+		expected []string
+	}{
+		{story: HNStory{Title: "Rust 2.0 released"}, expected: []string{"rust"}},
+		{story: HNStory{Title: "Trusting trust"}, expected: nil},
+		{story: HNStory{Title: "Blog", URL: "https://blog.rust-lang.org:443/2024"}, expected: []string{"rust"}},
+		{story: HNStory{Title: "Blog", URL: "https://notrust-lang.org"}, expected: nil},
+		{story: HNStory{Title: "Rust essay", By: "pg"}, expected: []string{"founders", "rust"}},
+		{story: HNStory{Title: "Ask HN"}, expected: nil},
+	} {
+		actual := watchlists.Match(testCase.story)
+		assert.Equal(t, testCase.expected, actual, testCase.story)
+	}
+}
+
+func TestParseWatchStages(t *testing.T) {
+	stages, err := ParseWatchStages("5m, 2h")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []time.Duration{5 * time.Minute, 2 * time.Hour}, stages)
+
+	_, err = ParseWatchStages("5m,-1h")
+	assert.NotNil(t, err)
+}
+
+func TestWatchStageLabel(t *testing.T) {
+	assert.Equal(t, "watch-5m", WatchStageLabel(5*time.Minute))
+	assert.Equal(t, "watch-90m", WatchStageLabel(90*time.Minute))
+	assert.Equal(t, "watch-2h", WatchStageLabel(2*time.Hour))
+}
+
+func TestWatchTagsLoad(t *testing.T) {
+	cache := new(mockTagCache)
+	cache.On("Get", mock.Anything, "ingestion-watch-tags:1").Return(redis.NewStringResult("founders,rust", nil))
+	cache.On("Get", mock.Anything, "ingestion-watch-tags:2").Return(redis.NewStringResult("", nil))
+	cache.On("Get", mock.Anything, "ingestion-watch-tags:3").Return(redis.NewStringResult("", redis.Nil))
+
+	tags := NewWatchTags(cache, time.Hour)
+
+	actual, checked, err := tags.Load(context.Background(), 1)
+	assert.Nil(t, err)
+	assert.True(t, checked)
+	assert.Equal(t, []string{"founders", "rust"}, actual)
+
+	actual, checked, err = tags.Load(context.Background(), 2)
+	assert.Nil(t, err)
+	assert.True(t, checked)
+	assert.Empty(t, actual)
+
+	actual, checked, err = tags.Load(context.Background(), 3)
+	assert.Nil(t, err)
+	assert.False(t, checked)
+	assert.Empty(t, actual)
+}
+
+func TestStoryWatcherWatch(t *testing.T) {
+	cache := new(mockTagCache)
+	cache.On("Set", mock.Anything, "ingestion-watch-tags:1", "rust", time.Hour).Return(redis.NewStatusResult("OK", nil))
+
+	dst := new(mockEnqueuer)
+	dst.On("Enqueue", mock.Anything, mock.Anything).Return(nil)
+
+	watchlists, err := ParseWatchlists(testWatchlists)
+	assert.Nil(t, err)
+
+	stages := []time.Duration{5 * time.Minute, 2 * time.Hour}
+	watcher := NewStoryWatcher(watchlists, NewWatchTags(cache, time.Hour), dst, stages)
+
+	items := StoryItems{Story: HNStory{ID: 1, Time: 1175714200, Title: "Rust in production", Type: "story"}}
+	tags, err := watcher.Watch(context.Background(), items)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"rust"}, tags)
+	createdAt := time.Date(2007, 4, 4, 19, 16, 40, 0, time.UTC)
+	dst.AssertCalled(t, "Enqueue", mock.Anything, Message{StoryID: 1, CreatedAt: &createdAt, Label: "watch-5m", ProcessAt: createdAt.Add(5 * time.Minute)})
+	dst.AssertCalled(t, "Enqueue", mock.Anything, Message{StoryID: 1, CreatedAt: &createdAt, Label: "watch-2h", ProcessAt: createdAt.Add(2 * time.Hour)})
+}
+
+func TestStoryWatcherWatchWhenUnmatchedSavesNoTags(t *testing.T) {
+	cache := new(mockTagCache)
+	cache.On("Set", mock.Anything, "ingestion-watch-tags:1", "", time.Hour).Return(redis.NewStatusResult("OK", nil))
+
+	dst := new(mockEnqueuer)
+
+	watchlists, err := ParseWatchlists(testWatchlists)
+	assert.Nil(t, err)
+
+	watcher := NewStoryWatcher(watchlists, NewWatchTags(cache, time.Hour), dst, DefaultWatchStages)
+
+	items := StoryItems{Story: HNStory{ID: 1, Time: 1175714200, Title: "Show HN", Type: "story"}}
+	tags, err := watcher.Watch(context.Background(), items)
+
+	assert.Nil(t, err)
+	assert.Empty(t, tags)
+	cache.AssertNumberOfCalls(t, "Set", 1)
+	dst.AssertNotCalled(t, "Enqueue", mock.Anything, mock.Anything)
+}
+
+func TestMessageConsumerFetchWatchesUncheckedStory(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"time":1175714200,"title":"Rust in production","type":"story"}`),
+		nil,
+	)
+
+	cache := new(mockTagCache)
+	cache.On("Get", mock.Anything, "ingestion-watch-tags:1").Return(redis.NewStringResult("", redis.Nil))
+
+	watcher := new(mockWatcher)
+	watcher.On("Watch", mock.Anything, mock.Anything).Return([]string{"rust"}, nil)
+
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
+	}
+
+	broker := newMockBrokerWithItem(item)
+
+	repo := new(mockRepo)
+	repo.On("WriteStory", mock.Anything, mock.Anything).Return(nil)
+
+	queueConfig := QueueConfig{Name: NewQueueName, GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+	consumer := NewMessageConsumer(client, src, repo)
+	consumer.Tags = NewWatchTags(cache, time.Hour)
+	consumer.Watcher = watcher
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	// The story is checked using the items of its snapshot, without fetching
+	// it again.
+	httpClient.AssertNumberOfCalls(t, "Get", 1)
+	watcher.AssertCalled(t, "Watch", mock.Anything, mock.MatchedBy(func(items StoryItems) bool {
+		return items.Story.ID == 1
+	}))
+	repo.AssertCalled(t, "WriteStory", mock.Anything, mock.MatchedBy(func(model StoryModel) bool {
+		return assert.ObjectsAreEqual([]string{"rust"}, model.Tags)
+	}))
+}
+
+func TestMessageConsumerFetchWhenWatchingFailsWritesStory(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"time":1175714200,"type":"story"}`),
+		nil,
+	)
+
+	watcher := new(mockWatcher)
+	watcher.On("Watch", mock.Anything, mock.Anything).Return([]string(nil), fmt.Errorf("Error"))
+
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
+	}
+
+	broker := newMockBrokerWithItem(item)
+
+	repo := new(mockRepo)
+	repo.On("WriteStory", mock.Anything, mock.Anything).Return(nil)
+
+	queueConfig := QueueConfig{Name: NewQueueName, GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+	consumer := NewMessageConsumer(client, src, repo)
+	consumer.Watcher = watcher
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	repo.AssertNumberOfCalls(t, "WriteStory", 1)
+}
+
+func TestMessageConsumerFetchStoresTags(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"kids":[2],"time":1175714200,"type":"story"}`),
+		nil,
+	)
+	httpClient.On("Get", "http://localhost/v0/item/2.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":2,"parent":1,"type":"comment"}`),
+		nil,
+	)
+
+	cache := new(mockTagCache)
+	cache.On("Get", mock.Anything, "ingestion-watch-tags:1").Return(redis.NewStringResult("rust", nil))
+
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z","label":"watch-5m"}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
+	}
+
+	broker := newMockBrokerWithItem(item)
+
+	repo := new(mockRepo)
+	repo.On("WriteStory", mock.Anything, mock.Anything).Return(nil)
+
+	queueConfig := QueueConfig{Name: WatchQueueName, GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+	consumer := NewMessageConsumer(client, src, repo)
+	consumer.Tags = NewWatchTags(cache, time.Hour)
+	consumer.SkipUnwatchedComments = true
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	repo.AssertCalled(t, "WriteStory", mock.Anything, mock.MatchedBy(func(model StoryModel) bool {
+		return model.QueueName == "watch-5m" && assert.ObjectsAreEqual([]string{"rust"}, model.Tags) && len(model.Comments) == 1
+	}))
+}
+
+func TestMessageConsumerFetchWhenUnwatchedSkipsComments(t *testing.T) {
+	httpClient := new(mockHTTPClient)
+	httpClient.On("Get", "http://localhost/v0/item/1.json").Return(
+		makeMockResponse(http.StatusOK, `{"id":1,"kids":[2],"time":1175714200,"type":"story"}`),
+		nil,
+	)
+
+	cache := new(mockTagCache)
+	cache.On("Get", mock.Anything, "ingestion-watch-tags:1").Return(redis.NewStringResult("", nil))
+
+	item := redis.Z{
+		Member: `{"story_id":1,"created_at":"2020-01-01T00:00:00Z"}`,
+		Score:  float64(time.Now().UTC().Unix()), // Process immediately.
+	}
+
+	broker := newMockBrokerWithItem(item)
+
+	repo := new(mockRepo)
+	repo.On("WriteStory", mock.Anything, mock.Anything).Return(nil)
+
+	queueConfig := QueueConfig{Name: "pq", GracePeriod: time.Hour}
+	src := NewPriorityQueue(broker, queueConfig, time.Nanosecond)
+
+	client := NewHNClient(httpClient, "http://localhost", "v0", 0*time.Second, 1)
+	consumer := NewMessageConsumer(client, src, repo)
+	consumer.Tags = NewWatchTags(cache, time.Hour)
+	consumer.SkipUnwatchedComments = true
+	_, _, err := consumer.Fetch(context.Background())
+
+	assert.Nil(t, err)
+	httpClient.AssertNumberOfCalls(t, "Get", 1)
+	repo.AssertCalled(t, "WriteStory", mock.Anything, mock.MatchedBy(func(model StoryModel) bool {
+		return len(model.Tags) == 0 && len(model.Comments) == 0
+	}))
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"log/slog"
+	"sync"
 	"time"
 )
 
@@ -17,13 +18,34 @@ type Producer interface {
 	SendMessage(context.Context, int64, *time.Time) error
 }
 
+// shuttingDown reports whether an error is due to the context being done, as
+// when the worker is asked to shut down.
+func shuttingDown(ctx context.Context, err error) bool {
+	return ctx.Err() != nil || errors.Is(err, context.Canceled)
+}
+
+// Run consumes and produces messages, one at a time, until the context is
+// done.
 func Run(ctx context.Context, consumer Consumer, producer Producer) {
-	for {
+	for ctx.Err() == nil {
 		storyID, createdAt, err := consumer.Fetch(ctx)
+		if errors.Is(err, ErrStoryRemoved) {
+			slog.Info("Not scheduling removed story", "story_id", storyID, "reason", err)
+			continue
+		}
+		if errors.Is(err, ErrStoryRequeued) {
+			slog.Info("Retrying missing story later", "story_id", storyID, "reason", err)
+			continue
+		}
+		if err != nil && shuttingDown(ctx, err) {
+			return
+		}
 		if err != nil {
 			slog.Error("Error fetching", "error", err)
 
-			if errors.Is(err, ErrMessageExpired) {
+			if errors.Is(err, ErrMessageExpired) ||
+				errors.Is(err, ErrLeadershipLost) ||
+				errors.Is(err, ErrCircuitOpen) {
 				continue
 			}
 
@@ -31,9 +53,32 @@ func Run(ctx context.Context, consumer Consumer, producer Producer) {
 		}
 
 		err = producer.SendMessage(ctx, storyID, createdAt)
+		if err != nil && shuttingDown(ctx, err) {
+			slog.Error("Shutting down before sending message", "story_id", storyID, "error", err)
+			return
+		}
 		if err != nil {
 			slog.Error("Error sending message", "error", err)
 			panic(err)
 		}
 	}
 }
+
+// RunConcurrently runs the given number of processing loops, which share the
+// consumer and producer, and waits for them to finish. Both the consumer and
+// producer must be safe for concurrent use.
+func RunConcurrently(ctx context.Context, consumer Consumer, producer Producer, concurrency int) {
+	if concurrency <= 0 {
+		panic("Concurrency must be positive")
+	}
+
+	var wg sync.WaitGroup
+	for range concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Run(ctx, consumer, producer)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingConsumer returns increasing story ids, cancelling the context once
+// the limit has been reached.
+type countingConsumer struct {
+	mu     sync.Mutex
+	next   int64
+	limit  int64
+	cancel context.CancelFunc
+}
+
+func (c *countingConsumer) Fetch(_ context.Context) (int64, *time.Time, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.next++
+	if c.next >= c.limit {
+		c.cancel()
+	}
+	return c.next, nil, nil
+}
+
+type recordingProducer struct {
+	mu       sync.Mutex
+	storyIDs []int64
+}
+
+func (p *recordingProducer) SendMessage(_ context.Context, storyID int64, _ *time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.storyIDs = append(p.storyIDs, storyID)
+	return nil
+}
+
+func TestRunConcurrently(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &countingConsumer{limit: 100, cancel: cancel}
+	producer := &recordingProducer{}
+
+	RunConcurrently(ctx, consumer, producer, 4)
+
+	// Every fetched story is produced exactly once.
+	assert.Len(t, producer.storyIDs, int(consumer.next))
+	assert.ElementsMatch(t, producer.storyIDs, uniqueIDs(producer.storyIDs))
+}
+
+func TestRunConcurrentlyWhenConcurrencyNotPositivePanics(t *testing.T) {
+	assert.Panics(t, func() {
+		RunConcurrently(context.Background(), &countingConsumer{}, &recordingProducer{}, 0)
+	})
+}
+
+func uniqueIDs(ids []int64) []int64 {
+	seen := make(map[int64]bool)
+	unique := []int64{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// removingConsumer reports every other story as removed, or with the given
+// error, cancelling the context once the limit has been reached.
+type removingConsumer struct {
+	countingConsumer
+	err error
+}
+
+func (c *removingConsumer) Fetch(ctx context.Context) (int64, *time.Time, error) {
+	storyID, createdAt, err := c.countingConsumer.Fetch(ctx)
+	if storyID%2 == 0 {
+		return storyID, createdAt, c.err
+	}
+	return storyID, createdAt, err
+}
+
+func TestRunWhenStoryRemovedDoesNotProduce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &removingConsumer{countingConsumer{limit: 4, cancel: cancel}, ErrStoryRemoved}
+	producer := &recordingProducer{}
+
+	Run(ctx, consumer, producer)
+
+	assert.Equal(t, []int64{1, 3}, producer.storyIDs)
+}
+
+func TestRunWhenStoryRequeuedDoesNotProduce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &removingConsumer{countingConsumer{limit: 4, cancel: cancel}, ErrStoryRequeued}
+	producer := &recordingProducer{}
+
+	Run(ctx, consumer, producer)
+
+	assert.Equal(t, []int64{1, 3}, producer.storyIDs)
+}
+
+// blockingConsumer blocks until the context is done, as when dequeuing from
+// an empty queue.
+type blockingConsumer struct{}
+
+func (c blockingConsumer) Fetch(ctx context.Context) (int64, *time.Time, error) {
+	<-ctx.Done()
+	return 0, nil, ctx.Err()
+}
+
+func TestRunWhenContextCancelledReturns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(time.Millisecond, cancel)
+
+	assert.NotPanics(t, func() {
+		Run(ctx, blockingConsumer{}, &recordingProducer{})
+	})
+}
+
+func TestRunWhenCancelledWhileSendingReturns(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	consumer := &countingConsumer{limit: 100, cancel: func() {}}
+	producer := cancellingProducer{cancel: cancel}
+
+	assert.NotPanics(t, func() {
+		Run(ctx, consumer, producer)
+	})
+}
+
+// cancellingProducer cancels the context, failing to send as it's cancelled.
+type cancellingProducer struct {
+	cancel context.CancelFunc
+}
+
+func (p cancellingProducer) SendMessage(ctx context.Context, _ int64, _ *time.Time) error {
+	p.cancel()
+	return ctx.Err()
+}